@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/lib/doa"
+	"github.com/mohanson/daze/protocol/ashe"
+)
+
+// Dump decodes and prints the frames of daze protocols, given the cipher. Each connection is decoded from the two
+// streams of it, the one sent by the client and the one sent by the server.
+type Dump struct {
+	Cipher []byte
+	Mu     *sync.Mutex
+	W      io.Writer
+}
+
+// Printf prints a line of the connection.
+func (d *Dump) Printf(conn string, format string, a ...any) {
+	d.Mu.Lock()
+	defer d.Mu.Unlock()
+	fmt.Fprintf(d.W, "%s %s\n", conn, fmt.Sprintf(format, a...))
+}
+
+// Data prints the length of data until the stream ends.
+func (d *Dump) Data(conn string, dir string, r io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n != 0 {
+			d.Printf(conn, "%s data len=%d", dir, n)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// AsheHello decodes the hello of the ashe protocol sent by the client, and returns the decrypted stream.
+func (d *Dump) AsheHello(conn string, c2s io.Reader) (io.Reader, []byte, error) {
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(c2s, salt); err != nil {
+		return nil, nil, err
+	}
+	key := make([]byte, 32)
+	for i := range 32 {
+		key[i] = salt[i] ^ d.Cipher[i]
+	}
+	r := daze.GravityReader(c2s, key)
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+	t := time.Unix(int64(binary.BigEndian.Uint64(buf)), 0)
+	d.Printf(conn, "c2s hello salt=%x time=%s skew=%s", salt[:4], t.Format(time.RFC3339), time.Since(t).Round(time.Second))
+	return r, key, nil
+}
+
+// Ashe decodes a connection of the ashe protocol.
+func (d *Dump) Ashe(conn string, c2s io.Reader, s2c io.Reader) {
+	// The key and the cipher suite of the session.
+	type session struct {
+		cpr   bool
+		key   []byte
+		opt   byte
+		suite string
+	}
+	done := make(chan session, 1)
+	go func() {
+		defer io.Copy(io.Discard, c2s)
+		r, key, err := d.AsheHello(conn, c2s)
+		if err != nil {
+			done <- session{}
+			d.Printf(conn, "c2s error %s", err)
+			return
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			done <- session{}
+			d.Printf(conn, "c2s error %s", err)
+			return
+		}
+		suite := cmp.Or(ashe.SuiteOf(buf[0]), ashe.SuiteRc4)
+		if buf[0]&0x40 != 0 {
+			// The key of the session comes from the ephemeral key exchange, which the pre-shared key can not recover.
+			done <- session{}
+			d.Printf(conn, "c2s ecdh network=%#02x suite=%s, the session can not be decoded", buf[0], suite)
+			return
+		}
+		cpr := buf[0]&0x80 != 0 && buf[0]&^0xf0 == 0x01
+		done <- session{cpr, key, buf[0], suite}
+		if buf[0]&0xf0 != 0 {
+			tag := make([]byte, 16)
+			if _, err := io.ReadFull(r, tag); err != nil {
+				d.Printf(conn, "c2s error %s", err)
+				return
+			}
+			d.Printf(conn, "c2s commit tag=%x", tag[:4])
+		}
+		if suite != ashe.SuiteRc4 {
+			r = DumpAead(c2s, key, suite, 0)
+		}
+		if _, err := io.ReadFull(r, buf[1:]); err != nil {
+			d.Printf(conn, "c2s error %s", err)
+			return
+		}
+		network := map[byte]string{0x01: "tcp", 0x03: "udp"}[buf[0]&^0xf0]
+		dst := make([]byte, buf[1])
+		if _, err := io.ReadFull(r, dst); err != nil {
+			d.Printf(conn, "c2s error %s", err)
+			return
+		}
+		d.Printf(conn, "c2s dial network=%s(%#02x) address=%q suite=%s compress=%t", network, buf[0], dst, suite, cpr)
+		if cpr {
+			r = flate.NewReader(r)
+		}
+		d.Data(conn, "c2s", r)
+	}()
+	e := <-done
+	if e.key == nil {
+		io.Copy(io.Discard, s2c)
+		return
+	}
+	r := daze.GravityReader(s2c, e.key)
+	if e.opt&0xf0 != 0 {
+		tag := make([]byte, 16)
+		if _, err := io.ReadFull(r, tag); err != nil {
+			io.Copy(io.Discard, s2c)
+			return
+		}
+		d.Printf(conn, "s2c commit tag=%x", tag[:4])
+	}
+	if e.suite != ashe.SuiteRc4 {
+		r = DumpAead(s2c, e.key, e.suite, 1)
+	}
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		io.Copy(io.Discard, s2c)
+		return
+	}
+	d.Printf(conn, "s2c reply code=%#02x", buf[0])
+	if e.cpr && buf[0] == 0 {
+		r = flate.NewReader(r)
+	}
+	d.Data(conn, "s2c", r)
+	io.Copy(io.Discard, s2c)
+}
+
+// DumpAead returns the reader which opens the chunks sealed by an aead cipher suite of ashe. The side is 0 for the
+// client and 1 for the server.
+func DumpAead(r io.Reader, key []byte, suite string, side byte) io.Reader {
+	c := &daze.ReadWriteCloser{Reader: r, Writer: io.Discard, Closer: io.NopCloser(r)}
+	// Data written by a side is read by the other side.
+	return doa.Try(daze.WrapCipher(c, suite, key, side == 1))
+}
+
+// CzarFrames decodes the frames of the czar protocol in one direction. Streams are decoded as ashe connections.
+func (d *Dump) CzarFrames(conn string, dir int, r io.Reader, stream func(sid uint8, open bool, opt uint8) *io.PipeWriter) {
+	defer io.Copy(io.Discard, r)
+	name := []string{"c2s", "s2c"}[dir]
+	pipes := map[uint8]*io.PipeWriter{}
+	defer func() {
+		for _, w := range pipes {
+			w.Close()
+		}
+	}()
+	buf := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+		sid := buf[0]
+		switch buf[1] {
+		case 0x00:
+			d.Printf(conn, "%s frame sid=%d cmd=open rsv=%d", name, sid, buf[2])
+			pipes[sid] = stream(sid, true, buf[2])
+		case 0x01:
+			n := binary.BigEndian.Uint16(buf[2:])
+			d.Printf(conn, "%s frame sid=%d cmd=push len=%d", name, sid, n)
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			// The server does not open streams, it learns a stream by the first frame of it.
+			if _, ok := pipes[sid]; !ok {
+				pipes[sid] = stream(sid, false, 0)
+			}
+			if w := pipes[sid]; w != nil {
+				w.Write(msg)
+			}
+		case 0x02:
+			d.Printf(conn, "%s frame sid=%d cmd=close", name, sid)
+			if w := pipes[sid]; w != nil {
+				w.Close()
+			}
+			delete(pipes, sid)
+		default:
+			d.Printf(conn, "%s frame sid=%d cmd=%#02x malformed", name, sid, buf[1])
+			return
+		}
+	}
+}
+
+// Czar decodes a connection of the czar protocol.
+func (d *Dump) Czar(conn string, c2s io.Reader, s2c io.Reader) {
+	if _, _, err := d.AsheHello(conn, c2s); err != nil {
+		d.Printf(conn, "c2s error %s", err)
+		io.Copy(io.Discard, s2c)
+		return
+	}
+	mu := sync.Mutex{}
+	streams := map[uint8][2]*io.PipeWriter{}
+	// Streams are opened by the client. A sid is reused once closed, so opening a stream replaces the old one.
+	stream := func(sid uint8, open bool, opt uint8) *io.PipeWriter {
+		mu.Lock()
+		defer mu.Unlock()
+		if !open {
+			return streams[sid][1]
+		}
+		cr, cw := io.Pipe()
+		sr, sw := io.Pipe()
+		streams[sid] = [2]*io.PipeWriter{cw, sw}
+		go func() {
+			name := fmt.Sprintf("%s sid=%d", conn, sid)
+			buf := make([]byte, 24)
+			switch opt {
+			case 0x01:
+				// A resumable stream starts with its ticket.
+				io.ReadFull(cr, buf[:16])
+				d.Printf(name, "c2s ticket=%x", buf[:4])
+			case 0x02:
+				// The stream resumes a stream of a lost connection, whose session is not known.
+				if _, err := io.ReadFull(cr, buf); err == nil {
+					d.Printf(name, "c2s resume ticket=%x received=%d", buf[:4], binary.BigEndian.Uint64(buf[16:]))
+				}
+				go io.Copy(io.Discard, sr)
+				io.Copy(io.Discard, cr)
+				return
+			}
+			d.Ashe(name, cr, sr)
+		}()
+		return cw
+	}
+	done := make(chan struct{})
+	go func() {
+		d.CzarFrames(conn, 1, s2c, stream)
+		close(done)
+	}()
+	d.CzarFrames(conn, 0, c2s, stream)
+	<-done
+	for _, e := range streams {
+		e[0].Close()
+		e[1].Close()
+	}
+}
+
+// Conn decodes a connection of the protocol.
+func (d *Dump) Conn(protocol string, conn string, c2s io.Reader, s2c io.Reader) {
+	d.Printf(conn, "open")
+	switch protocol {
+	case "ashe":
+		d.Ashe(conn, c2s, s2c)
+	case "czar":
+		d.Czar(conn, c2s, s2c)
+	}
+	d.Printf(conn, "closed")
+}
+
+// Live relays connections accepted on listen to the server, and decodes them on the way.
+func (d *Dump) Live(protocol string, listen string, server string) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for {
+		cli, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer cli.Close()
+			srv, err := daze.Dial("tcp", server)
+			if err != nil {
+				log.Println("main:", err)
+				return
+			}
+			defer srv.Close()
+			cr, cw := io.Pipe()
+			sr, sw := io.Pipe()
+			go d.Conn(protocol, cli.RemoteAddr().String(), cr, sr)
+			go func() {
+				io.Copy(io.MultiWriter(srv, cw), cli)
+				cw.Close()
+				srv.Close()
+			}()
+			io.Copy(io.MultiWriter(cli, sw), srv)
+			sw.Close()
+			cli.Close()
+		}()
+	}
+}
+
+// DumpFlow is a tcp flow being reassembled from captured packets.
+type DumpFlow struct {
+	// Next is the sequence number expected next in each direction, it is zero until the syn is seen.
+	Next [2]uint32
+	// Pend holds segments received ahead of the expected sequence number.
+	Pend [2]map[uint32][]byte
+	W    [2]*io.PipeWriter
+}
+
+// Pcap decodes the tcp connections to the server port in a pcap file. Linktypes ethernet, linux cooked capture, raw
+// ip and bsd loopback are supported.
+func (d *Dump) Pcap(protocol string, name string, port uint16) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	head := make([]byte, 24)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return err
+	}
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(head) == 0xa1b2c3d4 || binary.LittleEndian.Uint32(head) == 0xa1b23c4d:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(head) == 0xa1b2c3d4 || binary.BigEndian.Uint32(head) == 0xa1b23c4d:
+		order = binary.BigEndian
+	default:
+		return errors.New("daze: not a pcap file, pcapng is not supported")
+	}
+	link := order.Uint32(head[20:])
+	flows := map[string]*DumpFlow{}
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	defer func() {
+		for _, e := range flows {
+			e.W[0].Close()
+			e.W[1].Close()
+		}
+	}()
+	rec := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		pkt := make([]byte, order.Uint32(rec[8:]))
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			return err
+		}
+		switch link {
+		case 0:
+			pkt = pkt[min(len(pkt), 4):]
+		case 1:
+			pkt = pkt[min(len(pkt), 14):]
+		case 101:
+		case 113:
+			pkt = pkt[min(len(pkt), 16):]
+		case 276:
+			pkt = pkt[min(len(pkt), 20):]
+		default:
+			return fmt.Errorf("daze: unsupported linktype %d", link)
+		}
+		src, dst, seg, ok := DumpIP(pkt)
+		if !ok || len(seg) < 20 || seg[13]&0x04 != 0 {
+			continue
+		}
+		sport := binary.BigEndian.Uint16(seg[0:])
+		dport := binary.BigEndian.Uint16(seg[2:])
+		dir := 0
+		switch port {
+		case dport:
+		case sport:
+			dir = 1
+			src, dst, sport, dport = dst, src, dport, sport
+		default:
+			continue
+		}
+		conn := net.JoinHostPort(src.String(), fmt.Sprint(sport))
+		seq := binary.BigEndian.Uint32(seg[4:])
+		syn := seg[13]&0x02 != 0
+		fin := seg[13]&0x01 != 0
+		data := seg[min(len(seg), int(seg[12]>>4)*4):]
+		flow, ok := flows[conn]
+		if !ok {
+			if !syn || dir != 0 {
+				// Connections established before the capture started can not be decrypted.
+				continue
+			}
+			cr, cw := io.Pipe()
+			sr, sw := io.Pipe()
+			flow = &DumpFlow{Pend: [2]map[uint32][]byte{{}, {}}, W: [2]*io.PipeWriter{cw, sw}}
+			flows[conn] = flow
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.Conn(protocol, conn, cr, sr)
+			}()
+		}
+		if syn {
+			flow.Next[dir] = seq + 1
+			continue
+		}
+		if flow.Next[dir] == 0 {
+			continue
+		}
+		flow.Pend[dir][seq] = data
+		// Feed the segments which are in order, retransmitted bytes are skipped.
+		for {
+			keys := []uint32{}
+			for k := range flow.Pend[dir] {
+				keys = append(keys, k)
+			}
+			sort.Slice(keys, func(i, j int) bool { return int32(keys[i]-flow.Next[dir]) < int32(keys[j]-flow.Next[dir]) })
+			if len(keys) == 0 || int32(keys[0]-flow.Next[dir]) > 0 {
+				break
+			}
+			b := flow.Pend[dir][keys[0]]
+			delete(flow.Pend[dir], keys[0])
+			skip := flow.Next[dir] - keys[0]
+			if int(skip) < len(b) {
+				flow.W[dir].Write(b[skip:])
+				flow.Next[dir] += uint32(len(b)) - skip
+			}
+		}
+		if fin {
+			flow.W[dir].Close()
+		}
+	}
+}
+
+// DumpIP returns the addresses and the tcp segment of an ipv4 or ipv6 packet.
+func DumpIP(pkt []byte) (net.IP, net.IP, []byte, bool) {
+	if len(pkt) < 1 {
+		return nil, nil, nil, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[9] != 6 {
+			return nil, nil, nil, false
+		}
+		end := min(len(pkt), int(binary.BigEndian.Uint16(pkt[2:])))
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl > end {
+			return nil, nil, nil, false
+		}
+		return net.IP(pkt[12:16]), net.IP(pkt[16:20]), pkt[ihl:end], true
+	case 6:
+		// Extension headers are not supported.
+		if len(pkt) < 40 || pkt[6] != 6 {
+			return nil, nil, nil, false
+		}
+		end := min(len(pkt), 40+int(binary.BigEndian.Uint16(pkt[4:])))
+		return net.IP(pkt[8:24]), net.IP(pkt[24:40]), pkt[40:end], true
+	}
+	return nil, nil, nil, false
+}
@@ -1,34 +1,97 @@
 package main
 
 import (
+	"bufio"
+	"cmp"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/mohanson/daze"
 	"github.com/mohanson/daze/lib/doa"
 	"github.com/mohanson/daze/lib/gracefulexit"
+	"github.com/mohanson/daze/lib/rate"
 	"github.com/mohanson/daze/protocol/ashe"
 	"github.com/mohanson/daze/protocol/baboon"
 	"github.com/mohanson/daze/protocol/czar"
 	"github.com/mohanson/daze/protocol/dahlia"
+	"github.com/mohanson/daze/protocol/ferry"
+	"github.com/mohanson/daze/protocol/shadowsocks"
+	"github.com/mohanson/daze/protocol/sshx"
+	"github.com/mohanson/daze/protocol/trojan"
+	"github.com/mohanson/daze/protocol/tulip"
+	"github.com/mohanson/daze/protocol/wsocket"
 )
 
 // Conf is acting as package level configuration.
 var Conf = struct {
-	PathRule string
-	PathCIDR string
-	Version  string
+	// HealthProbe is the destination dialed through the server by the readiness probe of the client.
+	HealthProbe string
+	PathRule    string
+	PathCIDR    string
+	// SelftestTimeout bounds each case of the selftest.
+	SelftestTimeout time.Duration
+	// SoaktestGrowth is the ratio by which a series must grow over the window to be reported as a leak.
+	SoaktestGrowth float64
+	// SoaktestWindow is the number of consecutive samples which must not decrease to be reported as a leak.
+	SoaktestWindow int
+	Version        string
 }{
-	PathRule: "/rule.ls",
-	PathCIDR: "/rule.cidr",
-	Version:  "v1.21.2",
+	HealthProbe:     "1.1.1.1:443",
+	PathRule:        "rule.ls",
+	PathCIDR:        "rule.cidr",
+	SelftestTimeout: time.Second * 8,
+	SoaktestGrowth:  0.1,
+	SoaktestWindow:  8,
+	Version:         "v1.21.2",
+}
+
+// PublicKey is the hex encoded ed25519 public key of releases, used to verify downloaded artifacts. It is embedded at
+// build time by: go build -ldflags "-X main.PublicKey=...".
+var PublicKey = ""
+
+// BuildCommit and BuildDate describe the build, they are embedded at build time by: go build -ldflags "-X
+// main.BuildCommit=$(git rev-parse --short HEAD) -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)". The vcs stamp of go
+// build is used if they are empty.
+var (
+	BuildCommit = ""
+	BuildDate   = ""
+)
+
+// NewBuild returns the build of this daze.
+func NewBuild() daze.Build {
+	b := daze.Build{Commit: BuildCommit, Date: BuildDate, Go: runtime.Version(), Version: Conf.Version}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, e := range info.Settings {
+			switch {
+			case e.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = e.Value[:min(len(e.Value), 7)]
+			case e.Key == "vcs.time" && b.Date == "":
+				b.Date = e.Value
+			}
+		}
+	}
+	return b
 }
 
 const helpMsg = `Usage: daze <command> [<args>]
@@ -36,7 +99,16 @@ const helpMsg = `Usage: daze <command> [<args>]
 The most commonly used daze commands are:
   server     Start daze server
   client     Start daze client
+  bench      Run speedtest, usually with -profile to compare the hotspots of versions
   gen        Generate or update rule.cidr
+  paths      Show where resource files are loaded from
+  proto      Decode the frames of daze protocols
+  rule       Show how a rule change would route recent traffic
+  selftest   Run the protocol conformance suite
+  soaktest   Run a sustained load and watch for resource leaks
+  speedtest  Measure the latency and throughput through the server
+  token      Generate an access token which expires automatically
+  verify     Verify the signature of a downloaded file
   ver        Print the daze version number and exit
 
 Run 'daze <command> -h' for more information on a command.`
@@ -49,63 +121,875 @@ Supported region:
 Executing this command will update rule.cidr by remote data source.
 `
 
+const helpPaths = `Usage: daze paths
+
+Show the paths searched for rule.ls and rule.cidr, and which of them is loaded by default. The paths are searched in
+order: the user config directory, $XDG_CONFIG_HOME/daze or ~/.config/daze on linux, the system config directory
+/etc/daze, and the directory of the executable. Paths given by -r and -c are used as is.
+`
+
+const helpProto = `Usage: daze proto dump [<args>]
+
+Decode and print the frames of the ashe or czar protocol with the cipher: the handshake, the destination, the reply
+code, and for czar the frame headers and the handshake of each stream. Connections are either relayed from the address
+given by -l to the server, or read from a pcap file given by -r, in which case the server is known by the port of -s.
+Connections must be captured from the start.
+`
+
+const helpRule = `Usage: daze rule diff -traffic <log> <old.ls> <new.ls>
+
+Replay the destinations in the traffic log against both rule files, and report the hosts which would change road. The
+log is a daze client log, json lines with an address field, or a host per line.
+`
+
+const helpSelftest = `Usage: daze selftest [<args>]
+
+Run every case of the protocol conformance suite, and report pass or fail per case. Servers are started in process
+with a throwaway cipher, unless a live server is given by -s, in which case the destinations given by -d and -u must
+run the echo tester, which is started by -l, and be reachable from the server.
+`
+
+const helpSoaktest = `Usage: daze soaktest [<args>]
+
+Run the cases of the conformance suite in a loop on many workers for a long time, and sample the goroutines, the heap
+and the open file descriptors of the process every interval. It fails if any of them grows in every one of the last
+samples, which is how leaks show after days of uptime. The server is started in process unless it is given by -s, in
+which case only the client is watched and the destinations given by -d and -u must run the echo tester.
+`
+
+const helpSpeedtest = `Usage: daze speedtest [<args>]
+       daze bench [<args>]
+
+Measure the latency and the up and down throughput through the server, which tells whether the tunnel is throttled.
+The destination given by -d must run the echo tester and be reachable from the server, for example, it is started by
+daze server -tester 127.0.0.1:1090, or daze selftest -l. Bench is the same command, with -profile it saves the cpu and
+heap profiles of both ends and reports their hotspots, to find out whether a new version is slower.
+`
+
+const helpToken = `Usage: daze token [<args>]
+
+Generate an access token from the master secret given to the server by -k-master. The token is printed, and clients use
+it as the password, for example, daze client -k <token>. It is accepted until the end of its last day in the local time
+of the server, so shared access expires without changing any password.
+`
+
+const helpVerify = `Usage: daze verify <file>
+
+Verify the file with its detached signature <file>.sig, which is published along with each release.
+`
+
+const helpVer = `Usage: daze ver [<args>]
+
+Print the version, the git commit, the build date and the go version of daze. With -s, the build of the server is
+asked through the protocol, which requires a valid password.
+`
+
+// NewClient returns the client of the protocol, it connects to the server through the upstream dialer.
+func NewClient(protocol string, server string, cipher string, upstream daze.Dialer) daze.Dialer {
+	switch protocol {
+	case "ashe":
+		client := ashe.NewClient(server, cipher)
+		client.Dialer = upstream
+		return client
+	case "baboon":
+		client := baboon.NewClient(server, cipher)
+		client.Dialer = upstream
+		return client
+	case "czar":
+		client := czar.NewClient(server, cipher)
+		client.Dialer = upstream
+		return client
+	case "tulip":
+		client := tulip.NewClient(server, cipher)
+		client.Dialer = upstream
+		return client
+	case "wsocket":
+		// The server is an address or a url, for example, wss://example.com/ws.
+		client := wsocket.NewClient(server, cipher)
+		client.Dialer = upstream
+		return client
+	case "ferry":
+		client := ferry.NewClient(server, cipher)
+		// Fall back to icmp if udp is blocked, it requires raw sockets.
+		client.Network = "udp,icmp"
+		return client
+	case "socks5":
+		// The username and password are carried by the server address, for example, user:pass@127.0.0.1:1081.
+		u := doa.Try(url.Parse("socks5://" + server))
+		password, _ := u.User.Password()
+		return daze.NewSocksDialer(u.Host, u.User.Username(), password)
+	case "ssh":
+		// The ssh user and password are carried by the server address, and the optional path is the address of the
+		// ashe server as seen from the ssh server, for example, user:pass@a.com:22/127.0.0.1:1081.
+		u := doa.Try(url.Parse("ssh://" + server))
+		password, _ := u.User.Password()
+		client := sshx.NewClient(u.Host, u.User.Username(), password, cipher)
+		if u.Path != "" && u.Path != "/" {
+			client.Remote = u.Path[1:]
+		}
+		return client
+	}
+	log.Panicln("main: unknown protocol", protocol)
+	return nil
+}
+
+// NewResolver returns the resolver of the DNS, DoT or DoH server. The resolver is only used by daze instead of replacing
+// net.DefaultResolver, nil is returned for the default resolver. If addr is a hosts file, names are answered from it
+// without any network. Queries are recorded at /debug/vars, and logged if querylog is full or redact.
+func NewResolver(addr string, querylog string) *net.Resolver {
+	// If daze runs in Android through termux, then we set a default dns for it. See:
+	// https://stackoverflow.com/questions/38959067/dns-lookup-issue-when-running-my-go-app-in-termux
+	if addr == "" && os.Getenv("ANDROID_ROOT") != "" {
+		addr = "1.1.1.1:53"
+	}
+	if addr == "" {
+		return nil
+	}
+	log.Println("main: domain server is", addr)
+	var resolver *net.Resolver
+	if info, err := os.Stat(addr); err == nil && !info.IsDir() {
+		nameserver := daze.NewNameserver("")
+		doa.Nil(nameserver.FromFile(addr))
+		log.Println("main: offline, size is", len(nameserver.M))
+		resolver = nameserver.Resolver()
+	}
+	switch {
+	case resolver != nil:
+	case strings.HasSuffix(addr, ":53"):
+		resolver = daze.ResolverDns(addr)
+	case strings.HasSuffix(addr, ":853"):
+		resolver = daze.ResolverDot(addr)
+	case strings.HasPrefix(addr, "https://"):
+		resolver = daze.ResolverDoh(addr)
+	default:
+		log.Panicln("main: unknown domain server", addr)
+	}
+	meter := daze.NewResolverMeter("resolver")
+	switch querylog {
+	case "":
+	case "full":
+		meter.Log = true
+	case "redact":
+		meter.Log = true
+		meter.Redact = true
+	default:
+		log.Panicln("main: unknown query log mode", querylog)
+	}
+	return meter.Wrap(resolver)
+}
+
+// NewNetem wraps the dialer with artificial latency, jitter and loss given in the form of delay,jitter,loss, for
+// example, 150ms,20ms,0.01. Trailing parts can be omitted. The dialer is returned as is if s is empty.
+func NewNetem(s string, dialer daze.Dialer) daze.Dialer {
+	if s == "" {
+		return dialer
+	}
+	log.Println("main: simulate a slow link", s)
+	netem := &daze.Netem{Dialer: dialer}
+	seps := strings.Split(s, ",")
+	netem.Delay = doa.Try(time.ParseDuration(seps[0]))
+	if len(seps) > 1 {
+		netem.Jitter = doa.Try(time.ParseDuration(seps[1]))
+	}
+	if len(seps) > 2 {
+		netem.Loss = doa.Try(strconv.ParseFloat(seps[2], 64))
+	}
+	return netem
+}
+
+// NewLocaleFrontends parses the frontends of the locale separated by commas, each is a listen address with optional
+// settings in the form of a url query, for example, 0.0.0.0:1090?rate=512&allow=lan.ls. Rate is the bandwidth shared by
+// the connections of the frontend in KiB per second, and allow is an allow-list in rule format, destinations not
+// matched by L or R are rejected.
+func NewLocaleFrontends(s string) []*daze.LocaleFrontend {
+	r := []*daze.LocaleFrontend{}
+	for _, e := range strings.Split(s, ",") {
+		if e == "" {
+			continue
+		}
+		listen, query, _ := strings.Cut(e, "?")
+		v := doa.Try(url.ParseQuery(query))
+		f := &daze.LocaleFrontend{Listen: listen}
+		if v.Has("rate") {
+			f.Limits = rate.NewLimits(doa.Try(strconv.ParseUint(v.Get("rate"), 10, 64))*1024, time.Second)
+		}
+		if v.Has("allow") {
+			rules := daze.NewRouterRules()
+			doa.Nil(rules.FromSource(daze.NewRuleSource(v.Get("allow"))))
+			f.Router = daze.NewRouterChain(rules, daze.NewRouterRight(daze.RoadFucked))
+		}
+		log.Println("main: frontend", listen, "rate", cmp.Or(v.Get("rate"), "unlimited"), "allow", cmp.Or(v.Get("allow"), "all"))
+		r = append(r, f)
+	}
+	return r
+}
+
+// LoadUsers reads the users file, a line for each user: name password. Empty lines and lines starting with # are
+// ignored. The passwords are returned as pre-shared keys by the names of the users.
+func LoadUsers(name string) map[string][]byte {
+	f := doa.Try(daze.OpenFile(name))
+	defer f.Close()
+	users := map[string][]byte{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		seg := strings.Fields(line)
+		if len(seg) != 2 {
+			log.Panicln("main: invalid user", seg[0])
+		}
+		if _, ok := users[seg[0]]; ok {
+			log.Panicln("main: duplicate user", seg[0])
+		}
+		users[seg[0]] = daze.Salt(seg[1])
+	}
+	doa.Nil(s.Err())
+	return users
+}
+
+// Shared reports whether each listen address is given more than once, such addresses are served by a daze.Demux.
+func Shared(listens []string) []bool {
+	count := map[string]int{}
+	for _, e := range listens {
+		count[e]++
+	}
+	r := make([]bool, len(listens))
+	for i, e := range listens {
+		r[i] = count[e] > 1
+	}
+	return r
+}
+
+// Keys are the credentials of a listener besides its password. Listeners given by -l share the keys given by flags,
+// while each tenant has its own, so that the users of a tenant are never accepted by another.
+type Keys struct {
+	Master       string
+	Retired      [][]byte
+	RetiredUntil time.Time
+	Users        map[string][]byte
+}
+
+// NewKeys returns the keys given in the format of -users, -k-retired, -k-retired-until and -k-master.
+func NewKeys(users string, retired string, retiredUntil string, master string) Keys {
+	k := Keys{
+		Master:  master,
+		Retired: [][]byte{},
+		Users:   map[string][]byte{},
+	}
+	if users != "" {
+		k.Users = LoadUsers(users)
+	}
+	for _, e := range strings.Split(retired, ",") {
+		if e != "" {
+			k.Retired = append(k.Retired, daze.Salt(e))
+		}
+	}
+	if retiredUntil != "" {
+		k.RetiredUntil = doa.Try(time.ParseInLocation(time.DateOnly, retiredUntil, time.Local)).AddDate(0, 0, 1)
+	}
+	return k
+}
+
+// Tenant is a listener with its own credentials, see -tenants.
+type Tenant struct {
+	Cipher   string
+	Extend   string
+	Keys     Keys
+	Listen   string
+	Name     string
+	Protocol string
+}
+
+// NewTenant parses a line of -tenants: name listen protocol cipher [extend] [option=value ...]. The options are users,
+// k-retired, k-retired-until and k-master, which work as the flags of the same names for the tenant only.
+func NewTenant(line string) Tenant {
+	seg := strings.Fields(line)
+	if len(seg) < 4 {
+		log.Panicln("main: invalid tenant", line)
+	}
+	t := Tenant{
+		Cipher:   seg[3],
+		Listen:   seg[1],
+		Name:     seg[0],
+		Protocol: seg[2],
+	}
+	opts := map[string]string{}
+	for _, e := range seg[4:] {
+		k, v, ok := strings.Cut(e, "=")
+		switch {
+		case ok && slices.Contains([]string{"users", "k-retired", "k-retired-until", "k-master"}, k):
+			opts[k] = v
+		case t.Extend == "":
+			t.Extend = e
+		default:
+			log.Panicln("main: invalid tenant", line)
+		}
+	}
+	t.Keys = NewKeys(opts["users"], opts["k-retired"], opts["k-retired-until"], opts["k-master"])
+	return t
+}
+
+// LogLimit limits the rate of similar log lines to n per second, suppressed lines are summarized every minute.
+func LogLimit(n int) {
+	if n == 0 {
+		return
+	}
+	l := daze.NewLogLimit(os.Stderr, uint64(n), time.Second)
+	l.Sync(time.Minute)
+	log.SetOutput(daze.NewLogSafe(l))
+}
+
+// Configure fills flags from the config file and the environment. The precedence from low to high is the default
+// value, the config file, the command line and the environment, so that a container can be configured without baking
+// files into its image. The config file contains a flag per line, the name and the value are separated by a space:
+//
+// # Comment
+// l 0.0.0.0:1081
+// k password
+//
+// Flags may be followed by sections, whose lines are the value of a flag. The inline_rules section is the value of
+// -r-inline, and the tenants section is the value of -tenants, for example:
+//
+// [inline_rules]
+// L *.corp.example.com
+// R example.com
+//
+// The environment variable of a flag is its name in upper case with a DAZE_ prefix, and dashes are replaced by
+// underscores, for example, DAZE_K for -k and DAZE_TLS_CERT for -tls-cert.
+func Configure() {
+	name := flag.Lookup("conf").Value.String()
+	if v, ok := os.LookupEnv("DAZE_CONF"); ok {
+		name = v
+	}
+	seen := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		seen[f.Name] = true
+	})
+	if name != "" {
+		log.Println("main: load conf", name)
+		f := doa.Try(daze.OpenFile(name))
+		defer f.Close()
+		sections := map[string]string{"[inline_rules]": "r-inline", "[tenants]": "tenants"}
+		section := ""
+		lines := map[string][]string{}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if strings.HasPrefix(line, "[") {
+				section = sections[line]
+				if section == "" {
+					log.Panicln("main: unknown section", line)
+				}
+				lines[section] = []string{}
+				continue
+			}
+			if section != "" {
+				lines[section] = append(lines[section], line)
+				continue
+			}
+			k, v, _ := strings.Cut(line, " ")
+			if seen[k] {
+				continue
+			}
+			doa.Nil(flag.Set(k, strings.TrimSpace(v)))
+		}
+		doa.Nil(s.Err())
+		for k, v := range lines {
+			if seen[k] {
+				continue
+			}
+			doa.Nil(flag.Set(k, strings.Join(v, "\n")))
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv("DAZE_" + strings.ReplaceAll(strings.ToUpper(f.Name), "-", "_")); ok {
+			doa.Nil(flag.Set(f.Name, v))
+		}
+	})
+}
+
+// Exit codes of the server and the client, so that process supervisors can tell why they stop. Note that go exits
+// with 2 if a goroutine panics, which means a crash.
+const (
+	ExitOk        = 0
+	ExitConfig    = 3
+	ExitListen    = 4
+	ExitHandshake = 5
+)
+
+// ErrHandshake is returned when the client fails the handshake with the server at startup.
+var ErrHandshake = errors.New("handshake with the server failed")
+
+// ExitCode returns the exit code for a panic during the startup. Flags, files and other errors which are not listen
+// or handshake failures are regarded as errors of the configuration.
+func ExitCode(r any) int {
+	err, ok := r.(error)
+	if !ok {
+		// Panics of log.Panicln are strings, they reject bad flags and files.
+		return ExitConfig
+	}
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "listen":
+		return ExitListen
+	case errors.Is(err, ErrHandshake):
+		return ExitHandshake
+	}
+	return ExitConfig
+}
+
+// Shutdown reports how the server or the client stops. The traffic of connections dialed by dialers wrapped by Wrap
+// is counted into Usage.
+type Shutdown struct {
+	Time  time.Time
+	Usage *daze.QuotaUsage
+}
+
+// Exit recovers from a panic during the startup, logs a summary and exits with the code given by ExitCode. It must be
+// deferred.
+func (s *Shutdown) Exit() {
+	code := ExitOk
+	if r := recover(); r != nil {
+		if r == flag.ErrHelp {
+			os.Exit(ExitOk)
+		}
+		code = ExitCode(r)
+		if err, ok := r.(error); ok {
+			log.Println("main: error", err)
+		}
+	}
+	log.Printf("main: exit code=%d uptime=%s up=%d down=%d", code, time.Since(s.Time).Round(time.Second),
+		s.Usage.Up.Load(), s.Usage.Down.Load())
+	os.Exit(code)
+}
+
+// Wrap returns a dialer whose traffic is counted into the summary.
+func (s *Shutdown) Wrap(dialer daze.Dialer) daze.Dialer {
+	return daze.NewTraffic(dialer, s.Usage)
+}
+
+// NewShutdown returns a new Shutdown. Errors of flags become panics, so they exit with ExitConfig as well.
+func NewShutdown() *Shutdown {
+	flag.CommandLine.Init(flag.CommandLine.Name(), flag.PanicOnError)
+	return &Shutdown{
+		Time:  time.Now(),
+		Usage: &daze.QuotaUsage{},
+	}
+}
+
 func main() {
 	if len(os.Args) <= 1 {
 		fmt.Println(helpMsg)
 		return
 	}
-	// If daze runs in Android through termux, then we set a default dns for it. See:
-	// https://stackoverflow.com/questions/38959067/dns-lookup-issue-when-running-my-go-app-in-termux
-	if os.Getenv("ANDROID_ROOT") != "" {
-		net.DefaultResolver = daze.ResolverDns("1.1.1.1:53")
-	}
-	resExec := filepath.Dir(doa.Try(os.Executable()))
+	// Log lines may contain host names and errors from the network.
+	log.SetOutput(daze.NewLogSafe(os.Stderr))
+	build := NewBuild()
+	expvar.Publish("build", expvar.Func(func() any { return build }))
 	subCommand := os.Args[1]
 	os.Args = os.Args[1:len(os.Args)]
 	switch subCommand {
 	case "server":
+		shutdown := NewShutdown()
+		defer shutdown.Exit()
 		var (
-			flDnserv = flag.String("dns", "", "specifies the DNS, DoT or DoH server")
+			flAllows = flag.String("allow", "", "allow-list in rule format, destinations not matched by L or R are rejected")
+			flAllsrc = flag.String("allow-source", "", "only accept tcp connections from these networks, separated by commas, for example, 10.0.0.0/8,192.0.2.7")
+			flAudits = flag.String("audit", "", "append handshake attempts to this file as json lines")
+			flBanfai = flag.Int("ban-fails", 0, "ban a source for -ban-period after n failed handshakes in -ban-window, 0 disables it")
+			flBanlog = flag.Bool("ban-log", false, "log failed handshakes in a format for fail2ban")
+			flBanper = flag.Duration("ban-period", daze.Conf.BanTtl, "how long a source is banned for by -ban-fails")
+			flBantar = flag.Duration("ban-tarpit", 0, "hold connections from banned sources open for this time before closing them, for example, 30s, 0 closes them at once")
+			flBanwin = flag.Duration("ban-window", daze.Conf.BanWindow, "the window in which failed handshakes are counted by -ban-fails")
+			flSuites = flag.String("cipher-suite", "rc4", "cipher suite required from clients {rc4, rc4-hkdf, chacha20-poly1305, aes-256-gcm}, rc4 accepts all, ashe and czar only")
+			_        = flag.String("conf", "", "config file, flags are also read from DAZE_* environment variables")
+			flDnserv = flag.String("dns", "", "specifies the DNS, DoT or DoH server, or a hosts file for offline mode")
+			flDnslog = flag.String("dns-log", "", "log queries to the server given by -dns {full, redact}")
+			flEcdhkx = flag.Bool("ecdh", false, "require clients to run an ephemeral key exchange for forward secrecy, ashe and czar only")
 			flExtend = flag.String("e", "", "extend data for different protocols")
 			flGpprof = flag.String("g", "", "specify an address to enable net/http/pprof")
+			flH2Conn = flag.Bool("h2", false, "serve baboon over tls, which enables http/2")
+			flHealth = flag.String("health", "", "specify an address to serve /healthz and /readyz")
+			flIdleto = flag.Duration("idle", 0, "close relayed connections which are idle in both directions for this time, for example, 10m, 0 disables it")
 			flCipher = flag.String("k", "daze", "password, should be same with the one specified by client")
-			flListen = flag.String("l", "0.0.0.0:1081", "listen address")
-			flProtoc = flag.String("p", "ashe", "protocol {ashe, baboon, czar, dahlia}")
+			flMaster = flag.String("k-master", "", "master secret of access tokens generated by daze token, ashe, baboon and czar only")
+			flRetire = flag.String("k-retired", "", "old passwords still accepted after -k is changed, separated by commas, ashe, baboon and czar only")
+			flRetutl = flag.String("k-retired-until", "", "date after which the passwords given by -k-retired are rejected, for example, 2026-12-31, never if empty")
+			flListen = flag.String("l", "0.0.0.0:1081", "listen address, separated by commas")
+			flLograt = flag.Int("log-rate", 16, "max similar log lines per second, 0 means no limit")
+			flLimitc = flag.Int("limit-client", 0, "max concurrent connections per client ip, 0 means no limit")
+			flLimith = flag.Int("limit-host", 0, "max concurrent connections per destination host, 0 means no limit")
+			flLocale = flag.String("locale", "", "listen address of a local socks5/http proxy which shares the egress, for example, 127.0.0.1:1080")
+			flLocaut = flag.String("locale-auth", "", "user:pass required by the proxy given by -locale, so that it can be shared on the network")
+			flMuxing = flag.Bool("mux", true, "allow baboon clients to reuse a connection for all dials")
+			flNetems = flag.String("netem", "", "simulate a slow link to destinations, delay,jitter,loss, for example, 150ms,20ms,0.01")
+			flProtoc = flag.String("p", "ashe", "protocol {ashe, baboon, czar, dahlia, ferry, ping, shadowsocks, trojan, tulip, wsocket}, separated by commas")
+			flStrict = flag.Bool("strict", false, "never reply to failed handshakes, ashe and czar only")
+			flTLSCrt = flag.String("tls-cert", "", "tls certificate file, a self-signed certificate is used if empty")
+			flTLSCas = flag.String("tls-client-ca", "", "require tls clients to present a certificate issued by the authorities in this pem file, baboon -h2, trojan, tulip and wsocket with tls only")
+			flTelemt = flag.String("telemetry", "", "opt in to anonymous usage statistics, which are saved in this json file")
+			flTelpst = flag.String("telemetry-post", "", "post usage statistics to this url run by yourself")
+			flTenant = flag.String("tenants", "", "listeners with their own credentials, a line for each: name listen protocol cipher [extend] [option=value ...], options are users, k-retired, k-retired-until and k-master")
+			flTester = flag.String("tester", "", "run the echo tester for daze speedtest on the address, for example, 127.0.0.1:1090")
+			flTLSKey = flag.String("tls-key", "", "tls private key file")
+			flQuotas = flag.Uint64("quota", 0, "monthly traffic quota of each user given by -users in GiB, 0 means no limit")
+			flQuotaf = flag.String("quota-file", "", "keep the traffic of users given by -users in this json file across restarts")
+			flUsers  = flag.String("users", "", "users file, a line for each: name password, which replaces -k, ashe, baboon and czar only")
 		)
 		flag.Parse()
-		log.Println("main: server cipher is", *flCipher)
+		Configure()
+		LogLimit(*flLograt)
+		daze.Conf.LinkIdle = *flIdleto
+		// Passwords are rotated by moving the old one to -k-retired, clients are then moved to the new one within the
+		// grace period. They don't apply to tenants, which have their own keys.
+		keyring := NewKeys(*flUsers, *flRetire, *flRetutl, *flMaster)
+		if *flUsers != "" {
+			log.Println("main: load users", *flUsers, len(keyring.Users))
+		} else {
+			log.Println("main: server cipher is", *flCipher)
+		}
 		log.Println("main: protocol is used", *flProtoc)
-		if *flDnserv != "" {
+		if len(keyring.Retired) != 0 {
+			log.Println("main: retired passwords", len(keyring.Retired), "until", cmp.Or(*flRetutl, "forever"))
+		}
+		if keyring.Master != "" {
+			log.Println("main: access tokens are accepted")
+		}
+		resolver := NewResolver(*flDnserv, *flDnslog)
+		// Multiple protocols can be served in one process by separating listen addresses and protocols with commas,
+		// for example, -l 0.0.0.0:1081,0.0.0.0:1082 -p ashe,czar. If only one protocol is given, it applies to all
+		// listen addresses.
+		listens := strings.Split(*flListen, ",")
+		protocs := strings.Split(*flProtoc, ",")
+		if len(protocs) == 1 {
+			for len(protocs) < len(listens) {
+				protocs = append(protocs, protocs[0])
+			}
+		}
+		doa.Doa(len(listens) == len(protocs))
+		// Tenants are listeners with their own cipher, keys and extend data, so that one process serves separate
+		// groups of users with isolated credentials. Their stats are named after the tenant instead of the protocol.
+		// The default listen address is not used if there are tenants and -l is not given.
+		names := slices.Clone(protocs)
+		ciphers := make([]string, len(listens))
+		extends := make([]string, len(listens))
+		keys := make([]Keys, len(listens))
+		for i := range listens {
+			ciphers[i] = *flCipher
+			extends[i] = *flExtend
+			keys[i] = keyring
+		}
+		if *flTenant != "" {
+			seen := false
+			flag.Visit(func(f *flag.Flag) {
+				seen = seen || f.Name == "l"
+			})
+			if !seen {
+				listens, protocs, names, ciphers, extends, keys = nil, nil, nil, nil, nil, nil
+			}
+			for _, line := range strings.Split(*flTenant, "\n") {
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				t := NewTenant(line)
+				log.Println("main: tenant", t.Name, "listen on", t.Listen, "protocol is used", t.Protocol)
+				names = append(names, t.Name)
+				listens = append(listens, t.Listen)
+				protocs = append(protocs, t.Protocol)
+				ciphers = append(ciphers, t.Cipher)
+				extends = append(extends, t.Extend)
+				keys = append(keys, t.Keys)
+			}
+		}
+		// Protocols sharing a listen address are told apart by the first bytes of connections, one per class, for
+		// example, -l 0.0.0.0:443,0.0.0.0:443,0.0.0.0:443 -p baboon,trojan,ashe.
+		listeners := make([]net.Listener, len(listens))
+		demuxs := map[string]*daze.Demux{}
+		// Banned sources are rejected at accept time, and by the hook for protocols without a listener. The ban list is
+		// managed at /debug/ban along with the profiles, and the counters are at /debug/vars.
+		var ban *daze.Ban
+		if *flBanfai != 0 || *flBanlog || *flGpprof != "" {
+			ban = daze.NewBan()
+			ban.Fails = *flBanfai
+			ban.Log = *flBanlog
+			ban.Tarpit = *flBantar
+			ban.Ttl = *flBanper
+			ban.Window = *flBanwin
+			http.Handle("/debug/ban", ban)
+			expvar.Publish("ban", ban)
+		}
+		// Connections from sources out of the allow-source or banned are reset before any protocol handshake.
+		listen := func(address string) net.Listener {
+			if *flAllsrc == "" && ban == nil {
+				return nil
+			}
+			l := doa.Try(net.Listen("tcp", address))
+			if *flAllsrc != "" {
+				l = doa.Try(daze.NewAllowListener(l, *flAllsrc))
+			}
+			if ban != nil {
+				l = daze.NewBanListener(l, ban)
+			}
+			return l
+		}
+		shared := Shared(listens)
+		for i := range listens {
+			if !shared[i] {
+				if protocs[i] != "ferry" && protocs[i] != "ping" {
+					listeners[i] = listen(listens[i])
+				}
+				continue
+			}
+			demux, ok := demuxs[listens[i]]
+			if !ok {
+				demux = daze.NewDemux(listens[i])
+				demux.Listener = listen(listens[i])
+				demuxs[listens[i]] = demux
+			}
+			class := &demux.Raw
 			switch {
-			case strings.HasSuffix(*flDnserv, ":53"):
-				net.DefaultResolver = daze.ResolverDns(*flDnserv)
-			case strings.HasSuffix(*flDnserv, ":853"):
-				net.DefaultResolver = daze.ResolverDot(*flDnserv)
-			case strings.HasPrefix(*flDnserv, "https://"):
-				net.DefaultResolver = daze.ResolverDoh(*flDnserv)
-			}
-			log.Println("main: domain server is", *flDnserv)
-		}
-		switch *flProtoc {
-		case "ashe":
-			server := ashe.NewServer(*flListen, *flCipher)
-			defer server.Close()
-			doa.Nil(server.Run())
-		case "baboon":
-			server := baboon.NewServer(*flListen, *flCipher)
-			if *flExtend != "" {
-				server.Masker = *flExtend
-			}
-			defer server.Close()
-			doa.Nil(server.Run())
-		case "czar":
-			server := czar.NewServer(*flListen, *flCipher)
-			defer server.Close()
-			doa.Nil(server.Run())
-		case "dahlia":
-			server := dahlia.NewServer(*flListen, *flExtend, *flCipher)
-			defer server.Close()
-			doa.Nil(server.Run())
+			case protocs[i] == "baboon" && !*flH2Conn:
+				class = &demux.HTTP
+			case protocs[i] == "wsocket" && *flTLSCrt == "":
+				class = &demux.HTTP
+			case protocs[i] == "baboon" || protocs[i] == "trojan" || protocs[i] == "tulip" || protocs[i] == "wsocket":
+				class = &demux.TLS
+			case protocs[i] == "ferry" || protocs[i] == "ping":
+				log.Panicln("main: protocol", protocs[i], "can not share a listen address")
+			}
+			if *class != nil {
+				log.Panicln("main: protocol", protocs[i], "conflicts on", listens[i])
+			}
+			*class = daze.NewDemuxListener()
+			listeners[i] = *class
+		}
+		for _, demux := range demuxs {
+			defer demux.Close()
+			doa.Nil(demux.Run())
+		}
+		// All servers share the same egress and stats.
+		engine := daze.NewEngine()
+		engine.Dialer = NewNetem(*flNetems, &daze.Direct{Resolver: resolver})
+		if *flAllows != "" {
+			// Closed egress, the server only reaches the destinations in the allow-list.
+			log.Println("main: load allow-list", *flAllows)
+			rules := daze.NewRouterRules()
+			doa.Nil(rules.FromSource(daze.NewRuleSource(*flAllows)))
+			log.Println("main: size is", rules.Len())
+			engine.Router = daze.NewRouterChain(rules, daze.NewRouterRight(daze.RoadFucked))
+		}
+		expv := daze.NewExpv("daze")
+		hook := func(protocol string) daze.Hook { return expv.Sub(protocol) }
+		if *flTelemt != "" {
+			telemetry := daze.NewTelemetry(*flTelemt, Conf.Version)
+			telemetry.Post = *flTelpst
+			telemetry.Sync(time.Hour)
+			defer telemetry.Save()
+			hook = func(protocol string) daze.Hook {
+				return daze.NewHookChain(expv.Sub(protocol), telemetry.Hook(protocol))
+			}
+		}
+		if *flLimitc != 0 || *flLimith != 0 {
+			// Limits are shared by all protocols, so that a client can not bypass them by switching protocols.
+			limit := daze.NewHookLimit(*flLimitc, *flLimith)
+			base := hook
+			hook = func(protocol string) daze.Hook { return daze.NewHookChain(limit, base(protocol)) }
+		}
+		if ban != nil {
+			base := hook
+			hook = func(protocol string) daze.Hook { return daze.NewHookChain(ban, base(protocol)) }
+		}
+		if *flAudits != "" {
+			// The audit goes first, so that connections rejected by other hooks are audited as well.
+			f := doa.Try(os.OpenFile(*flAudits, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644))
+			defer f.Close()
+			audit := daze.NewAudit("audit", f)
+			base := hook
+			hook = func(protocol string) daze.Hook { return daze.NewHookChain(audit.Hook(protocol), base(protocol)) }
+		}
+		if *flGpprof != "" {
+			// Goroutine leaks are reported at /debug/vars along with the profiles.
+			tracer := daze.NewTracer("tracer")
+			base := hook
+			hook = func(protocol string) daze.Hook { return daze.NewHookChain(base(protocol), tracer) }
+		}
+		// Only devices holding a certificate issued by the authorities can complete the tls handshake.
+		clientAuth := func(conf *tls.Config) {
+			if *flTLSCas != "" {
+				doa.Nil(daze.ClientAuth(conf, *flTLSCas))
+			}
+		}
+		// Authenticated clients may ask for the build of the server, for example, by daze ver -s.
+		banner := daze.NewBanner(build, engine)
+		// Traffic is accounted per user, which is only known to protocols with users.
+		var egress daze.Dialer = shutdown.Wrap(banner)
+		if slices.ContainsFunc(keys, func(k Keys) bool { return len(k.Users) != 0 }) {
+			quota := daze.NewQuota(*flQuotaf, egress, *flQuotas*1024*1024*1024)
+			quota.Sync(time.Minute)
+			defer quota.Save()
+			expvar.Publish("quota", quota)
+			http.Handle("/debug/quota", quota)
+			egress = quota
+		}
+		health := daze.NewHealth(*flHealth)
+		for i := range listens {
+			switch protocs[i] {
+			case "ashe", "baboon", "czar", "dahlia", "shadowsocks", "trojan", "tulip", "wsocket":
+				// Protocols over udp or icmp have no listener to probe.
+				health.Live = append(health.Live, daze.HealthListen(listens[i]))
+			}
+			switch protocs[i] {
+			case "ashe":
+				server := ashe.NewServer(listens[i], ciphers[i])
+				server.Listener = listeners[i]
+				server.Dialer = egress
+				server.Ecdh = *flEcdhkx
+				server.Strict = *flStrict
+				server.Suite = *flSuites
+				server.Users = keys[i].Users
+				server.Retired = keys[i].Retired
+				server.RetiredUntil = keys[i].RetiredUntil
+				server.Master = keys[i].Master
+				server.Hook = hook(names[i])
+				defer server.Close()
+				doa.Nil(server.Run())
+			case "baboon":
+				server := baboon.NewServer(listens[i], ciphers[i])
+				server.Listener = listeners[i]
+				server.Dialer = egress
+				server.Hook = hook(names[i])
+				server.Users = keys[i].Users
+				server.Retired = keys[i].Retired
+				server.RetiredUntil = keys[i].RetiredUntil
+				server.Master = keys[i].Master
+				if extends[i] != "" {
+					server.Masker = extends[i]
+				}
+				server.Mux = *flMuxing
+				if *flH2Conn {
+					host, _, _ := net.SplitHostPort(listens[i])
+					crt := doa.Try(daze.Certificate(host))
+					if *flTLSCrt != "" {
+						crt = doa.Try(tls.LoadX509KeyPair(*flTLSCrt, *flTLSKey))
+					}
+					server.Config = &tls.Config{Certificates: []tls.Certificate{crt}}
+					clientAuth(server.Config)
+				}
+				defer server.Close()
+				doa.Nil(server.Run())
+			case "czar":
+				server := czar.NewServer(listens[i], ciphers[i])
+				server.Listener = listeners[i]
+				server.Dialer = egress
+				server.Ecdh = *flEcdhkx
+				server.Strict = *flStrict
+				server.Suite = *flSuites
+				server.Users = keys[i].Users
+				server.Retired = keys[i].Retired
+				server.RetiredUntil = keys[i].RetiredUntil
+				server.Master = keys[i].Master
+				server.Hook = hook(names[i])
+				defer server.Close()
+				doa.Nil(server.Run())
+			case "dahlia":
+				server := dahlia.NewServer(listens[i], extends[i], ciphers[i])
+				server.Listener = listeners[i]
+				server.Dialer = egress
+				server.Hook = hook(names[i])
+				defer server.Close()
+				doa.Nil(server.Run())
+			case "ferry":
+				server := ferry.NewServer(listens[i], ciphers[i])
+				server.Dialer = egress
+				server.Hook = hook(names[i])
+				defer server.Close()
+				doa.Nil(server.Run())
+			case "ping":
+				server := ferry.NewServer(listens[i], ciphers[i])
+				server.Dialer = egress
+				server.Hook = hook(names[i])
+				server.Network = "icmp"
+				defer server.Close()
+				doa.Nil(server.Run())
+			case "shadowsocks":
+				method := shadowsocks.Conf.Method
+				if extends[i] != "" {
+					method = extends[i]
+				}
+				server := shadowsocks.NewServer(listens[i], ciphers[i], method)
+				server.Listener = listeners[i]
+				server.Dialer = egress
+				server.Hook = hook(names[i])
+				defer server.Close()
+				doa.Nil(server.Run())
+			case "trojan":
+				server := trojan.NewServer(listens[i], ciphers[i])
+				server.Listener = listeners[i]
+				server.Dialer = egress
+				server.Hook = hook(names[i])
+				server.Masker = extends[i]
+				if *flTLSCrt != "" {
+					crt := doa.Try(tls.LoadX509KeyPair(*flTLSCrt, *flTLSKey))
+					server.Config.Certificates = []tls.Certificate{crt}
+				}
+				clientAuth(server.Config)
+				defer server.Close()
+				doa.Nil(server.Run())
+			case "tulip":
+				server := tulip.NewServer(listens[i], ciphers[i])
+				server.Listener = listeners[i]
+				server.Dialer = egress
+				server.Hook = hook(names[i])
+				if *flTLSCrt != "" {
+					crt := doa.Try(tls.LoadX509KeyPair(*flTLSCrt, *flTLSKey))
+					server.Config.Certificates = []tls.Certificate{crt}
+				}
+				clientAuth(server.Config)
+				defer server.Close()
+				doa.Nil(server.Run())
+			case "wsocket":
+				server := wsocket.NewServer(listens[i], ciphers[i])
+				server.Listener = listeners[i]
+				server.Dialer = egress
+				server.Hook = hook(names[i])
+				if extends[i] != "" {
+					server.Path = extends[i]
+				}
+				// Behind a cdn, tls is usually terminated by the cdn, so it is only enabled by a certificate.
+				if *flTLSCrt != "" {
+					crt := doa.Try(tls.LoadX509KeyPair(*flTLSCrt, *flTLSKey))
+					server.Config = &tls.Config{Certificates: []tls.Certificate{crt}}
+					clientAuth(server.Config)
+				}
+				defer server.Close()
+				doa.Nil(server.Run())
+			default:
+				log.Panicln("main: unknown protocol", protocs[i])
+			}
+		}
+		// The server machine itself may need a proxy too, it egresses directly but obeys the same rules and limits.
+		if *flLocale != "" {
+			locale := daze.NewLocale(*flLocale, shutdown.Wrap(engine))
+			locale.Auth = *flLocaut
+			locale.Hook = hook("locale")
+			defer locale.Close()
+			doa.Nil(locale.Run())
+			health.Live = append(health.Live, daze.HealthListen(*flLocale))
+		}
+		if *flTester != "" {
+			tester := daze.NewTester(*flTester)
+			defer tester.Close()
+			doa.Nil(tester.TCP())
+			log.Println("main: echo tester listen on", *flTester)
+		}
+		if *flHealth != "" {
+			defer health.Close()
+			doa.Nil(health.Run())
 		}
 		if *flGpprof != "" {
 			_ = pprof.Handler
@@ -114,67 +998,208 @@ func main() {
 		}
 		// Hang prevent program from exiting.
 		gracefulexit.Wait()
-		log.Println("main: exit")
 	case "client":
+		shutdown := NewShutdown()
+		defer shutdown.Exit()
 		var (
-			flCIDRls = flag.String("c", filepath.Join(resExec, Conf.PathCIDR), "cidr path")
-			flDnserv = flag.String("dns", "", "specifies the DNS, DoT or DoH server")
+			flAssist = flag.Int("assist", 0, "route a host through the server for an hour after n consecutive direct failures")
+			flLocaut = flag.String("auth", "", "user:pass required by the proxy given by -l and -frontend, so that it can be shared on the network")
+			flBlocks = flag.String("b", "", "blocklists in hosts format, separated by commas")
+			flCIDRls = flag.String("c", PathsFind(Conf.PathCIDR), "cidr path")
+			flChecks = flag.Bool("check", false, "ask the server for its build at startup, and exit if the handshake fails, daze servers only")
+			flSuites = flag.String("cipher-suite", "rc4", "cipher suite {rc4, rc4-hkdf, chacha20-poly1305, aes-256-gcm}, ashe and czar only")
+			_        = flag.String("conf", "", "config file, flags are also read from DAZE_* environment variables")
+			flDnserv = flag.String("dns", "", "specifies the DNS, DoT or DoH server, or a hosts file for offline mode")
+			flDnslog = flag.String("dns-log", "", "log queries to the server given by -dns {full, redact}")
+			flEarlyd = flag.Bool("early", false, "send data along with the request without waiting for the reply of the server, which saves a round trip, ashe and czar only")
+			flEcdhkx = flag.Bool("ecdh", false, "run an ephemeral key exchange for forward secrecy, ashe and czar only")
 			flFilter = flag.String("f", "rule", "filter {rule, remote, locale}")
+			flFucone = flag.Bool("full-cone", false, "relay socks5 udp as a full-cone nat, so that any peer can reply to the client, for destinations which go directly")
+			flFronts = flag.String("frontend", "", "listen addresses in addition to -l with their own limits, separated by commas, for example, 0.0.0.0:1090?rate=512&allow=lan.ls")
 			flGpprof = flag.String("g", "", "specify an address to enable net/http/pprof")
+			flH2Conn = flag.Bool("h2", false, "run each connection on a http/2 stream over tls, baboon only")
+			flHealth = flag.String("health", "", "specify an address to serve /healthz and /readyz")
+			flIdleto = flag.Duration("idle", 0, "close proxied connections which are idle in both directions for this time, for example, 10m, 0 disables it")
 			flCipher = flag.String("k", "daze", "password, should be same with the one specified by server")
+			flKalive = flag.Duration("keepalive", 0, "keep idle connections to the server alive at this interval, for example, 30s, ashe, baboon and czar only")
 			flListen = flag.String("l", "127.0.0.1:1080", "listen address")
-			flProtoc = flag.String("p", "ashe", "protocol {ashe, baboon, czar, dahlia}")
-			flRulels = flag.String("r", filepath.Join(resExec, Conf.PathRule), "rule path")
+			flLograt = flag.Int("log-rate", 16, "max similar log lines per second, 0 means no limit")
+			flMapper = flag.String("m", "", "static port maps path")
+			flMuxing = flag.Bool("mux", false, "reuse a connection to the server for all dials, baboon only")
+			flNetems = flag.String("netem", "", "simulate a slow link to the server, delay,jitter,loss, for example, 150ms,20ms,0.01")
+			flPrefet = flag.Bool("prefetch", false, "route and resolve hosts seen in plain http pages in advance, so that later connections to them start faster")
+			flProtoc = flag.String("p", "ashe", "protocol {ashe, baboon, czar, dahlia, ferry, socks5, ssh, tulip, wsocket}")
+			flRulels = flag.String("r", PathsFind(Conf.PathRule), "rule path, a directory of *.ls files or an http(s) url")
+			flRuinln = flag.String("r-inline", "", "rules in addition to -r, separated by newlines, see the inline_rules section of -conf")
+			flRusync = flag.Duration("r-sync", 0, "reload rules at this interval, for example, 10m")
+			flResume = flag.Duration("resume", 0, "keep connections alive if the client reconnects to the server within this time, for example, 5s, czar only")
 			flServer = flag.String("s", "127.0.0.1:1081", "server address")
+			flTelemt = flag.String("telemetry", "", "opt in to anonymous usage statistics, which are saved in this json file")
+			flTelpst = flag.String("telemetry-post", "", "post usage statistics to this url run by yourself")
+			flTLSCrt = flag.String("tls-cert", "", "tls client certificate file for servers which require one, baboon -h2, tulip and wsocket with tls only")
+			flTLSKey = flag.String("tls-key", "", "tls client private key file")
+			flUpstrm = flag.String("x", "", "upstream proxy to reach the server, http://host:port or socks5://host:port")
 		)
 		flag.Parse()
+		Configure()
+		LogLimit(*flLograt)
+		daze.Conf.LinkIdle = *flIdleto
+		if *flRulels == "-" && *flCIDRls == "-" {
+			log.Panicln("main: only one of -r and -c can read stdin")
+		}
 		log.Println("main: remote server is", *flServer)
 		log.Println("main: client cipher is", *flCipher)
 		log.Println("main: protocol is used", *flProtoc)
-		if *flDnserv != "" {
-			switch {
-			case strings.HasSuffix(*flDnserv, ":53"):
-				net.DefaultResolver = daze.ResolverDns(*flDnserv)
-			case strings.HasSuffix(*flDnserv, ":853"):
-				net.DefaultResolver = daze.ResolverDot(*flDnserv)
-			case strings.HasPrefix(*flDnserv, "https://"):
-				net.DefaultResolver = daze.ResolverDoh(*flDnserv)
-			}
-			log.Println("main: domain server is", *flDnserv)
-		}
-		switch *flProtoc {
-		case "ashe":
-			client := ashe.NewClient(*flServer, *flCipher)
-			locale := daze.NewLocale(*flListen, daze.NewAimbot(client, &daze.AimbotOption{
-				Type: *flFilter,
-				Rule: *flRulels,
-				Cidr: *flCIDRls,
-			}))
-			defer locale.Close()
-			doa.Nil(locale.Run())
-		case "baboon":
-			client := baboon.NewClient(*flServer, *flCipher)
-			locale := daze.NewLocale(*flListen, daze.NewAimbot(client, &daze.AimbotOption{
-				Type: *flFilter,
-				Rule: *flRulels,
-				Cidr: *flCIDRls,
-			}))
-			defer locale.Close()
-			doa.Nil(locale.Run())
-		case "czar":
-			client := czar.NewClient(*flServer, *flCipher)
-			defer client.Close()
-			locale := daze.NewLocale(*flListen, daze.NewAimbot(client, &daze.AimbotOption{
-				Type: *flFilter,
-				Rule: *flRulels,
-				Cidr: *flCIDRls,
-			}))
+		resolver := NewResolver(*flDnserv, *flDnslog)
+		// Corporate networks may only allow egress via a proxy, the server is reached through it.
+		var upstream daze.Dialer = &daze.Direct{Resolver: resolver}
+		if *flUpstrm != "" {
+			u := doa.Try(url.Parse(*flUpstrm))
+			password, _ := u.User.Password()
+			switch u.Scheme {
+			case "http":
+				upstream = daze.NewTunnelDialer(u.Host, u.User.Username(), password)
+			case "socks5":
+				upstream = daze.NewSocksDialer(u.Host, u.User.Username(), password)
+			default:
+				log.Panicln("main: unknown upstream proxy", *flUpstrm)
+			}
+			log.Println("main: upstream proxy is", u.Host)
+		}
+		upstream = NewNetem(*flNetems, upstream)
+		expv := daze.NewExpv("daze").Sub("locale")
+		var hook daze.Hook = expv
+		if *flTelemt != "" {
+			telemetry := daze.NewTelemetry(*flTelemt, Conf.Version)
+			telemetry.Post = *flTelpst
+			telemetry.Sync(time.Hour)
+			defer telemetry.Save()
+			hook = daze.NewHookChain(hook, telemetry.Hook(*flProtoc))
+		}
+		if *flGpprof != "" {
+			// Goroutine leaks are reported at /debug/vars along with the profiles.
+			hook = daze.NewHookChain(hook, daze.NewTracer("tracer"))
+		}
+		health := daze.NewHealth(*flHealth)
+		health.Live = append(health.Live, daze.HealthListen(*flListen))
+		var client daze.Dialer
+		if *flProtoc == "dahlia" {
+			c := dahlia.NewClient(*flListen, *flServer, *flCipher)
+			c.Dialer = upstream
+			defer c.Close()
+			doa.Nil(c.Run())
+		} else {
+			client = NewClient(*flProtoc, *flServer, *flCipher, upstream)
+			crts := []tls.Certificate{}
+			if *flTLSCrt != "" {
+				crts = append(crts, doa.Try(tls.LoadX509KeyPair(*flTLSCrt, *flTLSKey)))
+			}
+			switch c := client.(type) {
+			case *ashe.Client:
+				c.Early = *flEarlyd
+				c.Ecdh = *flEcdhkx
+				c.Keepalive = *flKalive
+				c.Suite = *flSuites
+			case *baboon.Client:
+				c.Config.Certificates = crts
+				c.H2 = *flH2Conn
+				c.Keepalive = *flKalive
+				c.Mux = *flMuxing
+			case *czar.Client:
+				c.Early = *flEarlyd
+				c.Ecdh = *flEcdhkx
+				c.Grace = *flResume
+				c.Keepalive = *flKalive
+				c.Suite = *flSuites
+			case *tulip.Client:
+				c.Config.Certificates = crts
+			case *wsocket.Client:
+				if c.Config != nil {
+					c.Config.Certificates = crts
+				}
+			}
+			if c, ok := client.(io.Closer); ok {
+				defer c.Close()
+			}
+			// A wrong password or server fails here rather than on the first connection of the user.
+			if *flChecks {
+				build, err := daze.BannerQuery(client)
+				if err != nil {
+					panic(fmt.Errorf("%w: %w", ErrHandshake, err))
+				}
+				log.Println("main: server is daze", build)
+			}
+		}
+		if client != nil {
+			aimbot := daze.NewAimbot(client, &daze.AimbotOption{
+				Type:       *flFilter,
+				Rule:       *flRulels,
+				RuleInline: *flRuinln,
+				RuleSync:   *flRusync,
+				Cidr:       *flCIDRls,
+				Hosts:      *flBlocks,
+				Assist:     *flAssist,
+				Resolver:   resolver,
+			})
+			aimbot.Expv = expv
+			locale := daze.NewLocale(*flListen, shutdown.Wrap(aimbot))
+			locale.Auth = *flLocaut
+			locale.Frontends = NewLocaleFrontends(*flFronts)
+			locale.FullCone = *flFucone
+			locale.Hook = hook
+			if *flPrefet {
+				locale.Prefetch = daze.NewPrefetch(aimbot.Router)
+			}
 			defer locale.Close()
 			doa.Nil(locale.Run())
-		case "dahlia":
-			client := dahlia.NewClient(*flListen, *flServer, *flCipher)
-			defer client.Close()
-			doa.Nil(client.Run())
+			for _, f := range locale.Frontends {
+				health.Live = append(health.Live, daze.HealthListen(f.Listen))
+			}
+			// The client is ready if the handshake with the server works.
+			health.Ready = append(health.Ready, daze.HealthDial(client, Conf.HealthProbe))
+			if *flMapper != "" {
+				log.Println("main: load map", *flMapper)
+				// Port maps which go through the same server share the client.
+				others := map[string]daze.Dialer{}
+				for _, e := range daze.LoadMapperOption(*flMapper) {
+					var dialer daze.Dialer
+					switch e.Road {
+					case "rule":
+						dialer = aimbot
+					case "remote":
+						dialer = client
+					case "locale":
+						dialer = &daze.Direct{Resolver: resolver}
+					default:
+						// The road is a server in the form of protocol://server?k=password, for example,
+						// czar://1.2.3.4:1081?k=password. The password is the same as -k if it is omitted.
+						protocol, server, ok := strings.Cut(e.Road, "://")
+						if !ok {
+							log.Panicln("main: unknown road", e.Road)
+						}
+						if others[e.Road] == nil {
+							server, query, _ := strings.Cut(server, "?")
+							cipher := *flCipher
+							if v := doa.Try(url.ParseQuery(query)); v.Has("k") {
+								cipher = v.Get("k")
+							}
+							others[e.Road] = NewClient(protocol, server, cipher, upstream)
+							if c, ok := others[e.Road].(io.Closer); ok {
+								defer c.Close()
+							}
+						}
+						dialer = others[e.Road]
+					}
+					mapper := daze.NewMapper(e.Listen, e.Server, shutdown.Wrap(dialer))
+					mapper.Hook = hook
+					defer mapper.Close()
+					doa.Nil(mapper.Run())
+				}
+			}
+		}
+		if *flHealth != "" {
+			defer health.Close()
+			doa.Nil(health.Run())
 		}
 		if *flGpprof != "" {
 			_ = pprof.Handler
@@ -183,7 +1208,6 @@ func main() {
 		}
 		// Hang prevent program from exiting.
 		gracefulexit.Wait()
-		log.Println("main: exit")
 	case "gen":
 		flag.Usage = func() {
 			fmt.Fprint(flag.CommandLine.Output(), helpGen)
@@ -201,7 +1225,7 @@ func main() {
 			flag.Usage()
 			return
 		}
-		name := filepath.Join(resExec, Conf.PathCIDR)
+		name := PathsFind(Conf.PathCIDR)
 		log.Println("main: save apnic data into", name)
 		f := doa.Try(os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644))
 		defer f.Close()
@@ -209,8 +1233,254 @@ func main() {
 			fmt.Fprintln(f, "L", e.String())
 		}
 		log.Println("main: save apnic data done")
+	case "paths":
+		flag.Usage = func() {
+			fmt.Fprint(flag.CommandLine.Output(), helpPaths)
+			flag.PrintDefaults()
+		}
+		flag.Parse()
+		PathsPrint(os.Stdout, []string{Conf.PathRule, Conf.PathCIDR})
+	case "proto":
+		var (
+			flCipher = flag.String("k", "daze", "password, should be same with the one specified by server")
+			flListen = flag.String("l", "127.0.0.1:1082", "listen address, which relays to the server")
+			flProtoc = flag.String("p", "ashe", "protocol {ashe, czar}")
+			flReadPc = flag.String("r", "", "pcap file to read instead of relaying")
+			flServer = flag.String("s", "127.0.0.1:1081", "server address")
+		)
+		flag.Usage = func() {
+			fmt.Fprint(flag.CommandLine.Output(), helpProto)
+			flag.PrintDefaults()
+		}
+		if len(os.Args) < 2 || os.Args[1] != "dump" {
+			flag.Usage()
+			return
+		}
+		os.Args = os.Args[1:]
+		flag.Parse()
+		if *flProtoc != "ashe" && *flProtoc != "czar" {
+			log.Panicln("main: unknown protocol", *flProtoc)
+		}
+		dump := &Dump{Cipher: daze.Salt(*flCipher), Mu: &sync.Mutex{}, W: os.Stdout}
+		if *flReadPc != "" {
+			_, port, err := net.SplitHostPort(*flServer)
+			doa.Nil(err)
+			doa.Nil(dump.Pcap(*flProtoc, *flReadPc, uint16(doa.Try(strconv.ParseUint(port, 10, 16)))))
+			return
+		}
+		log.Println("main: relay", *flListen, "to", *flServer)
+		doa.Nil(dump.Live(*flProtoc, *flListen, *flServer))
+	case "rule":
+		flTraffc := flag.String("traffic", "", "traffic log to replay")
+		flag.Usage = func() {
+			fmt.Fprint(flag.CommandLine.Output(), helpRule)
+			flag.PrintDefaults()
+		}
+		// Flags may come after the positional arguments, for example, daze rule diff old.ls new.ls -traffic log.
+		args := []string{}
+		flag.Parse()
+		for flag.NArg() != 0 {
+			args = append(args, flag.Arg(0))
+			doa.Nil(flag.CommandLine.Parse(flag.Args()[1:]))
+		}
+		if len(args) != 3 || args[0] != "diff" || *flTraffc == "" {
+			flag.Usage()
+			return
+		}
+		rules := [2]*daze.RouterRules{}
+		for i := range 2 {
+			rules[i] = daze.NewRouterRules()
+			doa.Nil(rules[i].FromSource(daze.NewRuleSource(args[i+1])))
+		}
+		f := doa.Try(daze.OpenFile(*flTraffc))
+		defer f.Close()
+		traffic := doa.Try(RuleTraffic(f))
+		n := RuleDiff(rules[0], rules[1], traffic, os.Stdout)
+		fmt.Println(n, "of", len(traffic), "hosts change road")
+	case "selftest":
+		var (
+			flCipher = flag.String("k", SelftestCipher(), "password, should be same with the one specified by server")
+			flListen = flag.String("l", "", "run the echo tester on the address for tcp and udp instead of the suite")
+			flProtoc = flag.String("p", "ashe,baboon,czar,ferry,tulip,wsocket", "protocol {ashe, baboon, czar, ferry, tulip, wsocket}, separated by commas")
+			flServer = flag.String("s", "", "server address, servers are started in process if empty")
+			flTCPDst = flag.String("d", "", "tcp destination running the echo tester, a local one is started if empty")
+			flUDPDst = flag.String("u", "", "udp destination running the echo tester, a local one is started if empty")
+		)
+		flag.Usage = func() {
+			fmt.Fprint(flag.CommandLine.Output(), helpSelftest)
+			flag.PrintDefaults()
+		}
+		flag.Parse()
+		if *flListen != "" {
+			tcp := daze.NewTester(*flListen)
+			defer tcp.Close()
+			doa.Nil(tcp.TCP())
+			udp := daze.NewTester(*flListen)
+			defer udp.Close()
+			doa.Nil(udp.UDP())
+			log.Println("main: echo tester listen on", *flListen)
+			gracefulexit.Wait()
+			return
+		}
+		log.SetOutput(io.Discard)
+		fail := Selftest(strings.Split(*flProtoc, ","), *flServer, *flCipher, *flTCPDst, *flUDPDst)
+		if fail != 0 {
+			fmt.Println(fail, "cases failed")
+			os.Exit(1)
+		}
+	case "soaktest":
+		var (
+			flCipher = flag.String("k", SelftestCipher(), "password, should be same with the one specified by server")
+			flInterv = flag.Duration("i", time.Minute, "interval between samples")
+			flProtoc = flag.String("p", "ashe", "protocol {ashe, baboon, czar, ferry, tulip, wsocket}")
+			flServer = flag.String("s", "", "server address, a server is started in process if empty")
+			flTCPDst = flag.String("d", "", "tcp destination running the echo tester, a local one is started if empty")
+			flTimout = flag.Duration("t", time.Hour*4, "duration of the whole test")
+			flUDPDst = flag.String("u", "", "udp destination running the echo tester, a local one is started if empty")
+			flWorker = flag.Int("n", 16, "number of concurrent workers")
+		)
+		flag.Usage = func() {
+			fmt.Fprint(flag.CommandLine.Output(), helpSoaktest)
+			flag.PrintDefaults()
+		}
+		flag.Parse()
+		log.SetOutput(io.Discard)
+		leaks := Soaktest(*flProtoc, *flServer, *flCipher, *flTCPDst, *flUDPDst, *flWorker, *flTimout, *flInterv)
+		if len(leaks) != 0 {
+			fmt.Println("soaktest failed, growing:", strings.Join(leaks, ", "))
+			os.Exit(1)
+		}
+	case "bench", "speedtest":
+		var (
+			flCipher = flag.String("k", "daze", "password, should be same with the one specified by server")
+			flCounts = flag.Int("c", 8, "number of samples of the latency")
+			flTCPDst = flag.String("d", "127.0.0.1:1090", "tcp destination running the echo tester, as seen from the server")
+			flVolume = flag.Int("n", 16, "megabytes transferred in each direction")
+			flProtoc = flag.String("p", "ashe", "protocol {ashe, baboon, czar, ferry, socks5, ssh, tulip, wsocket}")
+			flProfil = flag.String("profile", "", "save cpu and heap profiles of the run in this directory, and report the hotspots")
+			flProfsv = flag.String("profile-server", "", "net/http/pprof address of the server given by its -g, to profile the server as well")
+			flProftm = flag.Duration("profile-time", time.Second*10, "duration the server is profiled from the start of the run")
+			flServer = flag.String("s", "127.0.0.1:1081", "server address")
+			flTimout = flag.Duration("t", time.Minute, "timeout of the whole test")
+			flUpstrm = flag.String("x", "", "upstream proxy to reach the server, http://host:port or socks5://host:port")
+		)
+		flag.Usage = func() {
+			fmt.Fprint(flag.CommandLine.Output(), helpSpeedtest)
+			flag.PrintDefaults()
+		}
+		flag.Parse()
+		var upstream daze.Dialer = &daze.Direct{}
+		if *flUpstrm != "" {
+			u := doa.Try(url.Parse(*flUpstrm))
+			password, _ := u.User.Password()
+			switch u.Scheme {
+			case "http":
+				upstream = daze.NewTunnelDialer(u.Host, u.User.Username(), password)
+			case "socks5":
+				upstream = daze.NewSocksDialer(u.Host, u.User.Username(), password)
+			default:
+				log.Panicln("main: unknown upstream proxy", *flUpstrm)
+			}
+		}
+		client := NewClient(*flProtoc, *flServer, *flCipher, upstream)
+		if c, ok := client.(io.Closer); ok {
+			defer c.Close()
+		}
+		log.SetOutput(io.Discard)
+		var r *SpeedtestResult
+		run := func() (err error) {
+			r, err = SpeedtestRun(client, *flTCPDst, *flVolume*1024*1024, *flCounts, *flTimout)
+			return err
+		}
+		profiles := []string{}
+		var err error
+		if *flProfil != "" {
+			profiles, err = SpeedtestProfile(*flProfil, *flProfsv, *flProftm, run)
+		} else {
+			err = run()
+		}
+		if err != nil {
+			fmt.Println(subCommand, "failed:", err)
+			os.Exit(1)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "dial\t%s\n", r.Dial.Round(time.Microsecond))
+		fmt.Fprintf(w, "rtt\t%s\n", r.Rtt.Round(time.Microsecond))
+		fmt.Fprintf(w, "down\t%s\n", SpeedtestFormat(r.Down))
+		fmt.Fprintf(w, "up\t%s\n", SpeedtestFormat(r.Up))
+		w.Flush()
+		// Hotspots tell where the time goes, compare the saved profiles of two versions by go tool pprof -diff_base.
+		for _, name := range profiles {
+			f := doa.Try(os.Open(filepath.Join(*flProfil, name)))
+			top, err := ProfileTop(f, 5)
+			f.Close()
+			if err != nil {
+				fmt.Println(name, err)
+				continue
+			}
+			fmt.Println()
+			fmt.Println(name)
+			for _, e := range top {
+				fmt.Fprintf(w, "  %.2f%%\t%s\n", e.Share*100, e.Name)
+			}
+			w.Flush()
+		}
+	case "token":
+		var (
+			flMaster = flag.String("k", "", "master secret, should be same with the one given by -k-master of the server")
+			flDaysto = flag.Int("days", 7, "number of days the token is valid, counting today")
+		)
+		flag.Usage = func() {
+			fmt.Fprint(flag.CommandLine.Output(), helpToken)
+			flag.PrintDefaults()
+		}
+		flag.Parse()
+		if *flMaster == "" || *flDaysto < 1 || *flDaysto > ashe.Conf.TokenDays+1 {
+			flag.Usage()
+			return
+		}
+		day := time.Now().AddDate(0, 0, *flDaysto-1).Format(time.DateOnly)
+		log.Println("main: token expires after", day)
+		fmt.Println(daze.Token(*flMaster, day))
+	case "verify":
+		flag.Usage = func() {
+			fmt.Fprint(flag.CommandLine.Output(), helpVerify)
+			flag.PrintDefaults()
+		}
+		flag.Parse()
+		if flag.NArg() != 1 {
+			flag.Usage()
+			return
+		}
+		if PublicKey == "" {
+			log.Panicln("main: no public key is embedded in this build")
+		}
+		doa.Nil(daze.Verify(doa.Try(hex.DecodeString(PublicKey)), flag.Arg(0)))
+		log.Println("main: signature is valid")
 	case "ver":
-		fmt.Println("daze", Conf.Version)
+		var (
+			flCipher = flag.String("k", "daze", "password, should be same with the one specified by server")
+			flJsonfm = flag.Bool("json", false, "print the build as json")
+			flProtoc = flag.String("p", "ashe", "protocol {ashe, baboon, czar, ferry, tulip, wsocket}")
+			flServer = flag.String("s", "", "ask the server at this address for its build instead")
+		)
+		flag.Usage = func() {
+			fmt.Fprint(flag.CommandLine.Output(), helpVer)
+			flag.PrintDefaults()
+		}
+		flag.Parse()
+		if *flServer != "" {
+			client := NewClient(*flProtoc, *flServer, *flCipher, &daze.Direct{})
+			if c, ok := client.(io.Closer); ok {
+				defer c.Close()
+			}
+			build = doa.Try(daze.BannerQuery(client))
+		}
+		if *flJsonfm {
+			fmt.Println(string(doa.Try(json.Marshal(build))))
+			return
+		}
+		fmt.Println("daze", build)
 	case "", "-h", "--help":
 		fmt.Println(helpMsg)
 	}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/lib/doa"
+	"github.com/mohanson/daze/protocol/ashe"
+	"github.com/mohanson/daze/protocol/tulip"
+)
+
+func TestTenantKeys(t *testing.T) {
+	dir := t.TempDir()
+	doa.Nil(os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alice alice-password\n"), 0644))
+	doa.Nil(os.WriteFile(filepath.Join(dir, "b.txt"), []byte("bob bob-password\n"), 0644))
+	tenants := []Tenant{
+		NewTenant("a 127.0.0.1:0 ashe password-a users=" + filepath.Join(dir, "a.txt")),
+		NewTenant("b 127.0.0.1:0 ashe password-b /extend users=" + filepath.Join(dir, "b.txt") + " k-master=master-b"),
+	}
+	doa.Doa(tenants[0].Keys.Master == "" && tenants[1].Keys.Master == "master-b")
+	doa.Doa(tenants[0].Extend == "" && tenants[1].Extend == "/extend")
+	addrs := []string{}
+	for _, e := range tenants {
+		server := ashe.NewServer(e.Listen, e.Cipher)
+		server.Listener = doa.Try(net.Listen("tcp", e.Listen))
+		server.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+			return &daze.ReadWriteCloser{Reader: bytes.NewReader(nil), Writer: io.Discard, Closer: io.NopCloser(nil)}, nil
+		})
+		server.Users = e.Keys.Users
+		server.Master = e.Keys.Master
+		defer server.Close()
+		doa.Nil(server.Run())
+		addrs = append(addrs, server.Listener.Addr().String())
+	}
+	cli := doa.Try(ashe.NewClient(addrs[0], "alice-password").Dial(&daze.Context{}, "tcp", "example.com:80"))
+	cli.Close()
+	// A user of a tenant is rejected by another.
+	doa.Doa(doa.Err(ashe.NewClient(addrs[1], "alice-password").Dial(&daze.Context{}, "tcp", "example.com:80")) != nil)
+	cli = doa.Try(ashe.NewClient(addrs[1], "bob-password").Dial(&daze.Context{}, "tcp", "example.com:80"))
+	cli.Close()
+}
+
+func TestShutdownTraffic(t *testing.T) {
+	shutdown := &Shutdown{Time: time.Now(), Usage: &daze.QuotaUsage{}}
+	// Traffic through protocols other than ashe is counted as well.
+	server := tulip.NewServer("127.0.0.1:0", "password")
+	server.Listener = doa.Try(net.Listen("tcp", "127.0.0.1:0"))
+	server.Dialer = shutdown.Wrap(daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		c0, c1 := net.Pipe()
+		go daze.NewTester("").TCPServe(c1)
+		return c0, nil
+	}))
+	defer server.Close()
+	doa.Nil(server.Run())
+	cli := doa.Try(tulip.NewClient(server.Listener.Addr().String(), "password").Dial(&daze.Context{}, "tcp", "example.com:80"))
+	doa.Try(cli.Write([]byte{0x00, 0x2a, 0x01, 0x00}))
+	doa.Try(io.ReadFull(cli, make([]byte, 256)))
+	cli.Close()
+	doa.Doa(shutdown.Usage.Up.Load() == 4 && shutdown.Usage.Down.Load() == 256)
+}
+
+func TestShared(t *testing.T) {
+	doa.Doa(slices.Equal(Shared([]string{":443", ":443"}), []bool{true, true}))
+	doa.Doa(slices.Equal(Shared([]string{":443", ":443", ":443"}), []bool{true, true, true}))
+	doa.Doa(slices.Equal(Shared([]string{":443", ":80", ":443"}), []bool{true, false, true}))
+	doa.Doa(slices.Equal(Shared([]string{":443", ":80"}), []bool{false, false}))
+}
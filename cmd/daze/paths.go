@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"text/tabwriter"
+)
+
+// PathsDirs returns the directories searched for resource files such as rule.ls and rule.cidr, in order of
+// precedence: the user config directory, which is $XDG_CONFIG_HOME/daze or ~/.config/daze on linux, the system config
+// directory /etc/daze, and the directory of the executable.
+func PathsDirs() []string {
+	r := []string{}
+	if dir, err := os.UserConfigDir(); err == nil {
+		r = append(r, filepath.Join(dir, "daze"))
+	}
+	if runtime.GOOS != "windows" {
+		r = append(r, "/etc/daze")
+	}
+	if exe, err := os.Executable(); err == nil {
+		r = append(r, filepath.Dir(exe))
+	}
+	return r
+}
+
+// PathsFind returns the first existing path of the named resource file in the search directories. If it exists in
+// none of them, the path in the last directory is returned, so that errors show where the file was expected.
+func PathsFind(name string) string {
+	dirs := PathsDirs()
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dirs[len(dirs)-1], name)
+}
+
+// PathsPrint prints the search paths of the named resource files, and which of them is loaded.
+func PathsPrint(w io.Writer, names []string) {
+	t := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(t, "FILE\tPATH\tSTATUS")
+	for _, name := range names {
+		find := PathsFind(name)
+		for _, dir := range PathsDirs() {
+			path := filepath.Join(dir, name)
+			status := "missing"
+			if _, err := os.Stat(path); err == nil {
+				status = "shadowed"
+				if path == find {
+					status = "loaded"
+				}
+			}
+			fmt.Fprintf(t, "%s\t%s\t%s\n", name, path, status)
+		}
+	}
+	t.Flush()
+}
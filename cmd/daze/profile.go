@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// A pprof profile is a gzipped protobuf message, see https://github.com/google/pprof/blob/main/proto/profile.proto.
+// Only the fields needed to sum the samples by function are decoded, so no protobuf library is required.
+
+// ProfileField is a field of a protobuf message. Varints and fixed numbers are decoded into V, length delimited fields
+// are kept in B.
+type ProfileField struct {
+	B   []byte
+	Num int
+	V   uint64
+}
+
+// ProfileFields decodes the fields of a protobuf message.
+func ProfileFields(b []byte) ([]ProfileField, error) {
+	r := []ProfileField{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("daze: malformed profile")
+		}
+		b = b[n:]
+		f := ProfileField{Num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.V, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errors.New("daze: malformed profile")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, errors.New("daze: malformed profile")
+			}
+			f.V = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, errors.New("daze: malformed profile")
+			}
+			f.B = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return nil, errors.New("daze: malformed profile")
+			}
+			f.V = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return nil, errors.New("daze: malformed profile")
+		}
+		r = append(r, f)
+	}
+	return r, nil
+}
+
+// ProfileVarints returns the numbers of a repeated field, which are either packed or not.
+func ProfileVarints(f ProfileField) []uint64 {
+	if f.B == nil {
+		return []uint64{f.V}
+	}
+	r := []uint64{}
+	for b := f.B; len(b) > 0; {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			break
+		}
+		r = append(r, v)
+		b = b[n:]
+	}
+	return r
+}
+
+// ProfileEntry is a function of a profile along with the samples spent in it, but not in the functions it calls.
+type ProfileEntry struct {
+	Flat  int64
+	Name  string
+	Share float64
+}
+
+// ProfileTop returns the n functions with the most samples in a pprof profile. Samples are counted by the cpu time in
+// cpu profiles, by the allocated bytes in heap profiles, and by their last value in other profiles.
+func ProfileTop(r io.Reader, n int) ([]ProfileEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		g, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = io.ReadAll(g)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fields, err := ProfileFields(data)
+	if err != nil {
+		return nil, err
+	}
+	kinds := []uint64{}
+	samples := [][]ProfileField{}
+	locations := map[uint64]uint64{}
+	functions := map[uint64]uint64{}
+	strs := []string{}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			s, err := ProfileFields(f.B)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range s {
+				if e.Num == 1 {
+					kinds = append(kinds, e.V)
+				}
+			}
+		case 2:
+			s, err := ProfileFields(f.B)
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, s)
+		case 4:
+			// The first line of a location is the innermost of the functions inlined there.
+			s, err := ProfileFields(f.B)
+			if err != nil {
+				return nil, err
+			}
+			id, fn := uint64(0), uint64(0)
+			for _, e := range s {
+				switch {
+				case e.Num == 1:
+					id = e.V
+				case e.Num == 4 && fn == 0:
+					l, err := ProfileFields(e.B)
+					if err != nil {
+						return nil, err
+					}
+					for _, e := range l {
+						if e.Num == 1 {
+							fn = e.V
+						}
+					}
+				}
+			}
+			locations[id] = fn
+		case 5:
+			s, err := ProfileFields(f.B)
+			if err != nil {
+				return nil, err
+			}
+			id, name := uint64(0), uint64(0)
+			for _, e := range s {
+				switch e.Num {
+				case 1:
+					id = e.V
+				case 2:
+					name = e.V
+				}
+			}
+			functions[id] = name
+		case 6:
+			strs = append(strs, string(f.B))
+		}
+	}
+	kind := len(kinds) - 1
+	for i, e := range kinds {
+		if e < uint64(len(strs)) && (strs[e] == "cpu" || strs[e] == "alloc_space") {
+			kind = i
+		}
+	}
+	flat := map[string]int64{}
+	total := int64(0)
+	for _, s := range samples {
+		locs := []uint64{}
+		vals := []uint64{}
+		for _, e := range s {
+			switch e.Num {
+			case 1:
+				locs = append(locs, ProfileVarints(e)...)
+			case 2:
+				vals = append(vals, ProfileVarints(e)...)
+			}
+		}
+		if len(locs) == 0 || len(vals) != len(kinds) {
+			continue
+		}
+		v := int64(vals[kind])
+		name := "?"
+		if i := functions[locations[locs[0]]]; i < uint64(len(strs)) {
+			name = strs[i]
+		}
+		flat[name] += v
+		total += v
+	}
+	entries := []ProfileEntry{}
+	for k, v := range flat {
+		if v == 0 {
+			continue
+		}
+		entries = append(entries, ProfileEntry{Flat: v, Name: k, Share: float64(v) / float64(total)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Flat != entries[j].Flat {
+			return entries[i].Flat > entries[j].Flat
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries[:min(n, len(entries))], nil
+}
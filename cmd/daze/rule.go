@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mohanson/daze"
+)
+
+// RuleTraffic reads the destination hosts and the number of connections to them from a traffic log. Each line is
+// either a json object with an address or a host field, for example, an entry of the stream registry, a line of the
+// daze client log which contains address=, or a bare host.
+func RuleTraffic(r io.Reader) (map[string]int, error) {
+	hosts := map[string]int{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		addr := ""
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "{"):
+			var v struct {
+				Address string `json:"address"`
+				Host    string `json:"host"`
+			}
+			if err := json.Unmarshal([]byte(line), &v); err != nil {
+				return nil, err
+			}
+			addr = cmp.Or(v.Address, v.Host)
+		case strings.Contains(line, "address="):
+			_, addr, _ = strings.Cut(line, "address=")
+			addr, _, _ = strings.Cut(addr, " ")
+		case strings.Contains(line, " "):
+			continue
+		default:
+			addr = line
+		}
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		if addr == "" {
+			continue
+		}
+		hosts[strings.ToLower(addr)]++
+	}
+	return hosts, s.Err()
+}
+
+// RuleDiff prints the hosts in the traffic whose road changes from the prev rules to the next rules, busy hosts first.
+// It returns the number of changed hosts. A puzzle road means the host is left to the cidr rules.
+func RuleDiff(prev *daze.RouterRules, next *daze.RouterRules, traffic map[string]int, w io.Writer) int {
+	hosts := []string{}
+	for host := range traffic {
+		hosts = append(hosts, host)
+	}
+	slices.SortFunc(hosts, func(a, b string) int {
+		return cmp.Or(cmp.Compare(traffic[b], traffic[a]), cmp.Compare(a, b))
+	})
+	n := 0
+	t := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(t, "HOST\tCONN\tOLD\tNEW\tRULE")
+	for _, host := range hosts {
+		a := &daze.Context{}
+		b := &daze.Context{}
+		oldRoad := prev.Road(a, host)
+		newRoad := next.Road(b, host)
+		if oldRoad == newRoad {
+			continue
+		}
+		n++
+		// The rule which takes the host, or the removed rule which took it.
+		fmt.Fprintf(t, "%s\t%d\t%s\t%s\t%s\n", host, traffic[host], oldRoad, newRoad, cmp.Or(b.Match, a.Match))
+	}
+	t.Flush()
+	return n
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/lib/doa"
+	"github.com/mohanson/daze/protocol/ashe"
+	"github.com/mohanson/daze/protocol/baboon"
+	"github.com/mohanson/daze/protocol/czar"
+	"github.com/mohanson/daze/protocol/ferry"
+	"github.com/mohanson/daze/protocol/tulip"
+	"github.com/mohanson/daze/protocol/wsocket"
+)
+
+// SelftestCase is a single check of the conformance suite. It talks to the echo server of daze.Tester through the
+// dialer.
+type SelftestCase struct {
+	Name string
+	Test func(dialer daze.Dialer, tcp string, udp string) error
+}
+
+// SelftestCases lists the checks run for each protocol.
+var SelftestCases = []SelftestCase{
+	{Name: "tcp pull", Test: SelftestTCPPull},
+	{Name: "tcp push", Test: SelftestTCPPush},
+	{Name: "tcp server close", Test: SelftestTCPServerClose},
+	{Name: "tcp client close", Test: SelftestTCPClientClose},
+	{Name: "udp pull", Test: SelftestUDPPull},
+}
+
+// SelftestPull asks the echo server for n bytes of val and checks them.
+func SelftestPull(c io.ReadWriteCloser, val byte, n int) error {
+	_, err := c.Write([]byte{0x00, val, byte(n >> 8), byte(n)})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, bytes.Repeat([]byte{val}, n)) {
+		return errors.New("daze: data mangled")
+	}
+	return nil
+}
+
+// SelftestTCPPull checks data sent by the destination.
+func SelftestTCPPull(dialer daze.Dialer, tcp string, udp string) error {
+	c, err := dialer.Dial(&daze.Context{}, "tcp", tcp)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return SelftestPull(c, 0x2a, 0x8000)
+}
+
+// SelftestTCPPush checks data sent to the destination, the stream must still work afterwards.
+func SelftestTCPPush(dialer daze.Dialer, tcp string, udp string) error {
+	c, err := dialer.Dial(&daze.Context{}, "tcp", tcp)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write(append([]byte{0x01, 0x2a, 0x80, 0x00}, bytes.Repeat([]byte{0x2a}, 0x8000)...))
+	if err != nil {
+		return err
+	}
+	return SelftestPull(c, 0x2b, 0x10)
+}
+
+// SelftestTCPServerClose checks that closing by the destination is seen by the client.
+func SelftestTCPServerClose(dialer daze.Dialer, tcp string, udp string) error {
+	c, err := dialer.Dial(&daze.Context{}, "tcp", tcp)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte{0x02, 0x00, 0x00, 0x00})
+	if err != nil {
+		return err
+	}
+	_, err = c.Read(make([]byte, 1))
+	if err == nil {
+		return errors.New("daze: data after close")
+	}
+	return nil
+}
+
+// SelftestTCPClientClose checks that streams can be opened again after the client closes one.
+func SelftestTCPClientClose(dialer daze.Dialer, tcp string, udp string) error {
+	for range 4 {
+		c, err := dialer.Dial(&daze.Context{}, "tcp", tcp)
+		if err != nil {
+			return err
+		}
+		err = SelftestPull(c, 0x2a, 0x10)
+		c.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SelftestUDPPull checks datagrams sent by the destination.
+func SelftestUDPPull(dialer daze.Dialer, tcp string, udp string) error {
+	c, err := dialer.Dial(&daze.Context{}, "udp", udp)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return SelftestPull(c, 0x2a, 0x400)
+}
+
+// SelftestRun runs the case, which fails if it does not finish in Conf.SelftestTimeout.
+func SelftestRun(e SelftestCase, dialer daze.Dialer, tcp string, udp string) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- e.Test(dialer, tcp, udp)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(Conf.SelftestTimeout):
+		return errors.New("daze: timeout")
+	}
+}
+
+// SelftestFreeAddr returns a free local address on the network.
+func SelftestFreeAddr(network string) string {
+	switch network {
+	case "udp":
+		l := doa.Try(net.ListenPacket("udp", "127.0.0.1:0"))
+		defer l.Close()
+		return l.LocalAddr().String()
+	default:
+		l := doa.Try(net.Listen("tcp", "127.0.0.1:0"))
+		defer l.Close()
+		return l.Addr().String()
+	}
+}
+
+// SelftestServer starts a server of the protocol in process, and returns its address.
+func SelftestServer(protocol string, cipher string) (string, io.Closer, error) {
+	switch protocol {
+	case "ashe":
+		server := ashe.NewServer(SelftestFreeAddr("tcp"), cipher)
+		return server.Listen, server, server.Run()
+	case "baboon":
+		server := baboon.NewServer(SelftestFreeAddr("tcp"), cipher)
+		return server.Listen, server, server.Run()
+	case "czar":
+		server := czar.NewServer(SelftestFreeAddr("tcp"), cipher)
+		return server.Listen, server, server.Run()
+	case "ferry":
+		server := ferry.NewServer(SelftestFreeAddr("udp"), cipher)
+		return server.Listen, server, server.Run()
+	case "tulip":
+		server := tulip.NewServer(SelftestFreeAddr("tcp"), cipher)
+		return server.Listen, server, server.Run()
+	case "wsocket":
+		server := wsocket.NewServer(SelftestFreeAddr("tcp"), cipher)
+		return server.Listen, server, server.Run()
+	}
+	return "", nil, fmt.Errorf("daze: selftest does not support %s", protocol)
+}
+
+// Selftest runs the suite for each protocol and prints a report. Servers are started in process if server is empty.
+// The destination tcp and udp addresses must run daze.Tester, local ones are started if they are empty. It returns
+// the number of failed cases.
+func Selftest(protocols []string, server string, cipher string, tcp string, udp string) int {
+	if tcp == "" {
+		tester := daze.NewTester(SelftestFreeAddr("tcp"))
+		defer tester.Close()
+		doa.Nil(tester.TCP())
+		tcp = tester.Listen
+	}
+	if udp == "" {
+		tester := daze.NewTester(SelftestFreeAddr("udp"))
+		defer tester.Close()
+		doa.Nil(tester.UDP())
+		udp = tester.Listen
+	}
+	fail := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROTOCOL\tCASE\tRESULT")
+	for _, protocol := range protocols {
+		addr := server
+		if addr == "" {
+			a, c, err := SelftestServer(protocol, cipher)
+			if err != nil {
+				fmt.Fprintf(w, "%s\t-\tfail: %s\n", protocol, err)
+				fail++
+				continue
+			}
+			defer c.Close()
+			addr = a
+		}
+		client := NewClient(protocol, addr, cipher, &daze.Direct{})
+		if protocol == "ferry" {
+			// Raw sockets are not required by the suite.
+			client.(*ferry.Client).Network = "udp"
+		}
+		for _, e := range SelftestCases {
+			err := SelftestRun(e, client, tcp, udp)
+			if err != nil {
+				fmt.Fprintf(w, "%s\t%s\tfail: %s\n", protocol, e.Name, err)
+				fail++
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\tpass\n", protocol, e.Name)
+		}
+		if c, ok := client.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	w.Flush()
+	return fail
+}
+
+// SelftestCipher returns a throwaway cipher.
+func SelftestCipher() string {
+	buf := make([]byte, 16)
+	io.ReadFull(&daze.RandomReader{}, buf)
+	return hex.EncodeToString(buf)
+}
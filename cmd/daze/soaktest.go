@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/lib/doa"
+	"github.com/mohanson/daze/protocol/ferry"
+)
+
+// SoaktestSample is the resource usage of the process at a moment.
+type SoaktestSample struct {
+	Fds        int
+	Goroutines int
+	Heap       uint64
+}
+
+// SoaktestFds returns the number of open file descriptors of the process, or -1 if it is unknown on the platform.
+func SoaktestFds() int {
+	e, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(e)
+}
+
+// SoaktestMeasure collects garbage and samples the resource usage of the process.
+func SoaktestMeasure() SoaktestSample {
+	runtime.GC()
+	m := runtime.MemStats{}
+	runtime.ReadMemStats(&m)
+	return SoaktestSample{Fds: SoaktestFds(), Goroutines: runtime.NumGoroutine(), Heap: m.HeapInuse}
+}
+
+// SoaktestGrowth reports whether the last n values of the series never decrease and grow by more than a ratio of the
+// first of them. Usage under a steady load goes up and down around a level, while a leak climbs sample after sample.
+func SoaktestGrowth(series []float64, n int, ratio float64) bool {
+	if n < 2 || len(series) < n {
+		return false
+	}
+	s := series[len(series)-n:]
+	for i := 1; i < len(s); i++ {
+		if s[i] < s[i-1] {
+			return false
+		}
+	}
+	return s[len(s)-1] > s[0]*(1+ratio)
+}
+
+// Soaktest runs the selftest cases in a loop on each worker through the server for the duration, and samples the
+// resource usage every interval. The server is started in process if server is empty, then its usage is sampled along
+// with the client. It prints a row per sample, and returns the names of the series which grow monotonically.
+func Soaktest(protocol string, server string, cipher string, tcp string, udp string, workers int, duration time.Duration, interval time.Duration) []string {
+	if tcp == "" {
+		tester := daze.NewTester(SelftestFreeAddr("tcp"))
+		defer tester.Close()
+		doa.Nil(tester.TCP())
+		tcp = tester.Listen
+	}
+	if udp == "" {
+		tester := daze.NewTester(SelftestFreeAddr("udp"))
+		defer tester.Close()
+		doa.Nil(tester.UDP())
+		udp = tester.Listen
+	}
+	if server == "" {
+		a, c, err := SelftestServer(protocol, cipher)
+		if err != nil {
+			fmt.Println("soaktest failed:", err)
+			return []string{"server"}
+		}
+		defer c.Close()
+		server = a
+	}
+	client := NewClient(protocol, server, cipher, &daze.Direct{})
+	if protocol == "ferry" {
+		// Raw sockets are not required by the cases.
+		client.(*ferry.Client).Network = "udp"
+	}
+	if c, ok := client.(io.Closer); ok {
+		defer c.Close()
+	}
+	cases := atomic.Uint64{}
+	fails := atomic.Uint64{}
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := i; ; j++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if SelftestRun(SelftestCases[j%len(SelftestCases)], client, tcp, udp) != nil {
+					fails.Add(1)
+				}
+				cases.Add(1)
+			}
+		}()
+	}
+	series := map[string][]float64{}
+	leaks := []string{}
+	fmt.Printf("%-10s %-10s %-10s %-6s %-10s %s\n", "TIME", "GOROUTINES", "HEAP", "FDS", "CASES", "FAILS")
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for elapsed := interval; elapsed <= duration; elapsed += interval {
+		<-tick.C
+		s := SoaktestMeasure()
+		fmt.Printf("%-10s %-10d %-10s %-6d %-10d %d\n", elapsed, s.Goroutines, fmt.Sprintf("%.1fM", float64(s.Heap)/1024/1024),
+			s.Fds, cases.Load(), fails.Load())
+		series["goroutines"] = append(series["goroutines"], float64(s.Goroutines))
+		series["heap"] = append(series["heap"], float64(s.Heap))
+		if s.Fds >= 0 {
+			series["fds"] = append(series["fds"], float64(s.Fds))
+		}
+	}
+	close(done)
+	wg.Wait()
+	for _, name := range []string{"goroutines", "heap", "fds"} {
+		if SoaktestGrowth(series[name], Conf.SoaktestWindow, Conf.SoaktestGrowth) {
+			leaks = append(leaks, name)
+		}
+	}
+	return leaks
+}
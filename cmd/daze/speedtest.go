@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/mohanson/daze"
+)
+
+// SpeedtestResult is the result of a speed test. Throughputs are in bytes per second.
+type SpeedtestResult struct {
+	// Dial is the time to connect to the destination through the server, handshakes included.
+	Dial time.Duration
+	Down float64
+	// Rtt is the round trip time on an established connection.
+	Rtt time.Duration
+	Up  float64
+}
+
+// SpeedtestCommand returns a command of daze.Tester, which generates or discards n bytes.
+func SpeedtestCommand(cmd byte, n int) []byte {
+	buf := []byte{cmd, 0x2a, 0x00, 0x00}
+	binary.BigEndian.PutUint16(buf[2:], uint16(n))
+	return buf
+}
+
+// SpeedtestSync waits for a byte generated by the tester, so that all data sent before has been consumed.
+func SpeedtestSync(c io.ReadWriter) error {
+	_, err := c.Write(SpeedtestCommand(0x00, 1))
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(c, make([]byte, 1))
+	return err
+}
+
+// SpeedtestDial measures the minimum time of n dials.
+func SpeedtestDial(dialer daze.Dialer, dst string, n int) (time.Duration, error) {
+	r := time.Duration(0)
+	for range n {
+		now := time.Now()
+		c, err := dialer.Dial(&daze.Context{}, "tcp", dst)
+		if err != nil {
+			return 0, err
+		}
+		// Some protocols send the handshake along with the first data.
+		err = SpeedtestSync(c)
+		c.Close()
+		if err != nil {
+			return 0, err
+		}
+		if d := time.Since(now); r == 0 || d < r {
+			r = d
+		}
+	}
+	return r, nil
+}
+
+// SpeedtestRtt measures the minimum time of n round trips.
+func SpeedtestRtt(c io.ReadWriter, n int) (time.Duration, error) {
+	r := time.Duration(0)
+	for range n {
+		now := time.Now()
+		if err := SpeedtestSync(c); err != nil {
+			return 0, err
+		}
+		if d := time.Since(now); r == 0 || d < r {
+			r = d
+		}
+	}
+	return r, nil
+}
+
+// SpeedtestDown receives size bytes generated by the tester, and returns the throughput.
+func SpeedtestDown(c io.ReadWriter, size int) (float64, error) {
+	now := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		// Requests are pipelined, so the throughput is not bounded by the round trip time.
+		for n := size; n > 0; n -= 0xffff {
+			if _, err := c.Write(SpeedtestCommand(0x00, min(n, 0xffff))); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	_, err := io.CopyN(io.Discard, c, int64(size))
+	if err != nil {
+		return 0, err
+	}
+	if err := <-done; err != nil {
+		return 0, err
+	}
+	return float64(size) / time.Since(now).Seconds(), nil
+}
+
+// SpeedtestUp sends size bytes to be discarded by the tester, and returns the throughput.
+func SpeedtestUp(c io.ReadWriter, size int) (float64, error) {
+	buf := make([]byte, 4+0xffff)
+	for i := range buf {
+		buf[i] = 0x2a
+	}
+	now := time.Now()
+	for n := size; n > 0; n -= 0xffff {
+		m := min(n, 0xffff)
+		copy(buf, SpeedtestCommand(0x01, m))
+		if _, err := c.Write(buf[:4+m]); err != nil {
+			return 0, err
+		}
+	}
+	if err := SpeedtestSync(c); err != nil {
+		return 0, err
+	}
+	return float64(size) / time.Since(now).Seconds(), nil
+}
+
+// Speedtest measures the latency and throughput to the tester at dst through the dialer.
+func Speedtest(dialer daze.Dialer, dst string, size int, n int) (*SpeedtestResult, error) {
+	r := &SpeedtestResult{}
+	var err error
+	r.Dial, err = SpeedtestDial(dialer, dst, n)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialer.Dial(&daze.Context{}, "tcp", dst)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	r.Rtt, err = SpeedtestRtt(c, n)
+	if err != nil {
+		return nil, err
+	}
+	r.Down, err = SpeedtestDown(c, size)
+	if err != nil {
+		return nil, err
+	}
+	r.Up, err = SpeedtestUp(c, size)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SpeedtestRun runs Speedtest, which fails if it does not finish in the timeout.
+func SpeedtestRun(dialer daze.Dialer, dst string, size int, n int, timeout time.Duration) (*SpeedtestResult, error) {
+	type result struct {
+		r   *SpeedtestResult
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		r, err := Speedtest(dialer, dst, size, n)
+		done <- result{r, err}
+	}()
+	select {
+	case e := <-done:
+		return e.r, e.err
+	case <-time.After(timeout):
+		return nil, errors.New("daze: timeout")
+	}
+}
+
+// SpeedtestFormat formats a throughput in bytes per second as bits per second.
+func SpeedtestFormat(v float64) string {
+	return fmt.Sprintf("%.2f Mbit/s", v*8/1000/1000)
+}
+
+// SpeedtestProfile runs f while the cpu of the client is profiled, and of the server as well if server is the address
+// of its net/http/pprof, which is given by daze server -g. The server is profiled for the duration from the start of
+// f, since the endpoint takes a duration. Heap profiles are taken after f. Profiles are saved in dir, and the names of
+// the files are returned.
+func SpeedtestProfile(dir string, server string, duration time.Duration, f func() error) ([]string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	fetch := func(name string, url string) error {
+		ret, err := http.Get(url)
+		if err != nil {
+			return err
+		}
+		defer ret.Body.Close()
+		if ret.StatusCode != http.StatusOK {
+			return fmt.Errorf("daze: %s %s", url, ret.Status)
+		}
+		w, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		_, err = io.Copy(w, ret.Body)
+		return err
+	}
+	done := make(chan error, 1)
+	if server != "" {
+		go func() {
+			done <- fetch("server-cpu.pprof", fmt.Sprintf("http://%s/debug/pprof/profile?seconds=%d", server,
+				max(1, int(duration.Seconds()))))
+		}()
+	}
+	w, err := os.Create(filepath.Join(dir, "client-cpu.pprof"))
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	err = pprof.StartCPUProfile(w)
+	if err != nil {
+		return nil, err
+	}
+	err = f()
+	pprof.StopCPUProfile()
+	if err != nil {
+		return nil, err
+	}
+	names = append(names, "client-cpu.pprof")
+	h, err := os.Create(filepath.Join(dir, "client-heap.pprof"))
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+	runtime.GC()
+	err = pprof.WriteHeapProfile(h)
+	if err != nil {
+		return nil, err
+	}
+	names = append(names, "client-heap.pprof")
+	if server != "" {
+		if err := <-done; err != nil {
+			return nil, err
+		}
+		names = append(names, "server-cpu.pprof")
+		if err := fetch("server-heap.pprof", fmt.Sprintf("http://%s/debug/pprof/heap?gc=1", server)); err != nil {
+			return nil, err
+		}
+		names = append(names, "server-heap.pprof")
+	}
+	return names, nil
+}
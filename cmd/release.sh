@@ -3,13 +3,22 @@ set -ex
 rm -rf bin/release
 mkdir -p bin/release
 
+BUILD_COMMIT=$(git rev-parse --short HEAD)
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+
 make() {
     mkdir bin/release/daze_$1_$2
     cp README.md bin/release/daze_$1_$2/README.md
     cp res/rule.cidr bin/release/daze_$1_$2/rule.cidr
     cp res/rule.ls bin/release/daze_$1_$2/rule.ls
-    GOOS=$1 GOARCH=$2 go build -o bin/release/daze_$1_$2 github.com/mohanson/daze/cmd/daze
+    GOOS=$1 GOARCH=$2 go build -ldflags "-X main.PublicKey=$DAZE_PUBLIC_KEY -X main.BuildCommit=$BUILD_COMMIT -X main.BuildDate=$BUILD_DATE" -o bin/release/daze_$1_$2 github.com/mohanson/daze/cmd/daze
     python -m zipfile -c bin/release/daze_$1_$2.zip bin/release/daze_$1_$2
+    # The signature is the ed25519 signature of the sha256 hash of the zip file, encoded in hex.
+    if [ -n "$DAZE_SIGNING_KEY" ]; then
+        sha256sum bin/release/daze_$1_$2.zip | cut -d ' ' -f 1 | xxd -r -p > bin/release/daze_$1_$2.zip.sha256
+        openssl pkeyutl -sign -inkey "$DAZE_SIGNING_KEY" -rawin -in bin/release/daze_$1_$2.zip.sha256 | xxd -p -c 64 > bin/release/daze_$1_$2.zip.sig
+        rm bin/release/daze_$1_$2.zip.sha256
+    fi
 }
 
 # https://golang.org/doc/install/source#environment
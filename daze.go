@@ -3,32 +3,53 @@ package daze
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"compress/flate"
 	"context"
+	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
 	"crypto/rc4"
 	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"math/big"
 	"math/bits"
 	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mohanson/daze/lib/doa"
 	"github.com/mohanson/daze/lib/lru"
+	"github.com/mohanson/daze/lib/rate"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
 // ============================================================================
@@ -45,16 +66,63 @@ import (
 //              ~~            \/__/         \/__/         \/__/
 // ============================================================================
 
-// Conf is acting as package level configuration.
+// Conf is acting as package level configuration. They are the default values, instances can be tuned by their own
+// fields.
 var Conf = struct {
+	// BannerHost is the reserved host, dialed through a server, at which the server answers its build, see Banner.
+	BannerHost string
+	// BanTarpit is the max number of connections held by the tarpit of Ban at once, others are closed at once.
+	BanTarpit int
+	// BanTtl is how long a source is banned for by the brute-force detector of Ban.
+	BanTtl time.Duration
+	// BanWindow is the window in which failed handshakes of a source are counted by Ban.
+	BanWindow time.Duration
+	// BindTimeout is how long the socks5 BIND command waits for the peer to connect.
+	BindTimeout   time.Duration
 	DialerTimeout time.Duration
-	RouterLruSize int
+	LinkBufferMax int
+	LinkBufferMin int
+	// LinkIdle closes a link if neither side sends anything for the duration, it is disabled if zero.
+	LinkIdle time.Duration
+	// LinkSplice is the number of bytes copied by the kernel at a time between tcp connections, the bytes are counted
+	// into the usages of the connections after each copy.
+	LinkSplice int64
+	// NetemRto is the time a lost tcp segment is retransmitted after, see Netem.
+	NetemRto time.Duration
+	// PrefetchHosts is the max number of hosts prefetched for a response, see Prefetch.
+	PrefetchHosts int
+	// PrefetchSize is the number of bytes at the start of a html response which are scanned for hosts, see Prefetch.
+	PrefetchSize int
+	// RouterResolvedTtl is how long the ip resolved by the router is reused by hits of RouterCache.
+	RouterResolvedTtl time.Duration
+	RouterLruSize     int
+	// ResolverTimeout is the time limit of a DoH query, including the connection to the server if there is not an
+	// idle one.
+	ResolverTimeout time.Duration
+	// SealChunkSize is the maximum payload size of a chunk of Seal, which must fit in 16 bits.
+	SealChunkSize int
 }{
+	BannerHost:    "version.daze.invalid",
+	BanTarpit:     256,
+	BanTtl:        time.Hour,
+	BanWindow:     time.Minute * 10,
+	BindTimeout:   time.Minute * 2,
 	DialerTimeout: time.Second * 8,
+	// Link starts relaying with a buffer of LinkBufferMin bytes, and switches to a buffer of LinkBufferMax bytes once
+	// reads keep filling the buffer, which means that the stream is a bulk transfer rather than an interactive one.
+	LinkBufferMax: 64 * 1024,
+	LinkBufferMin: 4 * 1024,
+	LinkSplice:    1024 * 1024,
+	NetemRto:      time.Millisecond * 200,
+	PrefetchHosts: 8,
+	PrefetchSize:  64 * 1024,
 	// A single cache entry represents a single host or DNS name lookup. Make the cache as large as the maximum number
 	// of clients that access your web site concurrently. Note that setting the cache size too high is a waste of
 	// memory and degrades performance.
-	RouterLruSize: 64,
+	RouterLruSize:     64,
+	RouterResolvedTtl: time.Minute,
+	ResolverTimeout:   time.Second * 4,
+	SealChunkSize:     0x3fff,
 }
 
 // ResolverDns returns a DNS resolver.
@@ -92,102 +160,3170 @@ func ResolverDot(addr string) *net.Resolver {
 	}
 }
 
-// Cdoh structure can be used for DoH protocol processing.
+// Cdoh structure can be used for DoH protocol processing. A query is sent when it is written, and is aborted once
+// the deadline passes or the context of the lookup is canceled.
 type Cdoh struct {
 	Server string
 	Buffer *bytes.Buffer
+	// Client sends the queries, http.DefaultClient is used if it is nil.
+	Client *http.Client
+	// Context is the context of the lookup, context.Background is used if it is nil.
+	Context  context.Context
+	Deadline time.Time
+	// Method is either POST or GET, POST is used if it is empty. Queries sent by GET have a zero id, so that the
+	// responses can be cached by http caches.
+	Method string
 }
 
-func (c Cdoh) Read(b []byte) (n int, err error)   { return c.Buffer.Read(b) }
-func (c Cdoh) Close() error                       { return nil }
-func (c Cdoh) LocalAddr() net.Addr                { return nil }
-func (c Cdoh) RemoteAddr() net.Addr               { return nil }
-func (c Cdoh) SetDeadline(t time.Time) error      { return nil }
-func (c Cdoh) SetReadDeadline(t time.Time) error  { return nil }
-func (c Cdoh) SetWriteDeadline(t time.Time) error { return nil }
-func (c Cdoh) Write(b []byte) (n int, err error) {
+func (c *Cdoh) Close() error                       { return nil }
+func (c *Cdoh) LocalAddr() net.Addr                { return nil }
+func (c *Cdoh) RemoteAddr() net.Addr               { return nil }
+func (c *Cdoh) SetDeadline(t time.Time) error      { c.Deadline = t; return nil }
+func (c *Cdoh) SetReadDeadline(t time.Time) error  { c.Deadline = t; return nil }
+func (c *Cdoh) SetWriteDeadline(t time.Time) error { c.Deadline = t; return nil }
+func (c *Cdoh) Read(b []byte) (n int, err error) {
+	if c.Buffer.Len() == 0 && !c.Deadline.IsZero() && time.Now().After(c.Deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.Buffer.Read(b)
+}
+func (c *Cdoh) Write(b []byte) (n int, err error) {
 	size := int(binary.BigEndian.Uint16(b[:2]))
 	doa.Doa(size == len(b)-2)
-	resp, err := http.Post(c.Server, "application/dns-message", bytes.NewReader(b[2:]))
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ctx := c.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !c.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.Deadline)
+		defer cancel()
+	}
+	var req *http.Request
+	switch c.Method {
+	case http.MethodGet:
+		msg := append([]byte{}, b[2:]...)
+		msg[0] = 0x00
+		msg[1] = 0x00
+		sep := "?"
+		if strings.Contains(c.Server, "?") {
+			sep = "&"
+		}
+		u := c.Server + sep + "dns=" + base64.RawURLEncoding.EncodeToString(msg)
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	default:
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.Server, bytes.NewReader(b[2:]))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/dns-message")
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+	}
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(resp.Body)
+	}
+	// Tell the resolver that the query timed out or was canceled, so it gives up instead of waiting for a response.
+	if err != nil && ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, ctx.Err()
+	}
+	if err != nil {
+		log.Println("cdoh:", err)
+		return len(b), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Println("cdoh: unexpected status", resp.Status)
+		return len(b), nil
+	}
+	if len(body) < 2 {
+		log.Println("cdoh: response too short")
+		return len(b), nil
+	}
+	// Restore the id of the query.
+	copy(body[:2], b[2:4])
+	data := make([]byte, 2+len(body))
+	binary.BigEndian.PutUint16(data[:2], uint16(len(body)))
+	copy(data[2:], body)
+	c.Buffer.Write(data)
+	return len(b), nil
+}
+
+// CdohMethod returns the url and the method of a DoH server. The server is queried by GET if the address is a uri
+// template ending with {?dns}, for example, https://1.1.1.1/dns-query{?dns}, or by POST otherwise.
+func CdohMethod(addr string) (string, string) {
+	if strings.HasSuffix(addr, "{?dns}") {
+		return strings.TrimSuffix(addr, "{?dns}"), http.MethodGet
+	}
+	return addr, http.MethodPost
+}
+
+// ResolverDoh returns a DoH resolver. For further information, see https://datatracker.ietf.org/doc/html/rfc8484.
+// Queries share a client of their own, which keeps connections alive.
+func ResolverDoh(addr string) *net.Resolver {
+	addr, method := CdohMethod(addr)
+	urls := doa.Try(url.Parse(addr))
+	port := urls.Port()
+	urls.Host = doa.Try(net.LookupHost(urls.Hostname()))[0]
+	if port != "" {
+		urls.Host = net.JoinHostPort(urls.Host, port)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.DialContext = (&net.Dialer{Timeout: Conf.DialerTimeout}).DialContext
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   Conf.ResolverTimeout,
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := &Cdoh{
+				Server:  urls.String(),
+				Buffer:  bytes.NewBuffer([]byte{}),
+				Client:  client,
+				Context: ctx,
+				Method:  method,
+			}
+			return conn, nil
+		},
+	}
+}
+
+// ResolverDohDialer returns a DoH resolver which reaches the server through the dialer, for example, a daze client,
+// so that queries survive a poisoned network. The host name of the server is never resolved by the system resolver:
+// the connection goes to the bootstrap ip if it is not empty, or the dialer is left to resolve the host name.
+func ResolverDohDialer(addr string, bootstrap string, dialer Dialer) *net.Resolver {
+	addr, method := CdohMethod(addr)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				if bootstrap != "" {
+					_, port, _ := net.SplitHostPort(address)
+					address = net.JoinHostPort(bootstrap, port)
+				}
+				srv, err := dialer.Dial(&Context{}, network, address)
+				if err != nil {
+					return nil, err
+				}
+				return NewNetConn(srv), nil
+			},
+		},
+		Timeout: Conf.ResolverTimeout,
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := &Cdoh{
+				Server:  addr,
+				Buffer:  bytes.NewBuffer([]byte{}),
+				Client:  client,
+				Context: ctx,
+				Method:  method,
+			}
+			return conn, nil
+		},
+	}
+}
+
+// DnsQuestion returns the name and the type of the question of a DNS message, and the offset after the question. The
+// offset is zero if the message is malformed.
+func DnsQuestion(msg []byte) (string, uint16, int) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return "", 0, 0
+	}
+	end := 12
+	seps := []string{}
+	for {
+		if end >= len(msg) {
+			return "", 0, 0
+		}
+		l := int(msg[end])
+		if l == 0 {
+			end++
+			break
+		}
+		if l&0xc0 != 0 || end+1+l > len(msg) {
+			return "", 0, 0
+		}
+		seps = append(seps, string(msg[end+1:end+1+l]))
+		end += 1 + l
+	}
+	if end+4 > len(msg) {
+		return "", 0, 0
+	}
+	return strings.ToLower(strings.Join(seps, ".")), binary.BigEndian.Uint16(msg[end:]), end + 4
+}
+
+// ResolverMeter records the queries of a resolver: the number of queries, the answers by rcode, the queries left
+// without an answer, and the latency in a histogram. It is published by expvar, which can be viewed at /debug/vars.
+// Queries are logged if Log is set, and names in the log are cut to their last two labels if Redact is set.
+type ResolverMeter struct {
+	Latency *Histogram
+	Log     bool
+	M       *expvar.Map
+	Redact  bool
+}
+
+// Record records a query and its answer, the answer is nil if there is not one.
+func (m *ResolverMeter) Record(query []byte, answer []byte, d time.Duration) {
+	m.M.Add("query", 1)
+	rcode := "none"
+	if len(answer) < 4 {
+		m.M.Add("error", 1)
+	} else {
+		switch answer[3] & 0x0f {
+		case 0:
+			rcode = "noerror"
+		case 2:
+			rcode = "servfail"
+		case 3:
+			rcode = "nxdomain"
+		case 5:
+			rcode = "refused"
+		default:
+			rcode = strconv.Itoa(int(answer[3] & 0x0f))
+		}
+		m.M.Add("rcode."+rcode, 1)
+		m.Latency.Observe(d)
+	}
+	if !m.Log {
+		return
+	}
+	name, qtype, _ := DnsQuestion(query)
+	if seps := strings.Split(name, "."); m.Redact && len(seps) > 2 {
+		name = "*." + strings.Join(seps[len(seps)-2:], ".")
+	}
+	kind := strconv.Itoa(int(qtype))
+	switch qtype {
+	case 1:
+		kind = "A"
+	case 28:
+		kind = "AAAA"
+	}
+	log.Printf("dns: query name=%s type=%s rcode=%s time=%s", name, kind, rcode, d.Round(time.Millisecond))
+}
+
+// Wrap returns a copy of the resolver whose queries are recorded.
+func (m *ResolverMeter) Wrap(r *net.Resolver) *net.Resolver {
+	dial := r.Dial
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: Conf.DialerTimeout}).DialContext
+	}
+	return &net.Resolver{
+		PreferGo:     r.PreferGo,
+		StrictErrors: r.StrictErrors,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, err := dial(ctx, network, address)
+			if err != nil {
+				m.Record(nil, nil, 0)
+				return nil, err
+			}
+			// The resolver sends a query per connection. Queries on packet connections are not framed by length.
+			if p, ok := c.(net.PacketConn); ok {
+				return &ResolverMeterPacketConn{ResolverMeterConn: &ResolverMeterConn{Conn: c, Meter: m}, PacketConn: p}, nil
+			}
+			return &ResolverMeterConn{Conn: c, Meter: m, Stream: true}, nil
+		},
+	}
+}
+
+// NewResolverMeter returns a new ResolverMeter published with the given name. Note that names must be unique in a
+// process.
+func NewResolverMeter(name string) *ResolverMeter {
+	m := &ResolverMeter{
+		Latency: NewHistogram(),
+		M:       expvar.NewMap(name),
+	}
+	m.M.Set("latency", m.Latency)
+	return m
+}
+
+// ResolverMeterConn records the query written to the connection and the answer read from it when it is closed.
+type ResolverMeterConn struct {
+	net.Conn
+	Answer []byte
+	Meter  *ResolverMeter
+	Query  []byte
+	Start  time.Time
+	Stop   time.Time
+	Stream bool
+}
+
+// Read implements io.Reader.
+func (c *ResolverMeterConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n != 0 {
+		c.Answer = append(c.Answer, b[:n]...)
+		c.Stop = time.Now()
+	}
+	return n, err
+}
+
+// Write implements io.Writer.
+func (c *ResolverMeterConn) Write(b []byte) (int, error) {
+	if c.Query == nil {
+		c.Query = slices.Clone(b)
+		c.Start = time.Now()
+	}
+	return c.Conn.Write(b)
+}
+
+// Close implements io.Closer.
+func (c *ResolverMeterConn) Close() error {
+	if c.Query != nil {
+		query := c.Query
+		answer := c.Answer
+		if c.Stream {
+			query = query[min(len(query), 2):]
+			answer = answer[min(len(answer), 2):]
+		}
+		c.Meter.Record(query, answer, c.Stop.Sub(c.Start))
+		c.Query = nil
+	}
+	return c.Conn.Close()
+}
+
+// ResolverMeterPacketConn is a ResolverMeterConn over a packet connection, the resolver tells them apart by the
+// net.PacketConn interface.
+type ResolverMeterPacketConn struct {
+	*ResolverMeterConn
+	net.PacketConn
+}
+
+func (c *ResolverMeterPacketConn) Close() error        { return c.ResolverMeterConn.Close() }
+func (c *ResolverMeterPacketConn) LocalAddr() net.Addr { return c.ResolverMeterConn.LocalAddr() }
+func (c *ResolverMeterPacketConn) SetDeadline(t time.Time) error {
+	return c.ResolverMeterConn.SetDeadline(t)
+}
+func (c *ResolverMeterPacketConn) SetReadDeadline(t time.Time) error {
+	return c.ResolverMeterConn.SetReadDeadline(t)
+}
+func (c *ResolverMeterPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.ResolverMeterConn.SetWriteDeadline(t)
+}
+
+// Link copies from src to dst and dst to src until either EOF is reached.
+func Link(a, b io.ReadWriteCloser) {
+	(*Context)(nil).Link(a, b)
+}
+
+// LinkPool caches the relay buffers by their sizes.
+var LinkPool = sync.Map{}
+
+// LinkUnwrap returns the connection under the wrappers which implement Unwrap, and the usages of the QuotaConns
+// among them.
+func LinkUnwrap(conn any) (any, []*QuotaUsage) {
+	usages := []*QuotaUsage{}
+	for {
+		if c, ok := conn.(*QuotaConn); ok {
+			usages = append(usages, c.Usage)
+		}
+		c, ok := conn.(interface{ Unwrap() io.ReadWriteCloser })
+		if !ok {
+			return conn, usages
+		}
+		conn = c.Unwrap()
+	}
+}
+
+// LinkCopy copies from src to dst until either EOF is reached on src or an error occurs. The buffer grows from
+// Conf.LinkBufferMin to Conf.LinkBufferMax bytes if reads fill it up several times in a row.
+func LinkCopy(dst io.Writer, src io.Reader) (int64, error) {
+	// Leave tcp to tcp copies to the kernel, in pieces so that the wrappers still count the bytes.
+	dstConn, dstUsages := LinkUnwrap(dst)
+	srcConn, srcUsages := LinkUnwrap(src)
+	if d, ok := dstConn.(*net.TCPConn); ok {
+		if s, ok := srcConn.(*net.TCPConn); ok {
+			var n int64
+			for {
+				k, err := io.CopyN(d, s, Conf.LinkSplice)
+				n += k
+				for _, u := range dstUsages {
+					u.Up.Add(uint64(k))
+				}
+				for _, u := range srcUsages {
+					u.Down.Add(uint64(k))
+				}
+				if err == io.EOF {
+					return n, nil
+				}
+				if err != nil {
+					return n, err
+				}
+			}
+		}
+	}
+	var (
+		buf []byte
+		cnt = 0
+		err error
+		n   int64
+		r   int
+		w   int
+	)
+	get := func(size int) []byte {
+		pool, _ := LinkPool.LoadOrStore(size, &sync.Pool{New: func() any { return make([]byte, size) }})
+		return pool.(*sync.Pool).Get().([]byte)
+	}
+	put := func(b []byte) {
+		pool, _ := LinkPool.Load(len(b))
+		pool.(*sync.Pool).Put(b)
+	}
+	buf = get(Conf.LinkBufferMin)
+	defer func() { put(buf) }()
+	for {
+		r, err = src.Read(buf)
+		if r > 0 {
+			w, err = dst.Write(buf[:r])
+			n += int64(w)
+			if err == nil && w != r {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		if r == len(buf) {
+			cnt++
+		} else {
+			cnt = 0
+		}
+		if cnt >= 4 && len(buf) < Conf.LinkBufferMax {
+			put(buf)
+			buf = get(Conf.LinkBufferMax)
+		}
+	}
+}
+
+// Deadliner is implemented by connections which support deadlines, like net.Conn.
+type Deadliner interface {
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// ReadWriteCloser is the interface that groups the basic Read, Write and Close methods. Deadlines are passed to the
+// closer, which is the underlying connection of the reader and the writer, and os.ErrNoDeadline is returned if it does
+// not support deadlines.
+type ReadWriteCloser struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// SetDeadline implements daze.Deadliner.
+func (c ReadWriteCloser) SetDeadline(t time.Time) error {
+	if d, ok := c.Closer.(Deadliner); ok {
+		return d.SetDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// SetReadDeadline implements daze.Deadliner.
+func (c ReadWriteCloser) SetReadDeadline(t time.Time) error {
+	if d, ok := c.Closer.(Deadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// SetWriteDeadline implements daze.Deadliner.
+func (c ReadWriteCloser) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.Closer.(Deadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// NetConn adapts a io.ReadWriteCloser to a net.Conn. Addresses are not supported, deadlines are passed to the
+// connection if it supports them, and ignored otherwise.
+type NetConn struct {
+	io.ReadWriteCloser
+}
+
+func (c *NetConn) LocalAddr() net.Addr  { return nil }
+func (c *NetConn) RemoteAddr() net.Addr { return nil }
+func (c *NetConn) SetDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(Deadliner); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+func (c *NetConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(Deadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+func (c *NetConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(Deadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// NewNetConn returns the conn itself if it is already a net.Conn, otherwise a NetConn.
+func NewNetConn(conn io.ReadWriteCloser) net.Conn {
+	if c, ok := conn.(net.Conn); ok {
+		return c
+	}
+	return &NetConn{ReadWriteCloser: conn}
+}
+
+// ErrBlocked is returned when a destination is blocked by policy.
+var ErrBlocked = errors.New("blocked")
+
+// ErrLimited is returned when a connection exceeds a limit, for example, see HookLimit.
+var ErrLimited = errors.New("limited")
+
+// ErrUnreachable is returned when the server fails to connect to a destination.
+var ErrUnreachable = errors.New("unreachable")
+
+// Context carries infomations for a tcp connection.
+type Context struct {
+	Cid uint32
+	// Compress asks the remote dialer to compress the stream, it is set by rules with the compress option.
+	Compress bool
+	// Resolved records the ip addresses that hosts were resolved to by the router. The direct dialer connects to the
+	// ip instead of resolving the host again, so that the connection matches the routing decision.
+	Resolved map[string]net.IP
+	// Match records the rule which decided the road of the connection, for example, "rule R *.google.com". It
+	// answers why a host goes direct without bisecting the rule file.
+	Match string
+	// Tracer tracks goroutines of the connection if it is not nil, see Go.
+	Tracer *Tracer
+	// User is the name of the user authenticated by the server, it is empty if the server has a single credential.
+	User string
+}
+
+// Go runs f in a new goroutine, which is tracked by the tracer of the context if there is one.
+func (c *Context) Go(name string, f func()) {
+	if c == nil || c.Tracer == nil {
+		go f()
+		return
+	}
+	c.Tracer.Go(c, name, f)
+}
+
+// Link copies from src to dst and dst to src until either EOF is reached, the relays are run by Go. The link is closed
+// if neither side sends anything for Conf.LinkIdle, which requires at least one side to support deadlines.
+func (c *Context) Link(a, b io.ReadWriteCloser) {
+	var ra, rb io.Reader = a, b
+	if Conf.LinkIdle != 0 {
+		da := LinkDeadliner(a)
+		db := LinkDeadliner(b)
+		if da != nil || db != nil {
+			last := &atomic.Int64{}
+			last.Store(time.Now().UnixNano())
+			ra = &IdleReader{Deadliner: da, Idle: Conf.LinkIdle, Last: last, Reader: a}
+			rb = &IdleReader{Deadliner: db, Idle: Conf.LinkIdle, Last: last, Reader: b}
+		}
+	}
+	w := sync.WaitGroup{}
+	w.Add(2)
+	c.Go("link", func() {
+		LinkCopy(b, ra)
+		b.Close()
+		w.Done()
+	})
+	c.Go("link", func() {
+		LinkCopy(a, rb)
+		a.Close()
+		w.Done()
+	})
+	w.Wait()
+}
+
+// LinkDeadliner returns the connection as a deadliner if it supports read deadlines, or nil.
+func LinkDeadliner(conn io.ReadWriteCloser) Deadliner {
+	d, ok := conn.(Deadliner)
+	if !ok || d.SetReadDeadline(time.Time{}) != nil {
+		return nil
+	}
+	return d
+}
+
+// IdleReader fails reads once nothing has been read for the idle time by any reader sharing the same last time. It
+// only records the time of reads if the deadliner is nil, so a reader without deadlines keeps the others alive.
+type IdleReader struct {
+	Deadliner Deadliner
+	Idle      time.Duration
+	// Last is the unix nano time of the last read.
+	Last   *atomic.Int64
+	Reader io.Reader
+}
+
+// Read implements io.Reader.
+func (r *IdleReader) Read(p []byte) (int, error) {
+	for {
+		if r.Deadliner != nil {
+			r.Deadliner.SetReadDeadline(time.Unix(0, r.Last.Load()).Add(r.Idle))
+		}
+		n, err := r.Reader.Read(p)
+		if n > 0 {
+			r.Last.Store(time.Now().UnixNano())
+		}
+		// The other direction may have been busy meanwhile.
+		if n == 0 && errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, r.Last.Load())) < r.Idle {
+			continue
+		}
+		return n, err
+	}
+}
+
+// Resolve replaces the host of the address with the ip it was resolved to by the router, if any.
+func (c *Context) Resolve(address string) string {
+	if c == nil || c.Resolved == nil {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	ip, ok := c.Resolved[host]
+	if !ok {
+		return address
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+// Dialer abstracts the way to establish network connections.
+type Dialer interface {
+	Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error)
+}
+
+// Binder is implemented by dialers which can wait for a connection from the address, as asked by the socks5 BIND
+// command. Protocols such as active ftp use it to let the server connect back to the client.
+type Binder interface {
+	Bind(ctx *Context, address string) (Bound, error)
+}
+
+// Bound is a connection being waited for by a Binder.
+type Bound interface {
+	// Addr is the address the peer should connect to.
+	Addr() string
+	// Accept waits for the peer, returns the connection and the address of the peer. The bound is done after it, so
+	// there is no need to close it.
+	Accept() (io.ReadWriteCloser, string, error)
+	// Close stops a pending Accept.
+	Close() error
+}
+
+// ErrBindUnsupported is returned when the dialer of a destination can not wait for connections.
+var ErrBindUnsupported = errors.New("daze: bind is not supported")
+
+// Coner is implemented by dialers which can send datagrams of many destinations from one local socket, so that peers
+// the client never sent to can reply as well, which is known as full-cone nat. See Locale.FullCone.
+type Coner interface {
+	// Cone returns the address that datagrams to the address are sent to from the socket. It returns
+	// ErrConeUnsupported if the datagrams do not leave from the local machine, for example, they go through a server.
+	Cone(ctx *Context, address string) (net.Addr, error)
+	// ListenCone returns a socket shared by the destinations of an association.
+	ListenCone(ctx *Context) (net.PacketConn, error)
+}
+
+// ErrConeUnsupported is returned when the dialer of a destination can not send datagrams from a shared socket.
+var ErrConeUnsupported = errors.New("daze: full cone is not supported")
+
+// ConeConn sends datagrams to an address from the shared socket of a full-cone association. Datagrams of all peers are
+// read from the socket by the association, so it can not be read, and closing it leaves the socket open.
+type ConeConn struct {
+	Addr       net.Addr
+	PacketConn net.PacketConn
+}
+
+// Close implements io.Closer.
+func (c *ConeConn) Close() error {
+	return nil
+}
+
+// Read implements io.Reader.
+func (c *ConeConn) Read(p []byte) (int, error) {
+	return 0, errors.New("daze: cone conn can not be read")
+}
+
+// Write implements io.Writer.
+func (c *ConeConn) Write(p []byte) (int, error) {
+	return c.PacketConn.WriteTo(p, c.Addr)
+}
+
+// The DialerFunc type is an adapter to allow the use of ordinary functions as dialers, it is handy to stub networking
+// in tests.
+type DialerFunc func(ctx *Context, network string, address string) (io.ReadWriteCloser, error)
+
+// Dial implements daze.Dialer.
+func (f DialerFunc) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	return f(ctx, network, address)
+}
+
+// CheckAddr validates a destination address in the form of host:port, and returns it normalized: the host name is in
+// lower case, and the port has no leading zeros. Host names may only contain letters, digits, hyphens, underscores and
+// dots, so that garbage sent by a peer never reaches the resolver or the logs.
+func CheckAddr(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("daze: invalid destination address %q", address)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 || host == "" {
+		return "", fmt.Errorf("daze: invalid destination address %q", address)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return net.JoinHostPort(ip.String(), strconv.Itoa(int(p))), nil
+	}
+	for _, c := range []byte(host) {
+		switch {
+		case 'a' <= c && c <= 'z':
+		case 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return "", fmt.Errorf("daze: invalid destination address %q", address)
+		}
+	}
+	return net.JoinHostPort(strings.ToLower(host), strconv.Itoa(int(p))), nil
+}
+
+// SocksAddr encodes the address in the SOCKS5 format, which is the address type, the address and the port.
+func SocksAddr(address string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return nil, fmt.Errorf("daze: destination address too long %s", address)
+		}
+		buf = append([]byte{0x03, uint8(len(host))}, host...)
+	case ip.To4() != nil:
+		buf = append([]byte{0x01}, ip.To4()...)
+	default:
+		buf = append([]byte{0x04}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(p)), nil
+}
+
+// SocksReadAddr reads an address in the SOCKS5 format.
+func SocksReadAddr(r io.Reader) (string, error) {
+	var (
+		buf  = make([]byte, 256)
+		host string
+		err  error
+	)
+	_, err = io.ReadFull(r, buf[:1])
+	if err != nil {
+		return "", err
+	}
+	switch buf[0] {
+	case 0x01:
+		_, err = io.ReadFull(r, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 0x03:
+		_, err = io.ReadFull(r, buf[:1])
+		if err != nil {
+			return "", err
+		}
+		n := int(buf[0])
+		_, err = io.ReadFull(r, buf[:n])
+		host = string(buf[:n])
+	case 0x04:
+		_, err = io.ReadFull(r, buf[:16])
+		host = net.IP(buf[:16]).String()
+	default:
+		return "", fmt.Errorf("daze: unknown address type %d", buf[0])
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = io.ReadFull(r, buf[:2])
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2])))), nil
+}
+
+// SocksUDPConn is a udp association established through a SOCKS5 proxy. Each datagram is sent to a fixed destination.
+type SocksUDPConn struct {
+	// Ctl is the tcp connection which the udp association depends on.
+	Ctl io.Closer
+	Dst []byte
+	Udp net.Conn
+}
+
+// Close implements io.Closer.
+func (c *SocksUDPConn) Close() error {
+	c.Udp.Close()
+	return c.Ctl.Close()
+}
+
+// Read implements io.Reader.
+func (c *SocksUDPConn) Read(p []byte) (int, error) {
+	// The header is 262 bytes at most: 3 bytes of reserved fields and 259 bytes of the address.
+	buf := make([]byte, 262+len(p))
+	for {
+		n, err := c.Udp.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		r := bytes.NewReader(buf[3:n])
+		if doa.Err(SocksReadAddr(r)) != nil {
+			continue
+		}
+		return r.Read(p)
+	}
+}
+
+// Write implements io.Writer.
+func (c *SocksUDPConn) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, 3+len(c.Dst)+len(p))
+	buf = append(buf, 0x00, 0x00, 0x00)
+	buf = append(buf, c.Dst...)
+	buf = append(buf, p...)
+	_, err := c.Udp.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SocksDialer is a dialer which connects to the address through an upstream SOCKS5 proxy, such as "ssh -D". Username
+// and password authentication is used if the username is not empty.
+//
+// Introduction:
+// See https://tools.ietf.org/html/rfc1928
+// See https://tools.ietf.org/html/rfc1929
+type SocksDialer struct {
+	Password string
+	Server   string
+	Username string
+}
+
+// Hello connects to the proxy server and authenticates.
+func (s *SocksDialer) Hello() (net.Conn, error) {
+	srv, err := Dial("tcp", s.Server)
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		buf := make([]byte, 2)
+		if s.Username == "" {
+			_, err = srv.Write([]byte{0x05, 0x01, 0x00})
+		} else {
+			_, err = srv.Write([]byte{0x05, 0x02, 0x00, 0x02})
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(srv, buf)
+		if err != nil {
+			return err
+		}
+		switch buf[1] {
+		case 0x00:
+			return nil
+		case 0x02:
+			if len(s.Username) > 255 || len(s.Password) > 255 {
+				return errors.New("daze: username or password too long")
+			}
+			msg := []byte{0x01, uint8(len(s.Username))}
+			msg = append(msg, s.Username...)
+			msg = append(msg, uint8(len(s.Password)))
+			msg = append(msg, s.Password...)
+			_, err = srv.Write(msg)
+			if err != nil {
+				return err
+			}
+			_, err = io.ReadFull(srv, buf)
+			if err != nil {
+				return err
+			}
+			if buf[1] != 0x00 {
+				return errors.New("daze: socks5 authentication failed")
+			}
+			return nil
+		}
+		return errors.New("daze: no acceptable socks5 authentication methods")
+	}()
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+// Estab sends a request with the command and the address, returns the bound address replied by the proxy server.
+func (s *SocksDialer) Estab(srv io.ReadWriter, cmd uint8, address string) (string, error) {
+	dst, err := SocksAddr(address)
+	if err != nil {
+		return "", err
+	}
+	_, err = srv.Write(append([]byte{0x05, cmd, 0x00}, dst...))
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(srv, buf)
+	if err != nil {
+		return "", err
+	}
+	if buf[1] != 0x00 {
+		return "", fmt.Errorf("daze: socks5 request failed with reply %d", buf[1])
+	}
+	return SocksReadAddr(srv)
+}
+
+// Dial implements daze.Dialer.
+func (s *SocksDialer) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	var (
+		bnd string
+		dst []byte
+		err error
+		srv net.Conn
+		udp net.Conn
+	)
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("daze: network must be tcp or udp")
+	}
+	dst, err = SocksAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	srv, err = s.Hello()
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp":
+		_, err = s.Estab(srv, 0x01, address)
+		if err != nil {
+			srv.Close()
+			return nil, err
+		}
+		return srv, nil
+	case "udp":
+		bnd, err = s.Estab(srv, 0x03, "0.0.0.0:0")
+		if err != nil {
+			srv.Close()
+			return nil, err
+		}
+		// If the proxy server replies an unspecified address, the datagrams should be sent to the proxy server itself.
+		bndHost, bndPort, _ := net.SplitHostPort(bnd)
+		if net.ParseIP(bndHost).IsUnspecified() {
+			bndHost, _, _ = net.SplitHostPort(s.Server)
+		}
+		udp, err = Dial("udp", net.JoinHostPort(bndHost, bndPort))
+		if err != nil {
+			srv.Close()
+			return nil, err
+		}
+		return &SocksUDPConn{Ctl: srv, Dst: dst, Udp: udp}, nil
+	}
+	panic("unreachable")
+}
+
+// Bind implements daze.Binder. The proxy server waits for the connection, and it is relayed over the connection to the
+// proxy server.
+func (s *SocksDialer) Bind(ctx *Context, address string) (Bound, error) {
+	srv, err := s.Hello()
+	if err != nil {
+		return nil, err
+	}
+	bnd, err := s.Estab(srv, 0x02, address)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	// If the proxy server replies an unspecified address, the peer should connect to the proxy server itself.
+	bndHost, bndPort, _ := net.SplitHostPort(bnd)
+	if net.ParseIP(bndHost).IsUnspecified() {
+		bndHost, _, _ = net.SplitHostPort(s.Server)
+	}
+	return &SocksBound{Bnd: net.JoinHostPort(bndHost, bndPort), Srv: srv}, nil
+}
+
+// SocksBound is a connection being waited for by an upstream SOCKS5 proxy.
+type SocksBound struct {
+	Bnd string
+	Srv net.Conn
+}
+
+// Addr implements daze.Bound.
+func (b *SocksBound) Addr() string {
+	return b.Bnd
+}
+
+// Accept implements daze.Bound. The proxy server sends a second reply once the peer connects.
+func (b *SocksBound) Accept() (io.ReadWriteCloser, string, error) {
+	buf := make([]byte, 3)
+	_, err := io.ReadFull(b.Srv, buf)
+	if err != nil {
+		b.Srv.Close()
+		return nil, "", err
+	}
+	if buf[1] != 0x00 {
+		b.Srv.Close()
+		return nil, "", fmt.Errorf("daze: socks5 request failed with reply %d", buf[1])
+	}
+	adr, err := SocksReadAddr(b.Srv)
+	if err != nil {
+		b.Srv.Close()
+		return nil, "", err
+	}
+	return b.Srv, adr, nil
+}
+
+// Close implements daze.Bound.
+func (b *SocksBound) Close() error {
+	return b.Srv.Close()
+}
+
+// NewSocksDialer returns a new SocksDialer.
+func NewSocksDialer(server string, username string, password string) *SocksDialer {
+	return &SocksDialer{
+		Password: password,
+		Server:   server,
+		Username: username,
+	}
+}
+
+// TunnelDialer is a dialer which connects to the address through an upstream http proxy with the CONNECT method. Basic
+// authentication is used if the username is not empty.
+//
+// Introduction:
+// See https://en.wikipedia.org/wiki/HTTP_tunnel
+type TunnelDialer struct {
+	Password string
+	Server   string
+	Username string
+}
+
+// Dial implements daze.Dialer.
+func (t *TunnelDialer) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("daze: network must be tcp")
+	}
+	srv, err := Dial("tcp", t.Server)
+	if err != nil {
+		return nil, err
+	}
+	req := doa.Try(http.NewRequest("CONNECT", "http://"+address, http.NoBody))
+	req.Host = address
+	if t.Username != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(t.Username+":"+t.Password)))
+	}
+	srvReader := bufio.NewReader(srv)
+	err = func() error {
+		if err := req.Write(srv); err != nil {
+			return err
+		}
+		res, err := http.ReadResponse(srvReader, req)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("daze: http tunnel failed with status %s", res.Status)
+		}
+		return nil
+	}()
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return &ReadWriteCloser{
+		Reader: srvReader,
+		Writer: srv,
+		Closer: srv,
+	}, nil
+}
+
+// NewTunnelDialer returns a new TunnelDialer.
+func NewTunnelDialer(server string, username string, password string) *TunnelDialer {
+	return &TunnelDialer{
+		Password: password,
+		Server:   server,
+		Username: username,
+	}
+}
+
+// Blackhole is a connection that discards everything written to it and never returns any data. It is used to block a
+// destination silently.
+type Blackhole struct {
+	Done chan struct{}
+	Once sync.Once
+}
+
+// Close implements io.Closer.
+func (b *Blackhole) Close() error {
+	b.Once.Do(func() {
+		close(b.Done)
+	})
+	return nil
+}
+
+// Read implements io.Reader. It blocks until the connection is closed.
+func (b *Blackhole) Read(p []byte) (int, error) {
+	<-b.Done
+	return 0, io.EOF
+}
+
+// Write implements io.Writer.
+func (b *Blackhole) Write(p []byte) (int, error) {
+	select {
+	case <-b.Done:
+		return 0, io.ErrClosedPipe
+	default:
+		return len(p), nil
+	}
+}
+
+// NewBlackhole returns a new Blackhole.
+func NewBlackhole() *Blackhole {
+	return &Blackhole{
+		Done: make(chan struct{}),
+	}
+}
+
+// Notice is a connection that always responds with a fixed http page, whatever is written to it, by default a "blocked
+// by policy" page.
+type Notice struct {
+	io.Reader
+}
+
+// Close implements io.Closer.
+func (n *Notice) Close() error {
+	return nil
+}
+
+// Write implements io.Writer.
+func (n *Notice) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// NewNotice returns a new Notice for the blocked host.
+func NewNotice(host string) *Notice {
+	body := fmt.Sprintf("%s has been blocked by policy.\n", host)
+	page := fmt.Sprintf("HTTP/1.1 403 Forbidden\r\n"+
+		"Connection: close\r\n"+
+		"Content-Length: %d\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n%s", len(body), body)
+	return &Notice{
+		Reader: strings.NewReader(page),
+	}
+}
+
+// Hook is a set of callbacks invoked during the lifecycle of a connection. Hooks can be stacked on Locale and servers
+// to implement custom logging, auth, accounting or filtering.
+type Hook interface {
+	// OnAccept is called when a new connection is accepted. Return an error to reject the connection.
+	OnAccept(ctx *Context, addr net.Addr) error
+	// OnDial is called before connecting to the destination. Return an error to abort the dial.
+	OnDial(ctx *Context, network string, address string) error
+	// OnClose is called when the connection is closed, err is the reason it was closed and may be nil.
+	OnClose(ctx *Context, err error)
+}
+
+// HookChain concat multiple hooks in series.
+type HookChain struct {
+	L []Hook
+}
+
+// OnAccept implements daze.Hook.
+func (h *HookChain) OnAccept(ctx *Context, addr net.Addr) error {
+	for _, e := range h.L {
+		if err := e.OnAccept(ctx, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnDial implements daze.Hook.
+func (h *HookChain) OnDial(ctx *Context, network string, address string) error {
+	for _, e := range h.L {
+		if err := e.OnDial(ctx, network, address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnClose implements daze.Hook.
+func (h *HookChain) OnClose(ctx *Context, err error) {
+	for _, e := range h.L {
+		e.OnClose(ctx, err)
+	}
+}
+
+// NewHookChain returns a new HookChain.
+func NewHookChain(hook ...Hook) *HookChain {
+	return &HookChain{
+		L: hook,
+	}
+}
+
+// HookRate limits the rate of new connections. Connections exceeding the rate wait until tokens are available.
+type HookRate struct {
+	Limits *rate.Limits
+}
+
+// OnAccept implements daze.Hook.
+func (h *HookRate) OnAccept(ctx *Context, addr net.Addr) error {
+	h.Limits.Wait(1)
+	return nil
+}
+
+// OnDial implements daze.Hook.
+func (h *HookRate) OnDial(ctx *Context, network string, address string) error {
+	return nil
+}
+
+// OnClose implements daze.Hook.
+func (h *HookRate) OnClose(ctx *Context, err error) {}
+
+// NewHookRate returns a new HookRate. It allows n new connections per period.
+func NewHookRate(n uint64, period time.Duration) *HookRate {
+	return &HookRate{
+		Limits: rate.NewLimits(n, period),
+	}
+}
+
+// HookLimit caps the number of concurrent connections per client and per destination host, so that a client can not
+// use the server to hammer a single website, which puts the ip of the server at the risk of being banned. Zero means
+// no limit.
+type HookLimit struct {
+	Client int
+	// L records the client and the destination host of connections.
+	L    map[*Context][2]string
+	Host int
+	M    map[string]int
+	Mu   sync.Mutex
+}
+
+// OnAccept implements daze.Hook.
+func (h *HookLimit) OnAccept(ctx *Context, addr net.Addr) error {
+	client := addr.String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	if h.Client != 0 && h.M["client."+client] >= h.Client {
+		return fmt.Errorf("daze: client %s has been %w", client, ErrLimited)
+	}
+	h.M["client."+client]++
+	h.L[ctx] = [2]string{client, ""}
+	return nil
+}
+
+// OnDial implements daze.Hook.
+func (h *HookLimit) OnDial(ctx *Context, network string, address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	host = strings.ToLower(host)
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	e := h.L[ctx]
+	if e[1] != "" {
+		h.Release("host." + e[1])
+	}
+	if h.Host != 0 && h.M["host."+host] >= h.Host {
+		e[1] = ""
+		h.L[ctx] = e
+		return fmt.Errorf("daze: host %s has been %w", host, ErrLimited)
+	}
+	h.M["host."+host]++
+	e[1] = host
+	h.L[ctx] = e
+	return nil
+}
+
+// OnClose implements daze.Hook.
+func (h *HookLimit) OnClose(ctx *Context, err error) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+	e, ok := h.L[ctx]
+	if !ok {
+		return
+	}
+	delete(h.L, ctx)
+	h.Release("client." + e[0])
+	if e[1] != "" {
+		h.Release("host." + e[1])
+	}
+}
+
+// Release decreases the counter of the key. The caller must hold the lock.
+func (h *HookLimit) Release(key string) {
+	h.M[key]--
+	if h.M[key] <= 0 {
+		delete(h.M, key)
+	}
+}
+
+// NewHookLimit returns a new HookLimit.
+func NewHookLimit(client int, host int) *HookLimit {
+	return &HookLimit{
+		Client: client,
+		L:      map[*Context][2]string{},
+		Host:   host,
+		M:      map[string]int{},
+	}
+}
+
+// Histogram is a fixed bucket histogram of durations, it is published by expvar. Unlike an average, it makes tail
+// latencies visible. Bucket i counts observations not greater than Bounds[i], and the last bucket counts the rest.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []atomic.Uint64
+	Sum    atomic.Int64
+}
+
+// Observe records a duration.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i].Add(1)
+	h.Sum.Add(int64(d))
+}
+
+// Quantile returns the upper bound of the bucket where the q quantile falls in. The largest bound is returned for the
+// last bucket.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	total := uint64(0)
+	for i := range h.Counts {
+		total += h.Counts[i].Load()
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	acc := uint64(0)
+	for i := range h.Bounds {
+		acc += h.Counts[i].Load()
+		if acc >= rank {
+			return h.Bounds[i]
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// String implements expvar.Var. Durations are in milliseconds.
+func (h *Histogram) String() string {
+	b := &strings.Builder{}
+	total := uint64(0)
+	b.WriteString(`{"buckets": {`)
+	for i := range h.Counts {
+		n := h.Counts[i].Load()
+		total += n
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		if i < len(h.Bounds) {
+			fmt.Fprintf(b, `"%d": %d`, h.Bounds[i].Milliseconds(), n)
+		} else {
+			fmt.Fprintf(b, `"+Inf": %d`, n)
+		}
+	}
+	fmt.Fprintf(b, `}, "count": %d, "sum": %d`, total, time.Duration(h.Sum.Load()).Milliseconds())
+	fmt.Fprintf(b, `, "p50": %d, "p90": %d, "p99": %d}`, h.Quantile(0.5).Milliseconds(),
+		h.Quantile(0.9).Milliseconds(), h.Quantile(0.99).Milliseconds())
+	return b.String()
+}
+
+// NewHistogram returns a new Histogram. Buckets range from 1 millisecond to 10 seconds.
+func NewHistogram() *Histogram {
+	bounds := []time.Duration{}
+	for _, e := range []int{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000} {
+		bounds = append(bounds, time.Duration(e)*time.Millisecond)
+	}
+	return &Histogram{
+		Bounds: bounds,
+		Counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// Expv is a stats registry of connections. It is published by expvar, which can be viewed at /debug/vars. Besides
+// counters, it records the handshake duration, which is the time from accepting a connection to dialing the
+// destination, in a histogram per protocol.
+type Expv struct {
+	M *expvar.Map
+	// Mu guards creating histograms in M.
+	Mu *sync.Mutex
+	// Protocol names the handshake histogram, see Sub.
+	Protocol string
+	// T holds the accept time of connections.
+	T *sync.Map
+}
+
+// Histogram returns the histogram with the given name, it is created if not exists.
+func (e *Expv) Histogram(name string) *Histogram {
+	e.Mu.Lock()
+	defer e.Mu.Unlock()
+	if h, ok := e.M.Get(name).(*Histogram); ok {
+		return h
+	}
+	h := NewHistogram()
+	e.M.Set(name, h)
+	return h
+}
+
+// Sub returns a view of the registry for the protocol. Counters are shared, but handshake durations are recorded
+// separately.
+func (e *Expv) Sub(protocol string) *Expv {
+	return &Expv{
+		M:        e.M,
+		Mu:       e.Mu,
+		Protocol: protocol,
+		T:        e.T,
+	}
+}
+
+// OnAccept implements daze.Hook.
+func (e *Expv) OnAccept(ctx *Context, addr net.Addr) error {
+	e.M.Add("accept", 1)
+	e.T.Store(ctx, time.Now())
+	return nil
+}
+
+// OnDial implements daze.Hook.
+func (e *Expv) OnDial(ctx *Context, network string, address string) error {
+	e.M.Add("dial", 1)
+	if t, ok := e.T.LoadAndDelete(ctx); ok {
+		e.Histogram("handshake." + e.Protocol).Observe(time.Since(t.(time.Time)))
+	}
+	return nil
+}
+
+// OnClose implements daze.Hook.
+func (e *Expv) OnClose(ctx *Context, err error) {
+	e.M.Add("close", 1)
+	if err != nil {
+		e.M.Add("error", 1)
+	}
+	e.T.Delete(ctx)
+}
+
+// NewExpv returns a new Expv published with the given name. Note that names must be unique in a process.
+func NewExpv(name string) *Expv {
+	return &Expv{
+		M:        expvar.NewMap(name),
+		Mu:       &sync.Mutex{},
+		Protocol: "unknown",
+		T:        &sync.Map{},
+	}
+}
+
+// Tracer is a debug facility that tracks goroutines per connection, such as the readers, writers and relays of it.
+// Goroutines still running a while after the connection is closed are reported as leaks. It is a hook which attaches
+// itself to the context of accepted connections, and is published by expvar, which can be viewed at /debug/vars.
+type Tracer struct {
+	// Grace is the time allowed for goroutines to exit after the connection is closed.
+	Grace time.Duration
+	// L holds the number of running goroutines by name for each connection.
+	L  map[*Context]map[string]int
+	M  *expvar.Map
+	Mu *sync.Mutex
+}
+
+// Go runs f in a new goroutine and tracks it.
+func (t *Tracer) Go(ctx *Context, name string, f func()) {
+	t.Mu.Lock()
+	if t.L[ctx] == nil {
+		t.L[ctx] = map[string]int{}
+	}
+	t.L[ctx][name]++
+	t.Mu.Unlock()
+	t.M.Add("goroutine."+name, 1)
+	go func() {
+		defer func() {
+			t.Mu.Lock()
+			if l, ok := t.L[ctx]; ok {
+				l[name]--
+			}
+			t.Mu.Unlock()
+			t.M.Add("goroutine."+name, -1)
+		}()
+		f()
+	}()
+}
+
+// OnAccept implements daze.Hook.
+func (t *Tracer) OnAccept(ctx *Context, addr net.Addr) error {
+	ctx.Tracer = t
+	return nil
+}
+
+// OnDial implements daze.Hook.
+func (t *Tracer) OnDial(ctx *Context, network string, address string) error {
+	return nil
+}
+
+// OnClose implements daze.Hook.
+func (t *Tracer) OnClose(ctx *Context, err error) {
+	time.AfterFunc(t.Grace, func() {
+		t.Mu.Lock()
+		l := t.L[ctx]
+		delete(t.L, ctx)
+		t.Mu.Unlock()
+		for name, n := range l {
+			if n > 0 {
+				t.M.Add("leak."+name, int64(n))
+				log.Printf("conn: %08x   leak goroutine=%s count=%d", ctx.Cid, name, n)
+			}
+		}
+	})
+}
+
+// NewTracer returns a new Tracer published with the given name. Note that names must be unique in a process.
+func NewTracer(name string) *Tracer {
+	return &Tracer{
+		Grace: time.Second * 4,
+		L:     map[*Context]map[string]int{},
+		M:     expvar.NewMap(name),
+		Mu:    &sync.Mutex{},
+	}
+}
+
+// Telemetry aggregates anonymous usage statistics, it is strictly opt-in. Only counters are recorded: connections
+// and errors per protocol, dials per network and the version, never addresses or payloads. Statistics are written to
+// a local json file, and optionally posted to an endpoint run by the operator.
+type Telemetry struct {
+	Data map[string]uint64
+	M    *sync.Mutex
+	Name string
+	// Post is the url that statistics are posted to, nothing is sent if it is empty.
+	Post    string
+	Version string
+}
+
+// Add increases the counter by n.
+func (t *Telemetry) Add(key string, n uint64) {
+	t.M.Lock()
+	t.Data[key] += n
+	t.M.Unlock()
+}
+
+// Hook returns a hook that records statistics of the protocol.
+func (t *Telemetry) Hook(protocol string) Hook {
+	return &TelemetryHook{Protocol: protocol, Telemetry: t}
+}
+
+// Save writes statistics to the local file, and posts them if an endpoint is configured.
+func (t *Telemetry) Save() error {
+	t.M.Lock()
+	data, err := json.Marshal(map[string]any{
+		"data":    t.Data,
+		"version": t.Version,
+	})
+	t.M.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(t.Name, data, 0644)
+	if err != nil {
+		return err
+	}
+	if t.Post == "" {
+		return nil
+	}
+	resp, err := http.Post(t.Post, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("daze: telemetry post failed with status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sync saves statistics at regular intervals. Errors are logged.
+func (t *Telemetry) Sync(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := t.Save(); err != nil {
+				log.Println("daze:", err)
+			}
+		}
+	}()
+}
+
+// NewTelemetry returns a new Telemetry. Statistics are loaded from the local file if it exists, so that they are
+// aggregated across restarts.
+func NewTelemetry(name string, version string) *Telemetry {
+	t := &Telemetry{
+		Data:    map[string]uint64{},
+		M:       &sync.Mutex{},
+		Name:    name,
+		Version: version,
+	}
+	if data, err := os.ReadFile(name); err == nil {
+		var v struct {
+			Data map[string]uint64 `json:"data"`
+		}
+		if json.Unmarshal(data, &v) == nil && v.Data != nil {
+			t.Data = v.Data
+		}
+	}
+	return t
+}
+
+// TelemetryHook records statistics of a protocol into the telemetry.
+type TelemetryHook struct {
+	Protocol  string
+	Telemetry *Telemetry
+}
+
+// OnAccept implements daze.Hook.
+func (h *TelemetryHook) OnAccept(ctx *Context, addr net.Addr) error {
+	h.Telemetry.Add("accept."+h.Protocol, 1)
+	return nil
+}
+
+// OnDial implements daze.Hook.
+func (h *TelemetryHook) OnDial(ctx *Context, network string, address string) error {
+	h.Telemetry.Add("dial."+network, 1)
+	return nil
+}
+
+// OnClose implements daze.Hook.
+func (h *TelemetryHook) OnClose(ctx *Context, err error) {
+	if err != nil {
+		h.Telemetry.Add("error."+h.Protocol, 1)
+	}
+}
+
+// Build describes the build of daze, so that fleet tooling can inventory deployments.
+type Build struct {
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+	Go      string `json:"go"`
+	Version string `json:"version"`
+}
+
+// String returns the build in a line, for example, v1.21.2 (1a2b3c4 2026-10-16T00:00:00Z go1.23.0).
+func (b Build) String() string {
+	return fmt.Sprintf("%s (%s %s %s)", b.Version, cmp.Or(b.Commit, "unknown"), cmp.Or(b.Date, "unknown"), b.Go)
+}
+
+// Banner answers the build of the server to clients which dial Conf.BannerHost through it, and passes other dials to
+// Dialer. The build is served as a http response with a json body, whatever the client writes, so only clients which
+// passed the handshake of the protocol, and a plain http client behind them, can read it.
+type Banner struct {
+	Build  Build
+	Dialer Dialer
+}
+
+// Dial implements daze.Dialer.
+func (b *Banner) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host != Conf.BannerHost {
+		return b.Dialer.Dial(ctx, network, address)
+	}
+	body := doa.Try(json.Marshal(b.Build))
+	page := fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+		"Connection: close\r\n"+
+		"Content-Length: %d\r\n"+
+		"Content-Type: application/json\r\n"+
+		"\r\n%s", len(body), body)
+	return &Notice{Reader: strings.NewReader(page)}, nil
+}
+
+// NewBanner returns a new Banner.
+func NewBanner(build Build, dialer Dialer) *Banner {
+	return &Banner{
+		Build:  build,
+		Dialer: dialer,
+	}
+}
+
+// BannerQuery asks the server behind the dialer for its build, see Banner.
+func BannerQuery(dialer Dialer) (Build, error) {
+	b := Build{}
+	srv, err := dialer.Dial(&Context{}, "tcp", net.JoinHostPort(Conf.BannerHost, "80"))
+	if err != nil {
+		return b, err
+	}
+	defer srv.Close()
+	// The response is sent without waiting for a request, and the server may have closed its side before a request
+	// could be written, so nothing is written.
+	res, err := http.ReadResponse(bufio.NewReader(srv), nil)
+	if err != nil {
+		return b, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return b, fmt.Errorf("daze: server answered %s", res.Status)
+	}
+	err = json.NewDecoder(res.Body).Decode(&b)
+	return b, err
+}
+
+// Quota accounts the traffic of authenticated users, and refuses the connections of users who used up their monthly
+// quota. It is a dialer wrapping the egress of the server, so bytes are counted as they leave and enter the server.
+// Connections without a user are neither counted nor limited. Usage is kept in a local file across restarts, it is
+// published by expvar, and it is managed over http, see ServeHTTP.
+type Quota struct {
+	Dialer Dialer
+	// L is the usage of users in the month.
+	L map[string]*QuotaUsage
+	// Limit is the number of bytes, up and down, a user may transfer in a month. Zero means no limit.
+	Limit uint64
+	// Month is the month of the usage in the form of 2006-01, usage is reset when a new month begins.
+	Month string
+	Mu    *sync.Mutex
+	// Name is the local file of the usage, it is not saved if empty.
+	Name string
+}
+
+// QuotaUsage is the number of bytes transferred by a user.
+type QuotaUsage struct {
+	Down atomic.Uint64
+	Up   atomic.Uint64
+}
+
+// QuotaConn counts the bytes of a connection into the usage of its user.
+type QuotaConn struct {
+	io.ReadWriteCloser
+	Usage *QuotaUsage
+}
+
+// Read implements io.Reader.
+func (c *QuotaConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.Usage.Down.Add(uint64(n))
+	return n, err
+}
+
+// Write implements io.Writer.
+func (c *QuotaConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.Usage.Up.Add(uint64(n))
+	return n, err
+}
+
+// SetDeadline implements daze.Deadliner.
+func (c *QuotaConn) SetDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(Deadliner); ok {
+		return d.SetDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// SetReadDeadline implements daze.Deadliner.
+func (c *QuotaConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(Deadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// SetWriteDeadline implements daze.Deadliner.
+func (c *QuotaConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ReadWriteCloser.(Deadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// Unwrap returns the counted connection, LinkCopy counts the bytes it copies between tcp connections by itself.
+func (c *QuotaConn) Unwrap() io.ReadWriteCloser {
+	return c.ReadWriteCloser
+}
+
+// Roll resets the usage when a new month begins. The caller must hold the lock.
+func (q *Quota) Roll() {
+	if month := time.Now().UTC().Format("2006-01"); month != q.Month {
+		q.L = map[string]*QuotaUsage{}
+		q.Month = month
+	}
+}
+
+// Usage returns the usage of the user in the month, which is created if not exists. The caller must hold the lock.
+func (q *Quota) Usage(user string) *QuotaUsage {
+	q.Roll()
+	u, ok := q.L[user]
+	if !ok {
+		u = &QuotaUsage{}
+		q.L[user] = u
+	}
+	return u
+}
+
+// Dial implements daze.Dialer.
+func (q *Quota) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	if ctx.User == "" {
+		return q.Dialer.Dial(ctx, network, address)
+	}
+	q.Mu.Lock()
+	u := q.Usage(ctx.User)
+	q.Mu.Unlock()
+	if q.Limit != 0 && u.Down.Load()+u.Up.Load() >= q.Limit {
+		return nil, fmt.Errorf("daze: quota of %s has been %w", ctx.User, ErrLimited)
+	}
+	srv, err := q.Dialer.Dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &QuotaConn{ReadWriteCloser: srv, Usage: u}, nil
+}
+
+// Reset clears the usage of the user in the month.
+func (q *Quota) Reset(user string) {
+	q.Mu.Lock()
+	defer q.Mu.Unlock()
+	u := q.Usage(user)
+	u.Down.Store(0)
+	u.Up.Store(0)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (q *Quota) MarshalJSON() ([]byte, error) {
+	type usage struct {
+		Down uint64 `json:"down"`
+		Up   uint64 `json:"up"`
+	}
+	q.Mu.Lock()
+	defer q.Mu.Unlock()
+	q.Roll()
+	users := map[string]usage{}
+	for k, v := range q.L {
+		users[k] = usage{Down: v.Down.Load(), Up: v.Up.Load()}
+	}
+	return json.Marshal(map[string]any{
+		"limit": q.Limit,
+		"month": q.Month,
+		"users": users,
+	})
+}
+
+// String implements expvar.Var.
+func (q *Quota) String() string {
+	return string(doa.Try(json.Marshal(q)))
+}
+
+// Save writes the usage to the local file.
+func (q *Quota) Save() error {
+	if q.Name == "" {
+		return nil
+	}
+	return os.WriteFile(q.Name, []byte(q.String()), 0644)
+}
+
+// Sync saves the usage periodically.
+func (q *Quota) Sync(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := q.Save(); err != nil {
+				log.Println("daze:", err)
+			}
+		}
+	}()
+}
+
+// ServeHTTP manages the usage. GET lists the usage of users in json, and DELETE resets the usage of the user in the
+// form value user, which lets the user connect again before the month ends.
+func (q *Quota) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(q.String()))
+	case http.MethodDelete:
+		q.Reset(r.FormValue("user"))
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// NewQuota returns a new Quota. The usage of the month is loaded from the local file if it exists.
+func NewQuota(name string, dialer Dialer, limit uint64) *Quota {
+	q := &Quota{
+		Dialer: dialer,
+		L:      map[string]*QuotaUsage{},
+		Limit:  limit,
+		Month:  time.Now().UTC().Format("2006-01"),
+		Mu:     &sync.Mutex{},
+		Name:   name,
+	}
+	if name == "" {
+		return q
+	}
+	if data, err := os.ReadFile(name); err == nil {
+		var v struct {
+			Month string `json:"month"`
+			Users map[string]struct {
+				Down uint64 `json:"down"`
+				Up   uint64 `json:"up"`
+			} `json:"users"`
+		}
+		if json.Unmarshal(data, &v) == nil && v.Month == q.Month {
+			for k, e := range v.Users {
+				u := &QuotaUsage{}
+				u.Down.Store(e.Down)
+				u.Up.Store(e.Up)
+				q.L[k] = u
+			}
+		}
+	}
+	return q
+}
+
+// Traffic counts the bytes of all connections of a dialer into a usage, which may be shared by several traffics, for
+// example, to report the total traffic of a process when it exits. Unlike Quota, connections without a user are
+// counted as well.
+type Traffic struct {
+	Dialer Dialer
+	Usage  *QuotaUsage
+}
+
+// Dial implements daze.Dialer.
+func (t *Traffic) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	srv, err := t.Dialer.Dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &QuotaConn{ReadWriteCloser: srv, Usage: t.Usage}, nil
+}
+
+// Bind implements daze.Binder, it fails if the dialer is not a daze.Binder.
+func (t *Traffic) Bind(ctx *Context, address string) (Bound, error) {
+	b, ok := t.Dialer.(Binder)
+	if !ok {
+		return nil, ErrBindUnsupported
+	}
+	bnd, err := b.Bind(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return &TrafficBound{Bound: bnd, Usage: t.Usage}, nil
+}
+
+// Cone implements daze.Coner, it fails if the dialer is not a daze.Coner.
+func (t *Traffic) Cone(ctx *Context, address string) (net.Addr, error) {
+	c, ok := t.Dialer.(Coner)
+	if !ok {
+		return nil, ErrConeUnsupported
+	}
+	return c.Cone(ctx, address)
+}
+
+// ListenCone implements daze.Coner.
+func (t *Traffic) ListenCone(ctx *Context) (net.PacketConn, error) {
+	c, ok := t.Dialer.(Coner)
+	if !ok {
+		return nil, ErrConeUnsupported
+	}
+	pc, err := c.ListenCone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &TrafficPacketConn{PacketConn: pc, Usage: t.Usage}, nil
+}
+
+// TrafficPacketConn counts the bytes of a socket into the usage.
+type TrafficPacketConn struct {
+	net.PacketConn
+	Usage *QuotaUsage
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *TrafficPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	c.Usage.Down.Add(uint64(n))
+	return n, addr, err
+}
+
+// WriteTo implements net.PacketConn.
+func (c *TrafficPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.Usage.Up.Add(uint64(n))
+	return n, err
+}
+
+// TrafficBound counts the bytes of the accepted connection into the usage.
+type TrafficBound struct {
+	Bound
+	Usage *QuotaUsage
+}
+
+// Accept implements daze.Bound.
+func (b *TrafficBound) Accept() (io.ReadWriteCloser, string, error) {
+	c, peer, err := b.Bound.Accept()
+	if err != nil {
+		return nil, "", err
+	}
+	return &QuotaConn{ReadWriteCloser: c, Usage: b.Usage}, peer, nil
+}
+
+// NewTraffic returns a new Traffic.
+func NewTraffic(dialer Dialer, usage *QuotaUsage) *Traffic {
+	return &Traffic{
+		Dialer: dialer,
+		Usage:  usage,
+	}
+}
+
+// Audit records every handshake attempt with its outcome, source and failure reason as json lines, which can be fed
+// to fail2ban-style tools. The counters and the recent events are published by expvar, which can be viewed at
+// /debug/vars.
+type Audit struct {
+	// L is the ring of recent events.
+	L []AuditEvent
+	M *expvar.Map
+	// Mu guards L, T and W.
+	Mu *sync.Mutex
+	T  map[*Context]AuditEvent
+	W  io.Writer
+}
+
+// AuditEvent is a handshake attempt. The outcome is pass or fail.
+type AuditEvent struct {
+	Cid      uint32    `json:"cid"`
+	Outcome  string    `json:"outcome"`
+	Protocol string    `json:"protocol"`
+	Reason   string    `json:"reason,omitempty"`
+	Source   string    `json:"source"`
+	Time     time.Time `json:"time"`
+	// User is the authenticated user of a passed handshake, it is empty for protocols without users.
+	User string `json:"user,omitempty"`
+}
+
+// Hook returns a hook that audits handshakes of the protocol.
+func (a *Audit) Hook(protocol string) Hook {
+	return &AuditHook{Audit: a, Protocol: protocol}
+}
+
+// Record writes the event. The caller must hold the lock.
+func (a *Audit) Record(e AuditEvent) {
+	a.M.Add(e.Outcome, 1)
+	if len(a.L) == cap(a.L) {
+		copy(a.L, a.L[1:])
+		a.L = a.L[:len(a.L)-1]
+	}
+	a.L = append(a.L, e)
+	if a.W == nil {
+		return
+	}
+	data := doa.Try(json.Marshal(e))
+	if _, err := a.W.Write(append(data, '\n')); err != nil {
+		log.Println("daze:", err)
+	}
+}
+
+// NewAudit returns a new Audit, events are written to w if it is not nil. It keeps 64 recent events.
+func NewAudit(name string, w io.Writer) *Audit {
+	a := &Audit{
+		L:  make([]AuditEvent, 0, 64),
+		M:  expvar.NewMap(name),
+		Mu: &sync.Mutex{},
+		T:  map[*Context]AuditEvent{},
+		W:  w,
+	}
+	a.M.Set("recent", expvar.Func(func() any {
+		a.Mu.Lock()
+		defer a.Mu.Unlock()
+		return slices.Clone(a.L)
+	}))
+	return a
+}
+
+// AuditHook audits handshakes of a protocol. A handshake passes when the destination is dialed, and fails if the
+// connection is closed with an error before that.
+type AuditHook struct {
+	Audit    *Audit
+	Protocol string
+}
+
+// OnAccept implements daze.Hook.
+func (h *AuditHook) OnAccept(ctx *Context, addr net.Addr) error {
+	source := addr.String()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	h.Audit.Mu.Lock()
+	defer h.Audit.Mu.Unlock()
+	h.Audit.T[ctx] = AuditEvent{Cid: ctx.Cid, Protocol: h.Protocol, Source: source, Time: time.Now()}
+	return nil
+}
+
+// OnDial implements daze.Hook.
+func (h *AuditHook) OnDial(ctx *Context, network string, address string) error {
+	h.Audit.Mu.Lock()
+	defer h.Audit.Mu.Unlock()
+	e, ok := h.Audit.T[ctx]
+	if !ok {
+		return nil
+	}
+	delete(h.Audit.T, ctx)
+	e.Outcome = "pass"
+	e.User = ctx.User
+	h.Audit.Record(e)
+	return nil
+}
+
+// OnClose implements daze.Hook.
+func (h *AuditHook) OnClose(ctx *Context, err error) {
+	h.Audit.Mu.Lock()
+	defer h.Audit.Mu.Unlock()
+	e, ok := h.Audit.T[ctx]
+	if !ok {
+		return
+	}
+	delete(h.Audit.T, ctx)
+	if err == nil {
+		// Closed by the client before saying anything, for example, a port scan.
+		err = io.EOF
+	}
+	e.Outcome = "fail"
+	e.Reason = err.Error()
+	h.Audit.Record(e)
+}
+
+// Ban rejects connections from banned networks at accept time, entries expire after their ttl. It is also a
+// brute-force detector, which bans a source automatically after Fails failed handshakes within Window if Fails is not
+// zero. The ban list is managed over http, see ServeHTTP, and the counters are published by expvar, see String.
+type Ban struct {
+	// C counts failed handshakes per source.
+	C map[string]*BanCount
+	// Failed is the number of failed handshakes.
+	Failed uint64
+	Fails  int
+	// Held is the number of connections held by the tarpit at the moment.
+	Held int
+	L    map[string]*BanEntry
+	// Log emits a line for every failed handshake in a fixed format for fail2ban, the filter is:
+	// failregex = ban: handshake failed source=<HOST>
+	Log bool
+	Mu  *sync.Mutex
+	// Rejected is the number of connections rejected for banned sources.
+	Rejected uint64
+	T        map[*Context]string
+	// Tarpit holds connections from banned sources open for the duration before they are closed by a BanListener,
+	// which slows down the attacker. They are closed at once if it is zero.
+	Tarpit time.Duration
+	Ttl    time.Duration
+	Window time.Duration
+}
+
+// BanCount is the number of failed handshakes of a source since a time.
+type BanCount struct {
+	N     int
+	Since time.Time
+}
+
+// BanEntry is a banned network. It never expires if Until is zero.
+type BanEntry struct {
+	Cidr   *net.IPNet `json:"-"`
+	Name   string     `json:"cidr"`
+	Reason string     `json:"reason"`
+	Until  time.Time  `json:"until"`
+}
+
+// BanParse parses a network, a bare ip is a network of the ip only.
+func BanParse(cidr string) (*net.IPNet, error) {
+	if ip := net.ParseIP(cidr); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	return n, err
+}
+
+// Add bans the network for ttl, a bare ip bans the ip only. Zero ttl bans it forever.
+func (b *Ban) Add(cidr string, ttl time.Duration, reason string) error {
+	n, err := BanParse(cidr)
+	if err != nil {
+		return err
+	}
+	e := &BanEntry{Cidr: n, Name: n.String(), Reason: reason}
+	if ttl != 0 {
+		e.Until = time.Now().Add(ttl)
+	}
+	b.Mu.Lock()
+	defer b.Mu.Unlock()
+	b.L[e.Name] = e
+	log.Println("daze: ban", e.Name, "reason", reason)
+	return nil
+}
+
+// Del unbans the network.
+func (b *Ban) Del(cidr string) {
+	n, err := BanParse(cidr)
+	if err != nil {
+		return
+	}
+	b.Mu.Lock()
+	defer b.Mu.Unlock()
+	delete(b.L, n.String())
+}
+
+// List returns the entries which are not expired.
+func (b *Ban) List() []*BanEntry {
+	b.Mu.Lock()
+	defer b.Mu.Unlock()
+	b.Expire()
+	l := []*BanEntry{}
+	for _, e := range b.L {
+		l = append(l, e)
+	}
+	slices.SortFunc(l, func(x, y *BanEntry) int { return cmp.Compare(x.Name, y.Name) })
+	return l
+}
+
+// Expire removes expired entries. The caller must hold the lock.
+func (b *Ban) Expire() {
+	now := time.Now()
+	for k, e := range b.L {
+		if !e.Until.IsZero() && now.After(e.Until) {
+			delete(b.L, k)
+		}
+	}
+	for k, e := range b.C {
+		if now.Sub(e.Since) > b.Window {
+			delete(b.C, k)
+		}
+	}
+}
+
+// Banned reports whether the ip is banned.
+func (b *Ban) Banned(ip net.IP) bool {
+	b.Mu.Lock()
+	defer b.Mu.Unlock()
+	return b.banned(ip)
+}
+
+// banned reports whether the ip is banned. The caller must hold the lock.
+func (b *Ban) banned(ip net.IP) bool {
+	now := time.Now()
+	for _, e := range b.L {
+		if e.Cidr.Contains(ip) && (e.Until.IsZero() || now.Before(e.Until)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP manages the ban list. GET lists the entries in json, POST bans the network in the form value cidr for the
+// optional form value ttl, for example, 1h, and DELETE unbans the network in the form value cidr.
+func (b *Ban) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.List())
+	case http.MethodPost:
+		ttl := time.Duration(0)
+		if v := r.FormValue("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		if err := b.Add(r.FormValue("cidr"), ttl, "api"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	case http.MethodDelete:
+		b.Del(r.FormValue("cidr"))
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// OnAccept implements daze.Hook.
+func (b *Ban) OnAccept(ctx *Context, addr net.Addr) error {
+	source := addr.String()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	ip := net.ParseIP(source)
+	b.Mu.Lock()
+	defer b.Mu.Unlock()
+	if ip != nil && b.banned(ip) {
+		b.Rejected++
+		return fmt.Errorf("daze: %s has been %w", source, ErrBlocked)
+	}
+	b.T[ctx] = source
+	return nil
+}
+
+// Drop closes the connection of a banned source. It is held by the tarpit first if Tarpit is not zero and the tarpit
+// is not full.
+func (b *Ban) Drop(cli net.Conn) {
+	if c, ok := cli.(*net.TCPConn); ok {
+		c.SetLinger(0)
+	}
+	b.Mu.Lock()
+	b.Rejected++
+	hold := b.Tarpit != 0 && b.Held < Conf.BanTarpit
+	if hold {
+		b.Held++
+	}
+	b.Mu.Unlock()
+	if !hold {
+		cli.Close()
+		return
+	}
+	time.AfterFunc(b.Tarpit, func() {
+		b.Mu.Lock()
+		b.Held--
+		b.Mu.Unlock()
+		cli.Close()
+	})
+}
+
+// String implements expvar.Var.
+func (b *Ban) String() string {
+	b.Mu.Lock()
+	defer b.Mu.Unlock()
+	b.Expire()
+	return string(doa.Try(json.Marshal(map[string]any{
+		"banned":   len(b.L),
+		"failed":   b.Failed,
+		"held":     b.Held,
+		"rejected": b.Rejected,
+		"watched":  len(b.C),
+	})))
+}
+
+// OnDial implements daze.Hook.
+func (b *Ban) OnDial(ctx *Context, network string, address string) error {
+	b.Mu.Lock()
+	defer b.Mu.Unlock()
+	delete(b.T, ctx)
+	return nil
+}
+
+// OnClose implements daze.Hook. A connection closed before dialing is a failed handshake.
+func (b *Ban) OnClose(ctx *Context, err error) {
+	b.Mu.Lock()
+	source, ok := b.T[ctx]
+	delete(b.T, ctx)
+	if !ok {
+		b.Mu.Unlock()
+		return
+	}
+	b.Failed++
+	if b.Log {
+		log.Printf("ban: handshake failed source=%s", source)
+	}
+	if b.Fails == 0 {
+		b.Mu.Unlock()
+		return
+	}
+	b.Expire()
+	c, ok := b.C[source]
+	if !ok {
+		c = &BanCount{Since: time.Now()}
+		b.C[source] = c
+	}
+	c.N++
+	if c.N < b.Fails {
+		b.Mu.Unlock()
+		return
+	}
+	delete(b.C, source)
+	b.Mu.Unlock()
+	b.Add(source, b.Ttl, "brute force")
+}
+
+// NewBan returns a new Ban.
+func NewBan() *Ban {
+	return &Ban{
+		C:      map[string]*BanCount{},
+		L:      map[string]*BanEntry{},
+		Mu:     &sync.Mutex{},
+		T:      map[*Context]string{},
+		Ttl:    Conf.BanTtl,
+		Window: Conf.BanWindow,
+	}
+}
+
+// BanListener drops connections from banned sources at accept time, before any protocol reads from them. So banned
+// sources can not even try a handshake, which some protocols run before their hooks.
+type BanListener struct {
+	net.Listener
+	Ban *Ban
+}
+
+// Accept implements net.Listener.
+func (l *BanListener) Accept() (net.Conn, error) {
+	for {
+		cli, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		source := cli.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(source); err == nil {
+			source = host
+		}
+		ip := net.ParseIP(source)
+		if ip == nil || !l.Ban.Banned(ip) {
+			return cli, nil
+		}
+		log.Println("daze: reject", cli.RemoteAddr(), "banned")
+		l.Ban.Drop(cli)
+	}
+}
+
+// NewBanListener returns a new BanListener.
+func NewBanListener(l net.Listener, ban *Ban) *BanListener {
+	return &BanListener{Listener: l, Ban: ban}
+}
+
+// Health serves liveness and readiness probes over http, for example, for docker or kubernetes. Path /healthz runs
+// the live checks, and path /readyz runs both the live checks and the ready checks. The status code is 200 if all
+// checks pass, otherwise 503.
+type Health struct {
+	Closer io.Closer
+	Listen string
+	Live   []func() error
+	Ready  []func() error
+}
+
+// Check runs checks one by one, stops at the first error.
+func (h *Health) Check(w http.ResponseWriter, checks ...[]func() error) {
+	for _, l := range checks {
+		for _, e := range l {
+			if err := e(); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(w, err)
+				return
+			}
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		h.Check(w, h.Live)
+	case "/readyz":
+		h.Check(w, h.Live, h.Ready)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Close listener.
+func (h *Health) Close() error {
+	if h.Closer != nil {
+		return h.Closer.Close()
+	}
+	return nil
+}
+
+// Run it.
+func (h *Health) Run() error {
+	l, err := net.Listen("tcp", h.Listen)
+	if err != nil {
+		return err
+	}
+	log.Println("daze: listen and serve health on", h.Listen)
+	srv := &http.Server{Handler: h}
+	h.Closer = srv
+	go srv.Serve(l)
+	return nil
+}
+
+// NewHealth returns a new Health.
+func NewHealth(listen string) *Health {
+	return &Health{
+		Listen: listen,
+		Live:   []func() error{},
+		Ready:  []func() error{},
+	}
+}
+
+// HealthListen returns a check which passes if the tcp listener on the address is accepting connections.
+func HealthListen(address string) func() error {
+	return func() error {
+		// A listener on the unspecified address is reachable from the loopback address.
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if host == "" || net.ParseIP(host).IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		c, err := Dial("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+}
+
+// HealthDial returns a check which passes if the dialer connects to the address, for a daze client, it means the
+// handshake with the server works.
+func HealthDial(dialer Dialer, address string) func() error {
+	return func() error {
+		c, err := dialer.Dial(&Context{}, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+}
+
+// Direct is the default dialer for connecting to an address. If the host has been resolved by the router, the
+// resolved ip is used.
+type Direct struct {
+	// Resolver resolves host names, net.DefaultResolver is used if it is nil.
+	Resolver *net.Resolver
+	// Timeout is the dial timeout, Conf.DialerTimeout is used if it is zero.
+	Timeout time.Duration
+}
+
+// Dial implements daze.Dialer.
+func (d *Direct) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	n := net.Dialer{
+		Resolver: d.Resolver,
+		Timeout:  d.Timeout,
+	}
+	if n.Timeout == 0 {
+		n.Timeout = Conf.DialerTimeout
+	}
+	return n.Dial(network, ctx.Resolve(address))
+}
+
+// Bind implements daze.Binder. It listens on the local ip which routes to the address, and only accepts the peer at
+// the ip of the address. Any peer is accepted if the host of the address is unspecified.
+func (d *Direct) Bind(ctx *Context, address string) (Bound, error) {
+	host, _, err := net.SplitHostPort(ctx.Resolve(address))
 	if err != nil {
-		log.Println("cdoh:", err)
-		return len(b), nil
+		return nil, err
+	}
+	var (
+		bnd  = "0.0.0.0"
+		peer net.IP
+	)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+		n := net.Dialer{
+			Resolver: d.Resolver,
+			Timeout:  d.Timeout,
+		}
+		if n.Timeout == 0 {
+			n.Timeout = Conf.DialerTimeout
+		}
+		// Connecting a udp socket sends nothing, it only picks the route, so the port does not matter.
+		c, err := n.Dial("udp", net.JoinHostPort(host, "9"))
+		if err != nil {
+			return nil, err
+		}
+		bnd = c.LocalAddr().(*net.UDPAddr).IP.String()
+		peer = c.RemoteAddr().(*net.UDPAddr).IP
+		c.Close()
 	}
-	body, err := io.ReadAll(resp.Body)
+	l, err := net.Listen("tcp", net.JoinHostPort(bnd, "0"))
 	if err != nil {
-		log.Println("cdoh:", err)
-		return len(b), nil
+		return nil, err
 	}
-	data := make([]byte, 2+len(body))
-	binary.BigEndian.PutUint16(data[:2], uint16(len(body)))
-	copy(data[2:], body)
-	c.Buffer.Write(data)
-	return len(b), nil
+	return &DirectBound{Listener: l, Peer: peer}, nil
 }
 
-// ResolverDoh returns a DoH resolver. For further information, see https://datatracker.ietf.org/doc/html/rfc8484.
-func ResolverDoh(addr string) *net.Resolver {
-	urls := doa.Try(url.Parse(addr))
-	urls.Host = doa.Try(net.LookupHost(urls.Hostname()))[0]
-	return &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			conn := &Cdoh{
-				Server: urls.String(),
-				Buffer: bytes.NewBuffer([]byte{}),
-			}
-			return conn, nil
-		},
+// DirectBound is a connection being waited for by a local listener.
+type DirectBound struct {
+	Listener net.Listener
+	// Peer is the only ip accepted, all are accepted if it is nil.
+	Peer net.IP
+}
+
+// Addr implements daze.Bound.
+func (b *DirectBound) Addr() string {
+	return b.Listener.Addr().String()
+}
+
+// Accept implements daze.Bound. Connections from other ips are closed, and the one from the peer is waited for.
+func (b *DirectBound) Accept() (io.ReadWriteCloser, string, error) {
+	defer b.Listener.Close()
+	for {
+		c, err := b.Listener.Accept()
+		if err != nil {
+			return nil, "", err
+		}
+		ip := c.RemoteAddr().(*net.TCPAddr).IP
+		if b.Peer == nil || b.Peer.Equal(ip) {
+			return c, c.RemoteAddr().String(), nil
+		}
+		c.Close()
 	}
 }
 
-// Link copies from src to dst and dst to src until either EOF is reached.
-func Link(a, b io.ReadWriteCloser) {
-	w := sync.WaitGroup{}
-	w.Add(2)
+// Close implements daze.Bound.
+func (b *DirectBound) Close() error {
+	return b.Listener.Close()
+}
+
+// Cone implements daze.Coner.
+func (d *Direct) Cone(ctx *Context, address string) (net.Addr, error) {
+	host, port, err := net.SplitHostPort(ctx.Resolve(address))
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		r := cmp.Or(d.Resolver, net.DefaultResolver)
+		t, cancel := context.WithTimeout(context.Background(), cmp.Or(d.Timeout, Conf.DialerTimeout))
+		defer cancel()
+		l, err := r.LookupNetIP(t, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = l[0]
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(p))), nil
+}
+
+// ListenCone implements daze.Coner.
+func (d *Direct) ListenCone(ctx *Context) (net.PacketConn, error) {
+	return net.ListenPacket("udp", ":0")
+}
+
+// Netem wraps dialed connections with artificial latency, jitter and loss, so that issues which only appear on slow
+// links can be reproduced on a fast network. Both directions are delayed, so the round trip time grows by twice Delay.
+// A lost tcp segment is retransmitted after Conf.NetemRto, and a lost udp datagram is dropped.
+type Netem struct {
+	Delay  time.Duration
+	Dialer Dialer
+	Jitter time.Duration
+	// Loss is the probability of a write or a read being lost.
+	Loss float64
+}
+
+// Dial implements daze.Dialer.
+func (n *Netem) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	c, err := n.Dialer.Dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewNetemConn(c, n, network == "udp"), nil
+}
+
+// NetemPacket is a chunk of data in flight.
+type NetemPacket struct {
+	Data []byte
+	Err  error
+	Time time.Time
+}
+
+// NetemConn delays the reads and writes of a connection. Writes return at once, the data is written to the connection
+// when it is due.
+type NetemConn struct {
+	Conn     io.ReadWriteCloser
+	Datagram bool
+	Done     chan struct{}
+	Err      atomic.Pointer[error]
+	Netem    *Netem
+	Once     sync.Once
+	R        chan NetemPacket
+	Rbuf     []byte
+	Rlast    time.Time
+	W        chan NetemPacket
+	Wlast    time.Time
+}
+
+// Due returns the time a packet sent now arrives, it is not earlier than the last packet since tcp keeps the order. It
+// reports false if the packet is lost.
+func (c *NetemConn) Due(last *time.Time) (time.Time, bool) {
+	t := time.Now().Add(c.Netem.Delay)
+	if c.Netem.Jitter > 0 {
+		t = t.Add(rand.N(c.Netem.Jitter))
+	}
+	if rand.Float64() < c.Netem.Loss {
+		if c.Datagram {
+			return t, false
+		}
+		t = t.Add(Conf.NetemRto)
+	}
+	if t.Before(*last) {
+		t = *last
+	}
+	*last = t
+	return t, true
+}
+
+// Read implements io.Reader.
+func (c *NetemConn) Read(p []byte) (int, error) {
+	for len(c.Rbuf) == 0 {
+		e, ok := <-c.R
+		if !ok {
+			return 0, io.EOF
+		}
+		time.Sleep(time.Until(e.Time))
+		c.Rbuf = e.Data
+		if len(c.Rbuf) == 0 {
+			return 0, e.Err
+		}
+		if c.Datagram {
+			n := copy(p, c.Rbuf)
+			c.Rbuf = nil
+			return n, nil
+		}
+	}
+	n := copy(p, c.Rbuf)
+	c.Rbuf = c.Rbuf[n:]
+	return n, nil
+}
+
+// Write implements io.Writer.
+func (c *NetemConn) Write(p []byte) (int, error) {
+	if err := c.Err.Load(); err != nil {
+		return 0, *err
+	}
+	t, ok := c.Due(&c.Wlast)
+	if !ok {
+		return len(p), nil
+	}
+	select {
+	case c.W <- NetemPacket{Data: slices.Clone(p), Time: t}:
+		return len(p), nil
+	case <-c.Done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// Close implements io.Closer. Data in flight is still written before the connection is closed.
+func (c *NetemConn) Close() error {
+	c.Once.Do(func() {
+		close(c.Done)
+	})
+	return nil
+}
+
+// NewNetemConn returns a new NetemConn.
+func NewNetemConn(conn io.ReadWriteCloser, netem *Netem, datagram bool) *NetemConn {
+	c := &NetemConn{
+		Conn:     conn,
+		Datagram: datagram,
+		Done:     make(chan struct{}),
+		Netem:    netem,
+		R:        make(chan NetemPacket, 64),
+		W:        make(chan NetemPacket, 64),
+	}
 	go func() {
-		io.Copy(b, a)
-		b.Close()
-		w.Done()
+		defer close(c.R)
+		push := func(e NetemPacket) bool {
+			select {
+			case c.R <- e:
+				return true
+			case <-c.Done:
+				return false
+			}
+		}
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := c.Conn.Read(buf)
+			if n != 0 {
+				t, ok := c.Due(&c.Rlast)
+				if ok && !push(NetemPacket{Data: buf[:n], Time: t}) {
+					return
+				}
+			}
+			if err != nil {
+				// The error is never lost, and arrives after the data.
+				t := time.Now().Add(c.Netem.Delay)
+				if t.Before(c.Rlast) {
+					t = c.Rlast
+				}
+				push(NetemPacket{Err: err, Time: t})
+				return
+			}
+		}
 	}()
 	go func() {
-		io.Copy(a, b)
-		a.Close()
-		w.Done()
+		defer c.Conn.Close()
+		send := func(e NetemPacket) {
+			time.Sleep(time.Until(e.Time))
+			if _, err := c.Conn.Write(e.Data); err != nil {
+				c.Err.Store(&err)
+				c.Close()
+			}
+		}
+		for {
+			select {
+			case e := <-c.W:
+				send(e)
+			case <-c.Done:
+				for {
+					select {
+					case e := <-c.W:
+						send(e)
+					default:
+						return
+					}
+				}
+			}
+		}
 	}()
-	w.Wait()
+	return c
 }
 
-// ReadWriteCloser is the interface that groups the basic Read, Write and Close methods.
-type ReadWriteCloser struct {
-	io.Reader
-	io.Writer
-	io.Closer
+// Engine is the shared egress of daze servers. All server side protocols reach the destination through it, so features
+// like egress access control only need to be implemented once.
+type Engine struct {
+	Dialer Dialer
+	Router Router
 }
 
-// Context carries infomations for a tcp connection.
-type Context struct {
-	Cid uint32
+// Dial implements daze.Dialer.
+func (e *Engine) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	dst, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	road := e.Router.Road(ctx, dst)
+	if road != RoadLocale {
+		log.Printf("conn: %08x  route road=%s match=%s", ctx.Cid, road, ctx.Match)
+	}
+	switch road {
+	case RoadFucked:
+		return nil, fmt.Errorf("daze: %s has been %w", dst, ErrBlocked)
+	case RoadSilent:
+		return NewBlackhole(), nil
+	case RoadNotice:
+		return NewNotice(dst), nil
+	}
+	return e.Dialer.Dial(ctx, network, address)
 }
 
-// Dialer abstracts the way to establish network connections.
-type Dialer interface {
-	Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error)
+// NewEngine returns a new Engine. By default, it connects to the destination directly and blocks nothing.
+func NewEngine() *Engine {
+	return &Engine{
+		Dialer: &Direct{},
+		Router: NewRouterRight(RoadLocale),
+	}
+}
+
+// A Verdict is the decision made by a classifier for a proxied stream.
+type Verdict uint32
+
+const (
+	// VerdictPass means the stream is allowed
+	VerdictPass Verdict = iota
+	// VerdictBlock means the stream should be closed
+	VerdictBlock
+	// VerdictThrottle means the stream should be rate limited
+	VerdictThrottle
+)
+
+// Classifier recognizes a proxied stream by the first bytes the client sends, and decides what to do with it.
+type Classifier interface {
+	Classify(ctx *Context, head []byte) Verdict
+}
+
+// Sniff guesses the application protocol by the first bytes of a stream. It returns "unknown" if the protocol is not
+// recognized.
+func Sniff(head []byte) string {
+	switch {
+	case len(head) >= 20 && head[0] == 19 && string(head[1:20]) == "BitTorrent protocol":
+		return "bittorrent"
+	case len(head) >= 3 && head[0] == 0x16 && head[1] == 0x03:
+		return "tls"
+	case bytes.HasPrefix(head, []byte("SSH-")):
+		return "ssh"
+	}
+	for _, e := range []string{"CONNECT ", "DELETE ", "GET ", "HEAD ", "OPTIONS ", "PATCH ", "POST ", "PUT "} {
+		if bytes.HasPrefix(head, []byte(e)) {
+			return "http"
+		}
+	}
+	return "unknown"
+}
+
+// Sniffer is a simple classifier, it sniffs the protocol of a stream and looks up the verdict in the policy. Protocols
+// not in the policy are passed.
+type Sniffer struct {
+	Policy map[string]Verdict
+}
+
+// Classify implements daze.Classifier.
+func (s *Sniffer) Classify(ctx *Context, head []byte) Verdict {
+	name := Sniff(head)
+	log.Printf("conn: %08x  sniff protocol=%s", ctx.Cid, name)
+	return s.Policy[name]
+}
+
+// NewSniffer returns a new Sniffer.
+func NewSniffer() *Sniffer {
+	return &Sniffer{
+		Policy: map[string]Verdict{},
+	}
+}
+
+// InspectConn classifies the stream at the first write, and then enforces the verdict on it.
+type InspectConn struct {
+	io.ReadWriteCloser
+	Classifier Classifier
+	Ctx        *Context
+	Limits     *rate.Limits
+	Once       sync.Once
+	// Verdict is written by the writer and read by the reader, so it is accessed atomically.
+	Verdict atomic.Uint32
+}
+
+// Read implements io.Reader.
+func (c *InspectConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if Verdict(c.Verdict.Load()) == VerdictThrottle {
+		c.Limits.Wait(uint64(n))
+	}
+	return n, err
 }
 
-// Direct is the default dialer for connecting to an address.
-type Direct struct{}
+// Write implements io.Writer.
+func (c *InspectConn) Write(p []byte) (int, error) {
+	c.Once.Do(func() {
+		c.Verdict.Store(uint32(c.Classifier.Classify(c.Ctx, p)))
+	})
+	switch Verdict(c.Verdict.Load()) {
+	case VerdictBlock:
+		c.ReadWriteCloser.Close()
+		return 0, fmt.Errorf("daze: stream has been %w", ErrBlocked)
+	case VerdictThrottle:
+		c.Limits.Wait(uint64(len(p)))
+	}
+	return c.ReadWriteCloser.Write(p)
+}
+
+// Inspector is a dialer that classifies each stream by the first bytes written to it. It can wrap the dialer of Locale
+// or Engine.
+type Inspector struct {
+	Classifier Classifier
+	Dialer     Dialer
+	// Limits is shared by all throttled streams, in bytes.
+	Limits *rate.Limits
+}
 
 // Dial implements daze.Dialer.
-func (d *Direct) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
-	return Dial(network, address)
+func (i *Inspector) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	srv, err := i.Dialer.Dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &InspectConn{
+		ReadWriteCloser: srv,
+		Classifier:      i.Classifier,
+		Ctx:             ctx,
+		Limits:          i.Limits,
+	}, nil
+}
+
+// NewInspector returns a new Inspector. Throttled streams share a bandwidth of 64 KB per second.
+func NewInspector(dialer Dialer, classifier Classifier) *Inspector {
+	return &Inspector{
+		Classifier: classifier,
+		Dialer:     dialer,
+		Limits:     rate.NewLimits(64*1024, time.Second),
+	}
+}
+
+// Active describes an active stream.
+type Active struct {
+	Address string    `json:"address"`
+	Cid     uint32    `json:"cid"`
+	Idx     uint32    `json:"idx"`
+	Network string    `json:"network"`
+	Time    time.Time `json:"time"`
+}
+
+// ActiveConn is a stream registered in the registry, it leaves the registry when it is closed.
+type ActiveConn struct {
+	io.ReadWriteCloser
+	Active  Active
+	Actives *Actives
+	Once    sync.Once
+}
+
+// Close implements io.Closer.
+func (c *ActiveConn) Close() error {
+	c.Once.Do(func() {
+		c.Actives.Mu.Lock()
+		delete(c.Actives.M, c.Active.Idx)
+		c.Actives.Mu.Unlock()
+	})
+	return c.ReadWriteCloser.Close()
+}
+
+// Unwrap returns the registered stream.
+func (c *ActiveConn) Unwrap() io.ReadWriteCloser {
+	return c.ReadWriteCloser
+}
+
+// Actives is a registry of active streams. Streams can be listed with their destinations and closed by force.
+type Actives struct {
+	Idx uint32
+	M   map[uint32]*ActiveConn
+	Mu  *sync.Mutex
+}
+
+// Kill closes the stream with the given index by force.
+func (a *Actives) Kill(idx uint32) error {
+	a.Mu.Lock()
+	c, ok := a.M[idx]
+	a.Mu.Unlock()
+	if !ok {
+		return fmt.Errorf("daze: stream %d not found", idx)
+	}
+	return c.Close()
+}
+
+// List returns active streams ordered by index.
+func (a *Actives) List() []Active {
+	a.Mu.Lock()
+	r := make([]Active, 0, len(a.M))
+	for _, c := range a.M {
+		r = append(r, c.Active)
+	}
+	a.Mu.Unlock()
+	slices.SortFunc(r, func(a, b Active) int { return cmp.Compare(a.Idx, b.Idx) })
+	return r
+}
+
+// Wrap registers the stream, which is removed from the registry when it is closed.
+func (a *Actives) Wrap(ctx *Context, network string, address string, conn io.ReadWriteCloser) io.ReadWriteCloser {
+	a.Mu.Lock()
+	defer a.Mu.Unlock()
+	a.Idx++
+	c := &ActiveConn{
+		ReadWriteCloser: conn,
+		Active: Active{
+			Address: address,
+			Cid:     ctx.Cid,
+			Idx:     a.Idx,
+			Network: network,
+			Time:    time.Now(),
+		},
+		Actives: a,
+	}
+	a.M[a.Idx] = c
+	return c
+}
+
+// NewActives returns a new Actives.
+func NewActives() *Actives {
+	return &Actives{
+		M:  map[uint32]*ActiveConn{},
+		Mu: &sync.Mutex{},
+	}
 }
 
 // Locale is the main process of daze. In most cases, it is usually deployed as a daemon on a local machine.
 type Locale struct {
+	// Actives records the streams dialed by the locale.
+	Actives *Actives
+	// Auth is the username and password required from clients in the form of user:pass, so that the locale can be
+	// shared on a network. Socks4 has no password, so it is rejected. No authentication is required if it is empty.
+	Auth   string
 	Listen string
 	Dialer Dialer
 	Closer io.Closer
+	// Frontends are listeners in addition to Listen, each with its own limits and router. They share the dialer, the
+	// hook and the actives of the locale, and they are run and closed along with it.
+	Frontends []*LocaleFrontend
+	// FullCone relays socks5 udp associations as a full-cone nat if the dialer is a daze.Coner: destinations which
+	// go directly share a socket, and datagrams from any peer on it are delivered to the client, as needed by games
+	// and webrtc. Other destinations are relayed as usual.
+	FullCone bool
+	Hook     Hook
+	NextID   uint32
+	// Prefetch warms the routes of hosts seen in plain http responses of the http proxy, it is disabled if it is nil.
+	Prefetch *Prefetch
+}
+
+// LocaleFrontend is a listener of Locale in addition to its main one, for example, a throttled listener for the lan
+// besides an unrestricted one for localhost.
+type LocaleFrontend struct {
+	Closer io.Closer
+	Listen string
+	// Limits caps the bandwidth of all connections of the frontend in bytes, reads and writes draw from the same
+	// bucket. It is unlimited if it is nil.
+	Limits *rate.Limits
+	// Router restricts the destinations of the frontend. Destinations on RoadFucked, RoadSilent and RoadNotice are
+	// handled as Engine does, and others are dialed by the locale. Nothing is restricted if it is nil.
+	Router Router
+}
+
+// LimitConn throttles a connection, reads and writes wait for tokens of the limits.
+type LimitConn struct {
+	io.ReadWriteCloser
+	Limits *rate.Limits
+}
+
+// Read implements io.Reader.
+func (c *LimitConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.Limits.Wait(uint64(n))
+	return n, err
+}
+
+// Write implements io.Writer.
+func (c *LimitConn) Write(p []byte) (int, error) {
+	c.Limits.Wait(uint64(len(p)))
+	return c.ReadWriteCloser.Write(p)
+}
+
+// Dial connects to the address on the named network with the dialer of locale. The hook is called before dialing.
+func (l *Locale) Dial(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+	if err := l.Hook.OnDial(ctx, network, address); err != nil {
+		return nil, err
+	}
+	srv, err := l.Dialer.Dial(ctx, network, address)
+	if err != nil || l.Actives == nil {
+		return srv, err
+	}
+	return l.Actives.Wrap(ctx, network, address, srv), nil
+}
+
+// Bind waits for a connection from the address with the dialer of locale, which must be a daze.Binder. The hook is
+// called before binding.
+func (l *Locale) Bind(ctx *Context, address string) (Bound, error) {
+	if err := l.Hook.OnDial(ctx, "tcp", address); err != nil {
+		return nil, err
+	}
+	b, ok := l.Dialer.(Binder)
+	if !ok {
+		return nil, ErrBindUnsupported
+	}
+	return b.Bind(ctx, address)
 }
 
 // ServeProxy serves traffic in HTTP Proxy/Tunnel format.
@@ -210,6 +3346,15 @@ func (l *Locale) ServeProxy(ctx *Context, cli io.ReadWriteCloser) error {
 			if err != nil {
 				return err
 			}
+			if l.Auth != "" {
+				auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(l.Auth))
+				if subtle.ConstantTimeCompare([]byte(r.Header.Get("Proxy-Authorization")), []byte(auth)) != 1 {
+					cli.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"daze\"\r\nContent-Length: 0\r\n\r\n"))
+					return errors.New("daze: proxy authentication failed")
+				}
+				// The credentials are not forwarded to the destination.
+				r.Header.Del("Proxy-Authorization")
+			}
 
 			var port string
 			if r.URL.Port() == "" {
@@ -224,7 +3369,14 @@ func (l *Locale) ServeProxy(ctx *Context, cli io.ReadWriteCloser) error {
 				log.Printf("conn: %08x  proto format=hproxy", ctx.Cid)
 			}
 
-			srv, err := l.Dialer.Dial(ctx, "tcp", r.URL.Hostname()+":"+port)
+			srv, err := l.Dial(ctx, "tcp", r.URL.Hostname()+":"+port)
+			if errors.Is(err, ErrBlocked) && r.Method != "CONNECT" {
+				// Respond to blocked http requests instantly with a blank page, so that the browser doesn't need to
+				// wait for the connection to time out.
+				io.Copy(io.Discard, r.Body)
+				_, err = cli.Write([]byte("HTTP/1.1 204 No Content\r\nContent-Length: 0\r\n\r\n"))
+				return err
+			}
 			if err != nil {
 				return err
 			}
@@ -235,14 +3387,14 @@ func (l *Locale) ServeProxy(ctx *Context, cli io.ReadWriteCloser) error {
 				if err != nil {
 					return err
 				}
-				Link(cli, srv)
+				ctx.Link(cli, srv)
 				return io.EOF
 			}
 			if r.Method == "GET" && r.Header.Get("Upgrade") == "websocket" {
 				if err := r.Write(srv); err != nil {
 					return err
 				}
-				Link(cli, srv)
+				ctx.Link(cli, srv)
 				return io.EOF
 			}
 
@@ -254,6 +3406,9 @@ func (l *Locale) ServeProxy(ctx *Context, cli io.ReadWriteCloser) error {
 			if err != nil {
 				return err
 			}
+			if l.Prefetch != nil {
+				l.Prefetch.Response(ctx, r.URL.Hostname(), s)
+			}
 			return s.Write(cli)
 		}()
 		if err != nil {
@@ -264,7 +3419,103 @@ func (l *Locale) ServeProxy(ctx *Context, cli io.ReadWriteCloser) error {
 	if err == io.EOF {
 		return nil
 	}
-	return err
+	return err
+}
+
+// PrefetchHost matches the hosts of absolute urls in html and headers, for example, src="https://a.com/b.js" and
+// <//a.com/b.css>.
+var PrefetchHost = regexp.MustCompile(`(?i)(?:https?:)?//([a-z0-9][a-z0-9.-]*\.[a-z]{2,})`)
+
+// Prefetch warms the routes of hosts which a page is likely to hit soon, so that their connections don't wait for the
+// dns lookup of the router. Hosts are picked from the headers and the start of the html of plain http responses, and
+// routed in the background, which fills the route cache along with the ip the host resolves to.
+type Prefetch struct {
+	// Lru remembers the hosts prefetched recently, they are not prefetched again.
+	Lru    *lru.Lru[string, struct{}]
+	Router Router
+	// Sem bounds the number of routes running at once, hosts are skipped if it is full.
+	Sem chan struct{}
+}
+
+// Host routes the host in the background, unless it is prefetched recently.
+func (p *Prefetch) Host(ctx *Context, host string) {
+	if _, ok := p.Lru.GetExists(host); ok {
+		return
+	}
+	select {
+	case p.Sem <- struct{}{}:
+	default:
+		return
+	}
+	p.Lru.Set(host, struct{}{})
+	log.Printf("conn: %08x   prefetch host=%s", ctx.Cid, host)
+	go func() {
+		defer func() { <-p.Sem }()
+		p.Router.Road(&Context{Cid: ctx.Cid}, host)
+	}()
+}
+
+// Scan prefetches the hosts found in the data, except the host of the page itself.
+func (p *Prefetch) Scan(ctx *Context, self string, data []byte) {
+	seen := map[string]bool{self: true}
+	for _, m := range PrefetchHost.FindAllSubmatch(data, -1) {
+		host := strings.ToLower(string(m[1]))
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		p.Host(ctx, host)
+		if len(seen) > Conf.PrefetchHosts {
+			return
+		}
+	}
+}
+
+// Response prefetches the hosts in the headers of the response, and in the start of its body if it is html. The body
+// is scanned as it is read, so the response is not delayed.
+func (p *Prefetch) Response(ctx *Context, self string, s *http.Response) {
+	head := []byte{}
+	for _, k := range []string{"Link", "Location"} {
+		for _, v := range s.Header.Values(k) {
+			head = append(head, v...)
+			head = append(head, ' ')
+		}
+	}
+	p.Scan(ctx, self, head)
+	if strings.HasPrefix(s.Header.Get("Content-Type"), "text/html") && s.Header.Get("Content-Encoding") == "" {
+		s.Body = &PrefetchReader{Buf: &bytes.Buffer{}, Ctx: ctx, Prefetch: p, ReadCloser: s.Body, Self: self}
+	}
+}
+
+// NewPrefetch returns a new Prefetch.
+func NewPrefetch(router Router) *Prefetch {
+	return &Prefetch{
+		Lru:    lru.New[string, struct{}](Conf.RouterLruSize),
+		Router: router,
+		Sem:    make(chan struct{}, Conf.PrefetchHosts),
+	}
+}
+
+// PrefetchReader copies the first Conf.PrefetchSize bytes of a body, and scans them for hosts once they are read.
+type PrefetchReader struct {
+	io.ReadCloser
+	Buf      *bytes.Buffer
+	Ctx      *Context
+	Prefetch *Prefetch
+	Self     string
+}
+
+// Read implements io.Reader.
+func (r *PrefetchReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.Buf != nil {
+		r.Buf.Write(p[:min(n, Conf.PrefetchSize-r.Buf.Len())])
+		if r.Buf.Len() >= Conf.PrefetchSize || err != nil {
+			r.Prefetch.Scan(r.Ctx, r.Self, r.Buf.Bytes())
+			r.Buf = nil
+		}
+	}
+	return n, err
 }
 
 // ServeSocks4 serves traffic in SOCKS4/SOCKS4a format.
@@ -290,6 +3541,10 @@ func (l *Locale) ServeSocks4(ctx *Context, cli io.ReadWriteCloser) error {
 		srv       io.ReadWriteCloser
 		err       error
 	)
+	if l.Auth != "" {
+		cli.Write([]byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return errors.New("daze: socks4 has no authentication")
+	}
 	cliReader.Discard(1)
 	fCode, _ = cliReader.ReadByte()
 	io.ReadFull(cliReader, fDstPort)
@@ -313,13 +3568,13 @@ func (l *Locale) ServeSocks4(ctx *Context, cli io.ReadWriteCloser) error {
 	log.Printf("conn: %08x  proto format=socks4", ctx.Cid)
 	switch fCode {
 	case 0x01:
-		srv, err = l.Dialer.Dial(ctx, "tcp", dst)
+		srv, err = l.Dial(ctx, "tcp", dst)
 		if err != nil {
 			cli.Write([]byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 		} else {
 			defer srv.Close()
 			cli.Write([]byte{0x00, 0x5a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-			Link(cli, srv)
+			ctx.Link(cli, srv)
 		}
 		return err
 	case 0x02:
@@ -341,77 +3596,175 @@ func (l *Locale) ServeSocks5(ctx *Context, cli io.ReadWriteCloser) error {
 		Closer: cli,
 	}
 	var (
-		fN       uint8
-		fCmd     uint8
-		fAT      uint8
-		fDstAddr []byte
-		fDstPort = make([]byte, 2)
-		dstHost  string
-		dstPort  uint16
-		dst      string
-		err      error
+		// All fields of the request are read into the same buffer, the longest one is a domain name of 255 bytes.
+		buf     = make([]byte, 256)
+		fN      uint8
+		fCmd    uint8
+		fAT     uint8
+		dstHost string
+		dst     string
+		err     error
 	)
 	cliReader.Discard(1)
 	fN, _ = cliReader.ReadByte()
-	cliReader.Discard(int(fN))
-	cli.Write([]byte{0x05, 0x00})
+	_, err = io.ReadFull(cliReader, buf[:fN])
+	if err != nil {
+		return err
+	}
+	if l.Auth != "" {
+		err = l.ServeSocks5Auth(cli, buf[:fN])
+		if err != nil {
+			return err
+		}
+	} else {
+		cli.Write([]byte{0x05, 0x00})
+	}
 	cliReader.Discard(1)
 	fCmd, _ = cliReader.ReadByte()
 	cliReader.Discard(1)
 	fAT, _ = cliReader.ReadByte()
 	switch fAT {
 	case 0x01:
-		fDstAddr = make([]byte, 4)
-		io.ReadFull(cliReader, fDstAddr)
-		dstHost = net.IP(fDstAddr).String()
+		io.ReadFull(cliReader, buf[:4])
+		dstHost = net.IP(buf[:4]).String()
 	case 0x03:
 		fN, _ = cliReader.ReadByte()
-		fDstAddr = make([]byte, int(fN))
-		io.ReadFull(cliReader, fDstAddr)
-		dstHost = string(fDstAddr)
+		io.ReadFull(cliReader, buf[:fN])
+		dstHost = string(buf[:fN])
 	case 0x04:
-		fDstAddr = make([]byte, 16)
-		io.ReadFull(cliReader, fDstAddr)
-		dstHost = net.IP(fDstAddr).String()
+		io.ReadFull(cliReader, buf[:16])
+		dstHost = net.IP(buf[:16]).String()
 	}
-	_, err = io.ReadFull(cli, fDstPort)
+	_, err = io.ReadFull(cli, buf[:2])
 	if err != nil {
 		return err
 	}
-	dstPort = binary.BigEndian.Uint16(fDstPort)
-	dst = net.JoinHostPort(dstHost, strconv.Itoa(int(dstPort)))
+	dst = net.JoinHostPort(dstHost, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
 	switch fCmd {
 	case 0x01:
 		return l.ServeSocks5TCP(ctx, cli, dst)
 	case 0x02:
-		panic("unreachable")
+		return l.ServeSocks5Bind(ctx, cli, dst)
 	case 0x03:
 		return l.ServeSocks5UDP(ctx, cli)
 	}
 	return nil
 }
 
+// ServeSocks5Auth negotiates the username/password authentication of socks5.
+//
+// Introduction:
+// See https://datatracker.ietf.org/doc/html/rfc1929
+func (l *Locale) ServeSocks5Auth(cli io.ReadWriteCloser, methods []byte) error {
+	if !bytes.Contains(methods, []byte{0x02}) {
+		cli.Write([]byte{0x05, 0xff})
+		return errors.New("daze: socks5 authentication required")
+	}
+	_, err := cli.Write([]byte{0x05, 0x02})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 256)
+	_, err = io.ReadFull(cli, buf[:2])
+	if err != nil {
+		return err
+	}
+	user := make([]byte, buf[1])
+	_, err = io.ReadFull(cli, user)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(cli, buf[:1])
+	if err != nil {
+		return err
+	}
+	pass := make([]byte, buf[0])
+	_, err = io.ReadFull(cli, pass)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(string(user)+":"+string(pass)), []byte(l.Auth)) != 1 {
+		cli.Write([]byte{0x01, 0x01})
+		return errors.New("daze: socks5 authentication failed")
+	}
+	_, err = cli.Write([]byte{0x01, 0x00})
+	return err
+}
+
 // ServeSocks5TCP serves socks5 TCP protocol.
 func (l *Locale) ServeSocks5TCP(ctx *Context, cli io.ReadWriteCloser, dst string) error {
 	log.Printf("conn: %08x  proto format=socks5", ctx.Cid)
-	srv, err := l.Dialer.Dial(ctx, "tcp", dst)
+	srv, err := l.Dial(ctx, "tcp", dst)
 	if err != nil {
 		cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 	} else {
 		cli.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 		// Since the Link function will close the srv, there is no need to close it manually.
-		Link(cli, srv)
+		ctx.Link(cli, srv)
 	}
 	return err
 }
 
-// ServeSocks5UDP serves socks5 UDP protocol.
+// ServeSocks5Bind serves socks5 BIND command. The first reply is the address the peer should connect to, and the second
+// one is the address of the peer once it connects, or a failure if it does not connect within Conf.BindTimeout.
+func (l *Locale) ServeSocks5Bind(ctx *Context, cli io.ReadWriteCloser, dst string) error {
+	log.Printf("conn: %08x  proto format=socks5 command=bind", ctx.Cid)
+	bnd, err := l.Bind(ctx, dst)
+	if err != nil {
+		cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+	adr, err := SocksAddr(bnd.Addr())
+	if err != nil {
+		bnd.Close()
+		return err
+	}
+	log.Printf("conn: %08x   bind listen=%s", ctx.Cid, bnd.Addr())
+	_, err = cli.Write(append([]byte{0x05, 0x00, 0x00}, adr...))
+	if err != nil {
+		bnd.Close()
+		return err
+	}
+	t := time.AfterFunc(Conf.BindTimeout, func() { bnd.Close() })
+	srv, peer, err := bnd.Accept()
+	if !t.Stop() {
+		// The listener is closed by the timer, reply ttl expired rather than a general failure.
+		if err == nil {
+			srv.Close()
+		}
+		cli.Write([]byte{0x05, 0x06, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return errors.New("daze: bind timed out")
+	}
+	if err == nil {
+		adr, err = SocksAddr(peer)
+	}
+	if err != nil {
+		cli.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return err
+	}
+	log.Printf("conn: %08x   bind peer=%s", ctx.Cid, peer)
+	_, err = cli.Write(append([]byte{0x05, 0x00, 0x00}, adr...))
+	if err != nil {
+		srv.Close()
+		return err
+	}
+	if l.Actives != nil {
+		srv = l.Actives.Wrap(ctx, "tcp", dst, srv)
+	}
+	// Since the Link function will close the srv, there is no need to close it manually.
+	ctx.Link(cli, srv)
+	return nil
+}
+
+// ServeSocks5UDP serves socks5 UDP protocol. Once a destination is associated, its datagrams are relayed without
+// allocations: the association is looked up by the header of the datagram, and the buffers are reused.
 func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser) error {
 	var (
 		bndAddr     *net.UDPAddr
 		bndPort     uint16
 		bnd         *net.UDPConn
-		appAddr     *net.UDPAddr
+		appAddr     netip.AddrPort
+		appLast     atomic.Pointer[netip.AddrPort]
 		appSize     int
 		appHeadSize int
 		appHead     []byte
@@ -423,6 +3776,9 @@ func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser) error {
 		cpl         = map[string]io.ReadWriteCloser{}
 		buf         = make([]byte, 2048)
 		err         error
+		coneAddr    net.Addr
+		cone        net.PacketConn
+		coner, _    = l.Dialer.(Coner)
 	)
 	bndAddr = doa.Try(net.ResolveUDPAddr("udp", "127.0.0.1:0"))
 	bnd = doa.Try(net.ListenUDP("udp", bndAddr))
@@ -443,10 +3799,16 @@ func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser) error {
 	}()
 
 	for {
-		appSize, appAddr, err = bnd.ReadFromUDP(buf)
+		appSize, appAddr, err = bnd.ReadFromUDPAddrPort(buf)
 		if err != nil {
 			break
 		}
+		// The client may send from a new port, for example, after a nat rebinding. Datagrams of the cone go to the
+		// latest one. It is only stored when it changes, so that the relay does not allocate.
+		if last := appLast.Load(); last == nil || *last != appAddr {
+			addr := appAddr
+			appLast.Store(&addr)
+		}
 		// 	+----+------+------+----------+----------+----------+
 		// 	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
 		// 	+----+------+------+----------+----------+----------+
@@ -462,23 +3824,32 @@ func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser) error {
 		// 	    *  DST.ADDR       desired destination address
 		// 	    *  DST.PORT       desired destination port
 		// 	    *  DATA     user data
-		doa.Doa(buf[0] == 0x00)
-		doa.Doa(buf[1] == 0x00)
+		appHeadSize = 0
 		// Implementation of fragmentation is optional; an implementation that does not support fragmentation MUST drop
-		// any datagram whose FRAG field is other than X'00'.
-		doa.Doa(buf[2] == 0x00)
-		switch buf[3] {
-		case 0x01:
-			appHeadSize = 10
-		case 0x03:
-			appHeadSize = int(buf[4]) + 7
-		case 0x04:
-			appHeadSize = 22
+		// any datagram whose FRAG field is other than X'00'. Malformed datagrams are dropped as well.
+		if appSize >= 5 && buf[0] == 0x00 && buf[1] == 0x00 && buf[2] == 0x00 {
+			switch buf[3] {
+			case 0x01:
+				appHeadSize = 10
+			case 0x03:
+				appHeadSize = int(buf[4]) + 7
+			case 0x04:
+				appHeadSize = 22
+			}
+		}
+		if appHeadSize == 0 || appHeadSize > appSize {
+			continue
 		}
 
-		appHead = make([]byte, appHeadSize)
-		copy(appHead, buf[0:appHeadSize])
-
+		// Converting the bytes to a string to look up a map does not allocate.
+		srv, b = cpl[string(buf[:appHeadSize])]
+		if b {
+			goto send
+		} else {
+			goto init
+		}
+	init:
+		appHead = bytes.Clone(buf[:appHeadSize])
 		switch appHead[3] {
 		case 0x01:
 			dstHost = net.IP(appHead[4:8]).String()
@@ -491,23 +3862,25 @@ func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser) error {
 			dstHost = net.IP(appHead[4:20]).String()
 			dstPort = binary.BigEndian.Uint16(appHead[20:22])
 		}
-		dst = dstHost + ":" + strconv.Itoa(int(dstPort))
-
-		srv, b = cpl[dst]
-		if b {
-			goto send
-		} else {
-			goto init
-		}
-	init:
+		dst = net.JoinHostPort(dstHost, strconv.Itoa(int(dstPort)))
 		log.Printf("conn: %08x  proto format=socks5", ctx.Cid)
-		srv, err = l.Dialer.Dial(ctx, "udp", dst)
+		if l.FullCone && coner != nil {
+			coneAddr, err = coner.Cone(ctx, dst)
+			if err == nil {
+				goto cone
+			}
+			if !errors.Is(err, ErrConeUnsupported) {
+				log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				continue
+			}
+		}
+		srv, err = l.Dial(ctx, "udp", dst)
 		if err != nil {
 			log.Printf("conn: %08x  error %s", ctx.Cid, err)
 			continue
 		}
-		cpl[dst] = srv
-		go func(srv io.ReadWriteCloser, appHead []byte, appAddr *net.UDPAddr) error {
+		cpl[string(appHead)] = srv
+		go func(srv io.ReadWriteCloser, appHead []byte, appAddr netip.AddrPort) error {
 			var (
 				buf = make([]byte, 2048)
 				l   = len(appHead)
@@ -520,13 +3893,34 @@ func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser) error {
 				if err != nil {
 					break
 				}
-				_, err = bnd.WriteToUDP(buf[:l+n], appAddr)
+				_, err = bnd.WriteToUDPAddrPort(buf[:l+n], appAddr)
 				if err != nil {
 					break
 				}
 			}
 			return err
 		}(srv, appHead, appAddr)
+		goto send
+	cone:
+		err = l.Hook.OnDial(ctx, "udp", dst)
+		if err != nil {
+			log.Printf("conn: %08x  error %s", ctx.Cid, err)
+			continue
+		}
+		if cone == nil {
+			cone, err = coner.ListenCone(ctx)
+			if err != nil {
+				log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				continue
+			}
+			log.Printf("conn: %08x   cone listen=%s", ctx.Cid, cone.LocalAddr())
+			go l.ServeSocks5Cone(bnd, cone, &appLast)
+		}
+		srv = &ConeConn{Addr: coneAddr, PacketConn: cone}
+		if l.Actives != nil {
+			srv = l.Actives.Wrap(ctx, "udp", dst, srv)
+		}
+		cpl[string(appHead)] = srv
 	send:
 		_, err = srv.Write(buf[appHeadSize:appSize])
 		if err != nil {
@@ -534,90 +3928,462 @@ func (l *Locale) ServeSocks5UDP(ctx *Context, cli io.ReadWriteCloser) error {
 			continue
 		}
 	}
-	for _, e := range cpl {
-		e.Close()
+	for _, e := range cpl {
+		e.Close()
+	}
+	if cone != nil {
+		cone.Close()
+	}
+	return nil
+}
+
+// ServeSocks5Cone delivers datagrams from any peer on the shared socket of a full-cone association to the client. The
+// header of a datagram carries the ip of the peer, even if the client sent to it by a domain name. Datagrams go to the
+// latest address of the client.
+func (l *Locale) ServeSocks5Cone(bnd *net.UDPConn, cone net.PacketConn, appAddr *atomic.Pointer[netip.AddrPort]) error {
+	// The header is 22 bytes at most: 4 bytes of fields, an ipv6 address and a port.
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := cone.ReadFrom(buf[22:])
+		if err != nil {
+			return err
+		}
+		a, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		ip := a.AddrPort().Addr().Unmap()
+		head := 22 - 4 - ip.BitLen()/8 - 2
+		copy(buf[head:], []byte{0x00, 0x00, 0x00, 0x01})
+		if ip.Is4() {
+			b := ip.As4()
+			copy(buf[head+4:], b[:])
+		} else {
+			b := ip.As16()
+			buf[head+3] = 0x04
+			copy(buf[head+4:], b[:])
+		}
+		binary.BigEndian.PutUint16(buf[20:22], a.AddrPort().Port())
+		_, err = bnd.WriteToUDPAddrPort(buf[head:22+n], *appAddr.Load())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Serve serves incoming connections and handle it with a different handler(ServeProxy/ServeSocks4/ServeSocks5).
+func (l *Locale) Serve(ctx *Context, cli io.ReadWriteCloser) error {
+	var (
+		buf = make([]byte, 1)
+		err error
+	)
+	_, err = io.ReadFull(cli, buf)
+	if err != nil {
+		// There are some clients that will establish a link in advance without sending any messages so that they can
+		// immediately get the connected conn when they really need it. When they leave, it makes no sense to report a
+		// EOF error.
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	cli = ReadWriteCloser{
+		Reader: io.MultiReader(bytes.NewReader(buf), cli),
+		Writer: cli,
+		Closer: cli,
+	}
+	if buf[0] == 0x05 {
+		return l.ServeSocks5(ctx, cli)
+	}
+	if buf[0] == 0x04 {
+		return l.ServeSocks4(ctx, cli)
+	}
+	return l.ServeProxy(ctx, cli)
+}
+
+// Close listener.
+func (l *Locale) Close() error {
+	for _, f := range l.Frontends {
+		if f.Closer != nil {
+			f.Closer.Close()
+		}
+	}
+	if l.Closer != nil {
+		return l.Closer.Close()
+	}
+	return nil
+}
+
+// Frontend returns a locale which serves the connections of the frontend. It shares the settings of the locale, but
+// its dialer is restricted by the router and the limits of the frontend.
+func (l *Locale) Frontend(f *LocaleFrontend) *Locale {
+	// The locale is not copied as a whole, its counter is being updated by the loops.
+	r := Locale{
+		Actives:  l.Actives,
+		Auth:     l.Auth,
+		Closer:   l.Closer,
+		Dialer:   l.Dialer,
+		FullCone: l.FullCone,
+		Hook:     l.Hook,
+		Listen:   l.Listen,
+		Prefetch: l.Prefetch,
+	}
+	if f.Router != nil {
+		r.Dialer = &Engine{Dialer: r.Dialer, Router: f.Router}
+	}
+	if f.Limits != nil {
+		dialer := r.Dialer
+		r.Dialer = DialerFunc(func(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+			srv, err := dialer.Dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return &LimitConn{ReadWriteCloser: srv, Limits: f.Limits}, nil
+		})
+	}
+	return &r
+}
+
+// Loop accepts connections on the listener and serves them with the locale given by serve. Connections of all
+// listeners are numbered by the same counter.
+func (l *Locale) Loop(s net.Listener, serve *Locale) {
+	for {
+		cli, err := s.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("main:", err)
+			}
+			break
+		}
+		ctx := &Context{Cid: atomic.AddUint32(&l.NextID, 1)}
+		log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
+		go func() {
+			defer cli.Close()
+			err := serve.Hook.OnAccept(ctx, cli.RemoteAddr())
+			if err == nil {
+				err = serve.Serve(ctx, cli)
+			}
+			if err != nil {
+				log.Printf("conn: %08x  error %s", ctx.Cid, err)
+			}
+			if errors.Is(err, ErrBlocked) {
+				// Reset the connection instead of closing it gracefully, so that the client knows it is rejected
+				// immediately.
+				cli.(*net.TCPConn).SetLinger(0)
+			}
+			serve.Hook.OnClose(ctx, err)
+			log.Printf("conn: %08x closed", ctx.Cid)
+		}()
+	}
+}
+
+// Run it.
+func (l *Locale) Run() error {
+	s, err := net.Listen("tcp", l.Listen)
+	if err != nil {
+		return err
+	}
+	l.Closer = s
+	log.Println("main: listen and serve on", l.Listen)
+	for _, f := range l.Frontends {
+		fs, err := net.Listen("tcp", f.Listen)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		f.Closer = fs
+		log.Println("main: listen and serve on", f.Listen)
+		go l.Loop(fs, l.Frontend(f))
+	}
+	go l.Loop(s, l)
+	return nil
+}
+
+// NewLocale returns a Locale.
+func NewLocale(listen string, dialer Dialer) *Locale {
+	return &Locale{
+		Actives: NewActives(),
+		Listen:  listen,
+		Dialer:  dialer,
+		Hook:    NewHookChain(),
+		NextID:  uint32(math.MaxUint32),
+	}
+}
+
+// Mapper forwards connections on a local port to a fixed destination through the dialer, so that applications
+// without proxy support, such as database clients, can reach the destination.
+type Mapper struct {
+	Closer io.Closer
+	Dialer Dialer
+	Hook   Hook
+	Listen string
+	Server string
+}
+
+// Serve incoming connections. Parameter cli will be closed automatically when the function exits.
+func (m *Mapper) Serve(ctx *Context, cli io.ReadWriteCloser) error {
+	err := m.Hook.OnDial(ctx, "tcp", m.Server)
+	if err != nil {
+		return err
+	}
+	srv, err := m.Dialer.Dial(ctx, "tcp", m.Server)
+	if err != nil {
+		return err
+	}
+	ctx.Link(cli, srv)
+	return nil
+}
+
+// Close listener. Established connections will not be closed.
+func (m *Mapper) Close() error {
+	if m.Closer != nil {
+		return m.Closer.Close()
+	}
+	return nil
+}
+
+// Run it.
+func (m *Mapper) Run() error {
+	l, err := net.Listen("tcp", m.Listen)
+	if err != nil {
+		return err
+	}
+	m.Closer = l
+	log.Println("main: listen and serve on", m.Listen, "map to", m.Server)
+
+	go func() {
+		idx := uint32(math.MaxUint32)
+		for {
+			cli, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("main:", err)
+				}
+				break
+			}
+			idx++
+			ctx := &Context{Cid: idx}
+			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
+			go func() {
+				defer cli.Close()
+				err := m.Hook.OnAccept(ctx, cli.RemoteAddr())
+				if err == nil {
+					err = m.Serve(ctx, cli)
+				}
+				if err != nil {
+					log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				}
+				m.Hook.OnClose(ctx, err)
+				log.Printf("conn: %08x closed", ctx.Cid)
+			}()
+		}
+	}()
+	return nil
+}
+
+// NewMapper returns a new Mapper.
+func NewMapper(listen string, server string, dialer Dialer) *Mapper {
+	return &Mapper{
+		Dialer: dialer,
+		Hook:   NewHookChain(),
+		Listen: listen,
+		Server: server,
+	}
+}
+
+// MapperOption is a line of the MAP file, which declares static port maps. There are three or four parts per line:
+// network, listen address, destination and the optional road. Only tcp is supported now. The road is one of rule,
+// remote or locale, by default the destination is routed by rules like any other connection.
+//
+// This is a normal MAP document:
+// tcp 127.0.0.1:3306 db.internal:3306 remote
+// tcp 127.0.0.1:3389 10.0.0.2:3389 locale
+type MapperOption struct {
+	Network string
+	Listen  string
+	Server  string
+	Road    string
+}
+
+// LoadMapperOption loads a MAP file.
+func LoadMapperOption(name string) []*MapperOption {
+	f := doa.Try(OpenFile(name))
+	defer f.Close()
+	r := []*MapperOption{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		seps := strings.Fields(line)
+		if len(seps) == 0 {
+			continue
+		}
+		doa.Doa(len(seps) == 3 || len(seps) == 4)
+		doa.Doa(seps[0] == "tcp")
+		option := &MapperOption{
+			Network: seps[0],
+			Listen:  seps[1],
+			Server:  seps[2],
+			Road:    "rule",
+		}
+		if len(seps) == 4 {
+			option.Road = seps[3]
+		}
+		r = append(r, option)
+	}
+	doa.Nil(s.Err())
+	return r
+}
+
+// DemuxListener is a net.Listener fed by Demux with connections of one class.
+type DemuxListener struct {
+	C    chan net.Conn
+	Done chan struct{}
+	L    net.Listener
+	Once sync.Once
+}
+
+// Accept implements net.Listener.
+func (d *DemuxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-d.C:
+		return c, nil
+	case <-d.Done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr implements net.Listener.
+func (d *DemuxListener) Addr() net.Addr {
+	if d.L == nil {
+		return nil
 	}
+	return d.L.Addr()
+}
+
+// Close implements net.Listener. The shared listener is not closed.
+func (d *DemuxListener) Close() error {
+	d.Once.Do(func() {
+		close(d.Done)
+	})
 	return nil
 }
 
-// Serve serves incoming connections and handle it with a different handler(ServeProxy/ServeSocks4/ServeSocks5).
-func (l *Locale) Serve(ctx *Context, cli io.ReadWriteCloser) error {
-	var (
-		buf = make([]byte, 1)
-		err error
-	)
-	_, err = io.ReadFull(cli, buf)
-	if err != nil {
-		// There are some clients that will establish a link in advance without sending any messages so that they can
-		// immediately get the connected conn when they really need it. When they leave, it makes no sense to report a
-		// EOF error.
-		if err == io.EOF {
-			return nil
-		}
-		return err
+// NewDemuxListener returns a new DemuxListener. The shared listener is set by Demux when it runs.
+func NewDemuxListener() *DemuxListener {
+	return &DemuxListener{
+		C:    make(chan net.Conn),
+		Done: make(chan struct{}),
 	}
-	cli = ReadWriteCloser{
-		Reader: io.MultiReader(bytes.NewReader(buf), cli),
-		Writer: cli,
-		Closer: cli,
+}
+
+// DemuxConn replays the bytes peeked by Demux.
+type DemuxConn struct {
+	net.Conn
+	R *bufio.Reader
+}
+
+// Read implements io.Reader.
+func (c *DemuxConn) Read(p []byte) (int, error) {
+	return c.R.Read(p)
+}
+
+// Demux shares one tcp listener between a http protocol, a tls protocol and a raw protocol, for example, baboon,
+// trojan and ashe, so that all of them can live on port 443 behind one firewall rule. Connections are classified by
+// peeking their first bytes: a tls record, a http method, or anything else. Note that clients of all of them speak
+// first.
+type Demux struct {
+	Closer io.Closer
+	HTTP   *DemuxListener
+	Listen string
+	// Listener is used instead of listening on Listen if it is not nil, for example, an AllowListener.
+	Listener net.Listener
+	Raw      *DemuxListener
+	TLS      *DemuxListener
+	// Timeout is the time allowed for the client to send the first bytes.
+	Timeout time.Duration
+}
+
+// Class returns the class of the connection by its first bytes, it is one of "http", "tls" and "raw".
+func (d *Demux) Class(head []byte) string {
+	// A tls handshake record of version 3.x.
+	if len(head) >= 3 && head[0] == 0x16 && head[1] == 0x03 && head[2] <= 0x04 {
+		return "tls"
 	}
-	if buf[0] == 0x05 {
-		return l.ServeSocks5(ctx, cli)
+	for _, e := range []string{"CONNECT ", "DELETE ", "GET ", "HEAD ", "OPTIONS ", "PATCH ", "POST ", "PRI ", "PUT "} {
+		if bytes.HasPrefix(head, []byte(e)) {
+			return "http"
+		}
 	}
-	if buf[0] == 0x04 {
-		return l.ServeSocks4(ctx, cli)
+	return "raw"
+}
+
+// Serve classifies the connection and hands it over to the listener of its class. It is closed if there is no such
+// listener.
+func (d *Demux) Serve(cli net.Conn) {
+	cli.SetReadDeadline(time.Now().Add(d.Timeout))
+	r := bufio.NewReader(cli)
+	// Peek the length of the longest http method, fewer bytes are fine if the client has nothing more to say yet.
+	r.Peek(8)
+	head, _ := r.Peek(r.Buffered())
+	cli.SetReadDeadline(time.Time{})
+	l := map[string]*DemuxListener{"http": d.HTTP, "raw": d.Raw, "tls": d.TLS}[d.Class(head)]
+	if l == nil || len(head) == 0 {
+		cli.Close()
+		return
+	}
+	select {
+	case l.C <- &DemuxConn{Conn: cli, R: r}:
+	case <-l.Done:
+		cli.Close()
 	}
-	return l.ServeProxy(ctx, cli)
 }
 
 // Close listener.
-func (l *Locale) Close() error {
-	if l.Closer != nil {
-		return l.Closer.Close()
+func (d *Demux) Close() error {
+	if d.Closer != nil {
+		return d.Closer.Close()
 	}
 	return nil
 }
 
-// Run it.
-func (l *Locale) Run() error {
-	s, err := net.Listen("tcp", l.Listen)
+// Run it. Listeners of classes must be set before.
+func (d *Demux) Run() error {
+	l, err := Listen(d.Listener, d.Listen)
 	if err != nil {
 		return err
 	}
-	l.Closer = s
-	log.Println("main: listen and serve on", l.Listen)
-
+	d.Closer = l
+	for _, e := range []*DemuxListener{d.HTTP, d.Raw, d.TLS} {
+		if e != nil {
+			e.L = l
+		}
+	}
+	log.Println("daze: demux on", d.Listen)
 	go func() {
-		idx := uint32(math.MaxUint32)
 		for {
-			cli, err := s.Accept()
+			cli, err := l.Accept()
 			if err != nil {
 				if !errors.Is(err, net.ErrClosed) {
-					log.Println("main:", err)
+					log.Println("daze:", err)
 				}
 				break
 			}
-			idx++
-			ctx := &Context{idx}
-			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
-			go func() {
-				defer cli.Close()
-				if err := l.Serve(ctx, cli); err != nil {
-					log.Printf("conn: %08x  error %s", ctx.Cid, err)
-				}
-				log.Printf("conn: %08x closed", ctx.Cid)
-			}()
+			go d.Serve(cli)
+		}
+		for _, e := range []*DemuxListener{d.HTTP, d.Raw, d.TLS} {
+			if e != nil {
+				e.Close()
+			}
 		}
 	}()
-
 	return nil
 }
 
-// NewLocale returns a Locale.
-func NewLocale(listen string, dialer Dialer) *Locale {
-	return &Locale{
-		Listen: listen,
-		Dialer: dialer,
+// NewDemux returns a new Demux.
+func NewDemux(listen string) *Demux {
+	return &Demux{
+		Listen:  listen,
+		Timeout: Conf.DialerTimeout,
 	}
 }
 
@@ -647,6 +4413,10 @@ const (
 	RoadFucked
 	// RoadPuzzle means ?
 	RoadPuzzle
+	// RoadSilent means it is pure rubbish, but the connection is accepted and then silently dropped
+	RoadSilent
+	// RoadNotice means it is pure rubbish, and a "blocked by policy" page is returned for http
+	RoadNotice
 )
 
 func (r Road) String() string {
@@ -659,6 +4429,10 @@ func (r Road) String() string {
 		return "fucked"
 	case RoadPuzzle:
 		return "puzzle"
+	case RoadSilent:
+		return "silent"
+	case RoadNotice:
+		return "notice"
 	}
 	panic("unreachable")
 }
@@ -677,6 +4451,14 @@ type RouterIPNet struct {
 	L []*net.IPNet
 	R []*net.IPNet
 	B []*net.IPNet
+	// Fallback is asked if the resolver fails for reasons other than the host not being found, for example, SERVFAIL
+	// or a timeout.
+	Fallback *net.Resolver
+	// Missing is the road of hosts which are not found or have no addresses, RoadPuzzle leaves them to the next
+	// router.
+	Missing Road
+	// Resolver resolves host names, net.DefaultResolver is used if it is nil.
+	Resolver *net.Resolver
 }
 
 // FromFile loads a CIDR file.
@@ -707,24 +4489,46 @@ func (r *RouterIPNet) FromFile(name string) {
 
 // Road implements daze.Router.
 func (r *RouterIPNet) Road(ctx *Context, host string) Road {
-	l, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	l, err := resolver.LookupIPAddr(context.Background(), host)
+	dnsErr := &net.DNSError{}
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) && r.Fallback != nil {
+		log.Printf("conn: %08x  error %s, retry with the fallback resolver", ctx.Cid, err)
+		l, err = r.Fallback.LookupIPAddr(context.Background(), host)
+	}
+	if err == nil && len(l) == 0 || errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		ctx.Match = "cidr missing"
+		return r.Missing
+	}
 	if err != nil {
 		log.Printf("conn: %08x  error %s", ctx.Cid, err)
 		return RoadPuzzle
 	}
 	a := l[0]
+	// Remember the ip, so the direct dialer connects to the same ip. Remote dialers ignore it and let the server
+	// resolve the host, since the local dns may be polluted.
+	if ctx.Resolved == nil {
+		ctx.Resolved = map[string]net.IP{}
+	}
+	ctx.Resolved[host] = a.IP
 	for _, e := range r.L {
 		if e.Contains(a.IP) {
+			ctx.Match = "cidr L " + e.String()
 			return RoadLocale
 		}
 	}
 	for _, e := range r.R {
 		if e.Contains(a.IP) {
+			ctx.Match = "cidr R " + e.String()
 			return RoadRemote
 		}
 	}
 	for _, e := range r.B {
 		if e.Contains(a.IP) {
+			ctx.Match = "cidr B " + e.String()
 			return RoadFucked
 		}
 	}
@@ -734,9 +4538,10 @@ func (r *RouterIPNet) Road(ctx *Context, host string) Road {
 // NewRouterIPNet returns a new RouterIPNet object.
 func NewRouterIPNet() *RouterIPNet {
 	return &RouterIPNet{
-		L: LoadReservedIP(),
-		R: []*net.IPNet{},
-		B: []*net.IPNet{},
+		L:       LoadReservedIP(),
+		R:       []*net.IPNet{},
+		B:       []*net.IPNet{},
+		Missing: RoadPuzzle,
 	}
 }
 
@@ -747,6 +4552,7 @@ type RouterRight struct {
 
 // Road implements daze.Router.
 func (r *RouterRight) Road(ctx *Context, host string) Road {
+	ctx.Match = "right"
 	return r.R
 }
 
@@ -757,25 +4563,49 @@ func NewRouterRight(road Road) *RouterRight {
 
 // RouterCache cache routing results for next use.
 type RouterCache struct {
-	Lru *lru.Lru[string, Road]
+	Lru *lru.Lru[string, RouterCacheEntry]
 	Raw Router
 }
 
+// RouterCacheEntry is a cached routing result.
+type RouterCacheEntry struct {
+	Compress bool
+	Match    string
+	// Resolved is the ip the host was resolved to by the router, it is reused until Until.
+	Resolved net.IP
+	Road     Road
+	Until    time.Time
+}
+
 // Road implements daze.Router.
 func (r *RouterCache) Road(ctx *Context, host string) Road {
 	a, b := r.Lru.GetExists(host)
 	if b {
-		return a
+		ctx.Compress = a.Compress
+		ctx.Match = "cache " + a.Match
+		if a.Resolved != nil && time.Now().Before(a.Until) {
+			if ctx.Resolved == nil {
+				ctx.Resolved = map[string]net.IP{}
+			}
+			ctx.Resolved[host] = a.Resolved
+		}
+		return a.Road
 	}
+	ctx.Match = ""
 	c := r.Raw.Road(ctx, host)
-	r.Lru.Set(host, c)
+	e := RouterCacheEntry{Compress: ctx.Compress, Match: ctx.Match, Road: c}
+	if ctx.Resolved != nil && ctx.Resolved[host] != nil {
+		e.Resolved = ctx.Resolved[host]
+		e.Until = time.Now().Add(Conf.RouterResolvedTtl)
+	}
+	r.Lru.Set(host, e)
 	return c
 }
 
 // NewRouterCache returns a new Cache object.
 func NewRouterCache(r Router) *RouterCache {
 	return &RouterCache{
-		Lru: lru.New[string, Road](Conf.RouterLruSize),
+		Lru: lru.New[string, RouterCacheEntry](Conf.RouterLruSize),
 		Raw: r,
 	}
 }
@@ -823,36 +4653,64 @@ func NewRouterChain(router ...Router) *RouterChain {
 // L(ocale) means using locale network
 // R(emote) means using remote network
 // B(anned) means to block it
+// S(ilent) means to block it, but the connection is accepted and then silently dropped
+// N(otice) means to block it, and a "blocked by policy" page is returned for http
+//
+// A R line may end with the option compress, for example, R *.example.com compress. The streams to the hosts are then
+// compressed between the client and the server, which helps text-heavy traffic on thin links. It does nothing for
+// destinations whose traffic is already encrypted or compressed, so it is off unless given.
 type RouterRules struct {
 	L []string
 	R []string
 	B []string
+	S []string
+	N []string
+	// C is the globs of R with the compress option.
+	C []string
+	M *sync.RWMutex
 }
 
 // Road implements daze.Router.
 func (r *RouterRules) Road(ctx *Context, host string) Road {
+	r.M.RLock()
+	defer r.M.RUnlock()
 	for _, e := range r.L {
 		if doa.Try(filepath.Match(e, host)) {
+			ctx.Match = "rule L " + e
 			return RoadLocale
 		}
 	}
 	for _, e := range r.R {
 		if doa.Try(filepath.Match(e, host)) {
+			ctx.Match = "rule R " + e
+			ctx.Compress = slices.Contains(r.C, e)
 			return RoadRemote
 		}
 	}
 	for _, e := range r.B {
 		if doa.Try(filepath.Match(e, host)) {
+			ctx.Match = "rule B " + e
 			return RoadFucked
 		}
 	}
+	for _, e := range r.S {
+		if doa.Try(filepath.Match(e, host)) {
+			ctx.Match = "rule S " + e
+			return RoadSilent
+		}
+	}
+	for _, e := range r.N {
+		if doa.Try(filepath.Match(e, host)) {
+			ctx.Match = "rule N " + e
+			return RoadNotice
+		}
+	}
 	return RoadPuzzle
 }
 
-// FromFile loads a RULE file.
-func (r *RouterRules) FromFile(name string) {
-	f := doa.Try(OpenFile(name))
-	defer f.Close()
+// FromReader loads rules from a reader, they are appended to the current rules.
+func (r *RouterRules) FromReader(f io.Reader) error {
+	n := NewRouterRules()
 	s := bufio.NewScanner(f)
 	for s.Scan() {
 		line := s.Text()
@@ -863,14 +4721,65 @@ func (r *RouterRules) FromFile(name string) {
 		switch seps[0] {
 		case "#":
 		case "L":
-			r.L = append(r.L, seps[1:]...)
+			n.L = append(n.L, seps[1:]...)
 		case "R":
-			r.R = append(r.R, seps[1:]...)
+			globs := seps[1:]
+			if seps[len(seps)-1] == "compress" {
+				globs = seps[1 : len(seps)-1]
+				n.C = append(n.C, globs...)
+			}
+			n.R = append(n.R, globs...)
 		case "B":
-			r.B = append(r.B, seps[1:]...)
+			n.B = append(n.B, seps[1:]...)
+		case "S":
+			n.S = append(n.S, seps[1:]...)
+		case "N":
+			n.N = append(n.N, seps[1:]...)
 		}
 	}
-	doa.Nil(s.Err())
+	if err := s.Err(); err != nil {
+		return err
+	}
+	r.M.Lock()
+	defer r.M.Unlock()
+	r.L = append(r.L, n.L...)
+	r.R = append(r.R, n.R...)
+	r.B = append(r.B, n.B...)
+	r.S = append(r.S, n.S...)
+	r.N = append(r.N, n.N...)
+	r.C = append(r.C, n.C...)
+	return nil
+}
+
+// FromFile loads a RULE file.
+func (r *RouterRules) FromFile(name string) {
+	f := doa.Try(OpenFile(name))
+	defer f.Close()
+	doa.Nil(r.FromReader(f))
+}
+
+// FromSource loads rules from the source, the previous rules are replaced. On error, the previous rules are kept.
+func (r *RouterRules) FromSource(src RuleSource) error {
+	f, err := src.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n := NewRouterRules()
+	if err := n.FromReader(f); err != nil {
+		return err
+	}
+	r.M.Lock()
+	defer r.M.Unlock()
+	r.L, r.R, r.B, r.S, r.N, r.C = n.L, n.R, n.B, n.S, n.N, n.C
+	return nil
+}
+
+// Len returns the number of rules.
+func (r *RouterRules) Len() int {
+	r.M.RLock()
+	defer r.M.RUnlock()
+	return len(r.L) + len(r.R) + len(r.B) + len(r.S) + len(r.N)
 }
 
 // NewRouterRules returns a new RoaderRules.
@@ -879,11 +4788,283 @@ func NewRouterRules() *RouterRules {
 		L: []string{},
 		R: []string{},
 		B: []string{},
+		S: []string{},
+		N: []string{},
+		C: []string{},
+		M: &sync.RWMutex{},
+	}
+}
+
+// RuleSource provides the content of a RULE file. Rules can be distributed from a central place, and clients reload
+// them at regular intervals.
+type RuleSource interface {
+	// Open returns the current content of the source.
+	Open() (io.ReadCloser, error)
+}
+
+// RuleSourceFile is a local RULE file.
+type RuleSourceFile struct {
+	Name string
+}
+
+// Open implements daze.RuleSource.
+func (r *RuleSourceFile) Open() (io.ReadCloser, error) {
+	return os.Open(r.Name)
+}
+
+// RuleSourceData is a RULE file in memory, for example, rules read from stdin or from a config file.
+type RuleSourceData struct {
+	Data []byte
+}
+
+// Open implements daze.RuleSource.
+func (r *RuleSourceData) Open() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(r.Data)), nil
+}
+
+// RuleSourceMerge merges the sources in order.
+type RuleSourceMerge []RuleSource
+
+// Open implements daze.RuleSource.
+func (r RuleSourceMerge) Open() (io.ReadCloser, error) {
+	b := []byte{}
+	for _, e := range r {
+		f, err := e.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, data...)
+		b = append(b, '\n')
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// RuleSourceHTTP is a RULE file served over http. A key of a kv store with an http api works as well, for example,
+// http://127.0.0.1:8500/v1/kv/daze/rule.ls?raw for consul.
+type RuleSourceHTTP struct {
+	Client *http.Client
+	Url    string
+}
+
+// Open implements daze.RuleSource.
+func (r *RuleSourceHTTP) Open() (io.ReadCloser, error) {
+	resp, err := r.Client.Get(r.Url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("daze: %s returns %s", r.Url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// RuleSourceDir merges the fragments in a directory in lexical order, for example, a 00-base.ls shipped to everyone
+// and a 50-team.ls maintained by a team.
+type RuleSourceDir struct {
+	Name string
+	// Pattern selects the fragments, it is *.ls by default.
+	Pattern string
+}
+
+// Open implements daze.RuleSource.
+func (r *RuleSourceDir) Open() (io.ReadCloser, error) {
+	// Glob returns the names in lexical order.
+	l, err := filepath.Glob(filepath.Join(r.Name, r.Pattern))
+	if err != nil {
+		return nil, err
+	}
+	b := []byte{}
+	for _, e := range l {
+		data, err := os.ReadFile(e)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, data...)
+		b = append(b, '\n')
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// NewRuleSource returns a source by the form of the name, which is an http(s) url, a directory, a file, or - for stdin.
+func NewRuleSource(name string) RuleSource {
+	if name == "-" {
+		// Stdin can only be read once, reloads get the same rules.
+		return &RuleSourceData{Data: doa.Try(io.ReadAll(os.Stdin))}
+	}
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		return &RuleSourceHTTP{Client: &http.Client{Timeout: time.Minute}, Url: name}
+	}
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		return &RuleSourceDir{Name: name, Pattern: "*.ls"}
+	}
+	return &RuleSourceFile{Name: name}
+}
+
+// RouterHosts blocks hosts in blocklists, for example, the lists used by ad blockers like Pi-hole. Both hosts format
+// and domain list format are supported. A host is blocked if itself or any of its parent domains is in the blocklists.
+//
+// This is a hosts format blocklist:
+// 0.0.0.0 ads.example.com
+// 0.0.0.0 tracker.example.com
+//
+// This is a domain list format blocklist:
+// ads.example.com
+// tracker.example.com
+type RouterHosts struct {
+	B map[string]struct{}
+	M *sync.RWMutex
+	// Mode is the road returned for blocked hosts, it is one of RoadFucked, RoadSilent or RoadNotice.
+	Mode Road
+}
+
+// Road implements daze.Router.
+func (r *RouterHosts) Road(ctx *Context, host string) Road {
+	r.M.RLock()
+	defer r.M.RUnlock()
+	for {
+		if _, b := r.B[host]; b {
+			ctx.Match = "hosts " + host
+			return r.Mode
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return RoadPuzzle
+		}
+		host = host[i+1:]
+	}
+}
+
+// FromFile loads blocklists, the previous blocklists will be replaced.
+func (r *RouterHosts) FromFile(name ...string) {
+	b := map[string]struct{}{}
+	for _, e := range name {
+		f := doa.Try(OpenFile(e))
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line, _, _ := strings.Cut(s.Text(), "#")
+			seps := strings.Fields(line)
+			if len(seps) == 0 {
+				continue
+			}
+			if net.ParseIP(seps[0]) != nil {
+				seps = seps[1:]
+			}
+			for _, e := range seps {
+				switch e {
+				case "broadcasthost", "local", "localhost", "localhost.localdomain":
+					continue
+				}
+				b[strings.ToLower(e)] = struct{}{}
+			}
+		}
+		doa.Nil(s.Err())
+		f.Close()
+	}
+	r.M.Lock()
+	r.B = b
+	r.M.Unlock()
+}
+
+// Sync reloads blocklists at regular intervals. Errors during reloading are logged and the old blocklists are kept.
+func (r *RouterHosts) Sync(interval time.Duration, name ...string) {
+	go func() {
+		for range time.Tick(interval) {
+			err := func() (err error) {
+				defer func() {
+					if e := recover(); e != nil {
+						err = fmt.Errorf("%v", e)
+					}
+				}()
+				r.FromFile(name...)
+				return nil
+			}()
+			if err != nil {
+				log.Println("daze:", err)
+				continue
+			}
+			log.Println("daze: reload blocklists", strings.Join(name, ","))
+		}
+	}()
+}
+
+// NewRouterHosts returns a new RouterHosts.
+func NewRouterHosts() *RouterHosts {
+	return &RouterHosts{
+		B:    map[string]struct{}{},
+		M:    &sync.RWMutex{},
+		Mode: RoadFucked,
+	}
+}
+
+// Assist reclassifies a host to RoadRemote for a while after direct dials to it fail consecutively. It handles hosts
+// that are blocked by ip, but are routed to the local network by the cidr list.
+type Assist struct {
+	// Fails is the number of consecutive failures before a host is reclassified.
+	Fails int
+	Lru   *lru.Lru[string, *AssistEntry]
+	M     *sync.Mutex
+	Ttl   time.Duration
+}
+
+// AssistEntry is the state of a host.
+type AssistEntry struct {
+	Fails int
+	Until time.Time
+}
+
+// Remote reports whether the host is reclassified to RoadRemote.
+func (a *Assist) Remote(host string) bool {
+	a.M.Lock()
+	defer a.M.Unlock()
+	e, ok := a.Lru.GetExists(host)
+	return ok && time.Now().Before(e.Until)
+}
+
+// Fail records a failed direct dial to the host, it reports whether the host is reclassified by this failure.
+func (a *Assist) Fail(host string) bool {
+	a.M.Lock()
+	defer a.M.Unlock()
+	e, ok := a.Lru.GetExists(host)
+	if !ok {
+		e = &AssistEntry{}
+		a.Lru.Set(host, e)
+	}
+	e.Fails++
+	if e.Fails < a.Fails {
+		return false
+	}
+	e.Fails = 0
+	e.Until = time.Now().Add(a.Ttl)
+	return true
+}
+
+// Pass records a successful direct dial to the host.
+func (a *Assist) Pass(host string) {
+	a.Lru.Del(host)
+}
+
+// NewAssist returns a new Assist.
+func NewAssist(fails int, ttl time.Duration) *Assist {
+	return &Assist{
+		Fails: fails,
+		Lru:   lru.New[string, *AssistEntry](Conf.RouterLruSize),
+		M:     &sync.Mutex{},
+		Ttl:   ttl,
 	}
 }
 
 // Aimbot automatically distinguish whether to use a proxy or a local network.
 type Aimbot struct {
+	// Assist retries failed direct dials through the proxy if it is not nil.
+	Assist *Assist
+	// Expv records the dial latency and the number of failures per road if it is not nil.
+	Expv   *Expv
 	Remote Dialer
 	Locale Dialer
 	Router Router
@@ -896,35 +5077,141 @@ func (s *Aimbot) Dial(ctx *Context, network string, address string) (io.ReadWrit
 		err error
 		rwc io.ReadWriteCloser
 		tag Road
+		now = time.Now()
 	)
 	log.Printf("conn: %08x   dial network=%s address=%s", ctx.Cid, network, address)
 	dst, _, err = net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
+	ctx.Match = ""
 	tag = s.Router.Road(ctx, dst)
-	log.Printf("conn: %08x  route road=%s", ctx.Cid, tag)
+	if tag == RoadLocale && s.Assist != nil && s.Assist.Remote(dst) {
+		tag = RoadRemote
+		ctx.Match = "assist"
+		log.Printf("conn: %08x assist road=%s", ctx.Cid, tag)
+	}
+	log.Printf("conn: %08x  route road=%s match=%s", ctx.Cid, tag, ctx.Match)
 	switch tag {
 	case RoadLocale:
 		rwc, err = s.Locale.Dial(ctx, network, address)
+		if s.Assist == nil {
+			break
+		}
+		if err == nil {
+			s.Assist.Pass(dst)
+			break
+		}
+		if s.Assist.Fail(dst) {
+			// Direct failed, retried remote.
+			log.Printf("conn: %08x  error %s", ctx.Cid, err)
+			if s.Expv != nil {
+				s.Expv.M.Add("fail."+tag.String(), 1)
+			}
+			tag = RoadRemote
+			log.Printf("conn: %08x assist road=%s", ctx.Cid, tag)
+			now = time.Now()
+			rwc, err = s.Remote.Dial(ctx, network, address)
+		}
 	case RoadRemote:
 		rwc, err = s.Remote.Dial(ctx, network, address)
 	case RoadFucked:
-		err = fmt.Errorf("conn: %s has been blocked", dst)
+		err = fmt.Errorf("conn: %s has been %w", dst, ErrBlocked)
+	case RoadSilent:
+		rwc = NewBlackhole()
+	case RoadNotice:
+		rwc = NewNotice(dst)
 	case RoadPuzzle:
 		rwc, err = s.Remote.Dial(ctx, network, address)
 	}
 	if err == nil {
 		log.Printf("conn: %08x  estab", ctx.Cid)
+		if s.Expv != nil {
+			s.Expv.Histogram("dial." + tag.String()).Observe(time.Since(now))
+		}
+	}
+	if err != nil && s.Expv != nil {
+		s.Expv.M.Add("fail."+tag.String(), 1)
+		// Tell why the server rejects the connection.
+		for _, e := range []error{ErrBlocked, ErrLimited, ErrUnreachable} {
+			if errors.Is(err, e) {
+				s.Expv.M.Add("fail."+e.Error(), 1)
+			}
+		}
 	}
 	return rwc, err
 }
 
+// Bind waits for a connection from the address with the dialer of the road of the address. Servers of daze can not
+// wait for connections, so it only works for the roads which go directly, or through a dialer which is a daze.Binder.
+func (s *Aimbot) Bind(ctx *Context, address string) (Bound, error) {
+	log.Printf("conn: %08x   bind address=%s", ctx.Cid, address)
+	dst, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Match = ""
+	tag := s.Router.Road(ctx, dst)
+	log.Printf("conn: %08x  route road=%s match=%s", ctx.Cid, tag, ctx.Match)
+	var dialer Dialer
+	switch tag {
+	case RoadLocale:
+		dialer = s.Locale
+	case RoadRemote, RoadPuzzle:
+		dialer = s.Remote
+	case RoadFucked:
+		return nil, fmt.Errorf("conn: %s has been %w", dst, ErrBlocked)
+	}
+	b, ok := dialer.(Binder)
+	if !ok {
+		return nil, ErrBindUnsupported
+	}
+	return b.Bind(ctx, address)
+}
+
+// Cone implements daze.Coner. Only datagrams to destinations which go directly can be sent from a shared socket.
+func (s *Aimbot) Cone(ctx *Context, address string) (net.Addr, error) {
+	dst, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Match = ""
+	tag := s.Router.Road(ctx, dst)
+	c, ok := s.Locale.(Coner)
+	if tag != RoadLocale || !ok {
+		return nil, ErrConeUnsupported
+	}
+	log.Printf("conn: %08x  route road=%s match=%s cone=true", ctx.Cid, tag, ctx.Match)
+	return c.Cone(ctx, address)
+}
+
+// ListenCone implements daze.Coner.
+func (s *Aimbot) ListenCone(ctx *Context) (net.PacketConn, error) {
+	c, ok := s.Locale.(Coner)
+	if !ok {
+		return nil, ErrConeUnsupported
+	}
+	return c.ListenCone(ctx)
+}
+
 // AimbotOption provides configuration for quick initialization of Aimbot.
 type AimbotOption struct {
 	Type string
+	// Rule is a RULE file, a directory of *.ls fragments, or an http(s) url, see NewRuleSource.
 	Rule string
-	Cidr string
+	// RuleInline is rules in addition to Rule, for example, rules written in a config file.
+	RuleInline string
+	// RuleSync is the interval to reload the rules, zero disables it.
+	RuleSync time.Duration
+	Cidr     string
+	// Hosts is a list of blocklists separated by commas. Blocklists take precedence over other rules, and they are
+	// reloaded every day.
+	Hosts string
+	// Assist is the number of consecutive direct failures before a host is reclassified to RoadRemote for an hour.
+	// Zero disables it.
+	Assist int
+	// Resolver is used by the router and the local network, net.DefaultResolver is used if it is nil.
+	Resolver *net.Resolver
 }
 
 // NewAimbot returns a new Aimbot.
@@ -936,6 +5223,7 @@ func NewAimbot(client Dialer, option *AimbotOption) *Aimbot {
 		}
 		if option.Type == "remote" {
 			routerLocal := NewRouterIPNet()
+			routerLocal.Resolver = option.Resolver
 			routerRight := NewRouterRight(RoadRemote)
 			routerChain := NewRouterChain(routerLocal, routerRight)
 			routerCache := NewRouterCache(routerChain)
@@ -943,27 +5231,57 @@ func NewAimbot(client Dialer, option *AimbotOption) *Aimbot {
 		}
 		if option.Type == "rule" {
 			log.Println("main: load rule", option.Rule)
+			var source RuleSource = NewRuleSource(option.Rule)
+			if option.RuleInline != "" {
+				source = RuleSourceMerge{source, &RuleSourceData{Data: []byte(option.RuleInline)}}
+			}
 			routerRules := NewRouterRules()
-			routerRules.FromFile(option.Rule)
-			log.Println("main: size is", len(routerRules.L)+len(routerRules.R)+len(routerRules.B))
+			doa.Nil(routerRules.FromSource(source))
+			log.Println("main: size is", routerRules.Len())
 
 			log.Println("main: load rule", option.Cidr)
 			routerLocal := NewRouterIPNet()
+			routerLocal.Resolver = option.Resolver
 			routerLocal.FromFile(option.Cidr)
 			log.Println("main: size is", len(routerLocal.L)+len(routerLocal.R)+len(routerLocal.B))
 
 			routerRight := NewRouterRight(RoadRemote)
 			routerChain := NewRouterChain(routerRules, routerLocal, routerRight)
 			routerCache := NewRouterCache(routerChain)
+			if option.RuleSync != 0 {
+				go func() {
+					for range time.Tick(option.RuleSync) {
+						if err := routerRules.FromSource(source); err != nil {
+							log.Println("main:", err)
+							continue
+						}
+						// Routes cached by the old rules are stale.
+						routerCache.Lru.Purge()
+						log.Println("main: reload rule", option.Rule, "size is", routerRules.Len())
+					}
+				}()
+			}
 			return routerCache
 		}
 		panic("unreachable")
 	}()
-	return &Aimbot{
+	if option.Hosts != "" {
+		log.Println("main: load blocklists", option.Hosts)
+		routerHosts := NewRouterHosts()
+		routerHosts.FromFile(strings.Split(option.Hosts, ",")...)
+		routerHosts.Sync(time.Hour*24, strings.Split(option.Hosts, ",")...)
+		log.Println("main: size is", len(routerHosts.B))
+		router = NewRouterChain(routerHosts, router)
+	}
+	aimbot := &Aimbot{
 		Remote: client,
-		Locale: &Direct{},
+		Locale: &Direct{Resolver: option.Resolver},
 		Router: router,
 	}
+	if option.Assist != 0 {
+		aimbot.Assist = NewAssist(option.Assist, time.Hour)
+	}
+	return aimbot
 }
 
 // ============================================================================
@@ -982,15 +5300,109 @@ func NewAimbot(client Dialer, option *AimbotOption) *Aimbot {
 
 // Check interface implementation.
 var (
-	_ Dialer = (*Aimbot)(nil)
-	_ Dialer = (*Direct)(nil)
-	_ Router = (*RouterCache)(nil)
-	_ Router = (*RouterChain)(nil)
-	_ Router = (*RouterIPNet)(nil)
-	_ Router = (*RouterRight)(nil)
-	_ Router = (*RouterRules)(nil)
+	_ Classifier   = (*Sniffer)(nil)
+	_ Dialer       = (*Aimbot)(nil)
+	_ Dialer       = (*Direct)(nil)
+	_ Dialer       = (DialerFunc)(nil)
+	_ Dialer       = (*Engine)(nil)
+	_ Dialer       = (*Inspector)(nil)
+	_ Dialer       = (*Locale)(nil)
+	_ Dialer       = (*Netem)(nil)
+	_ Dialer       = (*SocksDialer)(nil)
+	_ Dialer       = (*TunnelDialer)(nil)
+	_ net.Conn     = (*Cstub)(nil)
+	_ net.Conn     = (*DemuxConn)(nil)
+	_ net.Conn     = (*ResolverMeterConn)(nil)
+	_ net.Conn     = (*ResolverMeterPacketConn)(nil)
+	_ net.Listener = (*AllowListener)(nil)
+	_ net.Listener = (*BanListener)(nil)
+	_ net.Listener = (*DemuxListener)(nil)
+	_ Hook         = (*AuditHook)(nil)
+	_ Hook         = (*Ban)(nil)
+	_ Hook         = (*Expv)(nil)
+	_ Hook         = (*HookChain)(nil)
+	_ Hook         = (*HookLimit)(nil)
+	_ Hook         = (*HookRate)(nil)
+	_ Hook         = (*TelemetryHook)(nil)
+	_ Hook         = (*Tracer)(nil)
+	_ Router       = (*RouterCache)(nil)
+	_ Router       = (*RouterChain)(nil)
+	_ Router       = (*RouterHosts)(nil)
+	_ Router       = (*RouterIPNet)(nil)
+	_ Router       = (*RouterRight)(nil)
+	_ Router       = (*RouterRules)(nil)
 )
 
+// Listen returns the listener if it is not nil, otherwise it listens on the tcp address. Servers use it so that they
+// can run on a listener shared by Demux.
+func Listen(l net.Listener, address string) (net.Listener, error) {
+	if l != nil {
+		return l, nil
+	}
+	return net.Listen("tcp", address)
+}
+
+// AllowListener only accepts connections from the networks in its allow-list. Others are reset as soon as they are
+// accepted, before any byte of a protocol is exchanged, so the server reveals nothing about itself to them.
+type AllowListener struct {
+	net.Listener
+	L []*net.IPNet
+}
+
+// Accept implements net.Listener.
+func (a *AllowListener) Accept() (net.Conn, error) {
+	for {
+		cli, err := a.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if a.Allowed(cli.RemoteAddr()) {
+			return cli, nil
+		}
+		log.Println("daze: reject", cli.RemoteAddr(), "not in the allow-source")
+		if c, ok := cli.(*net.TCPConn); ok {
+			c.SetLinger(0)
+		}
+		cli.Close()
+	}
+}
+
+// Allowed reports whether the address is in the allow-list.
+func (a *AllowListener) Allowed(addr net.Addr) bool {
+	source := addr.String()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return false
+	}
+	for _, e := range a.L {
+		if e.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAllowListener returns a new AllowListener. Networks are separated by commas, a bare ip is a network of the ip
+// only.
+func NewAllowListener(l net.Listener, cidrs string) (*AllowListener, error) {
+	a := &AllowListener{Listener: l, L: []*net.IPNet{}}
+	for _, e := range strings.Split(cidrs, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		n, err := BanParse(e)
+		if err != nil {
+			return nil, err
+		}
+		a.L = append(a.L, n)
+	}
+	return a, nil
+}
+
 // Dial connects to the address on the named network.
 func Dial(network string, address string) (net.Conn, error) {
 	d := net.Dialer{
@@ -999,6 +5411,17 @@ func Dial(network string, address string) (net.Conn, error) {
 	return d.Dial(network, address)
 }
 
+// Keepalive makes the kernel probe the tcp connection once it has been idle for d, and every d after, so that
+// stateful firewalls and nat devices along the path don't silently drop a long-lived idle connection. It does nothing
+// if d is zero or the connection is not a tcp connection.
+func Keepalive(conn io.ReadWriteCloser, d time.Duration) {
+	c, ok := conn.(*net.TCPConn)
+	if !ok || d == 0 {
+		return
+	}
+	c.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: d, Interval: d})
+}
+
 // GravityReader wraps an io.Reader with RC4 crypto.
 func GravityReader(r io.Reader, k []byte) io.Reader {
 	cr := doa.Try(rc4.NewCipher(k))
@@ -1022,12 +5445,342 @@ func Gravity(conn io.ReadWriteCloser, k []byte) io.ReadWriteCloser {
 	}
 }
 
-// OpenFile select the appropriate method to open the file based on the incoming args automatically.
+// FlateWriter compresses the data by deflate, each write is flushed so that interactive traffic is not held back.
+type FlateWriter struct {
+	W *flate.Writer
+}
+
+// Write implements io.Writer.
+func (f *FlateWriter) Write(p []byte) (int, error) {
+	n, err := f.W.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.W.Flush()
+}
+
+// Compress wraps a connection by deflate in both directions. The best speed is used, since the link is usually
+// slower than the cpu in the first place.
+func Compress(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	return &ReadWriteCloser{
+		Reader: flate.NewReader(conn),
+		Writer: &FlateWriter{W: doa.Try(flate.NewWriter(conn, flate.BestSpeed))},
+		Closer: conn,
+	}
+}
+
+// GravitySplit is Gravity with a key for each direction. The keys are derived from the key by hkdf-sha256 with the
+// direction as info, so that the two directions never share a keystream and xoring them reveals nothing.
+func GravitySplit(conn io.ReadWriteCloser, k []byte, client bool) io.ReadWriteCloser {
+	c2s := make([]byte, 32)
+	s2c := make([]byte, 32)
+	doa.Try(io.ReadFull(hkdf.New(sha256.New, k, nil, []byte("daze c2s")), c2s))
+	doa.Try(io.ReadFull(hkdf.New(sha256.New, k, nil, []byte("daze s2c")), s2c))
+	if !client {
+		c2s, s2c = s2c, c2s
+	}
+	return &ReadWriteCloser{
+		Reader: GravityReader(conn, s2c),
+		Writer: GravityWriter(conn, c2s),
+		Closer: conn,
+	}
+}
+
+// Token returns the password of the access token which expires after the day, given in the form of time.DateOnly. It is
+// derived from the master secret by hkdf-sha256 with the day as info, so that servers holding the master secret accept
+// tokens without knowing them in advance, and tokens can be shared without revealing the master secret.
+func Token(master string, day string) string {
+	buf := make([]byte, 16)
+	doa.Try(io.ReadFull(hkdf.New(sha256.New, []byte(master), nil, []byte("daze token "+day)), buf))
+	return hex.EncodeToString(buf)
+}
+
+// SealReader opens the chunks of a stream sealed by a SealWriter. Each chunk is the sealed big endian length of the
+// payload followed by the sealed payload. Nonces are counters of the opened messages, prefixed by the side which
+// sealed them, so the same key can be used in both directions.
+type SealReader struct {
+	A cipher.AEAD
+	B []byte
+	N []byte
+	R io.Reader
+}
+
+// Open opens a message of n bytes sealed and increases the nonce.
+func (s *SealReader) Open(n int) ([]byte, error) {
+	buf := make([]byte, n+s.A.Overhead())
+	_, err := io.ReadFull(s.R, buf)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = s.A.Open(buf[:0], s.N, buf, nil)
+	if err != nil {
+		return nil, errors.New("daze: message authentication failed")
+	}
+	binary.BigEndian.PutUint64(s.N[4:], binary.BigEndian.Uint64(s.N[4:])+1)
+	return buf, nil
+}
+
+// Read implements io.Reader.
+func (s *SealReader) Read(p []byte) (int, error) {
+	if len(s.B) == 0 {
+		buf, err := s.Open(2)
+		if err != nil {
+			return 0, err
+		}
+		s.B, err = s.Open(int(binary.BigEndian.Uint16(buf)))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.B)
+	s.B = s.B[n:]
+	return n, nil
+}
+
+// NewSealReader returns a new SealReader. The side is the side of the writer, 0 for the client and 1 for the server.
+func NewSealReader(r io.Reader, key []byte, side byte) *SealReader {
+	return &SealReader{A: SealAead(key), N: SealNonce(side), R: r}
+}
+
+// SealWriter seals data written to it in chunks. See SealReader for the format.
+type SealWriter struct {
+	A cipher.AEAD
+	B []byte
+	N []byte
+	W io.Writer
+}
+
+// Seal appends a sealed message to the buffer and increases the nonce.
+func (s *SealWriter) Seal(p []byte) {
+	s.B = s.A.Seal(s.B, s.N, p, nil)
+	binary.BigEndian.PutUint64(s.N[4:], binary.BigEndian.Uint64(s.N[4:])+1)
+}
+
+// Write implements io.Writer.
+func (s *SealWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m := min(len(p), Conf.SealChunkSize)
+		s.B = s.B[:0]
+		s.Seal(binary.BigEndian.AppendUint16(nil, uint16(m)))
+		s.Seal(p[:m])
+		// The length and the payload are written at once, so they are likely to be in the same packet.
+		_, err := s.W.Write(s.B)
+		if err != nil {
+			return n, err
+		}
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// NewSealWriter returns a new SealWriter. The side is 0 for the client and 1 for the server.
+func NewSealWriter(w io.Writer, key []byte, side byte) *SealWriter {
+	return &SealWriter{A: SealAead(key), N: SealNonce(side), W: w}
+}
+
+// SealAead returns the aes-256-gcm aead of a key of any length, which is hashed into 256 bits.
+func SealAead(key []byte) cipher.AEAD {
+	k := sha256.Sum256(key)
+	return doa.Try(cipher.NewGCM(doa.Try(aes.NewCipher(k[:]))))
+}
+
+// SealNonce returns the first nonce of a side.
+func SealNonce(side byte) []byte {
+	n := make([]byte, 12)
+	n[0] = side
+	return n
+}
+
+// Seal wraps a connection by aes-256-gcm, as an authenticated alternative of gravity which is fast on cpus with aes
+// instructions. The client is the side which initiates the connection. Keys must not be reused across connections.
+func Seal(conn io.ReadWriteCloser, key []byte, client bool) io.ReadWriteCloser {
+	side := map[bool]byte{true: 0, false: 1}[client]
+	return &ReadWriteCloser{
+		Reader: NewSealReader(conn, key, 1-side),
+		Writer: NewSealWriter(conn, key, side),
+		Closer: conn,
+	}
+}
+
+// SealChacha wraps a connection like Seal, but by chacha20-poly1305, which is the faster one on cpus without aes
+// instructions.
+func SealChacha(conn io.ReadWriteCloser, key []byte, client bool) io.ReadWriteCloser {
+	k := sha256.Sum256(key)
+	side := map[bool]byte{true: 0, false: 1}[client]
+	return &ReadWriteCloser{
+		Reader: &SealReader{A: doa.Try(chacha20poly1305.New(k[:])), N: SealNonce(1 - side), R: conn},
+		Writer: &SealWriter{A: doa.Try(chacha20poly1305.New(k[:])), N: SealNonce(side), W: conn},
+		Closer: conn,
+	}
+}
+
+// CipherSuite wraps a connection by an encryption scheme with a session key. The client is the side which initiates
+// the connection. Protocols pick suites by name from CipherSuites, so a new suite only needs to be registered there.
+type CipherSuite interface {
+	Wrap(conn io.ReadWriteCloser, key []byte, client bool) io.ReadWriteCloser
+}
+
+// CipherSuiteFunc is an adapter to allow the use of ordinary functions as cipher suites.
+type CipherSuiteFunc func(conn io.ReadWriteCloser, key []byte, client bool) io.ReadWriteCloser
+
+// Wrap calls f(conn, key, client).
+func (f CipherSuiteFunc) Wrap(conn io.ReadWriteCloser, key []byte, client bool) io.ReadWriteCloser {
+	return f(conn, key, client)
+}
+
+// CipherSuites is the registry of cipher suites.
+var CipherSuites = map[string]CipherSuite{
+	"aes-256-gcm":       CipherSuiteFunc(Seal),
+	"chacha20-poly1305": CipherSuiteFunc(SealChacha),
+	"rc4": CipherSuiteFunc(func(conn io.ReadWriteCloser, key []byte, client bool) io.ReadWriteCloser {
+		return Gravity(conn, key)
+	}),
+	"rc4-hkdf": CipherSuiteFunc(GravitySplit),
+}
+
+// WrapCipher wraps a connection by the cipher suite of the name.
+func WrapCipher(conn io.ReadWriteCloser, suite string, key []byte, client bool) (io.ReadWriteCloser, error) {
+	c, ok := CipherSuites[suite]
+	if !ok {
+		return nil, fmt.Errorf("daze: unknown cipher suite %s", suite)
+	}
+	return c.Wrap(conn, key, client), nil
+}
+
+// LogLimit is a writer for the log package, which limits the rate of similar lines, so that a port scan or a broken
+// client can not flood the log. Lines are similar if they only differ in numbers and connection ids. Suppressed lines
+// are summarized by Sync.
+type LogLimit struct {
+	L      map[string]*LogLimitClass
+	Mu     *sync.Mutex
+	N      uint64
+	Period time.Duration
+	W      io.Writer
+}
+
+// LogLimitClass is the state of a class of similar lines.
+type LogLimitClass struct {
+	Drop   uint64
+	Limits *rate.Limits
+	Line   string
+}
+
+// LogClass returns the class of a line, digits and connection ids are masked.
+func LogClass(line string) string {
+	b := []byte(line)
+	if i := strings.Index(line, "conn: "); i >= 0 && len(b) >= i+14 {
+		for j := i + 6; j < i+14; j++ {
+			b[j] = '#'
+		}
+	}
+	for i, c := range b {
+		if c >= '0' && c <= '9' {
+			b[i] = '#'
+		}
+	}
+	return string(b)
+}
+
+// Write implements io.Writer, p is a line of the log.
+func (l *LogLimit) Write(p []byte) (int, error) {
+	k := LogClass(string(p))
+	l.Mu.Lock()
+	c, ok := l.L[k]
+	if !ok {
+		c = &LogLimitClass{Limits: rate.NewLimits(l.N, l.Period)}
+		l.L[k] = c
+	}
+	pass := c.Limits.Peek(1)
+	if !pass {
+		c.Drop++
+		c.Line = string(bytes.TrimSpace(p))
+	}
+	l.Mu.Unlock()
+	if !pass {
+		return len(p), nil
+	}
+	return l.W.Write(p)
+}
+
+// Sync writes a summary of suppressed lines at regular intervals, and forgets the classes seen so far.
+func (l *LogLimit) Sync(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			l.Mu.Lock()
+			m := l.L
+			l.L = map[string]*LogLimitClass{}
+			l.Mu.Unlock()
+			for _, c := range m {
+				if c.Drop == 0 {
+					continue
+				}
+				fmt.Fprintf(l.W, "%s main: suppressed %d similar messages, the last is: %s\n",
+					time.Now().Format("2006/01/02 15:04:05"), c.Drop, c.Line)
+			}
+		}
+	}()
+}
+
+// NewLogLimit returns a new LogLimit, n similar lines are written per period at most.
+func NewLogLimit(w io.Writer, n uint64, period time.Duration) *LogLimit {
+	return &LogLimit{
+		L:      map[string]*LogLimitClass{},
+		Mu:     &sync.Mutex{},
+		N:      n,
+		Period: period,
+		W:      w,
+	}
+}
+
+// LogSafe is a writer for the log package, which escapes control characters in a line except its trailing newline.
+// Host names, request lines and errors may come from the network, so that a crafted one could otherwise forge log
+// lines or corrupt terminals and log parsers.
+type LogSafe struct {
+	W io.Writer
+}
+
+// Write implements io.Writer, p is a line of the log.
+func (l *LogSafe) Write(p []byte) (int, error) {
+	line := bytes.TrimSuffix(p, []byte{'\n'})
+	if !bytes.ContainsFunc(line, LogUnsafe) {
+		_, err := l.W.Write(p)
+		return len(p), err
+	}
+	buf := make([]byte, 0, len(p)+16)
+	for _, c := range line {
+		if LogUnsafe(rune(c)) {
+			buf = fmt.Appendf(buf, "\\x%02x", c)
+			continue
+		}
+		buf = append(buf, c)
+	}
+	buf = append(buf, '\n')
+	_, err := l.W.Write(buf)
+	return len(p), err
+}
+
+// LogUnsafe reports whether the byte is a control character other than the tab.
+func LogUnsafe(c rune) bool {
+	return (c < 0x20 && c != '\t') || c == 0x7f
+}
+
+// NewLogSafe returns a new LogSafe.
+func NewLogSafe(w io.Writer) *LogSafe {
+	return &LogSafe{W: w}
+}
+
+// OpenFile select the appropriate method to open the file based on the incoming args automatically, "-" is stdin.
 //
 // Examples:
 // OpenFile("/etc/hosts")
 // OpenFile("https://raw.githubusercontent.com/mohanson/daze/master/README.md")
+// OpenFile("-")
 func OpenFile(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
 	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
 		resp, err := http.Get(name)
 		if err != nil {
@@ -1056,6 +5809,87 @@ func Salt(s string) []byte {
 	return h[:]
 }
 
+// Certificate returns a self-signed certificate for the hosts, it is valid for ten years. Clients have to skip the
+// verification or pin the certificate.
+func Certificate(host ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(rand.Int64()),
+		Subject:               pkix.Name{Organization: []string{"daze"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, e := range host {
+		if ip := net.ParseIP(e); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, e)
+		}
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// ClientAuth makes the tls config require client certificates issued by the certificate authorities in the pem file,
+// so that only devices holding an issued certificate can complete the handshake.
+func ClientAuth(conf *tls.Config, name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("daze: no certificates in %s", name)
+	}
+	conf.ClientCAs = pool
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// Verify checks the detached signature of a file. The signature is the ed25519 signature of the sha256 hash of the
+// file, encoded in hex, and is stored next to the file with a ".sig" suffix. Both local files and urls are accepted.
+func Verify(key ed25519.PublicKey, name string) error {
+	if len(key) != ed25519.PublicKeySize {
+		return errors.New("daze: invalid public key")
+	}
+	f, err := OpenFile(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	g, err := OpenFile(name + ".sig")
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	data, err := io.ReadAll(io.LimitReader(g, 1024))
+	if err != nil {
+		return err
+	}
+	sign, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, h.Sum(nil), sign) {
+		return errors.New("daze: signature mismatch")
+	}
+	return nil
+}
+
 // ============================================================================
 //                 ___           ___           ___           ___
 //                /\  \         /\  \         /\  \         /\  \
@@ -1165,6 +5999,174 @@ func LoadReservedIP() []*net.IPNet {
 //                           \/__/         \/__/                     Isometric1
 // ============================================================================
 
+// Nameserver is a tiny DNS server, which answers A and AAAA queries by names loaded from hosts files. It is used by
+// tests, and by the offline mode where configured names are resolved without any network. Names not found are
+// answered with NXDOMAIN.
+type Nameserver struct {
+	Closer io.Closer
+	Listen string
+	M      map[string][]net.IP
+	Mu     *sync.RWMutex
+	// Ttl is the time to live of answers.
+	Ttl time.Duration
+}
+
+// Add adds addresses to the name.
+func (n *Nameserver) Add(name string, ip ...net.IP) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	n.Mu.Lock()
+	n.M[name] = append(n.M[name], ip...)
+	n.Mu.Unlock()
+}
+
+// FromFile loads names in hosts format, for example, /etc/hosts. Names loaded before are kept.
+func (n *Nameserver) FromFile(name string) error {
+	f, err := OpenFile(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		seps := strings.Fields(line)
+		if len(seps) < 2 {
+			continue
+		}
+		ip := net.ParseIP(seps[0])
+		if ip == nil {
+			return fmt.Errorf("daze: invalid address %s", seps[0])
+		}
+		for _, e := range seps[1:] {
+			n.Add(e, ip)
+		}
+	}
+	return s.Err()
+}
+
+// Answer returns the response to a query in DNS wire format, or nil if the query is malformed.
+func (n *Nameserver) Answer(req []byte) []byte {
+	name, qtype, end := DnsQuestion(req)
+	if end == 0 {
+		return nil
+	}
+	// Copy the header and the question, additional records such as EDNS0 are dropped.
+	ret := append([]byte{}, req[:end]...)
+	// Set QR and AA, keep opcode and RD, and set RA.
+	ret[2] = 0x84 | req[2]&0x79
+	ret[3] = 0x80
+	clear(ret[6:12])
+	n.Mu.RLock()
+	ips, ok := n.M[name]
+	n.Mu.RUnlock()
+	if !ok {
+		ret[3] |= 0x03
+		return ret
+	}
+	cnt := uint16(0)
+	for _, ip := range ips {
+		rtype := uint16(28)
+		data := ip.To16()
+		if ip.To4() != nil {
+			rtype = 1
+			data = ip.To4()
+		}
+		if rtype != qtype {
+			continue
+		}
+		ret = append(ret, 0xc0, 0x0c)
+		ret = binary.BigEndian.AppendUint16(ret, rtype)
+		ret = binary.BigEndian.AppendUint16(ret, 1)
+		ret = binary.BigEndian.AppendUint32(ret, uint32(n.Ttl.Seconds()))
+		ret = binary.BigEndian.AppendUint16(ret, uint16(len(data)))
+		ret = append(ret, data...)
+		cnt++
+	}
+	binary.BigEndian.PutUint16(ret[6:8], cnt)
+	return ret
+}
+
+// Run it on UDP.
+func (n *Nameserver) UDP() error {
+	conn, err := net.ListenPacket("udp", n.Listen)
+	if err != nil {
+		return err
+	}
+	n.Closer = conn
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			l, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if ret := n.Answer(buf[:l]); ret != nil {
+				conn.WriteTo(ret, addr)
+			}
+		}
+	}()
+	return nil
+}
+
+// Resolver returns a resolver which asks the nameserver in memory, no packets are sent.
+func (n *Nameserver) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := &Cstub{
+				Nameserver: n,
+				Buffer:     bytes.NewBuffer([]byte{}),
+			}
+			return conn, nil
+		},
+	}
+}
+
+// Close listener.
+func (n *Nameserver) Close() error {
+	if n.Closer != nil {
+		return n.Closer.Close()
+	}
+	return nil
+}
+
+// NewNameserver returns a new Nameserver.
+func NewNameserver(listen string) *Nameserver {
+	return &Nameserver{
+		Listen: listen,
+		M:      map[string][]net.IP{},
+		Mu:     &sync.RWMutex{},
+		Ttl:    time.Minute,
+	}
+}
+
+// Cstub structure answers queries by a nameserver in memory, it is used like Cdoh.
+type Cstub struct {
+	Nameserver *Nameserver
+	Buffer     *bytes.Buffer
+}
+
+func (c Cstub) Read(b []byte) (n int, err error)   { return c.Buffer.Read(b) }
+func (c Cstub) Close() error                       { return nil }
+func (c Cstub) LocalAddr() net.Addr                { return nil }
+func (c Cstub) RemoteAddr() net.Addr               { return nil }
+func (c Cstub) SetDeadline(t time.Time) error      { return nil }
+func (c Cstub) SetReadDeadline(t time.Time) error  { return nil }
+func (c Cstub) SetWriteDeadline(t time.Time) error { return nil }
+func (c Cstub) Write(b []byte) (n int, err error) {
+	size := int(binary.BigEndian.Uint16(b[:2]))
+	doa.Doa(size == len(b)-2)
+	ret := c.Nameserver.Answer(b[2:])
+	if ret == nil {
+		return len(b), nil
+	}
+	data := make([]byte, 2+len(ret))
+	binary.BigEndian.PutUint16(data[:2], uint16(len(ret)))
+	copy(data[2:], ret)
+	c.Buffer.Write(data)
+	return len(b), nil
+}
+
 // A remote server for testing.
 type Tester struct {
 	Listen string
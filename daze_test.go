@@ -3,14 +3,46 @@ package daze
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mohanson/daze/lib/doa"
+	"github.com/mohanson/daze/lib/rate"
 )
 
 const (
 	DazeServerListenOn = "127.0.0.1:28080"
+	EchoServerListenOn = "127.0.0.1:28081"
+	DnssServerListenOn = "127.0.0.1:28053"
 	CurlDest           = "https://www.zhihu.com"
 )
 
@@ -62,14 +94,175 @@ func TestLocaleSocks5(t *testing.T) {
 	}
 }
 
+// LocaleAssociate asks the socks5 server at listen for a udp association, and returns the control connection and a
+// socket connected to the relay.
+func LocaleAssociate(listen string) (net.Conn, *net.UDPConn) {
+	cli := doa.Try(net.Dial("tcp", listen))
+	doa.Try(cli.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}))
+	buf := make([]byte, 12)
+	doa.Try(io.ReadFull(cli, buf))
+	doa.Doa(buf[1] == 0x00 && buf[3] == 0x00)
+	bnd := doa.Try(net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(
+		netip.MustParseAddr("127.0.0.1"), binary.BigEndian.Uint16(buf[10:12])))))
+	return cli, bnd
+}
+
+// LocaleUDPHead returns the header of a socks5 udp datagram to the address.
+func LocaleUDPHead(address string) []byte {
+	addr := netip.MustParseAddrPort(address)
+	head := append([]byte{0x00, 0x00, 0x00, 0x01}, addr.Addr().AsSlice()...)
+	return binary.BigEndian.AppendUint16(head, addr.Port())
+}
+
+func TestLocaleSocks5UDP(t *testing.T) {
+	remote := NewTester(EchoServerListenOn)
+	defer remote.Close()
+	remote.UDP()
+
+	locale := NewLocale(DazeServerListenOn, &Direct{})
+	defer locale.Close()
+	locale.Run()
+
+	cli, bnd := LocaleAssociate(DazeServerListenOn)
+	defer cli.Close()
+	defer bnd.Close()
+	head := LocaleUDPHead(EchoServerListenOn)
+	// Fragments and truncated headers are dropped.
+	doa.Try(bnd.Write([]byte{0x00, 0x00, 0x01, 0x01}))
+	doa.Try(bnd.Write(head[:6]))
+	doa.Try(bnd.Write(append(head, 0x00, 0x2a, 0x00, 0x80)))
+	buf := make([]byte, 2048)
+	bnd.SetReadDeadline(time.Now().Add(time.Second))
+	n := doa.Try(bnd.Read(buf))
+	doa.Doa(n == len(head)+0x80)
+	doa.Doa(bytes.Equal(buf[:len(head)], head))
+	doa.Doa(bytes.Equal(buf[len(head):n], bytes.Repeat([]byte{0x2a}, 0x80)))
+}
+
+func TestLocaleFullCone(t *testing.T) {
+	locale := NewLocale(DazeServerListenOn, &Direct{})
+	locale.FullCone = true
+	defer locale.Close()
+	locale.Run()
+
+	peer := doa.Try(net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	defer peer.Close()
+	other := doa.Try(net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	defer other.Close()
+
+	cli, bnd := LocaleAssociate(DazeServerListenOn)
+	defer cli.Close()
+	defer bnd.Close()
+	doa.Try(bnd.Write(append(LocaleUDPHead(peer.LocalAddr().String()), "ping"...)))
+	buf := make([]byte, 2048)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, cone, err := peer.ReadFromUDP(buf)
+	doa.Nil(err)
+	doa.Doa(string(buf[:n]) == "ping")
+	// The destination is listed as active like dialed ones.
+	locale.Actives.Mu.Lock()
+	doa.Doa(len(locale.Actives.M) == 1)
+	for _, e := range locale.Actives.M {
+		doa.Doa(e.Active.Network == "udp" && e.Active.Address == peer.LocalAddr().String())
+	}
+	locale.Actives.Mu.Unlock()
+	// A peer the client never sent to reaches the client through the same socket.
+	doa.Try(other.WriteToUDP([]byte("pong"), cone))
+	bnd.SetReadDeadline(time.Now().Add(time.Second))
+	n = doa.Try(bnd.Read(buf))
+	head := LocaleUDPHead(other.LocalAddr().String())
+	doa.Doa(bytes.Equal(buf[:len(head)], head))
+	doa.Doa(string(buf[len(head):n]) == "pong")
+	// The client moves to another port, datagrams of the cone follow it.
+	rebind := doa.Try(net.DialUDP("udp", nil, bnd.RemoteAddr().(*net.UDPAddr)))
+	defer rebind.Close()
+	doa.Try(rebind.Write(append(LocaleUDPHead(peer.LocalAddr().String()), "ping"...)))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err = peer.ReadFromUDP(buf)
+	doa.Nil(err)
+	doa.Doa(string(buf[:n]) == "ping")
+	doa.Try(other.WriteToUDP([]byte("pong"), cone))
+	rebind.SetReadDeadline(time.Now().Add(time.Second))
+	n = doa.Try(rebind.Read(buf))
+	doa.Doa(string(buf[len(head):n]) == "pong")
+}
+
+func BenchmarkLocaleSocks5(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	locale := NewLocale(DazeServerListenOn, DialerFunc(func(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+		return &ReadWriteCloser{Reader: bytes.NewReader(nil), Writer: io.Discard, Closer: io.NopCloser(nil)}, nil
+	}))
+	req := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 0x0b}
+	req = append(req, "example.com"...)
+	req = append(req, 0x01, 0xbb)
+	b.ReportAllocs()
+	for range b.N {
+		cli := &ReadWriteCloser{Reader: bytes.NewReader(req), Writer: io.Discard, Closer: io.NopCloser(nil)}
+		doa.Nil(locale.Serve(&Context{}, cli))
+	}
+}
+
+func BenchmarkLocaleSocks5UDP(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	// Datagrams relayed to the destination come out of the pipe, replies never come.
+	r, w := io.Pipe()
+	defer r.Close()
+	idle, _ := io.Pipe()
+	defer idle.Close()
+	locale := NewLocale(DazeServerListenOn, DialerFunc(func(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+		return &ReadWriteCloser{Reader: idle, Writer: w, Closer: w}, nil
+	}))
+	defer locale.Close()
+	locale.Run()
+
+	cli, bnd := LocaleAssociate(DazeServerListenOn)
+	defer cli.Close()
+	defer bnd.Close()
+	msg := append(LocaleUDPHead(EchoServerListenOn), make([]byte, 512)...)
+	buf := make([]byte, 2048)
+	b.SetBytes(512)
+	b.ReportAllocs()
+	for range b.N {
+		doa.Try(bnd.Write(msg))
+		doa.Try(r.Read(buf))
+	}
+}
+
 func TestResolverDns(t *testing.T) {
-	dns := ResolverDns("1.1.1.1:53")
-	_, err := dns.LookupHost(context.Background(), "google.com")
+	nameserver := NewNameserver(DnssServerListenOn)
+	defer nameserver.Close()
+	nameserver.Add("daze.example", net.ParseIP("10.0.0.1"))
+	doa.Nil(nameserver.UDP())
+	dns := ResolverDns(DnssServerListenOn)
+	_, err := dns.LookupHost(context.Background(), "daze.example")
 	if err != nil {
 		t.FailNow()
 	}
 }
 
+func TestNameserver(t *testing.T) {
+	f := doa.Try(os.CreateTemp(t.TempDir(), "hosts"))
+	f.WriteString("# hosts\n10.0.0.1 daze.example www.daze.example\n::1 daze.example\n")
+	f.Close()
+	nameserver := NewNameserver(DnssServerListenOn)
+	defer nameserver.Close()
+	doa.Nil(nameserver.FromFile(f.Name()))
+	doa.Nil(nameserver.UDP())
+	for _, resolver := range []*net.Resolver{ResolverDns(DnssServerListenOn), nameserver.Resolver()} {
+		ret := doa.Try(resolver.LookupIP(context.Background(), "ip4", "WWW.daze.example"))
+		doa.Doa(len(ret) == 1 && ret[0].String() == "10.0.0.1")
+		ret = doa.Try(resolver.LookupIP(context.Background(), "ip6", "daze.example"))
+		doa.Doa(len(ret) == 1 && ret[0].String() == "::1")
+		_, err := resolver.LookupIP(context.Background(), "ip6", "www.daze.example")
+		doa.Doa(err != nil)
+		_, err = resolver.LookupHost(context.Background(), "none.daze.example")
+		var dnsErr *net.DNSError
+		doa.Doa(errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+	}
+}
+
 func TestResolverDot(t *testing.T) {
 	dot := ResolverDot("1.1.1.1:853")
 	_, err := dot.LookupHost(context.Background(), "google.com")
@@ -85,3 +278,1278 @@ func TestResolverDoh(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestResolverDohDialer(t *testing.T) {
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := doa.Try(io.ReadAll(r.Body))
+		// Answer every A query with 10.0.0.1, and nothing for other types.
+		end := 12
+		for req[end] != 0 {
+			end += int(req[end]) + 1
+		}
+		end += 5
+		ret := append([]byte{}, req[:end]...)
+		ret[2] = 0x81
+		ret[3] = 0x80
+		ret[11] = 0x00
+		if binary.BigEndian.Uint16(req[end-4:]) == 1 {
+			ret[7] = 0x01
+			ret = append(ret, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x04, 10, 0, 0, 1)
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(ret)
+	}))
+	defer doh.Close()
+	_, port, _ := net.SplitHostPort(doh.Listener.Addr().String())
+	dialer := DialerFunc(func(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+		doa.Doa(address == net.JoinHostPort("127.0.0.1", port))
+		return Dial(network, address)
+	})
+	resolver := ResolverDohDialer("http://doh.example:"+port+"/dns-query", "127.0.0.1", dialer)
+	ret := doa.Try(resolver.LookupHost(context.Background(), "daze.example"))
+	doa.Doa(len(ret) == 1)
+	doa.Doa(ret[0] == "10.0.0.1")
+}
+
+func TestResolverDohGet(t *testing.T) {
+	nameserver := NewNameserver("")
+	nameserver.Add("daze.example", net.ParseIP("10.0.0.1"))
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doa.Doa(r.Method == http.MethodGet)
+		req := doa.Try(base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns")))
+		// Queries sent by get have a zero id, so that they are cache friendly.
+		doa.Doa(binary.BigEndian.Uint16(req) == 0)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(nameserver.Answer(req))
+	}))
+	defer doh.Close()
+	resolver := ResolverDoh(doh.URL + "/dns-query{?dns}")
+	ret := doa.Try(resolver.LookupHost(context.Background(), "daze.example"))
+	doa.Doa(len(ret) == 1)
+	doa.Doa(ret[0] == "10.0.0.1")
+}
+
+func TestResolverMeter(t *testing.T) {
+	nameserver := NewNameserver(DnssServerListenOn)
+	defer nameserver.Close()
+	nameserver.Add("daze.example", net.ParseIP("10.0.0.1"))
+	doa.Nil(nameserver.UDP())
+	for i, resolver := range []*net.Resolver{ResolverDns(DnssServerListenOn), nameserver.Resolver()} {
+		meter := NewResolverMeter(fmt.Sprintf("resolver.%d", i))
+		resolver = meter.Wrap(resolver)
+		// Names are fully qualified, so that search domains are not tried.
+		doa.Try(resolver.LookupIP(context.Background(), "ip4", "daze.example."))
+		_, err := resolver.LookupIP(context.Background(), "ip4", "none.daze.example.")
+		doa.Doa(err != nil)
+		doa.Doa(meter.M.Get("query").(*expvar.Int).Value() == 2)
+		doa.Doa(meter.M.Get("rcode.noerror").(*expvar.Int).Value() == 1)
+		doa.Doa(meter.M.Get("rcode.nxdomain").(*expvar.Int).Value() == 1)
+		doa.Doa(meter.Latency.Counts[len(meter.Latency.Counts)-1].Load() == 0)
+	}
+	meter := NewResolverMeter("resolver.error")
+	resolver := meter.Wrap(ResolverDns("127.0.0.1:1"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := resolver.LookupIP(ctx, "ip4", "daze.example.")
+	doa.Doa(err != nil)
+	doa.Doa(meter.M.Get("error").(*expvar.Int).Value() != 0)
+}
+
+func TestResolverDohDeadline(t *testing.T) {
+	done := make(chan struct{})
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer doh.Close()
+	defer close(done)
+	resolver := ResolverDoh(doh.URL + "/dns-query")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	now := time.Now()
+	_, err := resolver.LookupHost(ctx, "daze.example.")
+	doa.Doa(err != nil)
+	doa.Doa(time.Since(now) < time.Second)
+}
+
+func TestEngine(t *testing.T) {
+	remote := NewTester(DazeServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	engine := NewEngine()
+	ctx := &Context{}
+	cli := doa.Try(engine.Dial(ctx, "tcp", DazeServerListenOn))
+	cli.Close()
+
+	rules := NewRouterRules()
+	rules.B = append(rules.B, "127.0.0.1")
+	engine.Router = rules
+	if doa.Err(engine.Dial(ctx, "tcp", DazeServerListenOn)) == nil {
+		t.FailNow()
+	}
+}
+
+func TestHook(t *testing.T) {
+	remote := NewTester(DazeServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	expv := NewExpv("TestHook")
+	locale := NewLocale("", &Direct{})
+	locale.Hook = NewHookChain(NewHookRate(1, time.Second), expv)
+	ctx := &Context{}
+	cli := doa.Try(locale.Dial(ctx, "tcp", DazeServerListenOn))
+	cli.Close()
+	if expv.M.Get("dial").String() != "1" {
+		t.FailNow()
+	}
+}
+
+func TestSniff(t *testing.T) {
+	for _, e := range [][2]string{
+		{"\x13BitTorrent protocol", "bittorrent"},
+		{"\x16\x03\x01\x02\x00", "tls"},
+		{"SSH-2.0-OpenSSH_9.6", "ssh"},
+		{"GET / HTTP/1.1\r\n", "http"},
+		{"\x00\x00", "unknown"},
+	} {
+		if Sniff([]byte(e[0])) != e[1] {
+			t.FailNow()
+		}
+	}
+}
+
+func TestInspector(t *testing.T) {
+	remote := NewTester(DazeServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	sniffer := NewSniffer()
+	sniffer.Policy["unknown"] = VerdictBlock
+	inspector := NewInspector(&Direct{}, sniffer)
+	ctx := &Context{}
+	cli := doa.Try(inspector.Dial(ctx, "tcp", DazeServerListenOn))
+	defer cli.Close()
+	if doa.Err(cli.Write([]byte{0x00, 0x00, 0x00, 0x80})) == nil {
+		t.FailNow()
+	}
+}
+
+func TestRouterHosts(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "hosts")
+	data := "# Blocklist\n0.0.0.0 ads.example.com\n127.0.0.1 localhost\ntracker.example.com # Tracker\n"
+	doa.Nil(os.WriteFile(name, []byte(data), 0644))
+	router := NewRouterHosts()
+	router.FromFile(name)
+	ctx := &Context{}
+	for _, e := range []struct {
+		host string
+		road Road
+	}{
+		{"ads.example.com", RoadFucked},
+		{"a.ads.example.com", RoadFucked},
+		{"tracker.example.com", RoadFucked},
+		{"example.com", RoadPuzzle},
+		{"localhost", RoadPuzzle},
+	} {
+		if router.Road(ctx, e.host) != e.road {
+			t.FailNow()
+		}
+	}
+}
+
+func TestEngineBlock(t *testing.T) {
+	rules := NewRouterRules()
+	rules.S = append(rules.S, "silent.com")
+	rules.N = append(rules.N, "notice.com")
+	engine := NewEngine()
+	engine.Router = rules
+	ctx := &Context{}
+
+	cli := doa.Try(engine.Dial(ctx, "tcp", "silent.com:80"))
+	doa.Try(cli.Write([]byte("GET / HTTP/1.1\r\n\r\n")))
+	cli.Close()
+	if doa.Err(cli.Read(make([]byte, 1))) != io.EOF {
+		t.FailNow()
+	}
+
+	cli = doa.Try(engine.Dial(ctx, "tcp", "notice.com:80"))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte("GET / HTTP/1.1\r\n\r\n")))
+	out := doa.Try(io.ReadAll(cli))
+	if !bytes.Contains(out, []byte("403 Forbidden")) {
+		t.FailNow()
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	for _, e := range [][2]string{
+		{"Example.COM:0443", "example.com:443"},
+		{"_srv.example.com.:80", "_srv.example.com.:80"},
+		{"127.0.0.1:80", "127.0.0.1:80"},
+		{"[0:0::1]:80", "[::1]:80"},
+	} {
+		doa.Doa(doa.Try(CheckAddr(e[0])) == e[1])
+	}
+	for _, e := range []string{
+		"",
+		"example.com",
+		"example.com:",
+		":80",
+		"example.com:0",
+		"example.com:65536",
+		"example.com:http",
+		"example.com\n2026/01/01 conn: 00000000 closed:80",
+		"example.com\x00.evil.com:80",
+		"exa mple.com:80",
+		"example.com/path:80",
+		"user@example.com:80",
+		"例子.com:80",
+	} {
+		doa.Doa(doa.Err(CheckAddr(e)) != nil)
+	}
+}
+
+func TestSocksDialerTCP(t *testing.T) {
+	remote := NewTester(EchoServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	locale := NewLocale(DazeServerListenOn, &Direct{})
+	defer locale.Close()
+	locale.Run()
+
+	dialer := NewSocksDialer(DazeServerListenOn, "", "")
+	ctx := &Context{}
+	cli := doa.Try(dialer.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	buf := make([]byte, 128)
+	doa.Try(io.ReadFull(cli, buf))
+}
+
+func TestSocksDialerUDP(t *testing.T) {
+	remote := NewTester(EchoServerListenOn)
+	defer remote.Close()
+	remote.UDP()
+
+	locale := NewLocale(DazeServerListenOn, &Direct{})
+	defer locale.Close()
+	locale.Run()
+
+	dialer := NewSocksDialer(DazeServerListenOn, "", "")
+	ctx := &Context{}
+	cli := doa.Try(dialer.Dial(ctx, "udp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	buf := make([]byte, 2048)
+	if doa.Try(cli.Read(buf)) != 128 {
+		t.FailNow()
+	}
+}
+
+func TestSocksDialerBind(t *testing.T) {
+	locale := NewLocale(DazeServerListenOn, &Direct{})
+	defer locale.Close()
+	locale.Run()
+
+	dialer := NewSocksDialer(DazeServerListenOn, "", "")
+	ctx := &Context{}
+	bnd := doa.Try(dialer.Bind(ctx, "127.0.0.1:0"))
+	go func() {
+		c := doa.Try(net.Dial("tcp", bnd.Addr()))
+		defer c.Close()
+		doa.Try(c.Write([]byte("ping")))
+	}()
+	cli, peer, err := bnd.Accept()
+	doa.Nil(err)
+	defer cli.Close()
+	doa.Doa(strings.HasPrefix(peer, "127.0.0.1:"))
+	buf := make([]byte, 4)
+	doa.Try(io.ReadFull(cli, buf))
+	doa.Doa(string(buf) == "ping")
+}
+
+func TestSocksDialerBindTimeout(t *testing.T) {
+	defer func(d time.Duration) { Conf.BindTimeout = d }(Conf.BindTimeout)
+	Conf.BindTimeout = time.Millisecond * 100
+
+	locale := NewLocale(DazeServerListenOn, &Direct{})
+	defer locale.Close()
+	locale.Run()
+
+	dialer := NewSocksDialer(DazeServerListenOn, "", "")
+	bnd := doa.Try(dialer.Bind(&Context{}, "127.0.0.1:0"))
+	defer bnd.Close()
+	// The peer never connects, the second reply is ttl expired.
+	_, _, err := bnd.Accept()
+	doa.Doa(err != nil && err.Error() == "daze: socks5 request failed with reply 6")
+}
+
+func TestTunnelDialer(t *testing.T) {
+	remote := NewTester(EchoServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	locale := NewLocale(DazeServerListenOn, &Direct{})
+	defer locale.Close()
+	locale.Run()
+
+	dialer := NewTunnelDialer(DazeServerListenOn, "", "")
+	ctx := &Context{}
+	cli := doa.Try(dialer.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	buf := make([]byte, 128)
+	doa.Try(io.ReadFull(cli, buf))
+}
+
+func TestHealth(t *testing.T) {
+	remote := NewTester(EchoServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	health := NewHealth(DazeServerListenOn)
+	health.Live = append(health.Live, HealthListen(EchoServerListenOn))
+	health.Ready = append(health.Ready, HealthDial(&Direct{}, "127.0.0.1:1"))
+	defer health.Close()
+	doa.Nil(health.Run())
+
+	rep := doa.Try(http.Get("http://" + DazeServerListenOn + "/healthz"))
+	rep.Body.Close()
+	if rep.StatusCode != http.StatusOK {
+		t.FailNow()
+	}
+	rep = doa.Try(http.Get("http://" + DazeServerListenOn + "/readyz"))
+	rep.Body.Close()
+	if rep.StatusCode != http.StatusServiceUnavailable {
+		t.FailNow()
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pub, prv, err := ed25519.GenerateKey(nil)
+	doa.Nil(err)
+	name := filepath.Join(t.TempDir(), "daze")
+	doa.Nil(os.WriteFile(name, []byte("daze"), 0644))
+	hash := sha256.Sum256([]byte("daze"))
+	doa.Nil(os.WriteFile(name+".sig", []byte(hex.EncodeToString(ed25519.Sign(prv, hash[:]))), 0644))
+	if Verify(pub, name) != nil {
+		t.FailNow()
+	}
+	doa.Nil(os.WriteFile(name, []byte("dazz"), 0644))
+	if Verify(pub, name) == nil {
+		t.FailNow()
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "telemetry.json")
+	telemetry := NewTelemetry(name, "v0.0.0")
+	hook := telemetry.Hook("ashe")
+	ctx := &Context{}
+	hook.OnAccept(ctx, nil)
+	hook.OnClose(ctx, io.EOF)
+	doa.Nil(telemetry.Save())
+	if NewTelemetry(name, "v0.0.0").Data["error.ashe"] != 1 {
+		t.FailNow()
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram()
+	for range 98 {
+		h.Observe(time.Millisecond)
+	}
+	h.Observe(time.Second)
+	h.Observe(time.Minute)
+	if h.Quantile(0.5) != time.Millisecond {
+		t.FailNow()
+	}
+	if h.Quantile(0.99) != time.Second {
+		t.FailNow()
+	}
+	if h.Quantile(1) != 10*time.Second {
+		t.FailNow()
+	}
+}
+
+func TestRouterIPNetResolved(t *testing.T) {
+	router := NewRouterIPNet()
+	ctx := &Context{}
+	if router.Road(ctx, "localhost") != RoadLocale {
+		t.FailNow()
+	}
+	host, _, _ := net.SplitHostPort(ctx.Resolve("localhost:80"))
+	if !net.ParseIP(host).IsLoopback() {
+		t.FailNow()
+	}
+}
+
+func TestRouterIPNetMissing(t *testing.T) {
+	nameserver := NewNameserver("")
+	nameserver.Add("daze.example", net.ParseIP("10.0.0.1"))
+	router := NewRouterIPNet()
+	router.Resolver = nameserver.Resolver()
+	doa.Doa(router.Road(&Context{}, "daze.example.") == RoadLocale)
+	doa.Doa(router.Road(&Context{}, "none.daze.example.") == RoadPuzzle)
+	router.Missing = RoadFucked
+	ctx := &Context{}
+	doa.Doa(router.Road(ctx, "none.daze.example.") == RoadFucked)
+	doa.Doa(ctx.Match == "cidr missing")
+	// A failing resolver is retried with the fallback, but a host not found is not.
+	router.Resolver = ResolverDns("127.0.0.1:1")
+	doa.Doa(router.Road(&Context{}, "daze.example.") == RoadPuzzle)
+	router.Fallback = nameserver.Resolver()
+	doa.Doa(router.Road(&Context{}, "daze.example.") == RoadLocale)
+	router.Resolver = nameserver.Resolver()
+	router.Fallback = ResolverDns("127.0.0.1:1")
+	doa.Doa(router.Road(&Context{}, "none.daze.example.") == RoadFucked)
+}
+
+func TestAimbotAssist(t *testing.T) {
+	remote := NewTester(EchoServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	// The remote dialer reaches the echo server, but the locale dialer can not.
+	aimbot := &Aimbot{
+		Assist: NewAssist(2, time.Hour),
+		Locale: NewSocksDialer("127.0.0.1:1", "", ""),
+		Remote: &Direct{},
+		Router: NewRouterRight(RoadLocale),
+	}
+	ctx := &Context{}
+	if doa.Err(aimbot.Dial(ctx, "tcp", EchoServerListenOn)) == nil {
+		t.FailNow()
+	}
+	cli := doa.Try(aimbot.Dial(ctx, "tcp", EchoServerListenOn))
+	cli.Close()
+	if !aimbot.Assist.Remote("127.0.0.1") {
+		t.FailNow()
+	}
+}
+
+func TestMapper(t *testing.T) {
+	remote := NewTester(EchoServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	mapper := NewMapper(DazeServerListenOn, EchoServerListenOn, &Direct{})
+	defer mapper.Close()
+	doa.Nil(mapper.Run())
+
+	cli := doa.Try(Dial("tcp", DazeServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Try(io.ReadFull(cli, make([]byte, 128)))
+}
+
+func TestLinkCopy(t *testing.T) {
+	src := make([]byte, 1024*1024)
+	io.ReadFull(&RandomReader{}, src)
+	dst := bytes.Buffer{}
+	n := doa.Try(LinkCopy(&dst, &ReadWriteCloser{Reader: bytes.NewReader(src)}))
+	doa.Doa(n == int64(len(src)))
+	doa.Doa(bytes.Equal(dst.Bytes(), src))
+}
+
+// SizeReader reads at most Size bytes at a time from N bytes, and records the size of the buffers it is given.
+type SizeReader struct {
+	L    []int
+	N    int
+	Size int
+}
+
+func (r *SizeReader) Read(p []byte) (int, error) {
+	if r.N == 0 {
+		return 0, io.EOF
+	}
+	r.L = append(r.L, len(p))
+	n := min(len(p), r.Size, r.N)
+	r.N -= n
+	return n, nil
+}
+
+func TestLinkCopyBuffer(t *testing.T) {
+	// An interactive stream keeps the small buffer.
+	r := &SizeReader{N: 64 * 1024, Size: 512}
+	doa.Try(LinkCopy(io.Discard, r))
+	for _, e := range r.L {
+		doa.Doa(e == Conf.LinkBufferMin)
+	}
+	// A bulk stream switches to the large buffer once reads fill the small one four times in a row.
+	r = &SizeReader{N: Conf.LinkBufferMin*4 + Conf.LinkBufferMax*4, Size: math.MaxInt}
+	doa.Try(LinkCopy(io.Discard, r))
+	doa.Doa(len(r.L) == 8)
+	for i, e := range r.L {
+		doa.Doa(e == map[bool]int{true: Conf.LinkBufferMin, false: Conf.LinkBufferMax}[i < 4])
+	}
+}
+
+func TestLinkIdle(t *testing.T) {
+	idle := Conf.LinkIdle
+	Conf.LinkIdle = time.Millisecond * 100
+	defer func() { Conf.LinkIdle = idle }()
+	key := make([]byte, 16)
+	c0, c1 := net.Pipe()
+	c2, c3 := net.Pipe()
+	defer c0.Close()
+	done := make(chan struct{})
+	go func() {
+		Link(c1, Gravity(c2, key))
+		close(done)
+	}()
+	go io.Copy(io.Discard, c3)
+	// Traffic in one direction keeps the link alive.
+	for range 6 {
+		doa.Try(c0.Write([]byte{0x00}))
+		time.Sleep(time.Millisecond * 50)
+	}
+	select {
+	case <-done:
+		t.FailNow()
+	default:
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.FailNow()
+	}
+}
+
+func TestLinkUnwrap(t *testing.T) {
+	idle := Conf.LinkIdle
+	Conf.LinkIdle = time.Millisecond * 100
+	defer func() { Conf.LinkIdle = idle }()
+	remote := NewTester(EchoServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+	usage := &QuotaUsage{}
+	srv := &QuotaConn{ReadWriteCloser: doa.Try(net.Dial("tcp", EchoServerListenOn)), Usage: usage}
+	// The relay reaches the tcp connection under the wrappers, for the kernel copy and for deadlines.
+	conn, usages := LinkUnwrap(&ActiveConn{ReadWriteCloser: srv})
+	_, ok := conn.(*net.TCPConn)
+	doa.Doa(ok && len(usages) == 1 && usages[0] == usage)
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	done := make(chan struct{})
+	go func() {
+		// The client side hides its deadlines, so only the wrapped side can end the idle link.
+		Link(&struct{ io.ReadWriteCloser }{c1}, srv)
+		close(done)
+	}()
+	doa.Try(c0.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Try(io.ReadFull(c0, make([]byte, 128)))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.FailNow()
+	}
+	doa.Doa(usage.Up.Load() == 4 && usage.Down.Load() == 128)
+}
+
+func TestLinkCopySplice(t *testing.T) {
+	l := doa.Try(net.Listen("tcp", "127.0.0.1:0"))
+	defer l.Close()
+	src := make([]byte, 4*1024*1024)
+	io.ReadFull(&RandomReader{}, src)
+	go func() {
+		cli := doa.Try(l.Accept())
+		cli.Write(src)
+		cli.Close()
+	}()
+	dst := doa.Try(net.Listen("tcp", "127.0.0.1:0"))
+	defer dst.Close()
+	ret := make(chan []byte)
+	go func() {
+		cli := doa.Try(dst.Accept())
+		ret <- doa.Try(io.ReadAll(cli))
+	}()
+	up := &QuotaUsage{}
+	down := &QuotaUsage{}
+	w := &QuotaConn{ReadWriteCloser: doa.Try(net.Dial("tcp", dst.Addr().String())), Usage: up}
+	r := &QuotaConn{ReadWriteCloser: doa.Try(net.Dial("tcp", l.Addr().String())), Usage: down}
+	// Bytes copied by the kernel are counted as well.
+	n := doa.Try(LinkCopy(w, r))
+	w.Close()
+	r.Close()
+	doa.Doa(n == int64(len(src)) && bytes.Equal(<-ret, src))
+	doa.Doa(up.Up.Load() == uint64(len(src)) && down.Down.Load() == uint64(len(src)))
+}
+
+func TestReadWriteCloserDeadline(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	// Deadlines pass through wrappers to the connection.
+	for _, e := range []Deadliner{Gravity(c1, make([]byte, 16)).(Deadliner), NewNetConn(Seal(c1, make([]byte, 32), true))} {
+		doa.Nil(e.SetReadDeadline(time.Now()))
+		_, err := e.(io.Reader).Read(make([]byte, 1))
+		doa.Doa(errors.Is(err, os.ErrDeadlineExceeded))
+	}
+	rwc := ReadWriteCloser{Reader: c1, Closer: io.NopCloser(nil)}
+	doa.Doa(errors.Is(rwc.SetReadDeadline(time.Now()), os.ErrNoDeadline))
+}
+
+func BenchmarkLinkCopy(b *testing.B) {
+	BenchLinkCopy(b, LinkCopy)
+}
+
+func BenchmarkLinkCopyStd(b *testing.B) {
+	BenchLinkCopy(b, io.Copy)
+}
+
+func BenchLinkCopy(b *testing.B, f func(io.Writer, io.Reader) (int64, error)) {
+	src := make([]byte, 256*1024)
+	b.SetBytes(int64(len(src)) * 64)
+	for range b.N {
+		r, w := net.Pipe()
+		go func() {
+			for range 64 {
+				w.Write(src)
+			}
+			w.Close()
+		}()
+		f(&ReadWriteCloser{Writer: io.Discard}, r)
+		r.Close()
+	}
+}
+
+func TestTracer(t *testing.T) {
+	tracer := NewTracer("tracer")
+	tracer.Grace = 0
+	ctx := &Context{}
+	tracer.OnAccept(ctx, nil)
+	done := make(chan struct{})
+	hang := make(chan struct{})
+	defer close(hang)
+	ctx.Go("done", func() { close(done) })
+	ctx.Go("hang", func() { <-hang })
+	<-done
+	for tracer.M.Get("goroutine.done").String() != "0" {
+		time.Sleep(time.Millisecond)
+	}
+	tracer.OnClose(ctx, nil)
+	for tracer.M.Get("leak.hang") == nil {
+		time.Sleep(time.Millisecond)
+	}
+	doa.Doa(tracer.M.Get("leak.hang").String() == "1")
+	doa.Doa(tracer.M.Get("leak.done") == nil)
+}
+
+func TestActives(t *testing.T) {
+	actives := NewActives()
+	r0, w0 := net.Pipe()
+	defer w0.Close()
+	c0 := actives.Wrap(&Context{Cid: 1}, "tcp", "a.com:80", r0)
+	r1, w1 := net.Pipe()
+	defer w1.Close()
+	actives.Wrap(&Context{Cid: 2}, "tcp", "b.com:80", r1)
+	doa.Doa(len(actives.List()) == 2)
+	doa.Doa(actives.List()[0].Address == "a.com:80")
+	c0.Close()
+	l := actives.List()
+	doa.Doa(len(l) == 1)
+	doa.Doa(l[0].Cid == 2)
+	doa.Nil(actives.Kill(l[0].Idx))
+	doa.Doa(doa.Err(r1.Read(make([]byte, 1))) != nil)
+	doa.Doa(len(actives.List()) == 0)
+	doa.Doa(actives.Kill(l[0].Idx) != nil)
+}
+
+func TestDemux(t *testing.T) {
+	demux := NewDemux(DazeServerListenOn)
+	demux.HTTP = NewDemuxListener()
+	demux.Raw = NewDemuxListener()
+	defer demux.Close()
+	doa.Nil(demux.Run())
+
+	for _, e := range []struct {
+		head string
+		l    *DemuxListener
+	}{
+		{"GET / HTTP/1.1\r\n", demux.HTTP},
+		{"\x16\x03\x01\x02\x00\x01\x00\x01", nil},
+		{"\x16\x7f\xa3\x00\x9e\x41\x10\x2c", demux.Raw},
+	} {
+		cli := doa.Try(net.Dial("tcp", DazeServerListenOn))
+		doa.Try(cli.Write([]byte(e.head)))
+		if e.l == nil {
+			// There is no tls listener, the connection is dropped.
+			doa.Doa(doa.Err(cli.Read(make([]byte, 1))) != nil)
+			cli.Close()
+			continue
+		}
+		srv := doa.Try(e.l.Accept())
+		buf := make([]byte, len(e.head))
+		doa.Try(io.ReadFull(srv, buf))
+		doa.Doa(string(buf) == e.head)
+		srv.Close()
+		cli.Close()
+	}
+}
+
+func TestRuleSource(t *testing.T) {
+	dir := t.TempDir()
+	doa.Nil(os.WriteFile(filepath.Join(dir, "00-base.ls"), []byte("L a.com\nR b.com\n"), 0644))
+	doa.Nil(os.WriteFile(filepath.Join(dir, "50-team.ls"), []byte("B c.com"), 0644))
+	doa.Nil(os.WriteFile(filepath.Join(dir, "README"), []byte("B a.com"), 0644))
+	rules := NewRouterRules()
+	doa.Nil(rules.FromSource(NewRuleSource(dir)))
+	ctx := &Context{}
+	doa.Doa(rules.Len() == 3)
+	doa.Doa(rules.Road(ctx, "a.com") == RoadLocale)
+	doa.Doa(rules.Road(ctx, "c.com") == RoadFucked)
+
+	data := "R a.com\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if data == "" {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, data)
+	}))
+	defer server.Close()
+	doa.Nil(rules.FromSource(NewRuleSource(server.URL)))
+	doa.Doa(rules.Len() == 1)
+	doa.Doa(rules.Road(ctx, "a.com") == RoadRemote)
+	// The previous rules are kept on error.
+	data = ""
+	doa.Doa(rules.FromSource(NewRuleSource(server.URL)) != nil)
+	doa.Doa(rules.Road(ctx, "a.com") == RoadRemote)
+
+	// Inline rules are merged with the rules of the file.
+	doa.Nil(rules.FromSource(RuleSourceMerge{NewRuleSource(dir), &RuleSourceData{Data: []byte("L d.com")}}))
+	doa.Doa(rules.Len() == 4)
+	doa.Doa(rules.Road(ctx, "d.com") == RoadLocale)
+}
+
+func TestRouterMatch(t *testing.T) {
+	rules := NewRouterRules()
+	rules.R = append(rules.R, "*.b.com")
+	ipnet := NewRouterIPNet()
+	router := NewRouterCache(NewRouterChain(rules, ipnet, NewRouterRight(RoadRemote)))
+	for _, e := range []struct {
+		host  string
+		match string
+	}{
+		{"a.b.com", "rule R *.b.com"},
+		{"a.b.com", "cache rule R *.b.com"},
+		{"127.0.0.1", "cidr L 127.0.0.0/8"},
+		{"1.1.1.1", "right"},
+	} {
+		ctx := &Context{}
+		router.Road(ctx, e.host)
+		doa.Doa(ctx.Match == e.match)
+	}
+}
+
+func TestNetem(t *testing.T) {
+	remote := NewTester(DazeServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	netem := &Netem{Delay: time.Millisecond * 50, Dialer: &Direct{}}
+	cli := doa.Try(netem.Dial(&Context{}, "tcp", DazeServerListenOn))
+	defer cli.Close()
+	now := time.Now()
+	doa.Try(cli.Write([]byte{0x00, 0x2a, 0x00, 0x01}))
+	doa.Try(io.ReadFull(cli, make([]byte, 1)))
+	doa.Doa(time.Since(now) >= netem.Delay*2)
+
+	// Data keeps its order with jitter and loss.
+	netem.Jitter = time.Millisecond * 10
+	netem.Loss = 0.1
+	buf := make([]byte, 0x8000)
+	for i := range 4 {
+		doa.Try(cli.Write([]byte{0x00, byte(i), 0x80, 0x00}))
+	}
+	for i := range 4 {
+		doa.Try(io.ReadFull(cli, buf))
+		doa.Doa(bytes.Equal(buf, bytes.Repeat([]byte{byte(i)}, 0x8000)))
+	}
+}
+
+func TestHookLimit(t *testing.T) {
+	hook := NewHookLimit(2, 1)
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	a := &Context{}
+	b := &Context{}
+	c := &Context{}
+	doa.Nil(hook.OnAccept(a, addr))
+	doa.Nil(hook.OnAccept(b, addr))
+	doa.Doa(errors.Is(hook.OnAccept(c, addr), ErrLimited))
+	hook.OnClose(c, nil)
+	doa.Nil(hook.OnDial(a, "tcp", "example.com:443"))
+	doa.Doa(errors.Is(hook.OnDial(b, "tcp", "EXAMPLE.com:80"), ErrLimited))
+	hook.OnClose(a, nil)
+	doa.Nil(hook.OnDial(b, "tcp", "example.com:80"))
+	hook.OnClose(b, nil)
+	doa.Doa(len(hook.M) == 0 && len(hook.L) == 0)
+}
+
+func TestAudit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	audit := NewAudit("TestAudit", buf)
+	hook := audit.Hook("ashe")
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	a := &Context{Cid: 1}
+	b := &Context{Cid: 2}
+	doa.Nil(hook.OnAccept(a, addr))
+	// The user is known once the handshake passes.
+	a.User = "alice"
+	doa.Nil(hook.OnAccept(b, addr))
+	doa.Nil(hook.OnDial(a, "tcp", "example.com:443"))
+	hook.OnClose(a, errors.New("daze: io timeout"))
+	hook.OnClose(b, errors.New("daze: request expired"))
+	l := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	doa.Doa(len(l) == 2)
+	e := AuditEvent{}
+	doa.Nil(json.Unmarshal([]byte(l[0]), &e))
+	doa.Doa(e.Cid == 1 && e.Outcome == "pass" && e.User == "alice")
+	e = AuditEvent{}
+	doa.Nil(json.Unmarshal([]byte(l[1]), &e))
+	doa.Doa(e.Cid == 2 && e.Outcome == "fail" && e.Reason == "daze: request expired" && e.Source == "192.0.2.1")
+	doa.Doa(audit.M.Get("pass").String() == "1" && audit.M.Get("fail").String() == "1")
+	doa.Doa(len(audit.L) == 2)
+}
+
+func TestAllowListener(t *testing.T) {
+	l := doa.Try(NewAllowListener(nil, "192.0.2.0/24,198.51.100.7"))
+	doa.Doa(l.Allowed(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 1}))
+	doa.Doa(l.Allowed(&net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 1}))
+	doa.Doa(!l.Allowed(&net.TCPAddr{IP: net.IPv4(198, 51, 100, 8), Port: 1}))
+	doa.Doa(doa.Err(NewAllowListener(nil, "192.0.2.256")) != nil)
+	for _, e := range []struct {
+		cidrs string
+		allow bool
+	}{{"127.0.0.0/8", true}, {"192.0.2.0/24", false}} {
+		l := doa.Try(NewAllowListener(doa.Try(net.Listen("tcp", "127.0.0.1:0")), e.cidrs))
+		defer l.Close()
+		go func() {
+			for {
+				cli, err := l.Accept()
+				if err != nil {
+					return
+				}
+				cli.Write([]byte{0x00})
+				cli.Close()
+			}
+		}()
+		// A rejected connection is reset before the server says anything, the reset may even fail the dial.
+		cli, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			defer cli.Close()
+			_, err = io.ReadFull(cli, make([]byte, 1))
+		}
+		doa.Doa((err == nil) == e.allow)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	build := Build{Commit: "1a2b3c4", Date: "2026-10-16T00:00:00Z", Go: "go1.23.0", Version: "v1.21.2"}
+	banner := NewBanner(build, &Direct{})
+	doa.Doa(doa.Try(BannerQuery(banner)) == build)
+	doa.Doa(build.String() == "v1.21.2 (1a2b3c4 2026-10-16T00:00:00Z go1.23.0)")
+}
+
+func TestBan(t *testing.T) {
+	ban := NewBan()
+	ban.Fails = 2
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	for range 2 {
+		ctx := &Context{}
+		doa.Nil(ban.OnAccept(ctx, addr))
+		ban.OnClose(ctx, io.EOF)
+	}
+	doa.Doa(errors.Is(ban.OnAccept(&Context{}, addr), ErrBlocked))
+
+	server := httptest.NewServer(ban)
+	defer server.Close()
+	doa.Try(http.PostForm(server.URL, url.Values{"cidr": {"198.51.100.0/24"}, "ttl": {"1h"}}))
+	doa.Doa(ban.Banned(net.IPv4(198, 51, 100, 7)))
+	req := doa.Try(http.NewRequest(http.MethodDelete, server.URL+"?cidr=192.0.2.1", nil))
+	doa.Try(http.DefaultClient.Do(req))
+	doa.Doa(!ban.Banned(addr.IP))
+	l := []BanEntry{}
+	doa.Nil(json.NewDecoder(doa.Try(http.Get(server.URL)).Body).Decode(&l))
+	doa.Doa(len(l) == 1 && l[0].Name == "198.51.100.0/24")
+}
+
+func TestBanStat(t *testing.T) {
+	ban := NewBan()
+	ban.Fails = 2
+	ban.Window = time.Millisecond * 10
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	fail := func() {
+		ctx := &Context{}
+		doa.Nil(ban.OnAccept(ctx, addr))
+		ban.OnClose(ctx, io.EOF)
+	}
+	// Failures out of the window are forgotten.
+	fail()
+	time.Sleep(time.Millisecond * 20)
+	fail()
+	doa.Nil(ban.OnAccept(&Context{}, addr))
+	fail()
+	doa.Doa(ban.OnAccept(&Context{}, addr) != nil)
+	stat := map[string]int{}
+	doa.Nil(json.Unmarshal([]byte(ban.String()), &stat))
+	doa.Doa(stat["banned"] == 1 && stat["failed"] == 3 && stat["rejected"] == 1)
+}
+
+func TestBanListener(t *testing.T) {
+	ban := NewBan()
+	ban.Tarpit = time.Millisecond * 200
+	doa.Nil(ban.Add("127.0.0.1", 0, "test"))
+	l := NewBanListener(doa.Try(net.Listen("tcp", "127.0.0.1:0")), ban)
+	defer l.Close()
+	go func() {
+		for {
+			cli, err := l.Accept()
+			if err != nil {
+				return
+			}
+			cli.Close()
+		}
+	}()
+	// The banned source is held by the tarpit, then closed.
+	cli, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return
+	}
+	defer cli.Close()
+	now := time.Now()
+	doa.Doa(doa.Err(cli.Read(make([]byte, 1))) != nil)
+	doa.Doa(time.Since(now) >= time.Millisecond*150)
+	ban.Mu.Lock()
+	defer ban.Mu.Unlock()
+	doa.Doa(ban.Rejected == 1 && ban.Held == 0)
+}
+
+func TestLogLimit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogLimit(buf, 2, time.Hour)
+	for i := range 4 {
+		fmt.Fprintf(l, "2026/10/16 00:00:0%d conn: %08x  error read tcp 192.0.2.1:%d: reset\n", i, 0xabcdef00+i, 1000+i)
+	}
+	fmt.Fprintln(l, "main: listen and serve on 127.0.0.1:1081")
+	doa.Doa(strings.Count(buf.String(), "\n") == 3)
+	drop := uint64(0)
+	for _, c := range l.L {
+		drop += c.Drop
+	}
+	doa.Doa(drop == 2)
+}
+
+func TestLogSafe(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := log.New(NewLogSafe(buf), "", 0)
+	l.Printf("conn: %08x   dial network=tcp address=%s", 0, "a.com\nconn: 00000000 closed\x1b[2J:80")
+	l.Println("main: listen and serve on 127.0.0.1:1081")
+	doa.Doa(buf.String() == "conn: 00000000   dial network=tcp address=a.com\\x0aconn: 00000000 closed\\x1b[2J:80\n"+
+		"main: listen and serve on 127.0.0.1:1081\n")
+}
+
+func TestSeal(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(&RandomReader{}, key)
+	src := make([]byte, 1024*1024)
+	io.ReadFull(&RandomReader{}, src)
+	c0, c1 := net.Pipe()
+	cli := Seal(c0, key, true)
+	srv := Seal(c1, key, false)
+	go func() {
+		doa.Try(cli.Write(src))
+		doa.Try(srv.Write(src[:16]))
+	}()
+	dst := make([]byte, len(src))
+	doa.Try(io.ReadFull(srv, dst))
+	doa.Doa(bytes.Equal(dst, src))
+	doa.Try(io.ReadFull(cli, dst[:16]))
+	doa.Doa(bytes.Equal(dst[:16], src[:16]))
+
+	// Chunks are bound to their direction and order.
+	buf := &bytes.Buffer{}
+	NewSealWriter(buf, key, 0).Write(src[:16])
+	doa.Doa(doa.Err(NewSealReader(bytes.NewReader(buf.Bytes()), key, 1).Read(dst)) != nil)
+	raw := buf.Bytes()
+	raw[len(raw)-1] ^= 0x01
+	doa.Doa(doa.Err(NewSealReader(bytes.NewReader(raw), key, 0).Read(dst)) != nil)
+}
+
+func TestWrapCipher(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(&RandomReader{}, key)
+	src := make([]byte, 1024)
+	io.ReadFull(&RandomReader{}, src)
+	for _, suite := range []string{"aes-256-gcm", "chacha20-poly1305", "rc4", "rc4-hkdf"} {
+		c0, c1 := net.Pipe()
+		cli := doa.Try(WrapCipher(c0, suite, key, true))
+		srv := doa.Try(WrapCipher(c1, suite, key, false))
+		go func() {
+			doa.Try(cli.Write(src))
+		}()
+		dst := make([]byte, len(src))
+		doa.Try(io.ReadFull(srv, dst))
+		doa.Doa(bytes.Equal(dst, src))
+		cli.Close()
+		srv.Close()
+	}
+	doa.Doa(doa.Err(WrapCipher(nil, "none", key, true)) != nil)
+}
+
+func TestToken(t *testing.T) {
+	doa.Doa(Token("master", "2026-10-16") == Token("master", "2026-10-16"))
+	doa.Doa(Token("master", "2026-10-16") != Token("master", "2026-10-17"))
+	doa.Doa(Token("master", "2026-10-16") != Token("other", "2026-10-16"))
+	doa.Doa(len(Token("master", "2026-10-16")) == 32)
+}
+
+func TestRouterRulesCompress(t *testing.T) {
+	rules := NewRouterRules()
+	doa.Nil(rules.FromReader(strings.NewReader("R a.com *.a.com compress\nR b.com\n")))
+	doa.Doa(rules.Len() == 3)
+	ctx := &Context{}
+	doa.Doa(rules.Road(ctx, "x.a.com") == RoadRemote)
+	doa.Doa(ctx.Compress)
+	doa.Doa(rules.Road(ctx, "b.com") == RoadRemote)
+	doa.Doa(!ctx.Compress)
+	// The option survives the cache of routes.
+	cache := NewRouterCache(rules)
+	cache.Road(ctx, "x.a.com")
+	ctx = &Context{}
+	doa.Doa(cache.Road(ctx, "x.a.com") == RoadRemote)
+	doa.Doa(ctx.Compress)
+}
+
+func TestCompress(t *testing.T) {
+	c0, c1 := net.Pipe()
+	cli := Compress(c0)
+	srv := Compress(c1)
+	defer cli.Close()
+	defer srv.Close()
+	go func() {
+		io.Copy(srv, srv)
+	}()
+	data := []string{"hello", strings.Repeat("daze", 4096)}
+	go func() {
+		for _, e := range data {
+			doa.Try(cli.Write([]byte(e)))
+		}
+	}()
+	// Each write is flushed, so that the echo comes back without waiting for more data.
+	for _, e := range data {
+		buf := make([]byte, len(e))
+		doa.Try(io.ReadFull(cli, buf))
+		doa.Doa(string(buf) == e)
+	}
+}
+
+func TestGravitySplit(t *testing.T) {
+	key := make([]byte, 32)
+	io.ReadFull(&RandomReader{}, key)
+	c2s := &bytes.Buffer{}
+	s2c := &bytes.Buffer{}
+	cli := GravitySplit(&ReadWriteCloser{Reader: s2c, Writer: c2s, Closer: io.NopCloser(nil)}, key, true)
+	srv := GravitySplit(&ReadWriteCloser{Reader: c2s, Writer: s2c, Closer: io.NopCloser(nil)}, key, false)
+	src := make([]byte, 64)
+	doa.Try(cli.Write(src))
+	doa.Try(srv.Write(src))
+	// The keystreams of the two directions differ, so the same plaintext is encrypted to different ciphertexts.
+	doa.Doa(!bytes.Equal(c2s.Bytes(), s2c.Bytes()))
+	dst := make([]byte, 64)
+	doa.Try(io.ReadFull(srv, dst))
+	doa.Doa(bytes.Equal(dst, src))
+	doa.Try(io.ReadFull(cli, dst))
+	doa.Doa(bytes.Equal(dst, src))
+}
+
+func TestQuota(t *testing.T) {
+	dialer := DialerFunc(func(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+		return &ReadWriteCloser{Reader: bytes.NewReader(make([]byte, 4)), Writer: io.Discard, Closer: io.NopCloser(nil)}, nil
+	})
+	name := filepath.Join(t.TempDir(), "quota.json")
+	quota := NewQuota(name, dialer, 10)
+	alice := &Context{User: "alice"}
+	srv := doa.Try(quota.Dial(alice, "tcp", "example.com:80"))
+	doa.Try(srv.Write(make([]byte, 6)))
+	doa.Try(io.ReadFull(srv, make([]byte, 4)))
+	doa.Doa(errors.Is(doa.Err(quota.Dial(alice, "tcp", "example.com:80")), ErrLimited))
+	// Connections without a user are not limited.
+	doa.Try(quota.Dial(&Context{}, "tcp", "example.com:80"))
+
+	rec := httptest.NewRecorder()
+	quota.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/quota", nil))
+	var v struct {
+		Users map[string]struct {
+			Down uint64 `json:"down"`
+			Up   uint64 `json:"up"`
+		} `json:"users"`
+	}
+	doa.Nil(json.Unmarshal(rec.Body.Bytes(), &v))
+	doa.Doa(len(v.Users) == 1 && v.Users["alice"].Down == 4 && v.Users["alice"].Up == 6)
+
+	// Usage is kept across restarts.
+	doa.Nil(quota.Save())
+	quota = NewQuota(name, dialer, 10)
+	doa.Doa(errors.Is(doa.Err(quota.Dial(alice, "tcp", "example.com:80")), ErrLimited))
+	quota.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/debug/quota?user=alice", nil))
+	doa.Try(quota.Dial(alice, "tcp", "example.com:80"))
+}
+
+func TestTraffic(t *testing.T) {
+	dialer := DialerFunc(func(ctx *Context, network string, address string) (io.ReadWriteCloser, error) {
+		return &ReadWriteCloser{Reader: bytes.NewReader(make([]byte, 4)), Writer: io.Discard, Closer: io.NopCloser(nil)}, nil
+	})
+	usage := &QuotaUsage{}
+	for _, traffic := range []*Traffic{NewTraffic(dialer, usage), NewTraffic(dialer, usage)} {
+		srv := doa.Try(traffic.Dial(&Context{}, "tcp", "example.com:80"))
+		doa.Try(srv.Write(make([]byte, 6)))
+		doa.Try(io.ReadFull(srv, make([]byte, 4)))
+	}
+	doa.Doa(usage.Down.Load() == 8 && usage.Up.Load() == 12)
+	doa.Doa(errors.Is(doa.Err(NewTraffic(dialer, usage).Bind(&Context{}, "example.com:80")), ErrBindUnsupported))
+}
+
+func TestLocaleFrontend(t *testing.T) {
+	remote := NewTester(EchoServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	locale := NewLocale(DazeServerListenOn, &Direct{})
+	locale.Frontends = []*LocaleFrontend{
+		{Listen: "127.0.0.1:28082", Router: NewRouterRight(RoadFucked)},
+		{Listen: "127.0.0.1:28083", Limits: rate.NewLimits(16*1024, time.Millisecond*100)},
+	}
+	defer locale.Close()
+	locale.Run()
+
+	for _, listen := range []string{DazeServerListenOn, "127.0.0.1:28083"} {
+		now := time.Now()
+		cli := doa.Try(NewSocksDialer(listen, "", "").Dial(&Context{}, "tcp", EchoServerListenOn))
+		doa.Try(cli.Write([]byte{0x00, 0x00, 0xff, 0xff}))
+		doa.Try(io.ReadFull(cli, make([]byte, 0xffff)))
+		cli.Close()
+		// A full bucket of 16 KiB, then 16 KiB every 100 milliseconds.
+		doa.Doa((time.Since(now) > time.Millisecond*200) == (listen != DazeServerListenOn))
+	}
+	_, err := NewSocksDialer("127.0.0.1:28082", "", "").Dial(&Context{}, "tcp", EchoServerListenOn)
+	doa.Doa(err != nil)
+}
+
+func TestLocaleAuth(t *testing.T) {
+	remote := NewTester(EchoServerListenOn)
+	defer remote.Close()
+	remote.TCP()
+
+	locale := NewLocale(DazeServerListenOn, &Direct{})
+	locale.Auth = "user:pass"
+	defer locale.Close()
+	locale.Run()
+
+	for _, dialer := range []Dialer{
+		NewSocksDialer(DazeServerListenOn, "user", "pass"),
+		NewTunnelDialer(DazeServerListenOn, "user", "pass"),
+	} {
+		cli := doa.Try(dialer.Dial(&Context{}, "tcp", EchoServerListenOn))
+		doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+		doa.Try(io.ReadFull(cli, make([]byte, 128)))
+		cli.Close()
+	}
+	for _, dialer := range []Dialer{
+		NewSocksDialer(DazeServerListenOn, "", ""),
+		NewSocksDialer(DazeServerListenOn, "user", "word"),
+		NewTunnelDialer(DazeServerListenOn, "", ""),
+		NewTunnelDialer(DazeServerListenOn, "user", "word"),
+	} {
+		_, err := dialer.Dial(&Context{}, "tcp", EchoServerListenOn)
+		doa.Doa(err != nil)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	rules := NewRouterRules()
+	rules.R = append(rules.R, "*")
+	cache := NewRouterCache(rules)
+	prefetch := NewPrefetch(cache)
+	body := `<script src="https://a.com/a.js"></script><img src="//B.com/b.png"><a href="http://self.com/">`
+	s := &http.Response{
+		Header: http.Header{"Content-Type": {"text/html"}, "Link": {"<https://c.com/c.css>; rel=preload"}},
+		Body:   io.NopCloser(strings.NewReader(body)),
+	}
+	prefetch.Response(&Context{}, "self.com", s)
+	doa.Doa(string(doa.Try(io.ReadAll(s.Body))) == body)
+	for range 100 {
+		if cache.Lru.Len() == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	for _, host := range []string{"a.com", "b.com", "c.com"} {
+		_, ok := cache.Lru.GetExists(host)
+		doa.Doa(ok)
+	}
+	_, ok := cache.Lru.GetExists("self.com")
+	doa.Doa(!ok)
+}
+
+func TestRouterCacheResolved(t *testing.T) {
+	cache := NewRouterCache(NewRouterIPNet())
+	cache.Road(&Context{}, "localhost")
+	// Hits of the cache reuse the ip resolved by the router, so the direct dialer does not resolve it again.
+	ctx := &Context{}
+	doa.Doa(cache.Road(ctx, "localhost") == RoadLocale)
+	doa.Doa(ctx.Resolved["localhost"] != nil)
+}
+
+func TestClientAuth(t *testing.T) {
+	caKey := doa.Try(ecdsa.GenerateKey(elliptic.P256(), crand.Reader))
+	caTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer := doa.Try(x509.CreateCertificate(crand.Reader, caTpl, caTpl, &caKey.PublicKey, caKey))
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	doa.Nil(os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0644))
+	cliKey := doa.Try(ecdsa.GenerateKey(elliptic.P256(), crand.Reader))
+	cliTpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cliDer := doa.Try(x509.CreateCertificate(crand.Reader, cliTpl, caTpl, &cliKey.PublicKey, caKey))
+	srvConf := &tls.Config{Certificates: []tls.Certificate{doa.Try(Certificate("127.0.0.1"))}}
+	doa.Nil(ClientAuth(srvConf, name))
+	handshake := func(crt []tls.Certificate) error {
+		c0, c1 := net.Pipe()
+		defer c0.Close()
+		defer c1.Close()
+		cli := tls.Client(c0, &tls.Config{Certificates: crt, InsecureSkipVerify: true})
+		go func() {
+			// The client of tls 1.3 finishes before the server verifies its certificate.
+			if cli.Handshake() == nil {
+				cli.Read(make([]byte, 1))
+			}
+			c0.Close()
+		}()
+		return tls.Server(c1, srvConf).Handshake()
+	}
+	doa.Nil(handshake([]tls.Certificate{{Certificate: [][]byte{cliDer}, PrivateKey: cliKey}}))
+	doa.Doa(handshake(nil) != nil)
+	// Certificates of other authorities are rejected.
+	doa.Doa(handshake([]tls.Certificate{doa.Try(Certificate("127.0.0.1"))}) != nil)
+	doa.Doa(ClientAuth(&tls.Config{}, filepath.Join(t.TempDir(), "none.pem")) != nil)
+}
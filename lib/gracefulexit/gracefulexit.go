@@ -6,12 +6,14 @@ package gracefulexit
 import (
 	"os"
 	"os/signal"
+	"syscall"
 )
 
-// Chan create a channel for os.Signal.
+// Chan create a channel for os.Signal. Both interrupt and terminate are caught, the latter is sent by process
+// supervisors to stop the program.
 func Chan() chan os.Signal {
 	buffer := make(chan os.Signal, 1)
-	signal.Notify(buffer, os.Interrupt)
+	signal.Notify(buffer, os.Interrupt, syscall.SIGTERM)
 	return buffer
 }
 
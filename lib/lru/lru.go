@@ -116,6 +116,14 @@ func (l *Lru[K, V]) Del(k K) {
 	}
 }
 
+// Purge removes all items from the cache.
+func (l *Lru[K, V]) Purge() {
+	l.M.Lock()
+	defer l.M.Unlock()
+	l.List.Init()
+	l.C = map[K]*Elem[K, V]{}
+}
+
 // Len returns the number of items in the cache.
 func (l *Lru[K, V]) Len() int {
 	l.M.Lock()
@@ -72,3 +72,17 @@ func TestLruSize(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestLruPurge(t *testing.T) {
+	c := New[int, int](4)
+	c.Set(1, 1)
+	c.Set(2, 2)
+	c.Purge()
+	if c.List.Size != c.Len() || c.Len() != 0 {
+		t.FailNow()
+	}
+	c.Set(3, 3)
+	if c.Get(1) != 0 || c.Get(3) != 3 {
+		t.FailNow()
+	}
+}
@@ -4,26 +4,55 @@ import (
 	"sync"
 )
 
-// Priority implement a lock with priorities.
+// Priority implement a lock with priorities. When the lock is released, it is handed over to the waiter of the highest
+// priority, which is the lowest level, and waiters of the same level are served in order. A waiter of level 0 thus
+// waits for at most the function in flight, however many waiters of other levels there are.
 type Priority struct {
-	l []sync.Mutex
+	c    []*sync.Cond
+	busy bool
+	hand []int
+	m    sync.Mutex
+	wait []int
 }
 
 // Call the function f with priority.
 func (p *Priority) Pri(n int, f func() error) error {
-	for i := n; i >= 0; i-- {
-		p.l[i].Lock()
+	p.m.Lock()
+	if p.busy {
+		p.wait[n]++
+		for p.hand[n] == 0 {
+			p.c[n].Wait()
+		}
+		p.hand[n]--
+		p.wait[n]--
 	}
+	p.busy = true
+	p.m.Unlock()
 	err := f()
-	for i := n; i >= 0; i-- {
-		p.l[i].Unlock()
+	p.m.Lock()
+	p.busy = false
+	for i := range p.wait {
+		if p.wait[i] != 0 {
+			// The lock stays busy, so that it can not be taken by a newcomer before the waiter wakes up.
+			p.busy = true
+			p.hand[i]++
+			p.c[i].Signal()
+			break
+		}
 	}
+	p.m.Unlock()
 	return err
 }
 
 // NewPriority returns a new Priority with n priority levels.
 func NewPriority(n int) *Priority {
-	return &Priority{
-		l: make([]sync.Mutex, n),
+	p := &Priority{
+		c:    make([]*sync.Cond, n),
+		hand: make([]int, n),
+		wait: make([]int, n),
 	}
+	for i := range n {
+		p.c[i] = sync.NewCond(&p.m)
+	}
+	return p
 }
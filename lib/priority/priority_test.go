@@ -1,7 +1,10 @@
 package priority
 
 import (
+	"slices"
+	"sync"
 	"testing"
+	"time"
 )
 
 func BenchmarkPriority(b *testing.B) {
@@ -25,3 +28,35 @@ func TestPriority(t *testing.T) {
 		return nil
 	})
 }
+
+func TestPriorityOrder(t *testing.T) {
+	pri := NewPriority(2)
+	order := []int{}
+	wg := sync.WaitGroup{}
+	queued := func(n int) bool {
+		pri.m.Lock()
+		defer pri.m.Unlock()
+		return pri.wait[0]+pri.wait[1] == n
+	}
+	pri.Pri(1, func() error {
+		// Waiters of level 0 go ahead of waiters of level 1 which came earlier.
+		for i, n := range []int{1, 1, 0, 0} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pri.Pri(n, func() error {
+					order = append(order, n*10+i)
+					return nil
+				})
+			}()
+			for !queued(i + 1) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		return nil
+	})
+	wg.Wait()
+	if !slices.Equal(order, []int{2, 3, 10, 11}) {
+		t.Fatal(order)
+	}
+}
@@ -0,0 +1,69 @@
+// Package rate implements a token bucket rate limiter.
+package rate
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits is a token bucket. The bucket is refilled with addition tokens every step, and it holds at most capacity
+// tokens.
+type Limits struct {
+	addition uint64
+	capacity uint64
+	last     time.Time
+	m        *sync.Mutex
+	size     uint64
+	step     time.Duration
+}
+
+// fill adds the tokens generated since the last fill into the bucket.
+func (l *Limits) fill() {
+	cycles := uint64(time.Since(l.last) / l.step)
+	if cycles == 0 {
+		return
+	}
+	l.last = l.last.Add(l.step * time.Duration(cycles))
+	l.size = min(l.capacity, l.size+cycles*l.addition)
+}
+
+// Peek reports whether n tokens are available, and takes them if so. It never blocks.
+func (l *Limits) Peek(n uint64) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.fill()
+	if l.size < n {
+		return false
+	}
+	l.size -= n
+	return true
+}
+
+// Wait takes n tokens from the bucket, blocks until enough tokens are available. Tokens are taken as soon as they are
+// generated, so n can be larger than the capacity.
+func (l *Limits) Wait(n uint64) {
+	for {
+		l.m.Lock()
+		l.fill()
+		m := min(n, l.size)
+		l.size -= m
+		n -= m
+		l.m.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(l.step)
+	}
+}
+
+// NewLimits returns a new Limits. The bucket is full initially.
+func NewLimits(addition uint64, step time.Duration) *Limits {
+	return &Limits{
+		addition: addition,
+		capacity: addition,
+		last:     time.Now(),
+		m:        &sync.Mutex{},
+		size:     addition,
+		step:     step,
+	}
+}
@@ -0,0 +1,27 @@
+package rate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitsPeek(t *testing.T) {
+	l := NewLimits(4, time.Second)
+	for range 4 {
+		if !l.Peek(1) {
+			t.FailNow()
+		}
+	}
+	if l.Peek(1) {
+		t.FailNow()
+	}
+}
+
+func TestLimitsWait(t *testing.T) {
+	l := NewLimits(4, time.Millisecond*10)
+	a := time.Now()
+	l.Wait(12)
+	if time.Since(a) < time.Millisecond*20 {
+		t.FailNow()
+	}
+}
@@ -1,6 +1,12 @@
 package ashe
 
 import (
+	"bytes"
+	"cmp"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,10 +14,14 @@ import (
 	"log"
 	"math"
 	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mohanson/daze"
 	"github.com/mohanson/daze/lib/doa"
+	"github.com/mohanson/daze/lib/lru"
 )
 
 // This document describes a tcp-based cryptographic proxy protocol. The main purpose of this protocol is to bypass
@@ -27,13 +37,41 @@ import (
 // +------+------+-----+---------+---------+
 //
 // - Salt    : Random 128 bytes for rc4 key, all data will be transmitted encrypted after there
-// - Time    : Timestamp of request. The server will reject requests with past or future timestamps to prevent replay
-//             attacks
+// - Time    : Timestamp of request. The server will reject requests with past or future timestamps, and requests whose
+//             salt has been seen in the validity window, to prevent replay attacks
 // - Net     : 0x01 : TCP
 //             0x03 : UDP
+//             The bit 0x10 is set if the client chooses the chacha20-poly1305 cipher suite
+//             The bit 0x20 is set if the client chooses the aes-256-gcm cipher suite
+//             The bits 0x30 are set if the client chooses the rc4-hkdf cipher suite, rc4 with a key for each direction
+//             The bit 0x40 is set if the client asks for an ephemeral key exchange
+//             The bit 0x80 is set if the client asks to compress the stream, tcp only
 // - Dst.Len : Destination address's length
 // - Dst     : Destination address
 //
+// With the chacha20-poly1305 cipher suite, everything after the Net, from Dst.Len on and in both directions, is sealed
+// in the chunks of daze.Seal by chacha20-poly1305 instead of rc4, with the rc4 key as the key. So the destination and
+// the data are protected from tampering as well. The aes-256-gcm cipher suite is the same, except that the chunks are
+// sealed by aes-256-gcm.
+//
+// With the ephemeral key exchange, the client sends its x25519 public key right after the Net, and waits for the
+// x25519 public key of the server. Both are encrypted with the key of the hello, that is, only peers which know the
+// pre-shared key can take part in the exchange. The key of the session is then the sha256 of the shared secret
+// followed by the key of the hello, which takes effect from Dst.Len on in both directions, and is used by the cipher
+// suite in place of the key of the hello. So a captured session can not be decrypted even if the pre-shared key leaks
+// later, at the cost of a round trip.
+//
+// With the compression, all data after the Code is compressed by deflate in both directions, and each write is flushed.
+// It is asked by the client for the destinations of rules with the compress option, see daze.RouterRules. Older
+// servers fail the request for the unknown network.
+//
+// Rc4 does not protect the Net from tampering, so an on-path attacker could strip the options above. If any of them is
+// set, the client sends a tag of 16 bytes after the Net and its public key, which is the truncated hmac-sha256 of them
+// keyed by the key of the hello. The server verifies the tag, and replies with its own tag over the Net, the public key
+// of the client and its own public key, right after its public key if any. Both sides abort the handshake on a
+// mismatch. Without the key exchange, the client does not wait for the tag of the server, it is read before the Code.
+// If all options are stripped, the server reads the tag as the destination, and fails to serve it.
+//
 // The server returns:
 //
 // +------+
@@ -44,13 +82,115 @@ import (
 //
 // - Code: 0x00: Succeed
 //         0x01: General server failure
+//         0x02: Destination blocked by the policy of the server
+//         0x03: Destination unreachable from the server
+//         0x04: Connection limit or quota of the server exceeded
+//
+// Clients treat unknown codes as a general failure, so codes can be added without breaking older clients.
+//
+// A tcp client may send data right after the request without waiting for the Code, which saves a round trip. The
+// server reads nothing after the request until the destination is dialed, so the data is relayed once the dial
+// succeeds, and dropped with the connection if it fails.
 
-// Conf is acting as package level configuration.
+// Conf is acting as package level configuration. They are the default values, instances can be tuned by their own
+// fields.
 var Conf = struct {
+	// EarlySize is the max number of bytes a client with Early sends before the reply of the server.
+	EarlySize int
 	// The time error allowed by the server in seconds.
 	LifeExpired int
+	// In strict mode, the time a failed handshake is held before the connection is closed, counting from its start.
+	Linger time.Duration
+	// ReplaySize is the number of handshakes the server remembers to reject replays. If more handshakes than that are
+	// made in the validity window, the oldest ones are forgotten and could be replayed.
+	ReplaySize int
+	// TokenDays is the max lifetime of access tokens in days, tokens which expire later are rejected.
+	TokenDays int
 }{
+	EarlySize:   16 * 1024,
 	LifeExpired: 120,
+	Linger:      time.Second * 8,
+	ReplaySize:  64 * 1024,
+	TokenDays:   31,
+}
+
+// Replay remembers the keys of recent handshakes, so that a captured handshake can not be replayed while its timestamp
+// is still valid.
+type Replay struct {
+	L *lru.Lru[[32]byte, int64]
+	M *sync.Mutex
+}
+
+// Seen reports whether the key has been seen before the time expired, and remembers it until then otherwise.
+func (r *Replay) Seen(key []byte, expired int64) bool {
+	r.M.Lock()
+	defer r.M.Unlock()
+	k := [32]byte(key)
+	if t, ok := r.L.GetExists(k); ok && time.Now().Unix() <= t {
+		return true
+	}
+	r.L.Set(k, expired)
+	return false
+}
+
+// NewReplay returns a new Replay, which remembers up to size handshakes.
+func NewReplay(size int) *Replay {
+	return &Replay{L: lru.New[[32]byte, int64](size), M: &sync.Mutex{}}
+}
+
+// Cipher suites. Rc4 is cryptographically broken and only kept for compatibility, it even encrypts both directions
+// with the same keystream. Rc4-hkdf derives a key for each direction, for peers which must stay with rc4.
+// Chacha20-poly1305 and aes-256-gcm provide both confidentiality and integrity. Aes-256-gcm is faster on cpus with aes
+// instructions.
+const (
+	SuiteAesGcm = "aes-256-gcm"
+	SuiteChacha = "chacha20-poly1305"
+	SuiteRc4    = "rc4"
+	SuiteRc4Kdf = "rc4-hkdf"
+)
+
+// Suites maps the cipher suites to their bits in the network byte of the hello. The suites themselves are implemented
+// by daze.CipherSuites.
+var Suites = map[string]byte{
+	SuiteAesGcm: 0x20,
+	SuiteChacha: 0x10,
+	SuiteRc4:    0x00,
+	SuiteRc4Kdf: 0x30,
+}
+
+// SuiteOf returns the cipher suite selected by the network byte of the hello, or an empty string if there is none.
+func SuiteOf(opt byte) string {
+	for k, v := range Suites {
+		if opt&0x30 == v {
+			return k
+		}
+	}
+	return ""
+}
+
+// Exchange derives the key of a session from the key of the hello, the private key of this side and the public key of
+// the other side.
+func Exchange(key []byte, pri *ecdh.PrivateKey, pub []byte) ([]byte, error) {
+	p, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := pri.ECDH(p)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(append(secret, key...))
+	return h[:], nil
+}
+
+// Commit returns the tag of the options negotiated in the handshake, side is 'c' for the client and 's' for the server.
+func Commit(key []byte, side byte, transcript ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte{side})
+	for _, e := range transcript {
+		h.Write(e)
+	}
+	return h.Sum(nil)[:16]
 }
 
 // TCPConn is an implementation of the Conn interface for tcp network connections.
@@ -63,6 +203,49 @@ func NewTCPConn(c io.ReadWriteCloser) *TCPConn {
 	return &TCPConn{c}
 }
 
+// EarlyConn is a connection whose request is sent but whose reply is not read yet. Writes are sent at once, until
+// Conf.EarlySize bytes are sent, then they wait for the reply. The reply is read by the first read or the waiting
+// write, and if the request failed, they and all later reads and writes return the error. The data sent early is
+// dropped by the server in that case.
+type EarlyConn struct {
+	io.ReadWriteCloser
+	Err   error
+	Once  *sync.Once
+	Reply func(io.ReadWriteCloser) error
+	Size  atomic.Int64
+}
+
+// Wait reads the reply once, and returns the error of it.
+func (e *EarlyConn) Wait() error {
+	e.Once.Do(func() {
+		e.Err = e.Reply(e.ReadWriteCloser)
+	})
+	return e.Err
+}
+
+// Read implements io.Reader.
+func (e *EarlyConn) Read(p []byte) (int, error) {
+	if err := e.Wait(); err != nil {
+		return 0, err
+	}
+	return e.ReadWriteCloser.Read(p)
+}
+
+// Write implements io.Writer.
+func (e *EarlyConn) Write(p []byte) (int, error) {
+	if e.Size.Add(int64(len(p))) > int64(Conf.EarlySize) {
+		if err := e.Wait(); err != nil {
+			return 0, err
+		}
+	}
+	return e.ReadWriteCloser.Write(p)
+}
+
+// NewEarlyConn returns a new EarlyConn, reply reads and checks the reply from the connection.
+func NewEarlyConn(c io.ReadWriteCloser, reply func(io.ReadWriteCloser) error) *EarlyConn {
+	return &EarlyConn{ReadWriteCloser: c, Once: &sync.Once{}, Reply: reply}
+}
+
 // UDPConn is an implementation of the Conn interface for udp network connections.
 type UDPConn struct {
 	io.ReadWriteCloser
@@ -106,11 +289,96 @@ type Server struct {
 	// Cipher is a pre-shared key.
 	Cipher []byte
 	Closer io.Closer
-	Listen string
+	// Dialer is the egress of the server, it is usually shared by all servers in the process.
+	Dialer daze.Dialer
+	// Ecdh requires clients to run the ephemeral key exchange, clients may choose whether to run it if it is false.
+	Ecdh bool
+	Hook daze.Hook
+	// LifeExpired is the time error allowed by the server in seconds, Conf.LifeExpired is used if it is zero.
+	LifeExpired int
+	Listen      string
+	// Listener is used instead of listening on Listen if it is not nil, for example, a listener shared by daze.Demux.
+	Listener net.Listener
+	// Master is the secret of access tokens, see daze.Token. If it is not empty, tokens are accepted until the day they
+	// expire, in the local time. They are ignored if Users is not empty.
+	Master string
+	// Replay rejects replayed handshakes, it is disabled if it is nil.
+	Replay *Replay
+	// Retired are pre-shared keys replaced by Cipher. They are still accepted until RetiredUntil, or forever if it is
+	// zero, so that passwords can be rotated without updating all clients at once. Handshakes made with them are
+	// logged, which tells the clients left behind. They are ignored if Users is not empty.
+	Retired      [][]byte
+	RetiredUntil time.Time
+	// Strict makes all failed handshakes look the same to the peer, wherever they fail.
+	Strict bool
+	// Suite is the cipher suite required from clients, clients may choose any suite if it is rc4 or empty.
+	Suite string
+	// Users maps the names of users to their pre-shared keys. If it is not empty, clients authenticate with the key
+	// of any user instead of Cipher, and the name of the user is recorded in the context.
+	Users map[string][]byte
+}
+
+// Cred is a pre-shared key accepted by the server.
+type Cred struct {
+	Cipher []byte
+	// Expires is the day after which the key is rejected, it is only set for access tokens.
+	Expires string
+	Retired bool
+	// User is the name of the user of the key, it is empty if the server has a single credential.
+	User string
+}
+
+// Keys returns the pre-shared keys accepted by the server at the moment.
+func (s *Server) Keys() []Cred {
+	r := []Cred{}
+	if len(s.Users) != 0 {
+		for user, cipher := range s.Users {
+			r = append(r, Cred{Cipher: cipher, User: user})
+		}
+		return r
+	}
+	r = append(r, Cred{Cipher: s.Cipher})
+	if s.RetiredUntil.IsZero() || time.Now().Before(s.RetiredUntil) {
+		for _, cipher := range s.Retired {
+			r = append(r, Cred{Cipher: cipher, Retired: true})
+		}
+	}
+	if s.Master != "" {
+		now := time.Now()
+		for i := range Conf.TokenDays + 1 {
+			day := now.AddDate(0, 0, i).Format(time.DateOnly)
+			r = append(r, Cred{Cipher: daze.Salt(daze.Token(s.Master, day)), Expires: day})
+		}
+	}
+	return r
+}
+
+// Strictly runs the handshake f. In strict mode, the server never replies to a failed handshake, instead it drains
+// the connection, which is closed Conf.Linger after the handshake started.
+func (s *Server) Strictly(cli io.ReadWriteCloser, f func() error) error {
+	if !s.Strict {
+		return f()
+	}
+	t := time.AfterFunc(Conf.Linger, func() { cli.Close() })
+	err := f()
+	if err == nil && t.Stop() {
+		return nil
+	}
+	if err == nil {
+		err = errors.New("daze: handshake timeout")
+	}
+	io.Copy(io.Discard, cli)
+	return err
 }
 
 // Hello creates an encrypted channel.
 func (s *Server) Hello(cli io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	con, _, _, err := s.Session(cli)
+	return con, err
+}
+
+// Session creates an encrypted channel, and returns the key of it and the credential of the client as well.
+func (s *Server) Session(cli io.ReadWriteCloser) (io.ReadWriteCloser, []byte, Cred, error) {
 	var (
 		buf     []byte
 		con     io.ReadWriteCloser
@@ -118,79 +386,194 @@ func (s *Server) Hello(cli io.ReadWriteCloser) (io.ReadWriteCloser, error) {
 		gap     int64
 		gapSign int64
 	)
-	buf = make([]byte, 32)
+	buf = make([]byte, 40)
 	_, err = io.ReadFull(cli, buf)
 	if err != nil {
-		return nil, err
+		return nil, nil, Cred{}, err
 	}
-	// To build a key from pre-shared key. Use xor as our key derivation function.
-	for i := range 32 {
-		buf[i] ^= s.Cipher[i]
+	life := s.LifeExpired
+	if life == 0 {
+		life = Conf.LifeExpired
 	}
-	con = daze.Gravity(cli, buf)
-	buf = make([]byte, 8)
-	_, err = io.ReadFull(con, buf)
-	if err != nil {
-		return nil, err
-	}
-	// Get absolute value. Hacker's Delight, 2-4, Absolute Value Function.
-	// See https://doc.lagout.org/security/Hackers%20Delight.pdf
-	gap = time.Now().Unix() - int64(binary.BigEndian.Uint64(buf))
-	gapSign = gap >> 63
-	if gap^gapSign-gapSign > int64(Conf.LifeExpired) {
-		return nil, errors.New("daze: request expired")
+	// The key of a user decrypts the timestamp into the allowed window, the others decrypt it into noise.
+	for _, cred := range s.Keys() {
+		// To build a key from pre-shared key. Use xor as our key derivation function.
+		key := make([]byte, 32)
+		for i := range 32 {
+			key[i] = buf[i] ^ cred.Cipher[i]
+		}
+		con = daze.Gravity(&daze.ReadWriteCloser{
+			Reader: io.MultiReader(bytes.NewReader(buf[32:]), cli),
+			Writer: cli,
+			Closer: cli,
+		}, key)
+		tsb := make([]byte, 8)
+		io.ReadFull(con, tsb)
+		// Get absolute value. Hacker's Delight, 2-4, Absolute Value Function.
+		// See https://doc.lagout.org/security/Hackers%20Delight.pdf
+		ts := int64(binary.BigEndian.Uint64(tsb))
+		gap = time.Now().Unix() - ts
+		gapSign = gap >> 63
+		// The comparison is branch free as well, so the time spent does not tell how far the timestamp is off.
+		if (int64(life)-(gap^gapSign-gapSign))>>63 != 0 {
+			continue
+		}
+		// The handshake can not be replayed once its timestamp expires, so it is remembered until then.
+		if s.Replay != nil && s.Replay.Seen(key, ts+int64(life)) {
+			return nil, nil, Cred{}, errors.New("daze: request replayed")
+		}
+		return con, key, cred, nil
 	}
-	return con, nil
+	return nil, nil, Cred{}, errors.New("daze: request expired")
 }
 
 // Serve incoming connections. Parameter cli will be closed automatically when the function exits.
 func (s *Server) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
 	var (
-		buf    []byte
-		con    io.ReadWriteCloser
-		dst    string
-		dstLen uint8
-		dstNet uint8
-		err    error
-		srv    io.ReadWriteCloser
+		buf     []byte
+		con     io.ReadWriteCloser
+		cpr     bool
+		cred    Cred
+		dst     string
+		dstLen  uint8
+		dstNet  uint8
+		err     error
+		key     []byte
+		network string
+		srv     io.ReadWriteCloser
 	)
-	con, err = s.Hello(cli)
-	if err != nil {
-		return err
-	}
-	buf = make([]byte, 2)
-	_, err = io.ReadFull(con, buf)
+	err = s.Strictly(cli, func() error {
+		con, key, cred, err = s.Session(cli)
+		if err != nil {
+			return err
+		}
+		ctx.User = cred.User
+		if ctx.User != "" {
+			log.Printf("conn: %08x   user %s", ctx.Cid, ctx.User)
+		}
+		if cred.Retired {
+			log.Printf("conn: %08x   retired key", ctx.Cid)
+		}
+		if cred.Expires != "" {
+			log.Printf("conn: %08x   token expires %s", ctx.Cid, cred.Expires)
+		}
+		buf = make([]byte, 1)
+		_, err = io.ReadFull(con, buf)
+		if err != nil {
+			return err
+		}
+		dstNet = buf[0] &^ 0xf0
+		opt := buf[0]
+		cpr = opt&0x80 != 0 && dstNet == 0x01
+		suite := SuiteOf(opt)
+		if suite == "" {
+			return errors.New("daze: unknown cipher suite")
+		}
+		if s.Suite != "" && s.Suite != SuiteRc4 && s.Suite != suite {
+			return fmt.Errorf("daze: cipher suite %s is not allowed", suite)
+		}
+		if opt&0x40 == 0 && s.Ecdh {
+			return errors.New("daze: ephemeral key exchange is required")
+		}
+		if opt&0xf0 != 0 {
+			pub := []byte{}
+			if opt&0x40 != 0 {
+				pub = make([]byte, 32)
+				_, err = io.ReadFull(con, pub)
+				if err != nil {
+					return err
+				}
+			}
+			tag := make([]byte, 16)
+			_, err = io.ReadFull(con, tag)
+			if err != nil {
+				return err
+			}
+			if !hmac.Equal(tag, Commit(key, 'c', []byte{opt}, pub)) {
+				return errors.New("daze: handshake options tampered")
+			}
+			pri := (*ecdh.PrivateKey)(nil)
+			mine := []byte{}
+			if opt&0x40 != 0 {
+				pri = doa.Try(ecdh.X25519().GenerateKey(rand.Reader))
+				mine = pri.PublicKey().Bytes()
+			}
+			_, err = con.Write(append(slices.Clip(mine), Commit(key, 's', []byte{opt}, pub, mine)...))
+			if err != nil {
+				return err
+			}
+			if pri != nil {
+				key, err = Exchange(key, pri, pub)
+				if err != nil {
+					return err
+				}
+				con = daze.Gravity(cli, key)
+			}
+		}
+		if suite != SuiteRc4 {
+			con, err = daze.WrapCipher(cli, suite, key, false)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = io.ReadFull(con, buf)
+		if err != nil {
+			return err
+		}
+		dstLen = buf[0]
+		buf = make([]byte, dstLen)
+		_, err = io.ReadFull(con, buf)
+		if err != nil {
+			return err
+		}
+		dst = string(buf)
+		switch dstNet {
+		case 0x01:
+			network = "tcp"
+		case 0x03:
+			network = "udp"
+		default:
+			// A wrong key passes the time check with a tiny chance, but hardly gives a known network.
+			if s.Strict {
+				return errors.New("daze: unknown network")
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	dstNet = buf[0]
-	dstLen = buf[1]
-	buf = make([]byte, dstLen)
-	_, err = io.ReadFull(con, buf)
-	if err != nil {
-		return err
+	code := byte(1)
+	dst, err = daze.CheckAddr(dst)
+	if err == nil {
+		err = s.Hook.OnDial(ctx, network, dst)
 	}
-	dst = string(buf)
-	switch dstNet {
-	case 0x01:
-		log.Printf("conn: %08x   dial network=tcp address=%s", ctx.Cid, dst)
-		srv, err = daze.Dial("tcp", dst)
-	case 0x03:
-		log.Printf("conn: %08x   dial network=udp address=%s", ctx.Cid, dst)
-		srv, err = daze.Dial("udp", dst)
+	if err == nil {
+		log.Printf("conn: %08x   dial network=%s address=%s", ctx.Cid, network, dst)
+		srv, err = s.Dialer.Dial(ctx, network, dst)
+		code = 3
 	}
 	if err != nil {
-		con.Write([]byte{1})
+		switch {
+		case errors.Is(err, daze.ErrBlocked):
+			code = 2
+		case errors.Is(err, daze.ErrLimited):
+			code = 4
+		}
+		con.Write([]byte{code})
 		return err
 	}
 	con.Write([]byte{0})
+	if cpr {
+		con = daze.Compress(con)
+	}
 	switch dstNet {
 	case 0x01:
 		con = NewTCPConn(con)
 	case 0x03:
 		con = NewUDPConn(con)
 	}
-	daze.Link(con, srv)
+	ctx.Link(con, srv)
 	return nil
 }
 
@@ -204,7 +587,7 @@ func (s *Server) Close() error {
 
 // Run it.
 func (s *Server) Run() error {
-	l, err := net.Listen("tcp", s.Listen)
+	l, err := daze.Listen(s.Listener, s.Listen)
 	if err != nil {
 		return err
 	}
@@ -226,9 +609,14 @@ func (s *Server) Run() error {
 			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
 			go func() {
 				defer cli.Close()
-				if err := s.Serve(ctx, cli); err != nil {
+				err := s.Hook.OnAccept(ctx, cli.RemoteAddr())
+				if err == nil {
+					err = s.Serve(ctx, cli)
+				}
+				if err != nil {
 					log.Printf("conn: %08x  error %s", ctx.Cid, err)
 				}
+				s.Hook.OnClose(ctx, err)
 				log.Printf("conn: %08x closed", ctx.Cid)
 			}()
 		}
@@ -240,8 +628,12 @@ func (s *Server) Run() error {
 // NewServer returns a new Server. Cipher is a password in string form, with no length limit.
 func NewServer(listen string, cipher string) *Server {
 	return &Server{
-		Listen: listen,
-		Cipher: daze.Salt(cipher),
+		Cipher:      daze.Salt(cipher),
+		Dialer:      daze.NewEngine(),
+		Hook:        daze.NewHookChain(),
+		LifeExpired: Conf.LifeExpired,
+		Listen:      listen,
+		Replay:      NewReplay(Conf.ReplaySize),
 	}
 }
 
@@ -249,11 +641,32 @@ func NewServer(listen string, cipher string) *Server {
 type Client struct {
 	// Cipher is a pre-shared key.
 	Cipher []byte
-	Server string
+	// Dialer is used to connect to the server, for example, through an upstream proxy.
+	Dialer daze.Dialer
+	// Early returns tcp connections without waiting for the reply of the server, so that the first data of the
+	// application is sent along with the request, which saves a round trip per connection. The reply is checked by the
+	// first read, see EarlyConn. Servers need no change for it.
+	Early bool
+	// Ecdh runs an ephemeral key exchange for each connection, so that captured sessions can not be decrypted even if
+	// the pre-shared key leaks later.
+	Ecdh bool
+	// Keepalive is the idle time after which the connection to the server is probed by tcp keepalives, so that
+	// long-lived idle connections are not dropped by stateful firewalls. Zero disables keepalives. Data is sent as is
+	// in the ashe protocol, so there is no room for a keepalive in the protocol itself.
+	Keepalive time.Duration
+	Server    string
+	// Suite is the cipher suite, rc4 is used if it is empty.
+	Suite string
 }
 
 // Hello creates an encrypted channel.
 func (c *Client) Hello(srv io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	con, _, err := c.Session(srv)
+	return con, err
+}
+
+// Session creates an encrypted channel, and returns the key of it as well.
+func (c *Client) Session(srv io.ReadWriteCloser) (io.ReadWriteCloser, []byte, error) {
 	var (
 		buf []byte
 		con io.ReadWriteCloser
@@ -263,20 +676,34 @@ func (c *Client) Hello(srv io.ReadWriteCloser) (io.ReadWriteCloser, error) {
 	io.ReadFull(&daze.RandomReader{}, buf)
 	_, err = srv.Write(buf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	// To build a key from pre-shared key. Use xor as our key derivation function.
 	for i := range 32 {
 		buf[i] ^= c.Cipher[i]
 	}
-	con = daze.Gravity(srv, buf)
+	key := buf
+	con = daze.Gravity(srv, key)
 	buf = make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, uint64(time.Now().Unix()))
 	_, err = con.Write(buf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return con, nil
+	return con, key, nil
+}
+
+// Verify reads the tag of the server from the hello, and compares it with the expected one.
+func (c *Client) Verify(hello io.Reader, tag []byte) error {
+	buf := make([]byte, len(tag))
+	_, err := io.ReadFull(hello, buf)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(buf, tag) {
+		return errors.New("daze: handshake options tampered")
+	}
+	return nil
 }
 
 // Establish an existing connection. It is the caller's responsibility to close the conn.
@@ -285,15 +712,25 @@ func (c *Client) Estab(ctx *daze.Context, srv io.ReadWriteCloser, network string
 		buf []byte
 		con io.ReadWriteCloser
 		err error
-		n   = len(address)
+		key []byte
+		n   int
 	)
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("daze: network must be tcp or udp")
+	}
+	address, err = daze.CheckAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	n = len(address)
 	if n > 255 {
 		return nil, fmt.Errorf("daze: destination address too long %s", address)
 	}
-	if network != "tcp" && network != "udp" {
-		return nil, fmt.Errorf("daze: network must be tcp or udp")
+	suite := cmp.Or(c.Suite, SuiteRc4)
+	if _, ok := Suites[suite]; !ok {
+		return nil, fmt.Errorf("daze: unknown cipher suite %s", c.Suite)
 	}
-	con, err = c.Hello(srv)
+	con, key, err = c.Session(srv)
 	if err != nil {
 		return nil, err
 	}
@@ -306,21 +743,75 @@ func (c *Client) Estab(ctx *daze.Context, srv io.ReadWriteCloser, network string
 	}
 	buf[1] = uint8(n)
 	copy(buf[2:], []byte(address))
+	buf[0] |= Suites[suite]
+	if c.Ecdh {
+		buf[0] |= 0x40
+	}
+	if ctx.Compress && network == "tcp" {
+		buf[0] |= 0x80
+	}
+	cpr := buf[0]&0x80 != 0
+	hello := con
+	tag := []byte{}
+	if buf[0]&0xf0 != 0 {
+		opt := buf[0]
+		pri := (*ecdh.PrivateKey)(nil)
+		mine := []byte{}
+		if c.Ecdh {
+			pri = doa.Try(ecdh.X25519().GenerateKey(rand.Reader))
+			mine = pri.PublicKey().Bytes()
+		}
+		head := append([]byte{opt}, mine...)
+		head = append(head, Commit(key, 'c', []byte{opt}, mine)...)
+		_, err = con.Write(head)
+		if err != nil {
+			return nil, err
+		}
+		pub := []byte{}
+		if c.Ecdh {
+			pub = make([]byte, 32)
+			_, err = io.ReadFull(con, pub)
+			if err != nil {
+				return nil, err
+			}
+		}
+		tag = Commit(key, 's', []byte{opt}, mine, pub)
+		if c.Ecdh {
+			err = c.Verify(hello, tag)
+			if err != nil {
+				return nil, err
+			}
+			tag = nil
+			key, err = Exchange(key, pri, pub)
+			if err != nil {
+				return nil, err
+			}
+			con = daze.Gravity(srv, key)
+		}
+		if suite != SuiteRc4 {
+			con, err = daze.WrapCipher(srv, suite, key, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		buf = buf[1:]
+	}
 	_, err = con.Write(buf)
 	if err != nil {
 		return nil, err
 	}
-	buf = make([]byte, 1)
-	_, err = io.ReadFull(con, buf)
-	if err != nil {
-		return nil, err
+	if c.Early && network == "tcp" {
+		con = NewEarlyConn(con, func(con io.ReadWriteCloser) error {
+			return c.Reply(hello, con, tag, address)
+		})
+	} else {
+		err = c.Reply(hello, con, tag, address)
+		if err != nil {
+			return nil, err
+		}
 	}
-	switch {
-	case buf[0] == 0:
-	case buf[0] == 1:
-		return nil, errors.New("daze: general server failure")
-	case buf[0] >= 2:
-		return nil, errors.New("daze: receive error response")
+	if cpr {
+		con = daze.Compress(con)
 	}
 	switch network {
 	case "tcp":
@@ -331,12 +822,42 @@ func (c *Client) Estab(ctx *daze.Context, srv io.ReadWriteCloser, network string
 	panic("unreachable")
 }
 
+// Reply reads the tag of the server from the hello if there is one, and the reply of the server to the request.
+func (c *Client) Reply(hello io.Reader, con io.Reader, tag []byte, address string) error {
+	if len(tag) != 0 {
+		err := c.Verify(hello, tag)
+		if err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(con, buf)
+	if err != nil {
+		return err
+	}
+	switch {
+	case buf[0] == 0:
+	case buf[0] == 1:
+		return errors.New("daze: general server failure")
+	case buf[0] == 2:
+		return fmt.Errorf("daze: %s has been %w by the server", address, daze.ErrBlocked)
+	case buf[0] == 3:
+		return fmt.Errorf("daze: %s is %w from the server", address, daze.ErrUnreachable)
+	case buf[0] == 4:
+		return fmt.Errorf("daze: %s has been %w by the server", address, daze.ErrLimited)
+	case buf[0] >= 5:
+		return errors.New("daze: receive error response")
+	}
+	return nil
+}
+
 // Dial connects to the address on the named network.
 func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
-	srv, err := daze.Dial("tcp", c.Server)
+	srv, err := c.Dialer.Dial(ctx, "tcp", c.Server)
 	if err != nil {
 		return nil, err
 	}
+	daze.Keepalive(srv, c.Keepalive)
 	con, err := c.Estab(ctx, srv, network, address)
 	if err != nil {
 		srv.Close()
@@ -347,7 +868,8 @@ func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.Rea
 // NewClient returns a new Client. Cipher is a password in string form, with no length limit.
 func NewClient(server, cipher string) *Client {
 	return &Client{
-		Server: server,
 		Cipher: daze.Salt(cipher),
+		Dialer: &daze.Direct{},
+		Server: server,
 	}
 }
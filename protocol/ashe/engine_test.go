@@ -1,10 +1,14 @@
 package ashe
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"math/rand/v2"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/mohanson/daze"
 	"github.com/mohanson/daze/lib/doa"
@@ -125,3 +129,489 @@ func TestProtocolAsheUDP(t *testing.T) {
 	buf := make([]byte, 128)
 	doa.Try(io.ReadFull(cli, buf[:128]))
 }
+
+func TestProtocolAsheStrict(t *testing.T) {
+	linger := Conf.Linger
+	Conf.Linger = time.Millisecond * 200
+	defer func() { Conf.Linger = linger }()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Strict = true
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	for _, e := range []func(c io.ReadWriteCloser){
+		// Short salt.
+		func(c io.ReadWriteCloser) { c.Write(make([]byte, 16)) },
+		// Wrong password, the time is garbage.
+		func(c io.ReadWriteCloser) { doa.Try(NewClient(DazeServerListenOn, "wrong").Hello(c)) },
+		// Expired request.
+		func(c io.ReadWriteCloser) {
+			buf := make([]byte, 32)
+			salt := daze.Salt(Password)
+			for i := range 32 {
+				buf[i] ^= salt[i]
+			}
+			c.Write(make([]byte, 32))
+			con := daze.Gravity(c, buf)
+			con.Write(make([]byte, 8))
+		},
+		// Unknown network.
+		func(c io.ReadWriteCloser) {
+			con := doa.Try(NewClient(DazeServerListenOn, Password).Hello(c))
+			con.Write([]byte{0x09, 0x00})
+		},
+	} {
+		cli := doa.Try(net.Dial("tcp", DazeServerListenOn))
+		now := time.Now()
+		e(cli)
+		n, err := cli.Read(make([]byte, 1))
+		doa.Doa(n == 0 && err != nil)
+		gap := time.Since(now)
+		doa.Doa(gap >= Conf.Linger && gap < Conf.Linger*2)
+		cli.Close()
+	}
+}
+
+func TestProtocolAsheBlocked(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	rules := daze.NewRouterRules()
+	rules.L = append(rules.L, "127.0.0.1")
+	engine := daze.NewEngine()
+	engine.Router = daze.NewRouterChain(rules, daze.NewRouterRight(daze.RoadFucked))
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Dialer = engine
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	cli.Close()
+	_, err := dazeClient.Dial(ctx, "tcp", "localhost:80")
+	doa.Doa(errors.Is(err, daze.ErrBlocked))
+}
+
+func TestProtocolAsheUsers(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	users := make(chan string, 1)
+	engine := daze.NewEngine()
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		users <- ctx.User
+		return engine.Dial(ctx, network, address)
+	})
+	dazeServer.Users = map[string][]byte{"alice": daze.Salt("alice"), "bob": daze.Salt("bob")}
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	for _, user := range []string{"alice", "bob"} {
+		dazeClient := NewClient(DazeServerListenOn, user)
+		cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+		doa.Doa(<-users == user)
+		cli.Close()
+	}
+	// The cipher is replaced by the users.
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	doa.Doa(doa.Err(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn)) != nil)
+}
+
+func TestProtocolAsheRetired(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Retired = [][]byte{daze.Salt("retired")}
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	for _, cipher := range []string{Password, "retired"} {
+		dazeClient := NewClient(DazeServerListenOn, cipher)
+		cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+		cli.Close()
+	}
+	dazeServer.Close()
+
+	// The grace period is over.
+	dazeServer = NewServer(DazeServerListenOn, Password)
+	dazeServer.Retired = [][]byte{daze.Salt("retired")}
+	dazeServer.RetiredUntil = time.Now().Add(-time.Second)
+	defer dazeServer.Close()
+	dazeServer.Run()
+	dazeClient := NewClient(DazeServerListenOn, "retired")
+	doa.Doa(doa.Err(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn)) != nil)
+}
+
+func TestProtocolAsheToken(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Master = "master"
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	now := time.Now()
+	for _, day := range []int{0, Conf.TokenDays} {
+		dazeClient := NewClient(DazeServerListenOn, daze.Token("master", now.AddDate(0, 0, day).Format(time.DateOnly)))
+		cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+		cli.Close()
+	}
+	// Tokens which expired, or live longer than allowed, are rejected.
+	for _, day := range []int{-1, Conf.TokenDays + 1} {
+		dazeClient := NewClient(DazeServerListenOn, daze.Token("master", now.AddDate(0, 0, day).Format(time.DateOnly)))
+		doa.Doa(doa.Err(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn)) != nil)
+	}
+	dazeClient := NewClient(DazeServerListenOn, daze.Token("other", now.Format(time.DateOnly)))
+	doa.Doa(doa.Err(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn)) != nil)
+}
+
+func TestProtocolAsheCompress(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	for _, suite := range []string{SuiteRc4, SuiteChacha} {
+		dazeClient := NewClient(DazeServerListenOn, Password)
+		dazeClient.Suite = suite
+		ctx := &daze.Context{Compress: true}
+		cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+		doa.Try(cli.Write([]byte{0x00, 0x2a, 0x10, 0x00}))
+		buf := make([]byte, 4096)
+		doa.Try(io.ReadFull(cli, buf))
+		for i := range buf {
+			doa.Doa(buf[i] == 0x2a)
+		}
+		cli.Close()
+	}
+}
+
+func TestProtocolAsheEarly(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		time.Sleep(time.Millisecond * 100)
+		return daze.Dial(network, address)
+	})
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	for _, ecdh := range []bool{false, true} {
+		for _, suite := range []string{SuiteRc4, SuiteChacha} {
+			dazeClient := NewClient(DazeServerListenOn, Password)
+			dazeClient.Early = true
+			dazeClient.Ecdh = ecdh
+			dazeClient.Suite = suite
+			ctx := &daze.Context{}
+			// The dial returns before the server dials the destination.
+			now := time.Now()
+			cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+			doa.Doa(time.Since(now) < time.Millisecond*100)
+			doa.Try(cli.Write([]byte{0x00, 0x2a, 0x10, 0x00}))
+			buf := make([]byte, 4096)
+			doa.Try(io.ReadFull(cli, buf))
+			for i := range buf {
+				doa.Doa(buf[i] == 0x2a)
+			}
+			cli.Close()
+		}
+	}
+
+	// The failure of the request is returned by the first read.
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.Early = true
+	cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", "127.0.0.1:1"))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x2a, 0x10, 0x00}))
+	doa.Doa(errors.Is(doa.Err(cli.Read(make([]byte, 1))), daze.ErrUnreachable))
+	doa.Doa(errors.Is(doa.Err(cli.Write(make([]byte, Conf.EarlySize))), daze.ErrUnreachable))
+}
+
+func TestProtocolAsheChacha(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Suite = SuiteChacha
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.Suite = SuiteChacha
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x2a, 0x10, 0x00}))
+	buf := make([]byte, 4096)
+	doa.Try(io.ReadFull(cli, buf))
+	for i := range buf {
+		doa.Doa(buf[i] == 0x2a)
+	}
+
+	// Clients of the rc4 cipher suite are rejected by the server which requires chacha20-poly1305.
+	dazeClient.Suite = SuiteRc4
+	doa.Doa(doa.Err(dazeClient.Dial(ctx, "tcp", EchoServerListenOn)) != nil)
+}
+
+func TestProtocolAsheRc4Hkdf(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.Suite = SuiteRc4Kdf
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x2a, 0x10, 0x00}))
+	buf := make([]byte, 4096)
+	doa.Try(io.ReadFull(cli, buf))
+	for i := range buf {
+		doa.Doa(buf[i] == 0x2a)
+	}
+	doa.Doa(SuiteOf(Suites[SuiteRc4Kdf]) == SuiteRc4Kdf)
+}
+
+func TestProtocolAsheAesGcm(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Suite = SuiteAesGcm
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.Suite = SuiteAesGcm
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x2a, 0x10, 0x00}))
+	buf := make([]byte, 4096)
+	doa.Try(io.ReadFull(cli, buf))
+	for i := range buf {
+		doa.Doa(buf[i] == 0x2a)
+	}
+
+	// Clients of other cipher suites are rejected by the server which requires aes-256-gcm.
+	dazeClient.Suite = SuiteChacha
+	doa.Doa(doa.Err(dazeClient.Dial(ctx, "tcp", EchoServerListenOn)) != nil)
+}
+
+func TestProtocolAsheEcdh(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Ecdh = true
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.Ecdh = true
+	ctx := &daze.Context{}
+	for _, suite := range []string{SuiteRc4, SuiteChacha, SuiteAesGcm} {
+		dazeClient.Suite = suite
+		cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+		doa.Try(cli.Write([]byte{0x00, 0x2a, 0x10, 0x00}))
+		buf := make([]byte, 4096)
+		doa.Try(io.ReadFull(cli, buf))
+		for i := range buf {
+			doa.Doa(buf[i] == 0x2a)
+		}
+		cli.Close()
+	}
+
+	// Clients without the key exchange are rejected by the server which requires it.
+	dazeClient.Ecdh = false
+	doa.Doa(doa.Err(dazeClient.Dial(ctx, "tcp", EchoServerListenOn)) != nil)
+}
+
+// RecordConn records the data written to the connection.
+type RecordConn struct {
+	io.ReadWriteCloser
+	B *bytes.Buffer
+}
+
+func (c *RecordConn) Write(p []byte) (int, error) {
+	c.B.Write(p)
+	return c.ReadWriteCloser.Write(p)
+}
+
+func TestProtocolAsheReplay(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	record := &bytes.Buffer{}
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		srv, err := daze.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &RecordConn{ReadWriteCloser: srv, B: record}, nil
+	})
+	cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+	cli.Close()
+
+	// The captured handshake is rejected when it is sent again.
+	srv := doa.Try(daze.Dial("tcp", DazeServerListenOn))
+	defer srv.Close()
+	doa.Try(srv.Write(record.Bytes()))
+	doa.Doa(doa.Err(io.ReadFull(srv, make([]byte, 1))) != nil)
+}
+
+// TamperConn flips the bits of Mask of the byte at offset Pos written to the connection.
+type TamperConn struct {
+	io.ReadWriteCloser
+	Mask byte
+	N    int
+	Pos  int
+}
+
+func (c *TamperConn) Write(p []byte) (int, error) {
+	if c.N <= c.Pos && c.Pos < c.N+len(p) {
+		p = append([]byte{}, p...)
+		p[c.Pos-c.N] ^= c.Mask
+	}
+	c.N += len(p)
+	return c.ReadWriteCloser.Write(p)
+}
+
+func TestProtocolAsheChachaTampered(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	// Flip a bit of the sealed destination, the server must refuse it rather than dialing a wrong address.
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.Suite = SuiteChacha
+	dazeClient.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		srv, err := daze.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		// Skip the salt and the time of the hello, the net and its tag, and the length chunk.
+		return &TamperConn{ReadWriteCloser: srv, Mask: 0x01, Pos: 32 + 8 + 1 + 16 + 18}, nil
+	})
+	ctx := &daze.Context{}
+	doa.Doa(doa.Err(dazeClient.Dial(ctx, "tcp", EchoServerListenOn)) != nil)
+	dazeClient.Dialer = &daze.Direct{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	cli.Close()
+}
+
+func TestProtocolAsheDowngrade(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	// Strip or change the cipher suite, or ask for a key exchange, the server must abort the handshake.
+	for _, mask := range []byte{0x10, 0x30, 0x40} {
+		dazeClient := NewClient(DazeServerListenOn, Password)
+		dazeClient.Suite = SuiteChacha
+		dazeClient.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+			srv, err := daze.Dial(network, address)
+			if err != nil {
+				return nil, err
+			}
+			// If the suite is stripped, the server reads the tag as the destination, and may wait for more data.
+			srv.SetDeadline(time.Now().Add(time.Second))
+			return &TamperConn{ReadWriteCloser: srv, Mask: mask, Pos: 32 + 8}, nil
+		})
+		ctx := &daze.Context{}
+		cli, err := dazeClient.Dial(ctx, "tcp", EchoServerListenOn)
+		if err == nil {
+			// The client may only notice it when the server closes the connection.
+			_, err = cli.Write([]byte{0x00, 0x00, 0x00, 0x80})
+			if err == nil {
+				_, err = io.ReadFull(cli, make([]byte, 128))
+			}
+			cli.Close()
+		}
+		doa.Doa(err != nil)
+	}
+}
+
+func TestProtocolAsheMalicious(t *testing.T) {
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		panic("unreachable")
+	})
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	for _, dst := range []string{
+		"example.com\n2026/01/01 main: exit:80",
+		"example.com\x1b[2J:80",
+		"example.com",
+	} {
+		// The client refuses to send it.
+		doa.Doa(doa.Err(dazeClient.Dial(&daze.Context{}, "tcp", dst)) != nil)
+		// The server refuses to dial it.
+		srv := doa.Try(daze.Dial("tcp", DazeServerListenOn))
+		con, _, err := dazeClient.Session(srv)
+		doa.Nil(err)
+		doa.Try(con.Write(append([]byte{0x01, byte(len(dst))}, dst...)))
+		buf := make([]byte, 1)
+		doa.Try(io.ReadFull(con, buf))
+		doa.Doa(buf[0] == 1)
+		srv.Close()
+	}
+}
+
+func TestProtocolAsheReason(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Hook = daze.NewHookLimit(0, 1)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	ctx := &daze.Context{}
+	_, err := dazeClient.Dial(ctx, "tcp", "127.0.0.1:1")
+	doa.Doa(errors.Is(err, daze.ErrUnreachable))
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	_, err = dazeClient.Dial(ctx, "tcp", EchoServerListenOn)
+	doa.Doa(errors.Is(err, daze.ErrLimited))
+}
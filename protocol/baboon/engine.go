@@ -1,25 +1,38 @@
 package baboon
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/mohanson/daze"
 	"github.com/mohanson/daze/lib/doa"
 	"github.com/mohanson/daze/protocol/ashe"
+	"github.com/mohanson/daze/protocol/czar"
 )
 
 // Protocol baboon is the ashe protocol based on http.
+//
+// Over tls, http/2 is negotiated and each proxied connection is a stream of the CONNECT method, like browsers talking
+// to a proxy, which benefits from the flow control of http/2.
+//
+// Each dial costs a http request and an ashe handshake. If the client asks for /mux, the connection is upgraded into a
+// multiplexer of the czar protocol after the http request, and subsequent dials open streams on it instead.
 
-// Conf is acting as package level configuration.
+// Conf is acting as package level configuration. They are the default values, instances can be tuned by their own
+// fields.
 var Conf = struct {
 	// Fake website, requests with incorrect signatures will be redirected to this address. Note that if you use the
 	// baboon protocol, specify a local address whenever possible. For a cloud service provider, if it finds that you
@@ -34,9 +47,26 @@ var Conf = struct {
 type Server struct {
 	Cipher []byte
 	Closer io.Closer
+	// Config enables tls and thus http/2 if it is not nil.
+	Config *tls.Config
+	Dialer daze.Dialer
+	Hook   daze.Hook
 	Listen string
-	Masker string
+	// Listener is used instead of listening on Listen if it is not nil, for example, a listener shared by daze.Demux.
+	Listener net.Listener
+	Masker   string
+	// Master is the secret of access tokens, see ashe.Server.Master.
+	Master string
+	// Mux allows clients to upgrade the connection into a multiplexer.
+	Mux    bool
 	NextID uint32
+	// Replay routes replayed signatures to the masker, it is disabled if it is nil.
+	Replay *ashe.Replay
+	// Retired are pre-shared keys replaced by Cipher, see ashe.Server.Retired.
+	Retired      [][]byte
+	RetiredUntil time.Time
+	// Users maps the names of users to their pre-shared keys, see ashe.Server.Users.
+	Users map[string][]byte
 }
 
 // ServeMask forward the request to a fake website. From the outside, the daze server looks like a normal website.
@@ -46,8 +76,20 @@ func (s *Server) ServeMask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.Header = r.Header
-	ret, err := http.DefaultClient.Do(req)
+	// The fake website is reached through the dialer of the server like any other destination.
+	tsp := &http.Transport{
+		DialContext: func(_ context.Context, network string, address string) (net.Conn, error) {
+			srv, err := s.Dialer.Dial(&daze.Context{}, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return daze.NewNetConn(srv), nil
+		},
+	}
+	defer tsp.CloseIdleConnections()
+	ret, err := (&http.Client{Transport: tsp}).Do(req)
 	if err != nil {
+		log.Println("baboon:", err)
 		return
 	}
 	defer ret.Body.Close()
@@ -74,12 +116,64 @@ func (s *Server) ServeDaze(w http.ResponseWriter, r *http.Request) {
 		Writer: cc,
 		Closer: cc,
 	}
-	spy := &ashe.Server{Cipher: s.Cipher}
+	if r.URL.Path != "/mux" {
+		s.Serve(cli, cc.RemoteAddr())
+		return
+	}
+	mux := czar.NewMuxServer(cli)
+	defer mux.Close()
+	for con := range mux.Accept() {
+		go func() {
+			defer con.Close()
+			s.Serve(con, cc.RemoteAddr())
+		}()
+	}
+}
+
+// FlushWriter flushes the response after each write, so that data of a http/2 stream is sent at once.
+type FlushWriter struct {
+	R *http.ResponseController
+	W io.Writer
+}
+
+// Write implements io.Writer.
+func (f *FlushWriter) Write(p []byte) (int, error) {
+	n, err := f.W.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.R.Flush()
+}
+
+// ServeStream runs ashe protocol on a http/2 stream of the CONNECT method.
+func (s *Server) ServeStream(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	cli := &daze.ReadWriteCloser{
+		Reader: r.Body,
+		Writer: &FlushWriter{R: rc, W: w},
+		Closer: r.Body,
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	s.Serve(cli, addr)
+}
+
+// Serve a proxied connection with the ashe protocol.
+func (s *Server) Serve(cli io.ReadWriteCloser, addr net.Addr) {
+	spy := &ashe.Server{Cipher: s.Cipher, Dialer: s.Dialer, Hook: s.Hook, Users: s.Users, Retired: s.Retired, RetiredUntil: s.RetiredUntil, Master: s.Master}
 	ctx := &daze.Context{Cid: atomic.AddUint32(&s.NextID, 1)}
-	log.Printf("conn: %08x accept remote=%s", ctx.Cid, cc.RemoteAddr())
-	if err := spy.Serve(ctx, cli); err != nil {
+	log.Printf("conn: %08x accept remote=%s", ctx.Cid, addr)
+	err := s.Hook.OnAccept(ctx, addr)
+	if err == nil {
+		err = spy.Serve(ctx, cli)
+	}
+	if err != nil {
 		log.Printf("conn: %08x  error %s", ctx.Cid, err)
 	}
+	s.Hook.OnClose(ctx, err)
 	log.Printf("conn: %08x closed", ctx.Cid)
 }
 
@@ -89,6 +183,14 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case 0:
 		s.ServeMask(w, r)
 	case 1:
+		if r.Method == "CONNECT" && r.ProtoMajor == 2 {
+			s.ServeStream(w, r)
+			return
+		}
+		if r.URL.Path == "/mux" && !s.Mux {
+			s.ServeMask(w, r)
+			return
+		}
 		s.ServeDaze(w, r)
 	}
 }
@@ -101,40 +203,47 @@ func (s *Server) Close() error {
 	return nil
 }
 
-// Route check if the request provided the correct signature.
+// Route check if the request provided the correct signature. A missing, malformed, wrong or replayed signature is
+// routed to the masker. It takes the same time whichever the case is and whichever key the signature matches, so that
+// active probers can tell the server from the masker neither by the response nor by the timing.
 func (s *Server) Route(r *http.Request) int {
+	authData := make([]byte, 32)
 	authText := r.Header.Get("Authorization")
-	if authText == "" {
-		return 0
+	valid := 0
+	if len(authText) == 64 && doa.Err(hex.Decode(authData, []byte(authText))) == nil {
+		valid = 1
 	}
-	authData, err := hex.DecodeString(authText)
-	if err != nil {
-		return 0
+	spy := &ashe.Server{Cipher: s.Cipher, Users: s.Users, Retired: s.Retired, RetiredUntil: s.RetiredUntil, Master: s.Master}
+	match := 0
+	for _, cred := range spy.Keys() {
+		hash := md5.New()
+		hash.Write(authData[:16])
+		hash.Write(cred.Cipher[:16])
+		match |= subtle.ConstantTimeCompare(authData[16:], hash.Sum(nil))
 	}
-	if len(authData) != 32 {
+	if valid&match == 0 {
 		return 0
 	}
-	hash := md5.New()
-	hash.Write(authData[:16])
-	hash.Write(s.Cipher[:16])
-	sign := hash.Sum(nil)
-	for i := range 16 {
-		if authData[16+i] != sign[i] {
-			return 0
-		}
+	// Signatures carry no timestamp, so they are remembered until they are evicted by newer ones.
+	if s.Replay != nil && s.Replay.Seen(authData, math.MaxInt64) {
+		return 0
 	}
 	return 1
 }
 
 // Run it.
 func (s *Server) Run() error {
-	l, err := net.Listen("tcp", s.Listen)
+	l, err := daze.Listen(s.Listener, s.Listen)
 	if err != nil {
 		return err
 	}
 	log.Println("main: listen and serve on", s.Listen)
-	srv := &http.Server{Handler: s}
+	srv := &http.Server{Handler: s, TLSConfig: s.Config}
 	s.Closer = srv
+	if s.Config != nil {
+		go srv.ServeTLS(l, "", "")
+		return nil
+	}
 	go srv.Serve(l)
 	return nil
 }
@@ -143,41 +252,208 @@ func (s *Server) Run() error {
 func NewServer(listen string, cipher string) *Server {
 	return &Server{
 		Cipher: daze.Salt(cipher),
+		Dialer: daze.NewEngine(),
+		Hook:   daze.NewHookChain(),
 		Listen: listen,
 		Masker: Conf.Masker,
+		Mux:    true,
 		NextID: uint32(math.MaxUint32),
+		Replay: ashe.NewReplay(ashe.Conf.ReplaySize),
 	}
 }
 
 // Client implemented the baboon protocol.
 type Client struct {
 	Cipher []byte
+	// Config is the tls config used by http/2, the server certificate is not verified if it is nil.
+	Config *tls.Config
+	// Dialer connects to the server, it is daze.Direct if it is nil.
+	Dialer daze.Dialer
+	// H2 connects to the server with tls, and runs each proxied connection on a http/2 stream. It takes precedence
+	// over Mux.
+	H2 bool
+	// Keepalive is the interval of keepalives, so that long-lived idle connections are not dropped by stateful
+	// firewalls. The multiplexer sends keepalives in the czar protocol, other connections are probed by tcp
+	// keepalives. Zero disables keepalives.
+	Keepalive time.Duration
+	// Mux reuses a single http session, upgraded into a multiplexer, for all dials.
+	Mux    bool
 	Server string
+	m      sync.Mutex
+	t      *http.Transport
+	x      *czar.Mux
 }
 
-// Dial connects to the address on the named network.
-func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+// Direct returns the dialer which connects to the server.
+func (c *Client) Direct() daze.Dialer {
+	if c.Dialer != nil {
+		return c.Dialer
+	}
+	return &daze.Direct{}
+}
+
+// Auth returns the authorization header value, which is a random nonce followed by its signature.
+func (c *Client) Auth() string {
+	buf := make([]byte, 32)
+	io.ReadFull(&daze.RandomReader{}, buf[:16])
+	copy(buf[16:], c.Cipher[:16])
+	sign := md5.Sum(buf)
+	copy(buf[16:], sign[:])
+	return hex.EncodeToString(buf)
+}
+
+// Hello connects to the server and degenerates the http protocol, the path is /sync for a single connection and /mux
+// for a multiplexer.
+func (c *Client) Hello(ctx *daze.Context, path string) (io.ReadWriteCloser, error) {
 	var (
 		buf []byte
 		err error
 		req *http.Request
 		srv io.ReadWriteCloser
 	)
-	srv, err = daze.Dial("tcp", c.Server)
+	srv, err = c.Direct().Dial(ctx, "tcp", c.Server)
 	if err != nil {
 		return nil, err
 	}
-	buf = make([]byte, 32)
-	io.ReadFull(&daze.RandomReader{}, buf[:16])
-	copy(buf[16:], c.Cipher[:16])
-	sign := md5.Sum(buf)
-	copy(buf[16:], sign[:])
-	req = doa.Try(http.NewRequest("POST", "http://"+c.Server+"/sync", http.NoBody))
-	req.Header.Set("Authorization", hex.EncodeToString(buf))
+	daze.Keepalive(srv, c.Keepalive)
+	req = doa.Try(http.NewRequest("POST", "http://"+c.Server+path, http.NoBody))
+	req.Header.Set("Authorization", c.Auth())
 	req.Write(srv)
-	// Discard responded header
+	// Discard responded header, the status line tells whether the request has been accepted.
 	buf = make([]byte, 147)
-	io.ReadFull(srv, buf)
+	_, err = io.ReadFull(srv, buf[:17])
+	if err == nil && string(buf[:17]) != "HTTP/1.1 200 OK\r\n" {
+		err = errors.New("daze: baboon request rejected")
+	}
+	if err == nil {
+		_, err = io.ReadFull(srv, buf[17:])
+	}
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+// Stream opens a http/2 stream of the CONNECT method to the server.
+func (c *Client) Stream() (io.ReadWriteCloser, error) {
+	c.m.Lock()
+	if c.t == nil {
+		conf := c.Config.Clone()
+		if conf == nil {
+			conf = NewConfig(c.Server)
+		}
+		conf.NextProtos = []string{"h2"}
+		c.t = &http.Transport{
+			DialContext: func(_ context.Context, network string, address string) (net.Conn, error) {
+				// The connection is shared by streams of many proxied connections.
+				srv, err := c.Direct().Dial(&daze.Context{}, network, address)
+				if err != nil {
+					return nil, err
+				}
+				daze.Keepalive(srv, c.Keepalive)
+				return daze.NewNetConn(srv), nil
+			},
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   conf,
+		}
+	}
+	t := c.t
+	c.m.Unlock()
+	pr, pw := io.Pipe()
+	req := doa.Try(http.NewRequest("CONNECT", "https://"+c.Server, pr))
+	req.Header.Set("Authorization", c.Auth())
+	ret, err := t.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	if ret.StatusCode != http.StatusOK || ret.ProtoMajor != 2 {
+		ret.Body.Close()
+		pw.Close()
+		return nil, errors.New("daze: baboon request rejected")
+	}
+	return &daze.ReadWriteCloser{
+		Reader: ret.Body,
+		Writer: pw,
+		Closer: StreamCloser{ret.Body, pw},
+	}, nil
+}
+
+// StreamCloser closes both directions of a http/2 stream.
+type StreamCloser []io.Closer
+
+// Close implements io.Closer.
+func (s StreamCloser) Close() error {
+	for _, e := range s {
+		e.Close()
+	}
+	return nil
+}
+
+// Session returns the multiplexer, it is established on demand and again once it is broken.
+func (c *Client) Session(ctx *daze.Context) (*czar.Mux, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.x != nil {
+		select {
+		case <-c.x.Done():
+		default:
+			return c.x, nil
+		}
+	}
+	srv, err := c.Hello(ctx, "/mux")
+	if err != nil {
+		return nil, err
+	}
+	log.Println("baboon: mux init")
+	c.x = czar.NewMuxClient(srv)
+	if c.Keepalive != 0 {
+		c.x.Keepalive(c.Keepalive)
+	}
+	return c.x, nil
+}
+
+// Close the multiplexer if there is one. All streams will be closed at the same time.
+func (c *Client) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.t != nil {
+		c.t.CloseIdleConnections()
+	}
+	if c.x != nil {
+		return c.x.Close()
+	}
+	return nil
+}
+
+// Dial connects to the address on the named network.
+func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	var (
+		err error
+		srv io.ReadWriteCloser
+	)
+	switch {
+	case c.H2:
+		srv, err = c.Stream()
+		if err != nil {
+			return nil, err
+		}
+	case c.Mux:
+		mux, err := c.Session(ctx)
+		if err != nil {
+			return nil, err
+		}
+		srv, err = mux.Open()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		srv, err = c.Hello(ctx, "/sync")
+		if err != nil {
+			return nil, err
+		}
+	}
 	spy := &ashe.Client{Cipher: c.Cipher}
 	con, err := spy.Estab(ctx, srv, network, address)
 	if err != nil {
@@ -190,6 +466,15 @@ func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.Rea
 func NewClient(server string, cipher string) *Client {
 	return &Client{
 		Cipher: daze.Salt(cipher),
+		Config: NewConfig(server),
+		Dialer: &daze.Direct{},
 		Server: server,
 	}
 }
+
+// NewConfig returns the default tls config of http/2 for the server. The certificate is not verified, the server is
+// authenticated by the ashe handshake inside the stream.
+func NewConfig(server string) *tls.Config {
+	host, _, _ := net.SplitHostPort(server)
+	return &tls.Config{ServerName: host, InsecureSkipVerify: true}
+}
@@ -2,10 +2,14 @@ package baboon
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"io"
 	"math/rand/v2"
 	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 
 	"github.com/mohanson/daze"
@@ -128,6 +132,188 @@ func TestProtocolBaboonUDP(t *testing.T) {
 	doa.Try(io.ReadFull(cli, buf[:128]))
 }
 
+func TestProtocolBaboonMux(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.Mux = true
+	defer dazeClient.Close()
+	buf := make([]byte, 0x80)
+	for i := range 4 {
+		cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+		doa.Try(cli.Write([]byte{0x00, byte(i), 0x00, 0x80}))
+		doa.Try(io.ReadFull(cli, buf))
+		doa.Doa(bytes.Equal(buf, bytes.Repeat([]byte{byte(i)}, 0x80)))
+		cli.Close()
+	}
+	mux := dazeClient.x
+	doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+	doa.Doa(dazeClient.x == mux)
+
+	masker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer masker.Close()
+	dazeServer.Masker = masker.URL
+	dazeServer.Mux = false
+	dazeClient.Close()
+	doa.Doa(doa.Err(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn)) != nil)
+}
+
+func TestProtocolBaboonUsers(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	masker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer masker.Close()
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Masker = masker.URL
+	dazeServer.Users = map[string][]byte{"alice": daze.Salt("alice"), "bob": daze.Salt("bob")}
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	buf := make([]byte, 0x80)
+	for _, user := range []string{"alice", "bob"} {
+		dazeClient := NewClient(DazeServerListenOn, user)
+		dazeClient.Mux = true
+		cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+		doa.Try(cli.Write([]byte{0x00, 0x2a, 0x00, 0x80}))
+		doa.Try(io.ReadFull(cli, buf))
+		cli.Close()
+		dazeClient.Close()
+	}
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	doa.Doa(doa.Err(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn)) != nil)
+}
+
+func TestProtocolBaboonRoute(t *testing.T) {
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Retired = [][]byte{daze.Salt("retired")}
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	auth := dazeClient.Auth()
+	sign := doa.Try(hex.DecodeString(auth))
+	sign[31] ^= 0x01
+	for _, e := range []struct {
+		auth  string
+		route int
+	}{
+		{"", 0},
+		{"zz" + auth[2:], 0},
+		{auth[:62], 0},
+		{hex.EncodeToString(sign), 0},
+		{NewClient(DazeServerListenOn, "bad").Auth(), 0},
+		{NewClient(DazeServerListenOn, "retired").Auth(), 1},
+		{auth, 1},
+		// Replayed.
+		{auth, 0},
+	} {
+		r := doa.Try(http.NewRequest("POST", "http://"+DazeServerListenOn+"/sync", http.NoBody))
+		r.Header.Set("Authorization", e.auth)
+		doa.Doa(dazeServer.Route(r) == e.route)
+	}
+}
+
+func TestProtocolBaboonH2(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Config = &tls.Config{Certificates: []tls.Certificate{doa.Try(daze.Certificate("127.0.0.1"))}}
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.H2 = true
+	defer dazeClient.Close()
+	buf := make([]byte, 0x8000)
+	for i := range 4 {
+		cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+		doa.Try(cli.Write([]byte{0x00, byte(i), 0x80, 0x00}))
+		doa.Try(io.ReadFull(cli, buf))
+		doa.Doa(bytes.Equal(buf, bytes.Repeat([]byte{byte(i)}, 0x8000)))
+		cli.Close()
+	}
+	cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x02, 0x00, 0x00, 0x00}))
+	doa.Doa(doa.Err(io.ReadFull(cli, buf[:1])) != nil)
+}
+
+func TestProtocolBaboonClientLiteral(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	// A client which is not created by NewClient works with the default config, dialer and multiplexer.
+	for _, dazeClient := range []*Client{
+		{Cipher: daze.Salt(Password), Server: DazeServerListenOn},
+		{Cipher: daze.Salt(Password), Mux: true, Server: DazeServerListenOn},
+		{Cipher: daze.Salt(Password), H2: true, Server: DazeServerListenOn},
+	} {
+		dazeServer := NewServer(DazeServerListenOn, Password)
+		if dazeClient.H2 {
+			dazeServer.Config = &tls.Config{Certificates: []tls.Certificate{doa.Try(daze.Certificate("127.0.0.1"))}}
+		}
+		dazeServer.Run()
+		cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+		doa.Try(cli.Write([]byte{0x00, 0x01, 0x00, 0x80}))
+		buf := make([]byte, 128)
+		doa.Try(io.ReadFull(cli, buf))
+		doa.Doa(bytes.Equal(buf, bytes.Repeat([]byte{0x01}, 128)))
+		cli.Close()
+		dazeClient.Close()
+		dazeServer.Close()
+	}
+}
+
+func TestProtocolBaboonH2Shared(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Config = &tls.Config{Certificates: []tls.Certificate{doa.Try(daze.Certificate("127.0.0.1"))}}
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	// Concurrent connections are streams of a single connection to the server.
+	dials := atomic.Int32{}
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.H2 = true
+	dazeClient.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		dials.Add(1)
+		return daze.Dial(network, address)
+	})
+	defer dazeClient.Close()
+	cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	clis := []io.ReadWriteCloser{cli}
+	for range 3 {
+		cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+		defer cli.Close()
+		clis = append(clis, cli)
+	}
+	for i, cli := range clis {
+		doa.Try(cli.Write([]byte{0x00, byte(i), 0x00, 0x80}))
+	}
+	for i, cli := range clis {
+		buf := make([]byte, 0x80)
+		doa.Try(io.ReadFull(cli, buf))
+		doa.Doa(bytes.Equal(buf, bytes.Repeat([]byte{byte(i)}, 0x80)))
+	}
+	doa.Doa(dials.Load() == 1)
+}
+
 func TestProtocolBaboonMasker(t *testing.T) {
 	dazeServer := NewServer(DazeServerListenOn, Password)
 	defer dazeServer.Close()
@@ -1,12 +1,16 @@
 package czar
 
 import (
+	crand "crypto/rand"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"math/rand/v2"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mohanson/daze"
@@ -29,31 +33,121 @@ import (
 // | Sid |  0  |    Rsv    |
 // +-----+-----+-----+-----+
 //
+// Rsv is zero, except for resumable streams, see Resume.
+//
 // Both server and client can push data to each other.
 //
 // +-----+-----+-----+-----+-----+-----+
 // | Sid |  1  |    Len    |    Msg    |
 // +-----+-----+-----+-----+-----+-----+
 //
+// A push of no data is a keepalive, it is sent on any stream and ignored by the receiver.
+//
 // Close the specified stream.
 //
 // +-----+-----+-----+-----+
 // | Sid |  2  | 0/1 | Rsv |
 // +-----+-----+-----+-----+
+//
+// Before any stream is opened, the client authenticates itself with the hello of the ashe protocol. The server does
+// not allocate the multiplexer until the hello is verified, and drops connections that fail to say hello in time.
+
+// Conf is acting as package level configuration. They are the default values, instances can be tuned by their own
+// fields.
+var Conf = struct {
+	// HelloTimeout is the time allowed for the client to say hello.
+	HelloTimeout time.Duration
+	// ReconnectBase is the time the client waits after the first failed attempt to connect to the server, the time
+	// doubles after each failed attempt up to ReconnectCap.
+	ReconnectBase time.Duration
+	ReconnectCap  time.Duration
+	// ReconnectJitter is the fraction of the wait that is randomized, 1 means full jitter and 0 means none. Jitter
+	// spreads the reconnections of many clients after a server restart.
+	ReconnectJitter float64
+	// ResumeBuffer is the number of bytes written to a resumable stream that are kept, in case they are lost along with
+	// the connection. A stream can not be resumed if more data than that is lost.
+	ResumeBuffer int
+	// ResumeGrace is the time the server keeps a resumable stream after the connection is lost.
+	ResumeGrace time.Duration
+	// WriteBatch is the maximum number of frames a stream writes to the connection at once.
+	WriteBatch int
+}{
+	HelloTimeout:    time.Second * 8,
+	ReconnectBase:   time.Second,
+	ReconnectCap:    time.Second * 32,
+	ReconnectJitter: 1,
+	ResumeBuffer:    1024 * 1024,
+	ResumeGrace:     time.Second * 30,
+	WriteBatch:      16,
+}
 
 // Server implemented the czar protocol.
 type Server struct {
 	Cipher []byte
 	Closer io.Closer
-	Listen string
+	Dialer daze.Dialer
+	// Ecdh requires streams to run the ephemeral key exchange, see ashe.Server.Ecdh.
+	Ecdh bool
+	// Grace is the time a resumable stream is kept after the connection is lost, zero disables resumption.
+	Grace time.Duration
+	// HelloTimeout is the time allowed for the client to say hello.
+	HelloTimeout time.Duration
+	Hook         daze.Hook
+	Listen       string
+	// Listener is used instead of listening on Listen if it is not nil, for example, a listener shared by daze.Demux.
+	Listener net.Listener
+	// Master is the secret of access tokens, see ashe.Server.Master.
+	Master string
+	// Replay rejects replayed hellos, see ashe.Server.Replay.
+	Replay  *ashe.Replay
+	Resumes *Resumes
+	// Strict makes all failed handshakes look the same to the peer, see ashe.Server.Strict.
+	Strict bool
+	// Suite is the cipher suite required from streams, see ashe.Server.Suite.
+	Suite string
+	// Retired are pre-shared keys replaced by Cipher, see ashe.Server.Retired.
+	Retired      [][]byte
+	RetiredUntil time.Time
+	// Users maps the names of users to their pre-shared keys, see ashe.Server.Users.
+	Users map[string][]byte
 }
 
 // Serve incoming connections. Parameter cli will be closed automatically when the function exits.
 func (s *Server) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
-	spy := &ashe.Server{Cipher: s.Cipher}
+	spy := &ashe.Server{Cipher: s.Cipher, Dialer: s.Dialer, Ecdh: s.Ecdh, Hook: s.Hook, Suite: s.Suite, Users: s.Users, Retired: s.Retired, RetiredUntil: s.RetiredUntil, Master: s.Master}
 	return spy.Serve(ctx, cli)
 }
 
+// Spy returns the ashe server which authenticates the hellos of clients.
+func (s *Server) Spy() *ashe.Server {
+	return &ashe.Server{Cipher: s.Cipher, Replay: s.Replay, Strict: s.Strict, Users: s.Users, Retired: s.Retired, RetiredUntil: s.RetiredUntil, Master: s.Master}
+}
+
+// Ticket reads the ticket of a resumable stream in the encrypted channel of a hello, and puts the stream in the table
+// along with the credential of the hello.
+func (s *Server) Ticket(con *Stream) (io.ReadWriteCloser, error) {
+	hello, _, cred, err := s.Spy().Session(con)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 16)
+	_, err = io.ReadFull(hello, buf)
+	if err != nil {
+		return nil, err
+	}
+	if s.Grace == 0 {
+		return con, nil
+	}
+	ticket := string(buf)
+	r := NewResume(con, ticket, s.Grace, func() {
+		s.Resumes.Del(ticket)
+	})
+	r.key = cred.Cipher
+	r.usr = cred.User
+	s.Resumes.Put(r)
+	return r, nil
+}
+
 // Close listener.
 func (s *Server) Close() error {
 	if s.Closer != nil {
@@ -64,7 +158,7 @@ func (s *Server) Close() error {
 
 // Run it.
 func (s *Server) Run() error {
-	l, err := net.Listen("tcp", s.Listen)
+	l, err := daze.Listen(s.Listener, s.Listen)
 	if err != nil {
 		return err
 	}
@@ -81,18 +175,53 @@ func (s *Server) Run() error {
 				}
 				break
 			}
-			mux := NewMuxServer(cli)
 			go func() {
+				// Authenticate before allocating the multiplexer, so scanners can not exhaust resources cheaply.
+				cli.SetDeadline(time.Now().Add(s.HelloTimeout))
+				spy := s.Spy()
+				err := spy.Strictly(cli, func() error {
+					_, err := spy.Hello(cli)
+					return err
+				})
+				if err != nil {
+					log.Printf("czar: %s error %s", cli.RemoteAddr(), err)
+					cli.Close()
+					// Let hooks see the failed handshake, for example, to audit it.
+					ctx := &daze.Context{Cid: atomic.AddUint32(&idx, 1)}
+					if s.Hook.OnAccept(ctx, cli.RemoteAddr()) == nil {
+						s.Hook.OnClose(ctx, err)
+					}
+					return
+				}
+				cli.SetDeadline(time.Time{})
+				mux := NewMuxServer(cli)
 				defer mux.Close()
 				for con := range mux.Accept() {
-					idx++
-					ctx := &daze.Context{Cid: idx}
+					if con.opt == 0x02 {
+						go func() {
+							if err := ResumeAccept(con, s.Resumes, s.Spy()); err != nil {
+								log.Printf("czar: %s error %s", cli.RemoteAddr(), err)
+								con.Close()
+							}
+						}()
+						continue
+					}
+					ctx := &daze.Context{Cid: atomic.AddUint32(&idx, 1)}
 					log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
 					go func() {
-						defer con.Close()
-						if err := s.Serve(ctx, con); err != nil {
+						var stm io.ReadWriteCloser = con
+						defer func() { stm.Close() }()
+						err := s.Hook.OnAccept(ctx, cli.RemoteAddr())
+						if err == nil && con.opt == 0x01 {
+							stm, err = s.Ticket(con)
+						}
+						if err == nil {
+							err = s.Serve(ctx, stm)
+						}
+						if err != nil {
 							log.Printf("conn: %08x  error %s", ctx.Cid, err)
 						}
+						s.Hook.OnClose(ctx, err)
 						log.Printf("conn: %08x closed", ctx.Cid)
 					}()
 				}
@@ -106,17 +235,61 @@ func (s *Server) Run() error {
 // NewServer returns a new Server. Cipher is a password in string form, with no length limit.
 func NewServer(listen string, cipher string) *Server {
 	return &Server{
-		Cipher: daze.Salt(cipher),
-		Listen: listen,
+		Cipher:       daze.Salt(cipher),
+		Dialer:       daze.NewEngine(),
+		Grace:        Conf.ResumeGrace,
+		HelloTimeout: Conf.HelloTimeout,
+		Hook:         daze.NewHookChain(),
+		Listen:       listen,
+		Replay:       ashe.NewReplay(ashe.Conf.ReplaySize),
+		Resumes:      NewResumes(),
 	}
 }
 
+// Event is a change of the state of the connection to the server, see Client.OnEvent.
+type Event struct {
+	// Attempt is the number of failed connection attempts since the client was last connected.
+	Attempt int
+	// Err is the reason of the failed attempt or the disconnection.
+	Err error
+	// Kind is one of connected, disconnected or reconnect. A reconnect event is sent after each failed attempt, before
+	// the client waits to try again.
+	Kind string
+}
+
 // Client implemented the czar protocol.
 type Client struct {
-	Cancel chan struct{}
-	Cipher []byte
-	Mux    chan *Mux
-	Server string
+	// Actives records the streams dialed by the client, so they can be listed and closed by force.
+	Actives *daze.Actives
+	Cancel  chan struct{}
+	Cipher  []byte
+	Dialer  daze.Dialer
+	// Early sends the first data of streams along with the request, see ashe.Client.Early.
+	Early bool
+	// Ecdh runs the ephemeral key exchange for each stream, see ashe.Client.Ecdh.
+	Ecdh bool
+	// Grace makes streams resumable, they survive the loss of the connection to the server if the client reconnects
+	// within the grace period. Zero disables resumption, which the server must support otherwise.
+	Grace time.Duration
+	// Keepalive is the interval of keepalives sent to the server, so that long-lived idle connections are not dropped
+	// by stateful firewalls. Zero disables keepalives.
+	Keepalive time.Duration
+	Mux       chan *Mux
+	// OnEvent is called with the state changes of the connection to the server, so that user interfaces can show the
+	// state of the tunnel. It is called from the goroutine that maintains the connection, and must not block.
+	OnEvent func(e Event)
+	Once    sync.Once
+	// ReconnectBase, ReconnectCap and ReconnectJitter control the wait between attempts to connect to the server, see
+	// Conf.
+	ReconnectBase   time.Duration
+	ReconnectCap    time.Duration
+	ReconnectJitter float64
+	Resumes         *Resumes
+	Server          string
+	// Suite is the cipher suite of streams, see ashe.Client.Suite.
+	Suite string
+	// Timeout is the time to wait for the connection to the server when dialing.
+	Timeout time.Duration
 }
 
 // Close the connection. All streams will be closed at the same time.
@@ -127,52 +300,134 @@ func (c *Client) Close() error {
 
 // Dial connects to the address on the named network.
 func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	// The connection to the server is established on the first dial, so that fields of the client can be modified after
+	// it is created.
+	c.Once.Do(func() {
+		go c.Run()
+	})
 	select {
 	case mux := <-c.Mux:
+		if c.Grace != 0 {
+			return c.DialResume(ctx, mux, network, address)
+		}
 		srv, err := mux.Open()
 		if err != nil {
 			return nil, err
 		}
 		log.Printf("czar: mux slot stream id=0x%02x", srv.idx)
-		spy := &ashe.Client{Cipher: c.Cipher}
+		spy := &ashe.Client{Cipher: c.Cipher, Early: c.Early, Ecdh: c.Ecdh, Suite: c.Suite}
 		con, err := spy.Estab(ctx, srv, network, address)
 		if err != nil {
 			srv.Close()
+			return nil, err
 		}
-		return con, err
-	case <-time.After(daze.Conf.DialerTimeout):
+		return c.Actives.Wrap(ctx, network, address, con), nil
+	case <-time.After(c.Timeout):
 		return nil, fmt.Errorf("dial tcp: %s: i/o timeout", address)
 	}
 }
 
+// DialResume dials on a resumable stream of the multiplexer.
+func (c *Client) DialResume(ctx *daze.Context, mux *Mux, network string, address string) (io.ReadWriteCloser, error) {
+	srv, err := mux.OpenWith(0x01)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("czar: mux slot stream id=0x%02x", srv.idx)
+	// Whoever knows the ticket may take over the stream, so it is unpredictable and only sent encrypted.
+	buf := make([]byte, 16)
+	_, err = crand.Read(buf)
+	if err == nil {
+		var hello io.ReadWriteCloser
+		hello, err = (&ashe.Client{Cipher: c.Cipher}).Hello(srv)
+		if err == nil {
+			_, err = hello.Write(buf)
+		}
+	}
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	ticket := string(buf)
+	r := NewResume(srv, ticket, c.Grace, func() {
+		c.Resumes.Del(ticket)
+	})
+	c.Resumes.Put(r)
+	spy := &ashe.Client{Cipher: c.Cipher, Early: c.Early, Ecdh: c.Ecdh, Suite: c.Suite}
+	con, err := spy.Estab(ctx, r, network, address)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return c.Actives.Wrap(ctx, network, address, con), nil
+}
+
+// Backoff returns the time to wait after the nth consecutive failed attempt to connect to the server.
+func (c *Client) Backoff(attempt int) time.Duration {
+	d := c.ReconnectBase
+	for range attempt - 1 {
+		if d >= c.ReconnectCap {
+			break
+		}
+		d *= 2
+	}
+	d = min(d, c.ReconnectCap)
+	return d - time.Duration(rand.Float64()*c.ReconnectJitter*float64(d))
+}
+
 // Run creates an establish connection to czar server.
 func (c *Client) Run() {
 	var (
 		err error
 		mux *Mux
-		rtt = 0
 		sid = 0
-		srv net.Conn
+		srv io.ReadWriteCloser
+		try = 0
 	)
+	emit := func(e Event) {
+		if c.OnEvent != nil {
+			c.OnEvent(e)
+		}
+	}
 	for {
 		switch sid {
 		case 0:
-			srv, err = daze.Dial("tcp", c.Server)
+			srv, err = c.Dialer.Dial(&daze.Context{}, "tcp", c.Server)
+			if err == nil {
+				// The server does not allocate the multiplexer until the client says hello.
+				spy := &ashe.Client{Cipher: c.Cipher}
+				_, err = spy.Hello(srv)
+				if err != nil {
+					srv.Close()
+				}
+			}
 			switch {
-			case srv == nil:
+			case err != nil:
 				log.Println("czar:", err)
+				try++
+				emit(Event{Attempt: try, Err: err, Kind: "reconnect"})
 				select {
-				case <-time.After(time.Second * time.Duration(math.Pow(2, float64(rtt)))):
-					// A slow start reconnection algorithm.
-					rtt = min(rtt+1, 5)
+				case <-time.After(c.Backoff(try)):
 				case <-c.Cancel:
 					sid = 2
 				}
 			case err == nil:
 				log.Println("czar: mux init")
 				mux = NewMuxClient(srv)
-				rtt = 0
+				if c.Keepalive != 0 {
+					mux.Keepalive(c.Keepalive)
+				}
 				sid = 1
+				try = 0
+				emit(Event{Kind: "connected"})
+				for _, r := range c.Resumes.All() {
+					go func() {
+						if err := ResumeDial(r, mux, &ashe.Client{Cipher: c.Cipher}); err != nil {
+							log.Println("czar:", err)
+							r.Fail(err)
+						}
+					}()
+				}
 			}
 		case 1:
 			select {
@@ -181,10 +436,12 @@ func (c *Client) Run() {
 				log.Println("czar: mux done")
 				mux.Close()
 				sid = 0
+				emit(Event{Err: mux.rer.Get(), Kind: "disconnected"})
 			case <-c.Cancel:
 				log.Println("czar: mux done")
 				mux.Close()
 				sid = 2
+				emit(Event{Err: net.ErrClosed, Kind: "disconnected"})
 			}
 		case 2:
 			return
@@ -194,12 +451,17 @@ func (c *Client) Run() {
 
 // NewClient returns a new Client. Cipher is a password in string form, with no length limit.
 func NewClient(server, cipher string) *Client {
-	client := &Client{
-		Cancel: make(chan struct{}),
-		Cipher: daze.Salt(cipher),
-		Mux:    make(chan *Mux),
-		Server: server,
+	return &Client{
+		Actives:         daze.NewActives(),
+		Cancel:          make(chan struct{}),
+		Cipher:          daze.Salt(cipher),
+		Dialer:          &daze.Direct{},
+		Mux:             make(chan *Mux),
+		ReconnectBase:   Conf.ReconnectBase,
+		ReconnectCap:    Conf.ReconnectCap,
+		ReconnectJitter: Conf.ReconnectJitter,
+		Resumes:         NewResumes(),
+		Server:          server,
+		Timeout:         daze.Conf.DialerTimeout,
 	}
-	go client.Run()
-	return client
 }
@@ -1,13 +1,17 @@
 package czar
 
 import (
+	crand "crypto/rand"
 	"encoding/binary"
 	"io"
+	"math"
 	"math/rand/v2"
 	"testing"
+	"time"
 
 	"github.com/mohanson/daze"
 	"github.com/mohanson/daze/lib/doa"
+	"github.com/mohanson/daze/protocol/ashe"
 )
 
 const (
@@ -129,3 +133,180 @@ func TestProtocolCzarUDP(t *testing.T) {
 	buf := make([]byte, 128)
 	doa.Try(io.ReadFull(cli, buf[:128]))
 }
+
+func TestProtocolCzarHello(t *testing.T) {
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	cli := doa.Try(daze.Dial("tcp", DazeServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write(make([]byte, 40)))
+	if doa.Err(cli.Read(make([]byte, 1))) != io.EOF {
+		t.FailNow()
+	}
+}
+
+func TestProtocolCzarEvent(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	conns := make(chan io.ReadWriteCloser, 4)
+	event := make(chan Event, 8)
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	defer dazeClient.Close()
+	dazeClient.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		srv, err := daze.Dial(network, address)
+		if err == nil {
+			conns <- srv
+		}
+		return srv, err
+	})
+	dazeClient.OnEvent = func(e Event) {
+		event <- e
+	}
+	dazeClient.Timeout = time.Millisecond * 100
+	doa.Doa(doa.Err(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn)) != nil)
+	e := <-event
+	doa.Doa(e.Kind == "reconnect" && e.Attempt == 1 && e.Err != nil)
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+	// With the jitter the client may retry more than once before the server is up.
+	for e = <-event; e.Kind == "reconnect"; e = <-event {
+	}
+	doa.Doa(e.Kind == "connected")
+	cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+	defer cli.Close()
+
+	(<-conns).Close()
+	e = <-event
+	doa.Doa(e.Kind == "disconnected" && e.Err != nil)
+	e = <-event
+	doa.Doa(e.Kind == "connected")
+}
+
+func TestProtocolCzarResume(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	conns := make(chan io.ReadWriteCloser, 4)
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	defer dazeClient.Close()
+	dazeClient.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		srv, err := daze.Dial(network, address)
+		if err == nil {
+			conns <- srv
+		}
+		return srv, err
+	})
+	dazeClient.Grace = time.Second * 4
+	cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	buf := make([]byte, 0xffff)
+	doa.Try(cli.Write([]byte{0x00, 0x2a, 0xff, 0xff}))
+	doa.Try(io.ReadFull(cli, buf[:0x1000]))
+	// The connection is lost in the middle of the transfer, the stream goes on over the new connection.
+	(<-conns).Close()
+	doa.Try(io.ReadFull(cli, buf[0x1000:]))
+	for i := range buf {
+		doa.Doa(buf[i] == 0x2a)
+	}
+	doa.Try(cli.Write([]byte{0x00, 0x2a, 0x10, 0x00}))
+	doa.Try(io.ReadFull(cli, buf[:0x1000]))
+	doa.Doa(len(conns) == 1)
+}
+
+func TestProtocolCzarResumeExpired(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Run()
+
+	conns := make(chan io.ReadWriteCloser, 4)
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	defer dazeClient.Close()
+	dazeClient.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		srv, err := daze.Dial(network, address)
+		if err == nil {
+			conns <- srv
+		}
+		return srv, err
+	})
+	dazeClient.Grace = time.Millisecond * 100
+	cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	// The server is gone, the stream fails once the grace period ends.
+	dazeServer.Close()
+	(<-conns).Close()
+	doa.Doa(doa.Err(cli.Read(make([]byte, 1))) != nil)
+}
+
+func TestProtocolCzarResumeTicket(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Users = map[string][]byte{"alice": daze.Salt("alice"), "bob": daze.Salt("bob")}
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, "alice")
+	defer dazeClient.Close()
+	dazeClient.Grace = time.Second * 4
+	cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Doa(len(dazeServer.Resumes.All()) == 1)
+	ticket := dazeServer.Resumes.All()[0].tkt
+
+	resume := func(user string, ticket string) uint64 {
+		spy := &ashe.Client{Cipher: daze.Salt(user)}
+		srv := doa.Try(daze.Dial("tcp", DazeServerListenOn))
+		doa.Try(spy.Hello(srv))
+		mux := NewMuxClient(srv)
+		defer mux.Close()
+		stm := doa.Try(mux.OpenWith(0x02))
+		con := doa.Try(spy.Hello(stm))
+		doa.Try(con.Write(binary.BigEndian.AppendUint64([]byte(ticket), 0)))
+		buf := make([]byte, 8)
+		doa.Try(io.ReadFull(con, buf))
+		return binary.BigEndian.Uint64(buf)
+	}
+	// A forged ticket is unknown.
+	forged := make([]byte, 16)
+	doa.Try(crand.Read(forged))
+	doa.Doa(resume("alice", string(forged)) == math.MaxUint64)
+	// A ticket presented by another user is refused.
+	doa.Doa(resume("bob", ticket) == math.MaxUint64)
+	// The stream of the owner is left alone.
+	buf := make([]byte, 0x10)
+	doa.Try(cli.Write([]byte{0x00, 0x2a, 0x00, 0x10}))
+	doa.Try(io.ReadFull(cli, buf))
+	for i := range buf {
+		doa.Doa(buf[i] == 0x2a)
+	}
+}
+
+func TestProtocolCzarBackoff(t *testing.T) {
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.ReconnectJitter = 0
+	doa.Doa(dazeClient.Backoff(1) == time.Second)
+	doa.Doa(dazeClient.Backoff(2) == time.Second*2)
+	doa.Doa(dazeClient.Backoff(6) == time.Second*32)
+	doa.Doa(dazeClient.Backoff(100) == time.Second*32)
+	dazeClient.ReconnectJitter = 1
+	for range 64 {
+		d := dazeClient.Backoff(3)
+		doa.Doa(d >= 0 && d <= time.Second*4)
+	}
+}
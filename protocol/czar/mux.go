@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/mohanson/daze/lib/doa"
 	"github.com/mohanson/daze/lib/priority"
@@ -13,6 +14,7 @@ import (
 type Stream struct {
 	idx uint8
 	mux *Mux
+	opt uint8
 	rbf []byte
 	rch chan []byte
 	rer *Err
@@ -79,29 +81,25 @@ func (s *Stream) Read(p []byte) (int, error) {
 	}
 }
 
-// Write implements io.Writer.
+// Write implements io.Writer. Frames are coalesced into one write of the underlying connection, up to Conf.WriteBatch
+// frames at a time, to reduce syscalls on bulk transfers.
 func (s *Stream) Write(p []byte) (int, error) {
 	var (
 		buf []byte
 		l   = 0
+		m   = 0
 		n   = 0
 	)
-	for {
-		switch {
-		case len(p) >= 2044:
-			buf = make([]byte, 2048)
-			l = 2044
-		case len(p) >= 1:
-			buf = make([]byte, 4+len(p))
-			l = len(p)
-		case len(p) >= 0:
-			return n, nil
+	for len(p) != 0 {
+		m = min(len(p), 2044*Conf.WriteBatch)
+		buf = make([]byte, 0, m+4*((m+2043)/2044))
+		for i := 0; i < m; i += l {
+			l = min(m-i, 2044)
+			buf = append(buf, s.idx, 0x01, 0x00, 0x00)
+			binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(l))
+			buf = append(buf, p[i:i+l]...)
 		}
-		buf[0] = s.idx
-		buf[1] = 0x01
-		binary.BigEndian.PutUint16(buf[2:4], uint16(l))
-		copy(buf[4:], p[:l])
-		p = p[l:]
+		p = p[m:]
 		err := s.mux.pri.Pri(1, func() error {
 			if err := s.wer.Get(); err != nil {
 				return err
@@ -109,6 +107,8 @@ func (s *Stream) Write(p []byte) (int, error) {
 			_, err := s.mux.con.Write(buf)
 			if err != nil {
 				s.wer.Put(err)
+				// A frame may have been written in part, the connection can not be used anymore.
+				s.mux.con.Close()
 				return err
 			}
 			return nil
@@ -116,8 +116,9 @@ func (s *Stream) Write(p []byte) (int, error) {
 		if err != nil {
 			return n, err
 		}
-		n += l
+		n += m
 	}
+	return n, nil
 }
 
 // NewStream returns a new Stream.
@@ -151,6 +152,8 @@ type Mux struct {
 	pri *priority.Priority
 	rer *Err
 	usb []*Stream
+	// Streams are opened by callers of Open and closed by the receiving loop, so the stream table is guarded.
+	usm sync.Mutex
 }
 
 // Accept is used to block until the next available stream is ready to be accepted.
@@ -164,8 +167,18 @@ func (m *Mux) Close() error {
 	return m.con.Close()
 }
 
+// Done returns a channel that is closed when the underlying connection is broken.
+func (m *Mux) Done() <-chan struct{} {
+	return m.rer.Sig()
+}
+
 // Open is used to create a new stream as a io.ReadWriteCloser.
 func (m *Mux) Open() (*Stream, error) {
+	return m.OpenWith(0x00)
+}
+
+// OpenWith creates a new stream, the option is sent to the peer in the Rsv of the open frame.
+func (m *Mux) OpenWith(opt uint8) (*Stream, error) {
 	var (
 		err error
 		idx uint8
@@ -175,18 +188,52 @@ func (m *Mux) Open() (*Stream, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The stream must be in the table before the peer knows it, or data pushed back at once would be lost.
+	stm = NewStream(idx, m)
+	m.Set(idx, stm)
 	err = m.pri.Pri(0, func() error {
-		return doa.Err(m.con.Write([]byte{idx, 0x00, 0x00, 0x00}))
+		return doa.Err(m.con.Write([]byte{idx, 0x00, opt, 0x00}))
 	})
 	if err != nil {
 		m.idp.Put(idx)
 		return nil, err
 	}
-	stm = NewStream(idx, m)
-	m.usb[idx] = stm
 	return stm, nil
 }
 
+// Keepalive sends a keepalive every d until the connection is broken, so that stateful firewalls and nat devices
+// along the path don't drop the connection while all streams are idle.
+func (m *Mux) Keepalive(d time.Duration) {
+	go func() {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				m.pri.Pri(0, func() error {
+					return doa.Err(m.con.Write([]byte{0x00, 0x01, 0x00, 0x00}))
+				})
+			case <-m.rer.Sig():
+				return
+			}
+		}
+	}()
+}
+
+// Get returns the stream with the given id in the stream table.
+func (m *Mux) Get(idx uint8) *Stream {
+	m.usm.Lock()
+	defer m.usm.Unlock()
+	return m.usb[idx]
+}
+
+// Set puts the stream with the given id in the stream table.
+func (m *Mux) Set(idx uint8, stm *Stream) {
+	m.usm.Lock()
+	defer m.usm.Unlock()
+	m.usb[idx] = stm
+}
+
 // Recv continues to receive data until a fatal error is encountered.
 func (m *Mux) Recv() {
 	var (
@@ -210,14 +257,15 @@ func (m *Mux) Recv() {
 		switch {
 		case cmd == 0x00:
 			// Make sure the stream has been closed properly.
-			old = m.usb[idx]
+			old = m.Get(idx)
 			if old.rer.Get() == nil || old.wer.Get() == nil {
 				m.con.Close()
 				break
 			}
 			stm = NewStream(idx, m)
+			stm.opt = buf[2]
 			m.idp.Set(idx)
-			m.usb[idx] = stm
+			m.Set(idx, stm)
 			m.ach <- stm
 		case cmd == 0x01:
 			bsz = binary.BigEndian.Uint16(buf[2:4])
@@ -227,8 +275,12 @@ func (m *Mux) Recv() {
 				m.con.Close()
 				break
 			}
-			stm = m.usb[idx]
-			if stm.rer.Get() != nil {
+			if bsz == 0 {
+				// Keepalive.
+				break
+			}
+			stm = m.Get(idx)
+			if stm == nil || stm.rer.Get() != nil {
 				break
 			}
 			select {
@@ -236,10 +288,13 @@ func (m *Mux) Recv() {
 			case <-stm.rer.Sig():
 			}
 		case cmd == 0x02:
-			stm = m.usb[idx]
+			stm = m.Get(idx)
+			if stm == nil {
+				break
+			}
 			stm.Esolc()
 			old = NewWither(idx, m)
-			m.usb[idx] = old
+			m.Set(idx, old)
 		case cmd >= 0x03:
 			// Packet format error, connection closed.
 			m.con.Close()
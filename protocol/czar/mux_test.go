@@ -7,7 +7,9 @@ import (
 	"log"
 	"math/rand/v2"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/mohanson/daze"
 	"github.com/mohanson/daze/lib/doa"
@@ -151,6 +153,116 @@ func TestProtocolCzarMuxServerReopen(t *testing.T) {
 	doa.Doa(doa.Err(io.ReadFull(cli, buf[:1])) != nil)
 }
 
+func TestProtocolCzarMuxConcurrent(t *testing.T) {
+	rmt := &Tester{daze.NewTester(EchoServerListenOn)}
+	rmt.Mux()
+	defer rmt.Close()
+
+	mux := NewMuxClient(doa.Try(net.Dial("tcp", EchoServerListenOn)))
+	defer mux.Close()
+
+	var wg sync.WaitGroup
+	for range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 8 {
+				cli := doa.Try(mux.Open())
+				buf := make([]byte, 0x100)
+				doa.Try(cli.Write([]byte{0x00, 0x02, 0x01, 0x00}))
+				doa.Try(io.ReadFull(cli, buf))
+				for i := range 0x100 {
+					doa.Doa(buf[i] == 0x02)
+				}
+				cli.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// SlowConn takes a while for each write, like a congested link.
+type SlowConn struct {
+	io.ReadWriteCloser
+	D time.Duration
+}
+
+// Write implements io.Writer.
+func (c *SlowConn) Write(p []byte) (int, error) {
+	time.Sleep(c.D)
+	return c.ReadWriteCloser.Write(p)
+}
+
+func TestProtocolCzarMuxControlLatency(t *testing.T) {
+	c0, c1 := net.Pipe()
+	srv := NewMuxServer(c1)
+	defer srv.Close()
+	go func() {
+		for stm := range srv.Accept() {
+			go io.Copy(io.Discard, stm)
+		}
+	}()
+	d := time.Millisecond * 10
+	cli := NewMuxClient(&SlowConn{ReadWriteCloser: c0, D: d})
+	defer cli.Close()
+	buf := make([]byte, 2044*Conf.WriteBatch)
+	for range 16 {
+		stm := doa.Try(cli.Open())
+		go func() {
+			for {
+				if _, err := stm.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(d * 4)
+	// Control frames wait for the write in flight, but not for the writes queued by bulk streams.
+	for range 4 {
+		now := time.Now()
+		stm := doa.Try(cli.Open())
+		if time.Since(now) > d*4 {
+			t.Fatal(time.Since(now))
+		}
+		stm.Close()
+	}
+}
+
+func BenchmarkProtocolCzarMux(b *testing.B) {
+	rmt := &Tester{daze.NewTester(EchoServerListenOn)}
+	rmt.Mux()
+	defer rmt.Close()
+
+	mux := NewMuxClient(doa.Try(net.Dial("tcp", EchoServerListenOn)))
+	defer mux.Close()
+	cli := doa.Try(mux.Open())
+	defer cli.Close()
+
+	buf := make([]byte, 0x8000)
+	b.SetBytes(0x8000)
+	b.ResetTimer()
+	for range b.N {
+		doa.Try(cli.Write([]byte{0x00, 0x00, 0x80, 0x00}))
+		doa.Try(io.ReadFull(cli, buf))
+	}
+}
+
+func TestProtocolCzarMuxKeepalive(t *testing.T) {
+	c0, c1 := net.Pipe()
+	mux := NewMuxClient(c0)
+	defer mux.Close()
+	mux.Keepalive(time.Millisecond)
+	rmt := NewMuxServer(c1)
+	defer rmt.Close()
+	cli := doa.Try(mux.Open())
+	srv := <-rmt.Accept()
+	time.Sleep(time.Millisecond * 16)
+	// Keepalives are not seen by the streams.
+	doa.Try(cli.Write([]byte{0x2a}))
+	buf := make([]byte, 2)
+	doa.Doa(doa.Try(srv.Read(buf)) == 1)
+}
+
 type Tester struct {
 	*daze.Tester
 }
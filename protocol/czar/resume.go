@@ -0,0 +1,379 @@
+package czar
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mohanson/daze/protocol/ashe"
+)
+
+// Resume is a stream which outlives its multiplexer. When the connection under the multiplexer is lost, the stream is
+// suspended instead of closed, and reads and writes block until the stream is bound to a stream of a new multiplexer,
+// or until the grace period ends. Written data is kept in a bounded buffer, so that data lost along with the old
+// connection can be sent again.
+//
+// To open a resumable stream, the client sets Rsv of the open frame to 1, and sends a ticket of 16 random bytes in the
+// encrypted channel of an ashe hello before any data. To resume it on a new multiplexer, the client sets Rsv of the
+// open frame to 2, and sends the ticket and the number of bytes it has received in the encrypted channel of another
+// hello, the server replies in the channel with the number of bytes it has received, or 0xffffffffffffffff if the
+// ticket is unknown or belongs to another credential. Then both sides send again the data the other side has not
+// received.
+type Resume struct {
+	buf []byte
+	err error
+	gra time.Duration
+	// key and usr are the credential which opened the stream, only it can resume the stream.
+	key []byte
+	mu  sync.Mutex
+	one sync.Once
+	rxn uint64
+	sig chan struct{}
+	stm *Stream
+	tkt string
+	tmr *time.Timer
+	txn uint64
+	usr string
+	zdn func()
+}
+
+// Close implements io.Closer.
+func (r *Resume) Close() error {
+	r.Fail(io.ErrClosedPipe)
+	return nil
+}
+
+// Fail closes the stream with the error.
+func (r *Resume) Fail(err error) {
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = err
+		if r.stm != nil {
+			r.stm.Close()
+		}
+		if r.tmr != nil {
+			r.tmr.Stop()
+		}
+		r.wake()
+	}
+	r.mu.Unlock()
+	r.one.Do(r.zdn)
+}
+
+// wake wakes up the readers and writers waiting for a change of the state. The caller must hold the lock.
+func (r *Resume) wake() {
+	close(r.sig)
+	r.sig = make(chan struct{})
+}
+
+// detach suspends the stream, and starts the grace period. The caller must hold the lock.
+func (r *Resume) detach() {
+	r.stm = nil
+	r.tmr = time.AfterFunc(r.gra, func() {
+		r.mu.Lock()
+		lost := r.stm == nil
+		r.mu.Unlock()
+		if lost {
+			r.Fail(errors.New("daze: stream not resumed in time"))
+		}
+	})
+	r.wake()
+}
+
+// Detach suspends the stream if it is still bound to s.
+func (r *Resume) Detach(s *Stream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil && r.stm == s {
+		r.detach()
+	}
+}
+
+// Lost reports whether the error of the stream s is caused by the loss of its multiplexer, rather than a close.
+func (r *Resume) Lost(s *Stream, err error) bool {
+	r.mu.Lock()
+	bound := r.stm == s
+	r.mu.Unlock()
+	if !bound {
+		return true
+	}
+	select {
+	case <-s.mux.Done():
+		return true
+	default:
+	}
+	if err == io.EOF || errors.Is(err, io.ErrClosedPipe) {
+		return false
+	}
+	// Other errors come from the connection, which has been closed then.
+	<-s.mux.Done()
+	return true
+}
+
+// Wait waits until the stream is bound to a stream other than s.
+func (r *Resume) Wait(s *Stream) (*Stream, error) {
+	for {
+		r.mu.Lock()
+		err := r.err
+		stm := r.stm
+		sig := r.sig
+		r.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if stm != nil && stm != s {
+			return stm, nil
+		}
+		<-sig
+	}
+}
+
+// Read implements io.Reader.
+func (r *Resume) Read(p []byte) (int, error) {
+	s, err := r.Wait(nil)
+	for err == nil {
+		n, e := s.Read(p)
+		r.mu.Lock()
+		// Data read from a detached stream is dropped, the peer sends it again.
+		bound := r.stm == s
+		if bound {
+			r.rxn += uint64(n)
+		}
+		r.mu.Unlock()
+		if bound && n != 0 {
+			return n, nil
+		}
+		if !r.Lost(s, e) {
+			return 0, e
+		}
+		r.Detach(s)
+		s, err = r.Wait(s)
+	}
+	return 0, err
+}
+
+// Write implements io.Writer.
+func (r *Resume) Write(p []byte) (int, error) {
+	var s *Stream
+	for s == nil {
+		r.mu.Lock()
+		err := r.err
+		sig := r.sig
+		if err == nil && r.stm != nil {
+			s = r.stm
+			r.buf = append(r.buf, p...)
+			r.txn += uint64(len(p))
+			// Keep the tail of the written data, the buffer is reallocated once in a while to release memory.
+			if len(r.buf) > 2*Conf.ResumeBuffer {
+				r.buf = append([]byte{}, r.buf[len(r.buf)-Conf.ResumeBuffer:]...)
+			}
+		}
+		r.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if s == nil {
+			<-sig
+		}
+	}
+	_, err := s.Write(p)
+	if err == nil {
+		return len(p), nil
+	}
+	if !r.Lost(s, err) {
+		return 0, err
+	}
+	r.Detach(s)
+	// The data is sent again when the stream is bound.
+	_, err = r.Wait(s)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Owned reports whether the stream was opened by the credential.
+func (r *Resume) Owned(cred ashe.Cred) bool {
+	return r.usr == cred.User && hmac.Equal(r.key, cred.Cipher)
+}
+
+// Take suspends the stream and closes the stream it is bound to, which has been replaced. Other streams of the
+// multiplexer are left alone. It returns the number of bytes received.
+func (r *Resume) Take() (uint64, error) {
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return 0, r.err
+	}
+	old := r.stm
+	if old != nil {
+		r.detach()
+	}
+	rxn := r.rxn
+	r.mu.Unlock()
+	if old != nil {
+		// The connection under the old multiplexer may be half-open, so the close frame is written in the background.
+		go old.Close()
+	}
+	return rxn, nil
+}
+
+// Bind binds the suspended stream to the stream s of a new multiplexer. The peer has received peer bytes, the rest of
+// the written data is sent again.
+func (r *Resume) Bind(s *Stream, peer uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if r.stm != nil {
+		return errors.New("daze: stream is not suspended")
+	}
+	if peer > r.txn || r.txn-peer > uint64(len(r.buf)) {
+		return errors.New("daze: stream can not be resumed")
+	}
+	_, err := s.Write(r.buf[uint64(len(r.buf))-(r.txn-peer):])
+	if err != nil {
+		return err
+	}
+	r.tmr.Stop()
+	r.stm = s
+	r.wake()
+	return nil
+}
+
+// NewResume returns a new Resume bound to the stream. The function done is called once the stream is closed.
+func NewResume(s *Stream, ticket string, grace time.Duration, done func()) *Resume {
+	return &Resume{
+		buf: make([]byte, 0),
+		gra: grace,
+		sig: make(chan struct{}),
+		stm: s,
+		tkt: ticket,
+		zdn: done,
+	}
+}
+
+// Resumes is a table of resumable streams by their tickets.
+type Resumes struct {
+	m  map[string]*Resume
+	mu sync.Mutex
+}
+
+// All returns all streams in the table.
+func (r *Resumes) All() []*Resume {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := make([]*Resume, 0, len(r.m))
+	for _, e := range r.m {
+		l = append(l, e)
+	}
+	return l
+}
+
+// Del removes the stream of the ticket.
+func (r *Resumes) Del(ticket string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, ticket)
+}
+
+// Get returns the stream of the ticket, or nil.
+func (r *Resumes) Get(ticket string) *Resume {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.m[ticket]
+}
+
+// Put adds a stream to the table.
+func (r *Resumes) Put(e *Resume) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m[e.tkt] = e
+}
+
+// NewResumes returns a new Resumes.
+func NewResumes() *Resumes {
+	return &Resumes{m: map[string]*Resume{}}
+}
+
+// ResumeAccept serves a request on the stream s to resume a stream in the table. The request is authenticated by spy,
+// and a stream opened by another credential is never resumed.
+func ResumeAccept(s *Stream, table *Resumes, spy *ashe.Server) error {
+	con, _, cred, err := spy.Session(s)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 24)
+	_, err = io.ReadFull(con, buf)
+	if err != nil {
+		return err
+	}
+	r := table.Get(string(buf[:16]))
+	if r != nil && !r.Owned(cred) {
+		r = nil
+	}
+	rxn := uint64(math.MaxUint64)
+	if r != nil {
+		rxn, err = r.Take()
+		if err != nil {
+			rxn = math.MaxUint64
+		}
+	}
+	_, err = con.Write(binary.BigEndian.AppendUint64(nil, rxn))
+	if err != nil {
+		return err
+	}
+	if rxn == math.MaxUint64 {
+		return errors.New("daze: unknown ticket")
+	}
+	err = r.Bind(s, binary.BigEndian.Uint64(buf[16:]))
+	if err != nil {
+		r.Fail(err)
+	}
+	return err
+}
+
+// ResumeDial resumes the stream r on the multiplexer, the request is authenticated by spy.
+func ResumeDial(r *Resume, mux *Mux, spy *ashe.Client) error {
+	r.mu.Lock()
+	fresh := r.stm != nil && r.stm.mux == mux
+	r.mu.Unlock()
+	if fresh {
+		// The stream has been opened on the multiplexer.
+		return nil
+	}
+	rxn, err := r.Take()
+	if err != nil {
+		return err
+	}
+	s, err := mux.OpenWith(0x02)
+	if err != nil {
+		return err
+	}
+	buf := binary.BigEndian.AppendUint64([]byte(r.tkt), rxn)
+	con, err := spy.Hello(s)
+	if err == nil {
+		_, err = con.Write(buf)
+	}
+	if err == nil {
+		_, err = io.ReadFull(con, buf[:8])
+	}
+	if err == nil && binary.BigEndian.Uint64(buf[:8]) == math.MaxUint64 {
+		err = errors.New("daze: unknown ticket")
+	}
+	if err == nil {
+		err = r.Bind(s, binary.BigEndian.Uint64(buf[:8]))
+	}
+	if err != nil {
+		s.Close()
+		return err
+	}
+	log.Printf("czar: mux resume stream id=0x%02x", s.idx)
+	return nil
+}
@@ -18,8 +18,12 @@ import (
 type Server struct {
 	Cipher []byte
 	Closer io.Closer
+	Dialer daze.Dialer
+	Hook   daze.Hook
 	Listen string
-	Server string
+	// Listener is used instead of listening on Listen if it is not nil, for example, a listener shared by daze.Demux.
+	Listener net.Listener
+	Server   string
 }
 
 // Close listener. Established connections will not be closed.
@@ -37,17 +41,21 @@ func (s *Server) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
 	if err != nil {
 		return err
 	}
-	srv, err := daze.Dial("tcp", s.Server)
+	err = s.Hook.OnDial(ctx, "tcp", s.Server)
 	if err != nil {
 		return err
 	}
-	daze.Link(con, srv)
+	srv, err := s.Dialer.Dial(ctx, "tcp", s.Server)
+	if err != nil {
+		return err
+	}
+	ctx.Link(con, srv)
 	return nil
 }
 
 // Run it.
 func (s *Server) Run() error {
-	l, err := net.Listen("tcp", s.Listen)
+	l, err := daze.Listen(s.Listener, s.Listen)
 	if err != nil {
 		return err
 	}
@@ -69,9 +77,14 @@ func (s *Server) Run() error {
 			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
 			go func() {
 				defer cli.Close()
-				if err := s.Serve(ctx, cli); err != nil {
+				err := s.Hook.OnAccept(ctx, cli.RemoteAddr())
+				if err == nil {
+					err = s.Serve(ctx, cli)
+				}
+				if err != nil {
 					log.Printf("conn: %08x  error %s", ctx.Cid, err)
 				}
+				s.Hook.OnClose(ctx, err)
 				log.Printf("conn: %08x closed", ctx.Cid)
 			}()
 		}
@@ -83,6 +96,8 @@ func (s *Server) Run() error {
 func NewServer(listen string, server string, cipher string) *Server {
 	return &Server{
 		Cipher: daze.Salt(cipher),
+		Dialer: daze.NewEngine(),
+		Hook:   daze.NewHookChain(),
 		Listen: listen,
 		Server: server,
 	}
@@ -92,6 +107,7 @@ func NewServer(listen string, server string, cipher string) *Server {
 type Client struct {
 	Cipher []byte
 	Closer io.Closer
+	Dialer daze.Dialer
 	Listen string
 	Server string
 }
@@ -106,7 +122,7 @@ func (c *Client) Close() error {
 
 // Serve incoming connections. Parameter cli will be closed automatically when the function exits.
 func (c *Client) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
-	srv, err := daze.Dial("tcp", c.Server)
+	srv, err := c.Dialer.Dial(ctx, "tcp", c.Server)
 	if err != nil {
 		return err
 	}
@@ -116,7 +132,7 @@ func (c *Client) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
 		srv.Close()
 		return err
 	}
-	daze.Link(cli, con)
+	ctx.Link(cli, con)
 	return nil
 }
 
@@ -158,6 +174,7 @@ func (c *Client) Run() error {
 func NewClient(listen string, server string, cipher string) *Client {
 	return &Client{
 		Cipher: daze.Salt(cipher),
+		Dialer: &daze.Direct{},
 		Listen: listen,
 		Server: server,
 	}
@@ -166,6 +183,8 @@ func NewClient(listen string, server string, cipher string) *Client {
 // Middle implemented the dahlia protocol.
 type Middle struct {
 	Closer io.Closer
+	// Dialer is used to connect to the server.
+	Dialer daze.Dialer
 	Listen string
 	Server string
 }
@@ -180,11 +199,11 @@ func (m *Middle) Close() error {
 
 // Serve incoming connections. Parameter cli will be closed automatically when the function exits.
 func (m *Middle) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
-	srv, err := daze.Dial("tcp", m.Server)
+	srv, err := m.Dialer.Dial(ctx, "tcp", m.Server)
 	if err != nil {
 		return err
 	}
-	daze.Link(cli, srv)
+	ctx.Link(cli, srv)
 	return nil
 }
 
@@ -225,6 +244,7 @@ func (m *Middle) Run() error {
 // NewMiddle returns a new Middle.
 func NewMiddle(listen string, server string) *Middle {
 	return &Middle{
+		Dialer: &daze.Direct{},
 		Listen: listen,
 		Server: server,
 	}
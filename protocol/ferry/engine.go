@@ -0,0 +1,481 @@
+package ferry
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/protocol/ashe"
+	"github.com/mohanson/daze/protocol/czar"
+)
+
+// Protocol ferry carries the czar protocol over udp, in a way similar to wireguard. A noise handshake establishes a
+// session, and the session is identified by a random index rather than the address of the client, so the client can
+// roam between networks, for example, from wifi to cellular, without handshaking again. The session is kept alive by
+// keepalive messages, and the maximum message size is found by path mtu discovery.
+//
+// Handshake initiation, the payload is the unix timestamp of the client in seconds:
+//
+// +-----+-----+-----+-----+-----+-----+-----+-----+
+// |  1  |  Sender index   |  Ephemeral  | Payload |
+// +-----+-----+-----+-----+-----+-----+-----+-----+
+// |  1  |        4        |     32      |  8 + 16 |
+// +-----+-----+-----+-----+-----+-----+-----+-----+
+//
+// Handshake response, the payload is empty:
+//
+// +-----+-----+-----+-----+-----+-----+-----+-----+-----+
+// |  2  |  Sender index   | Receiver index  |  Ephemeral  | Payload |
+// +-----+-----+-----+-----+-----+-----+-----+-----+-----+
+// |  1  |        4        |        4        |     32      |  0 + 16 |
+// +-----+-----+-----+-----+-----+-----+-----+-----+-----+
+//
+// Transport, the payload is an optional frame:
+//
+// +-----+-----+-----+-----+-----+-----+-----+
+// |  3  | Receiver index  | Counter | Payload |
+// +-----+-----+-----+-----+-----+-----+-----+
+// |  1  |        4        |    8    |  n + 16 |
+// +-----+-----+-----+-----+-----+-----+-----+
+//
+// Frames: data(0, seq, msg), ack(1, seq), probe(2, size, padding), probe ack(3, size) and fin(4).
+//
+// Messages are carried by udp datagrams or, for networks that only allow ping, by icmp echo messages.
+
+// Conf is acting as package level configuration.
+var Conf = struct {
+	// Session is closed if nothing is received from the peer for this duration.
+	Expired time.Duration
+	// Handshake on each network is given up after this duration, and the next network is tried.
+	HandshakeTimeout time.Duration
+	// Keepalive is sent when the session is idle, so that nat mappings along the path are not expired.
+	Keepalive time.Duration
+	// Maximum size of udp payload before path mtu discovery, it is safe on almost all networks.
+	Mtu int
+	// Candidates of path mtu discovery.
+	MtuProbe []int
+	// Path mtu is discovered again periodically.
+	MtuProbeInterval time.Duration
+	// Retries of a segment before the session is considered broken.
+	Retries int
+	// Bounds of retransmission timeout.
+	RtoMax time.Duration
+	RtoMin time.Duration
+	// Tick is the resolution of the retransmission timer.
+	Tick time.Duration
+	// Maximum segments in flight.
+	Window int
+}{
+	Expired:          time.Second * 60,
+	HandshakeTimeout: time.Second * 4,
+	Keepalive:        time.Second * 15,
+	Mtu:              1200,
+	MtuProbe:         []int{1232, 1280, 1372, 1400, 1452, 1472},
+	MtuProbeInterval: time.Minute * 10,
+	Retries:          12,
+	RtoMax:           time.Second * 4,
+	RtoMin:           time.Millisecond * 100,
+	Tick:             time.Millisecond * 20,
+	Window:           256,
+}
+
+// Index returns a random session index.
+func Index() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// Listen announces on the local address. For icmp, the port of the address is ignored, and the client side is chosen if
+// the address is empty.
+func Listen(network string, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp":
+		return net.ListenPacket("udp", address)
+	case "icmp":
+		if address == "" {
+			conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+			if err != nil {
+				return nil, err
+			}
+			return NewIcmpClientConn(conn), nil
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		conn, err := net.ListenPacket("ip4:icmp", host)
+		if err != nil {
+			return nil, err
+		}
+		return NewIcmpServerConn(conn), nil
+	}
+	return nil, fmt.Errorf("daze: ferry unknown network %s", network)
+}
+
+// Resolve returns the address of the server on the named network. For icmp, the port of the address is ignored.
+func Resolve(network string, address string) (net.Addr, error) {
+	switch network {
+	case "udp":
+		return net.ResolveUDPAddr("udp", address)
+	case "icmp":
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		return net.ResolveIPAddr("ip4", host)
+	}
+	return nil, fmt.Errorf("daze: ferry unknown network %s", network)
+}
+
+// Server implemented the ferry protocol.
+type Server struct {
+	Cipher []byte
+	Closer io.Closer
+	Dialer daze.Dialer
+	Hook   daze.Hook
+	Listen string
+	// Network is udp or icmp.
+	Network string
+	m       *sync.Mutex
+	s       map[uint32]*Session
+}
+
+// Serve incoming connections. Parameter cli will be closed automatically when the function exits.
+func (s *Server) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
+	spy := &ashe.Server{Cipher: s.Cipher, Dialer: s.Dialer, Hook: s.Hook}
+	return spy.Serve(ctx, cli)
+}
+
+// Close listener.
+func (s *Server) Close() error {
+	if s.Closer != nil {
+		return s.Closer.Close()
+	}
+	return nil
+}
+
+// Accept handles a handshake initiation and returns a new session.
+func (s *Server) Accept(conn net.PacketConn, msg []byte, addr net.Addr) (*Session, error) {
+	if len(msg) != 61 {
+		return nil, errors.New("daze: ferry malformed handshake")
+	}
+	noise := NewNoise(s.Cipher)
+	re, err := noise.ReadE(msg[5:37])
+	if err != nil {
+		return nil, err
+	}
+	payload, err := noise.DecryptAndHash(msg[37:61])
+	if err != nil {
+		return nil, err
+	}
+	gap := time.Now().Unix() - int64(binary.BigEndian.Uint64(payload))
+	if gap < -int64(ashe.Conf.LifeExpired) || gap > int64(ashe.Conf.LifeExpired) {
+		return nil, errors.New("daze: ferry expired handshake")
+	}
+	peer := binary.BigEndian.Uint32(msg[1:5])
+	idx := Index()
+	buf := make([]byte, 9, 57)
+	buf[0] = MsgResponse
+	binary.BigEndian.PutUint32(buf[1:5], idx)
+	binary.BigEndian.PutUint32(buf[5:9], peer)
+	buf = append(buf, noise.WriteE()...)
+	if err := noise.MixEE(re); err != nil {
+		return nil, err
+	}
+	buf = append(buf, noise.EncryptAndHash([]byte{})...)
+	if _, err := conn.WriteTo(buf, addr); err != nil {
+		return nil, err
+	}
+	dec, enc := noise.Split()
+	ses := NewSession(conn, addr, idx, peer, enc, dec, func() {
+		s.m.Lock()
+		delete(s.s, idx)
+		s.m.Unlock()
+	})
+	s.m.Lock()
+	s.s[idx] = ses
+	s.m.Unlock()
+	return ses, nil
+}
+
+// Run it.
+func (s *Server) Run() error {
+	l, err := Listen(s.Network, s.Listen)
+	if err != nil {
+		return err
+	}
+	s.Closer = l
+	log.Println("ferry: listen and serve on", s.Listen)
+
+	go func() {
+		idx := atomic.Uint32{}
+		idx.Store(math.MaxUint32)
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := l.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("ferry:", err)
+				}
+				break
+			}
+			if n < 5 {
+				continue
+			}
+			switch buf[0] {
+			case MsgInitiation:
+				ses, err := s.Accept(l, buf[:n], addr)
+				if err != nil {
+					log.Println("ferry:", err)
+					continue
+				}
+				log.Printf("ferry: session %08x init remote=%s", ses.idx, addr)
+				mux := czar.NewMuxServer(ses)
+				go func() {
+					defer mux.Close()
+					for con := range mux.Accept() {
+						ctx := &daze.Context{Cid: idx.Add(1)}
+						log.Printf("conn: %08x accept remote=%s", ctx.Cid, addr)
+						go func() {
+							defer con.Close()
+							err := s.Hook.OnAccept(ctx, addr)
+							if err == nil {
+								err = s.Serve(ctx, con)
+							}
+							if err != nil {
+								log.Printf("conn: %08x  error %s", ctx.Cid, err)
+							}
+							s.Hook.OnClose(ctx, err)
+							log.Printf("conn: %08x closed", ctx.Cid)
+						}()
+					}
+					log.Printf("ferry: session %08x done", ses.idx)
+				}()
+			case MsgTransport:
+				s.m.Lock()
+				ses := s.s[binary.BigEndian.Uint32(buf[1:5])]
+				s.m.Unlock()
+				if ses != nil {
+					ses.Recv(buf[:n], addr)
+				}
+			}
+		}
+		s.m.Lock()
+		for _, e := range s.s {
+			e.err.Put(net.ErrClosed)
+		}
+		s.m.Unlock()
+	}()
+
+	return nil
+}
+
+// NewServer returns a new Server. Cipher is a password in string form, with no length limit.
+func NewServer(listen string, cipher string) *Server {
+	return &Server{
+		Cipher:  daze.Salt(cipher),
+		Dialer:  daze.NewEngine(),
+		Hook:    daze.NewHookChain(),
+		Listen:  listen,
+		Network: "udp",
+		m:       &sync.Mutex{},
+		s:       map[uint32]*Session{},
+	}
+}
+
+// Client implemented the ferry protocol.
+type Client struct {
+	Cancel chan struct{}
+	Cipher []byte
+	Mux    chan *czar.Mux
+	// Network is a comma separated list of udp and icmp, they are tried in order until a session is established.
+	Network string
+	Once    sync.Once
+	Server  string
+}
+
+// Close the connection. All streams will be closed at the same time.
+func (c *Client) Close() error {
+	close(c.Cancel)
+	return nil
+}
+
+// Dial connects to the address on the named network.
+func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	c.Once.Do(func() {
+		go c.Run()
+	})
+	select {
+	case mux := <-c.Mux:
+		srv, err := mux.Open()
+		if err != nil {
+			return nil, err
+		}
+		spy := &ashe.Client{Cipher: c.Cipher}
+		con, err := spy.Estab(ctx, srv, network, address)
+		if err != nil {
+			srv.Close()
+		}
+		return con, err
+	case <-time.After(daze.Conf.DialerTimeout):
+		return nil, fmt.Errorf("dial udp: %s: i/o timeout", address)
+	}
+}
+
+// Handshake establishes a new session with the server, networks are tried in order.
+func (c *Client) Handshake() (*Session, error) {
+	var (
+		err error
+		ses *Session
+	)
+	for _, e := range strings.Split(c.Network, ",") {
+		ses, err = c.HandshakeOn(e)
+		if err == nil {
+			return ses, nil
+		}
+		log.Printf("ferry: handshake on %s failed %s", e, err)
+	}
+	return nil, err
+}
+
+// HandshakeOn establishes a new session with the server on the named network. The local address is not bound to any
+// interface, so that the session survives when the client moves between networks.
+func (c *Client) HandshakeOn(network string) (*Session, error) {
+	addr, err := Resolve(network, c.Server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := Listen(network, "")
+	if err != nil {
+		return nil, err
+	}
+	idx := Index()
+	buf := make([]byte, 2048)
+	end := time.Now().Add(Conf.HandshakeTimeout)
+	for time.Now().Before(end) {
+		noise := NewNoise(c.Cipher)
+		msg := make([]byte, 5, 61)
+		msg[0] = MsgInitiation
+		binary.BigEndian.PutUint32(msg[1:5], idx)
+		msg = append(msg, noise.WriteE()...)
+		msg = append(msg, noise.EncryptAndHash(binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix())))...)
+		if _, err := conn.WriteTo(msg, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// Handshake initiation is retransmitted every second until a response is received.
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if n != 57 || buf[0] != MsgResponse || binary.BigEndian.Uint32(buf[5:9]) != idx {
+				continue
+			}
+			re, err := noise.ReadE(buf[9:41])
+			if err != nil {
+				continue
+			}
+			if noise.MixEE(re) != nil {
+				continue
+			}
+			if _, err := noise.DecryptAndHash(buf[41:57]); err != nil {
+				continue
+			}
+			conn.SetReadDeadline(time.Time{})
+			enc, dec := noise.Split()
+			ses := NewSession(conn, addr, idx, binary.BigEndian.Uint32(buf[1:5]), enc, dec, func() {
+				conn.Close()
+			})
+			go func() {
+				buf := make([]byte, 2048)
+				for {
+					n, addr, err := conn.ReadFrom(buf)
+					if err != nil {
+						ses.m.Lock()
+						ses.Shut(err)
+						ses.m.Unlock()
+						break
+					}
+					if n < 5 || buf[0] != MsgTransport || binary.BigEndian.Uint32(buf[1:5]) != idx {
+						continue
+					}
+					ses.Recv(buf[:n], addr)
+				}
+			}()
+			return ses, nil
+		}
+	}
+	conn.Close()
+	return nil, fmt.Errorf("dial udp: %s: i/o timeout", c.Server)
+}
+
+// Run creates an establish session to ferry server.
+func (c *Client) Run() {
+	var (
+		err error
+		mux *czar.Mux
+		rtt = 0
+		sid = 0
+		ses *Session
+	)
+	for {
+		switch sid {
+		case 0:
+			ses, err = c.Handshake()
+			switch {
+			case err != nil:
+				log.Println("ferry:", err)
+				select {
+				case <-time.After(time.Second * time.Duration(math.Pow(2, float64(rtt)))):
+					// A slow start reconnection algorithm.
+					rtt = min(rtt+1, 5)
+				case <-c.Cancel:
+					sid = 2
+				}
+			case err == nil:
+				log.Println("ferry: session init")
+				mux = czar.NewMuxClient(ses)
+				rtt = 0
+				sid = 1
+			}
+		case 1:
+			select {
+			case c.Mux <- mux:
+			case <-mux.Done():
+				log.Println("ferry: session done")
+				mux.Close()
+				sid = 0
+			case <-c.Cancel:
+				log.Println("ferry: session done")
+				mux.Close()
+				sid = 2
+			}
+		case 2:
+			return
+		}
+	}
+}
+
+// NewClient returns a new Client. Cipher is a password in string form, with no length limit.
+func NewClient(server, cipher string) *Client {
+	return &Client{
+		Cancel:  make(chan struct{}),
+		Cipher:  daze.Salt(cipher),
+		Mux:     make(chan *czar.Mux),
+		Network: "udp",
+		Server:  server,
+	}
+}
@@ -0,0 +1,113 @@
+package ferry
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/lib/doa"
+)
+
+const (
+	EchoServerListenOn = "127.0.0.1:28080"
+	DazeServerListenOn = "127.0.0.1:28081"
+	Password           = "password"
+)
+
+func TestProtocolFerryTCP(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	defer dazeClient.Close()
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+
+	var (
+		buf = make([]byte, 4)
+		rsz = int(rand.Uint32N(65536))
+	)
+	copy(buf[0:2], []byte{0x00, 0x00})
+	binary.BigEndian.PutUint16(buf[2:], uint16(rsz))
+	doa.Try(cli.Write(buf[:4]))
+	doa.Try(io.ReadFull(cli, make([]byte, rsz)))
+	copy(buf[0:2], []byte{0x01, 0x00})
+	binary.BigEndian.PutUint16(buf[2:], uint16(rsz))
+	doa.Try(cli.Write(buf[:4]))
+	doa.Try(cli.Write(make([]byte, rsz)))
+}
+
+func TestProtocolFerryUDP(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.UDP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	defer dazeClient.Close()
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "udp", EchoServerListenOn))
+	defer cli.Close()
+
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	buf := make([]byte, 128)
+	doa.Try(io.ReadFull(cli, buf[:128]))
+}
+
+func TestProtocolFerryHandshake(t *testing.T) {
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	ses := doa.Try(dazeClient.Handshake())
+	doa.Doa(ses.Mtu() == Conf.Mtu)
+	ses.Close()
+
+	dazeClient = NewClient(DazeServerListenOn, "wrong")
+	handshakeTimeout := Conf.HandshakeTimeout
+	Conf.HandshakeTimeout = time.Second * 2
+	defer func() { Conf.HandshakeTimeout = handshakeTimeout }()
+	doa.Doa(doa.Err(dazeClient.Handshake()) != nil)
+}
+
+func TestProtocolFerryICMP(t *testing.T) {
+	if doa.Err(Listen("icmp", "")) != nil {
+		t.Skip("raw sockets are not permitted")
+	}
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer("127.0.0.1", Password)
+	dazeServer.Network = "icmp"
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	// Nothing listens on the udp port, the client falls back to icmp.
+	handshakeTimeout := Conf.HandshakeTimeout
+	Conf.HandshakeTimeout = time.Second
+	defer func() { Conf.HandshakeTimeout = handshakeTimeout }()
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	dazeClient.Network = "udp,icmp"
+	defer dazeClient.Close()
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	buf := make([]byte, 128)
+	doa.Try(io.ReadFull(cli, buf[:128]))
+}
@@ -0,0 +1,98 @@
+package ferry
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"github.com/mohanson/daze/lib/lru"
+)
+
+// IcmpConn is a packet conn which carries messages in the payload of icmp echo messages, it allows the ferry protocol
+// to pass through networks that block tcp and udp but allow ping. The client sends echo requests and the server sends
+// echo replies. Raw sockets are required, which means root or the CAP_NET_RAW capability on linux.
+//
+// The kernel of the server also answers echo requests, these replies are dropped by the client since they are not
+// addressed to the session. Set net.ipv4.icmp_echo_ignore_all to 1 on the server to save the bandwidth.
+type IcmpConn struct {
+	net.PacketConn
+	id  uint16
+	idm *lru.Lru[string, uint16]
+	rcv uint8
+	seq atomic.Uint32
+	snd uint8
+}
+
+// IcmpChecksum returns the internet checksum of the message, see rfc 1071.
+func IcmpChecksum(b []byte) uint16 {
+	s := uint32(0)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *IcmpConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(p)+8)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		if n < 8 || buf[0] != c.rcv || buf[1] != 0 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(buf[4:6])
+		if c.idm == nil && id != c.id {
+			continue
+		}
+		if c.idm != nil {
+			c.idm.Set(addr.String(), id)
+		}
+		return copy(p, buf[8:n]), addr, nil
+	}
+}
+
+// WriteTo implements net.PacketConn.
+func (c *IcmpConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	id := c.id
+	if c.idm != nil {
+		id = c.idm.Get(addr.String())
+	}
+	buf := make([]byte, 8+len(p))
+	buf[0] = c.snd
+	binary.BigEndian.PutUint16(buf[4:6], id)
+	binary.BigEndian.PutUint16(buf[6:8], uint16(c.seq.Add(1)))
+	copy(buf[8:], p)
+	binary.BigEndian.PutUint16(buf[2:4], IcmpChecksum(buf))
+	_, err := c.PacketConn.WriteTo(buf, addr)
+	return len(p), err
+}
+
+// NewIcmpClientConn returns a new IcmpConn for the client. Only echo replies with the identifier are received.
+func NewIcmpClientConn(conn net.PacketConn) *IcmpConn {
+	return &IcmpConn{
+		PacketConn: conn,
+		id:         uint16(Index()),
+		rcv:        0,
+		snd:        8,
+	}
+}
+
+// NewIcmpServerConn returns a new IcmpConn for the server. Echo replies are sent with the identifier of the latest echo
+// request from the same address.
+func NewIcmpServerConn(conn net.PacketConn) *IcmpConn {
+	return &IcmpConn{
+		PacketConn: conn,
+		idm:        lru.New[string, uint16](1024),
+		rcv:        8,
+		snd:        0,
+	}
+}
@@ -0,0 +1,160 @@
+package ferry
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The handshake is the Noise_NNpsk0_25519_ChaChaPoly_BLAKE2s pattern of the noise protocol framework[1]. Both sides
+// only share a pre-shared key, which authenticates the first message, so the server does not keep any state for
+// handshakes that fail:
+//
+//	-> psk, e
+//	<- e, ee
+//
+// [1] https://noiseprotocol.org/noise.html
+
+const (
+	NoiseName     = "Noise_NNpsk0_25519_ChaChaPoly_BLAKE2s"
+	NoisePrologue = "daze"
+)
+
+// NoiseHmac returns a new hmac hash with blake2s as the underlying hash.
+func NoiseHmac(key []byte) hash.Hash {
+	return hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+}
+
+// NoiseHkdf derives n keys from the chaining key and the input key material.
+func NoiseHkdf(ck []byte, ikm []byte, n int) [][]byte {
+	h := NoiseHmac(ck)
+	h.Write(ikm)
+	k := h.Sum(nil)
+	r := make([][]byte, n)
+	o := []byte{}
+	for i := range n {
+		h = NoiseHmac(k)
+		h.Write(o)
+		h.Write([]byte{byte(i + 1)})
+		o = h.Sum(nil)
+		r[i] = o
+	}
+	return r
+}
+
+// NoiseNonce returns the 96 bits nonce of chacha20poly1305 for a counter.
+func NoiseNonce(n uint64) []byte {
+	b := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(b[4:], n)
+	return b
+}
+
+// Noise is the symmetric state and handshake state of the noise protocol.
+type Noise struct {
+	ck []byte
+	e  *ecdh.PrivateKey
+	h  []byte
+	k  cipher.AEAD
+	n  uint64
+}
+
+// MixHash mixes data into the handshake hash.
+func (n *Noise) MixHash(data []byte) {
+	h, _ := blake2s.New256(nil)
+	h.Write(n.h)
+	h.Write(data)
+	n.h = h.Sum(nil)
+}
+
+// MixKey mixes the input key material into the chaining key and sets a new cipher key.
+func (n *Noise) MixKey(ikm []byte) {
+	r := NoiseHkdf(n.ck, ikm, 2)
+	n.ck = r[0]
+	n.k, _ = chacha20poly1305.New(r[1])
+	n.n = 0
+}
+
+// MixKeyAndHash is used for handling pre-shared symmetric keys.
+func (n *Noise) MixKeyAndHash(ikm []byte) {
+	r := NoiseHkdf(n.ck, ikm, 3)
+	n.ck = r[0]
+	n.MixHash(r[1])
+	n.k, _ = chacha20poly1305.New(r[2])
+	n.n = 0
+}
+
+// EncryptAndHash encrypts the plaintext with the handshake hash as associated data.
+func (n *Noise) EncryptAndHash(plaintext []byte) []byte {
+	c := n.k.Seal(nil, NoiseNonce(n.n), plaintext, n.h)
+	n.n++
+	n.MixHash(c)
+	return c
+}
+
+// DecryptAndHash decrypts the ciphertext with the handshake hash as associated data.
+func (n *Noise) DecryptAndHash(ciphertext []byte) ([]byte, error) {
+	p, err := n.k.Open(nil, NoiseNonce(n.n), ciphertext, n.h)
+	if err != nil {
+		return nil, errors.New("daze: noise decryption failed")
+	}
+	n.n++
+	n.MixHash(ciphertext)
+	return p, nil
+}
+
+// WriteE generates an ephemeral key pair and returns the public key.
+func (n *Noise) WriteE() []byte {
+	n.e, _ = ecdh.X25519().GenerateKey(rand.Reader)
+	e := n.e.PublicKey().Bytes()
+	n.MixHash(e)
+	n.MixKey(e)
+	return e
+}
+
+// ReadE reads the ephemeral public key of the remote.
+func (n *Noise) ReadE(e []byte) (*ecdh.PublicKey, error) {
+	r, err := ecdh.X25519().NewPublicKey(e)
+	if err != nil {
+		return nil, err
+	}
+	n.MixHash(e)
+	n.MixKey(e)
+	return r, nil
+}
+
+// MixEE mixes the diffie-hellman result of the local and remote ephemeral keys.
+func (n *Noise) MixEE(r *ecdh.PublicKey) error {
+	s, err := n.e.ECDH(r)
+	if err != nil {
+		return err
+	}
+	n.MixKey(s)
+	return nil
+}
+
+// Split returns a pair of cipher keys for the transport. The first is used by the initiator to send messages.
+func (n *Noise) Split() (cipher.AEAD, cipher.AEAD) {
+	r := NoiseHkdf(n.ck, []byte{}, 2)
+	a, _ := chacha20poly1305.New(r[0])
+	b, _ := chacha20poly1305.New(r[1])
+	return a, b
+}
+
+// NewNoise returns a new Noise with the pre-shared key mixed.
+func NewNoise(psk []byte) *Noise {
+	h := blake2s.Sum256([]byte(NoiseName))
+	n := &Noise{ck: h[:], h: h[:]}
+	n.MixHash([]byte(NoisePrologue))
+	n.MixKeyAndHash(psk)
+	return n
+}
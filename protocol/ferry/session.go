@@ -0,0 +1,384 @@
+package ferry
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mohanson/daze/protocol/czar"
+)
+
+// Message types.
+const (
+	MsgInitiation = 0x01
+	MsgResponse   = 0x02
+	MsgTransport  = 0x03
+)
+
+// Frame types carried by transport messages. A transport message without any frame is a keepalive.
+const (
+	FrameData     = 0x00
+	FrameAck      = 0x01
+	FrameProbe    = 0x02
+	FrameProbeAck = 0x03
+	FrameFin      = 0x04
+)
+
+// Overhead of a data frame in a transport message: the message header, the aead tag and the data frame header.
+const Overhead = 13 + 16 + 5
+
+// Segment is a data frame waiting to be acknowledged.
+type Segment struct {
+	at  time.Time
+	buf []byte
+	n   int
+}
+
+// Session is a reliable ordered connection over an encrypted udp association. The session is identified by the index
+// rather than the address of the peer, and the address is updated by every authenticated message, so the peer can roam
+// between networks without handshaking again.
+type Session struct {
+	addr net.Addr
+	conn net.PacketConn
+	ctr  atomic.Uint64
+	dec  cipher.AEAD
+	enc  cipher.AEAD
+	err  *czar.Err
+	idx  uint32
+	m    *sync.Mutex // Guards following
+	mtu  int
+	ona  func()
+	pat  time.Time
+	peer uint32
+	plt  time.Time
+	pmx  int
+	rat  time.Time
+	rbf  []byte
+	rbm  uint64
+	rcv  map[uint32][]byte
+	rmx  uint64
+	rnx  uint32
+	rsg  chan struct{}
+	rto  time.Duration
+	rtt  time.Duration
+	rtv  time.Duration
+	sat  time.Time
+	snd  map[uint32]*Segment
+	snx  uint32
+	una  uint32
+	wsg  chan struct{}
+}
+
+// Send encrypts and sends frames to the peer. The caller must hold the lock.
+func (s *Session) Send(frame []byte) error {
+	ctr := s.ctr.Add(1) - 1
+	buf := make([]byte, 13, 13+len(frame)+16)
+	buf[0] = MsgTransport
+	binary.BigEndian.PutUint32(buf[1:5], s.peer)
+	binary.BigEndian.PutUint64(buf[5:13], ctr)
+	buf = s.enc.Seal(buf, NoiseNonce(ctr), frame, nil)
+	s.sat = time.Now()
+	_, err := s.conn.WriteTo(buf, s.addr)
+	return err
+}
+
+// Probe starts a round of path mtu discovery. The caller must hold the lock.
+func (s *Session) Probe() {
+	s.pat = time.Now()
+	s.plt = s.pat
+	s.pmx = Conf.Mtu
+	for _, e := range Conf.MtuProbe {
+		if e <= Conf.Mtu {
+			continue
+		}
+		// The size of the message is exactly the size of the probe.
+		buf := make([]byte, e-13-16)
+		buf[0] = FrameProbe
+		binary.BigEndian.PutUint16(buf[1:3], uint16(e))
+		// Probes larger than the mtu of the local interface fail immediately, it is ok.
+		s.Send(buf)
+	}
+}
+
+// Mtu returns the maximum size of udp payload currently in use.
+func (s *Session) Mtu() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.mtu
+}
+
+// Read implements io.Reader.
+func (s *Session) Read(p []byte) (int, error) {
+	for {
+		s.m.Lock()
+		if len(s.rbf) != 0 {
+			n := copy(p, s.rbf)
+			s.rbf = s.rbf[n:]
+			s.m.Unlock()
+			return n, nil
+		}
+		s.m.Unlock()
+		if err := s.err.Get(); err != nil {
+			return 0, err
+		}
+		select {
+		case <-s.rsg:
+		case <-s.err.Sig():
+		}
+	}
+}
+
+// Write implements io.Writer.
+func (s *Session) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) != 0 {
+		if err := s.err.Get(); err != nil {
+			return n, err
+		}
+		s.m.Lock()
+		if int(s.snx-s.una) >= Conf.Window {
+			s.m.Unlock()
+			select {
+			case <-s.wsg:
+			case <-s.err.Sig():
+			}
+			continue
+		}
+		l := min(len(p), s.mtu-Overhead)
+		buf := make([]byte, 5+l)
+		buf[0] = FrameData
+		binary.BigEndian.PutUint32(buf[1:5], s.snx)
+		copy(buf[5:], p[:l])
+		s.snd[s.snx] = &Segment{at: time.Now(), buf: buf}
+		s.snx++
+		err := s.Send(buf)
+		if err != nil {
+			s.Shut(err)
+			s.m.Unlock()
+			return n, err
+		}
+		s.m.Unlock()
+		p = p[l:]
+		n += l
+	}
+	return n, nil
+}
+
+// Recv handles a transport message from the peer.
+func (s *Session) Recv(msg []byte, addr net.Addr) {
+	if len(msg) < 13+16 {
+		return
+	}
+	ctr := binary.BigEndian.Uint64(msg[5:13])
+	frame, err := s.dec.Open(nil, NoiseNonce(ctr), msg[13:], nil)
+	if err != nil {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	// Reject replayed messages with a sliding window of 64 counters.
+	switch {
+	case ctr > s.rmx:
+		s.rbm = s.rbm<<min(ctr-s.rmx, 64) | 1
+		s.rmx = ctr
+	case s.rmx-ctr >= 64:
+		return
+	case s.rbm&(1<<(s.rmx-ctr)) != 0:
+		return
+	default:
+		s.rbm |= 1 << (s.rmx - ctr)
+	}
+	s.rat = time.Now()
+	// The peer has roamed, the new path may have a different mtu.
+	if addr.String() != s.addr.String() {
+		s.addr = addr
+		s.mtu = Conf.Mtu
+		s.Probe()
+	}
+	if len(frame) == 0 {
+		return
+	}
+	switch frame[0] {
+	case FrameData:
+		if len(frame) < 5 {
+			return
+		}
+		seq := binary.BigEndian.Uint32(frame[1:5])
+		gap := int32(seq - s.rnx)
+		if gap >= int32(Conf.Window) || len(s.rbf) >= Conf.Window*s.mtu {
+			// No room for it, the peer will retransmit it later.
+			return
+		}
+		if gap >= 0 {
+			s.rcv[seq] = frame[5:]
+		}
+		for {
+			data, ok := s.rcv[s.rnx]
+			if !ok {
+				break
+			}
+			delete(s.rcv, s.rnx)
+			s.rbf = append(s.rbf, data...)
+			s.rnx++
+		}
+		select {
+		case s.rsg <- struct{}{}:
+		default:
+		}
+		// Duplicate segments are acknowledged as well, since the previous ack may have been lost.
+		buf := make([]byte, 5)
+		buf[0] = FrameAck
+		binary.BigEndian.PutUint32(buf[1:5], s.rnx)
+		s.Send(buf)
+	case FrameAck:
+		if len(frame) < 5 {
+			return
+		}
+		ack := binary.BigEndian.Uint32(frame[1:5])
+		if int32(ack-s.una) <= 0 || int32(s.snx-ack) < 0 {
+			return
+		}
+		for ; s.una != ack; s.una++ {
+			seg := s.snd[s.una]
+			delete(s.snd, s.una)
+			// Karn's algorithm: retransmitted segments are ambiguous and not sampled.
+			if seg.n == 0 {
+				s.Sample(time.Since(seg.at))
+			}
+		}
+		select {
+		case s.wsg <- struct{}{}:
+		default:
+		}
+	case FrameProbe:
+		if len(frame) < 3 {
+			return
+		}
+		buf := make([]byte, 3)
+		buf[0] = FrameProbeAck
+		copy(buf[1:3], frame[1:3])
+		s.Send(buf)
+	case FrameProbeAck:
+		if len(frame) < 3 || s.pat.IsZero() {
+			return
+		}
+		s.pmx = max(s.pmx, int(binary.BigEndian.Uint16(frame[1:3])))
+	case FrameFin:
+		s.Shut(io.EOF)
+	}
+}
+
+// Sample updates the retransmission timeout with a round trip time sample, see rfc 6298. The caller must hold the lock.
+func (s *Session) Sample(rtt time.Duration) {
+	if s.rtt == 0 {
+		s.rtt = rtt
+		s.rtv = rtt / 2
+	} else {
+		s.rtv = s.rtv*3/4 + (s.rtt-rtt).Abs()/4
+		s.rtt = s.rtt*7/8 + rtt/8
+	}
+	s.rto = min(max(s.rtt+4*s.rtv, Conf.RtoMin), Conf.RtoMax)
+}
+
+// Tick retransmits lost segments, sends keepalives and finishes mtu discovery. It returns false if the session is dead.
+func (s *Session) Tick() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.err.Get() != nil {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(s.rat) > Conf.Expired {
+		s.Shut(errors.New("daze: ferry session expired"))
+		return false
+	}
+	for seq := s.una; seq != s.snx; seq++ {
+		seg := s.snd[seq]
+		if now.Sub(seg.at) < min(s.rto<<seg.n, Conf.RtoMax) {
+			continue
+		}
+		if seg.n >= Conf.Retries {
+			s.Shut(errors.New("daze: ferry session timeout"))
+			return false
+		}
+		seg.at = now
+		seg.n++
+		s.Send(seg.buf)
+	}
+	if !s.pat.IsZero() && now.Sub(s.pat) > time.Second {
+		s.pat = time.Time{}
+		s.mtu = s.pmx
+	}
+	if s.pat.IsZero() && now.Sub(s.plt) > Conf.MtuProbeInterval {
+		s.Probe()
+	}
+	if now.Sub(s.sat) > Conf.Keepalive {
+		s.Send([]byte{})
+	}
+	return true
+}
+
+// Shut closes the session with an error, without notifying the peer. The caller must hold the lock.
+func (s *Session) Shut(err error) {
+	if s.err.Get() != nil {
+		return
+	}
+	s.err.Put(err)
+	s.ona()
+}
+
+// Close implements io.Closer.
+func (s *Session) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.err.Get() != nil {
+		return nil
+	}
+	s.Send([]byte{FrameFin})
+	s.Shut(io.ErrClosedPipe)
+	return nil
+}
+
+// Run ticks the session until it is dead.
+func (s *Session) Run() {
+	for range time.Tick(Conf.Tick) {
+		if !s.Tick() {
+			break
+		}
+	}
+}
+
+// NewSession returns a new Session. Function ona is called once when the session is closed.
+func NewSession(conn net.PacketConn, addr net.Addr, idx, peer uint32, enc, dec cipher.AEAD, ona func()) *Session {
+	now := time.Now()
+	s := &Session{
+		addr: addr,
+		conn: conn,
+		dec:  dec,
+		enc:  enc,
+		err:  czar.NewErr(),
+		idx:  idx,
+		m:    &sync.Mutex{},
+		mtu:  Conf.Mtu,
+		ona:  ona,
+		peer: peer,
+		rat:  now,
+		rbf:  []byte{},
+		rcv:  map[uint32][]byte{},
+		rsg:  make(chan struct{}, 1),
+		rto:  Conf.RtoMax / 4,
+		sat:  now,
+		snd:  map[uint32]*Segment{},
+		wsg:  make(chan struct{}, 1),
+	}
+	s.m.Lock()
+	s.Probe()
+	s.m.Unlock()
+	go s.Run()
+	return s
+}
@@ -0,0 +1,111 @@
+package ferry
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mohanson/daze/lib/doa"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Lossy is a packet conn which drops outgoing packets randomly.
+type Lossy struct {
+	net.PacketConn
+	Rate float64
+}
+
+// WriteTo implements net.PacketConn.
+func (l *Lossy) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if mrand.Float64() < l.Rate {
+		return len(p), nil
+	}
+	return l.PacketConn.WriteTo(p, addr)
+}
+
+// Pipe returns a pair of connected sessions over the loopback address.
+func Pipe(rate float64) (*Session, *Session, net.PacketConn) {
+	k0 := make([]byte, chacha20poly1305.KeySize)
+	k1 := make([]byte, chacha20poly1305.KeySize)
+	rand.Read(k0)
+	rand.Read(k1)
+	a0 := doa.Try(chacha20poly1305.New(k0))
+	a1 := doa.Try(chacha20poly1305.New(k1))
+	c0 := doa.Try(net.ListenPacket("udp", "127.0.0.1:0"))
+	c1 := doa.Try(net.ListenPacket("udp", "127.0.0.1:0"))
+	s0 := NewSession(&Lossy{c0, rate}, c1.LocalAddr(), 0, 1, a0, a1, func() { c0.Close() })
+	s1 := NewSession(&Lossy{c1, rate}, c0.LocalAddr(), 1, 0, a1, a0, func() { c1.Close() })
+	go Pump(c0, s0)
+	go Pump(c1, s1)
+	return s0, s1, c0
+}
+
+// Pump delivers received messages to the session.
+func Pump(c net.PacketConn, s *Session) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		s.Recv(buf[:n], addr)
+	}
+}
+
+func TestProtocolFerrySession(t *testing.T) {
+	s0, s1, _ := Pipe(0)
+	defer s0.Close()
+	defer s1.Close()
+	src := make([]byte, 1<<20)
+	rand.Read(src)
+	go s0.Write(src)
+	dst := doa.Try(io.ReadAll(io.LimitReader(s1, int64(len(src)))))
+	doa.Doa(bytes.Equal(src, dst))
+	// Path mtu of the loopback interface is large enough for all probes.
+	time.Sleep(time.Second + Conf.Tick*2)
+	doa.Doa(s0.Mtu() == Conf.MtuProbe[len(Conf.MtuProbe)-1])
+}
+
+func TestProtocolFerrySessionLossy(t *testing.T) {
+	s0, s1, _ := Pipe(0.1)
+	defer s0.Close()
+	defer s1.Close()
+	src := make([]byte, 1<<18)
+	rand.Read(src)
+	go s0.Write(src)
+	dst := doa.Try(io.ReadAll(io.LimitReader(s1, int64(len(src)))))
+	doa.Doa(bytes.Equal(src, dst))
+}
+
+func TestProtocolFerrySessionRoaming(t *testing.T) {
+	s0, s1, c0 := Pipe(0)
+	defer s1.Close()
+	buf := make([]byte, 4)
+	doa.Try(s0.Write([]byte{0x00, 0x01, 0x02, 0x03}))
+	doa.Try(io.ReadFull(s1, buf))
+	// The client moves to a new address.
+	c2 := doa.Try(net.ListenPacket("udp", "127.0.0.1:0"))
+	defer c2.Close()
+	s0.m.Lock()
+	s0.conn = c2
+	s0.m.Unlock()
+	c0.Close()
+	go Pump(c2, s0)
+	doa.Try(s0.Write([]byte{0x04, 0x05, 0x06, 0x07}))
+	doa.Try(io.ReadFull(s1, buf))
+	doa.Doa(bytes.Equal(buf, []byte{0x04, 0x05, 0x06, 0x07}))
+	doa.Try(s1.Write([]byte{0x08, 0x09, 0x0a, 0x0b}))
+	doa.Try(io.ReadFull(s0, buf))
+	doa.Doa(bytes.Equal(buf, []byte{0x08, 0x09, 0x0a, 0x0b}))
+}
+
+func TestProtocolFerrySessionClose(t *testing.T) {
+	s0, s1, _ := Pipe(0)
+	defer s1.Close()
+	s0.Close()
+	doa.Doa(doa.Err(s1.Read(make([]byte, 1))) == io.EOF)
+}
@@ -0,0 +1,370 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"time"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/protocol/ashe"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Protocol shadowsocks is the shadowsocks aead protocol[1]. It is implemented so that existing shadowsocks clients,
+// especially mobile apps, can connect to a daze server. Only tcp is supported.
+//
+// Each direction of a connection begins with a random salt, a session key is derived from the pre-shared key and the
+// salt. The rest of the stream is a sequence of chunks:
+//
+// +--------------+------------+--------------+------------+
+// | Length (enc) | Length tag | Payload(enc) | Payload tag|
+// +--------------+------------+--------------+------------+
+// |      2       |     16     |    Length    |     16     |
+// +--------------+------------+--------------+------------+
+//
+// The first payload sent by the client is the destination address in socks5 format.
+//
+// [1] https://shadowsocks.org/doc/aead.html
+
+// Conf is acting as package level configuration.
+var Conf = struct {
+	// HandshakeTimeout is the time a client has to send the destination address. A failed handshake is not answered,
+	// the connection is drained and closed when the time is up, as if the handshake was still going on.
+	HandshakeTimeout time.Duration
+	// Method is the default cipher.
+	Method string
+	// ReplaySize is the number of salts the server remembers to reject replays.
+	ReplaySize int
+}{
+	HandshakeTimeout: time.Second * 8,
+	Method:           "chacha20-ietf-poly1305",
+	ReplaySize:       64 * 1024,
+}
+
+// PayloadSizeMask is the maximum size of a payload.
+const PayloadSizeMask = 0x3fff
+
+// Method describes an aead cipher.
+type Method struct {
+	KeySize int
+	New     func(key []byte) (cipher.AEAD, error)
+}
+
+// Methods are supported ciphers.
+var Methods = map[string]Method{
+	"aes-128-gcm":            {KeySize: 16, New: NewAesGcm},
+	"aes-256-gcm":            {KeySize: 32, New: NewAesGcm},
+	"chacha20-ietf-poly1305": {KeySize: 32, New: chacha20poly1305.New},
+}
+
+// NewAesGcm returns a aes-gcm aead.
+func NewAesGcm(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// Kdf derives the pre-shared key from the password, it is the EVP_BytesToKey function of openssl.
+func Kdf(password string, size int) []byte {
+	var (
+		key = []byte{}
+		prv = []byte{}
+	)
+	for len(key) < size {
+		h := md5.Sum(append(prv, password...))
+		prv = h[:]
+		key = append(key, prv...)
+	}
+	return key[:size]
+}
+
+// Nonce increments the little endian nonce.
+func Nonce(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
+
+// Pad extends the salt to the 32 bytes key of ashe.Replay.
+func Pad(salt []byte) []byte {
+	key := make([]byte, 32)
+	copy(key, salt)
+	return key
+}
+
+// Conn is an encrypted connection of shadowsocks. The salt of each direction is exchanged on the first read and write.
+type Conn struct {
+	io.ReadWriteCloser
+	// Replay rejects the salts read before, it is nil on the client side.
+	Replay *ashe.Replay
+	key    []byte
+	met    Method
+	rbf    []byte
+	rcp    cipher.AEAD
+	rno    []byte
+	wcp    cipher.AEAD
+	wno    []byte
+}
+
+// Aead derives the session key from the salt.
+func (c *Conn) Aead(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, c.met.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), key)
+	if err != nil {
+		return nil, err
+	}
+	return c.met.New(key)
+}
+
+// Read implements io.Reader.
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.rcp == nil {
+		salt := make([]byte, c.met.KeySize)
+		if _, err := io.ReadFull(c.ReadWriteCloser, salt); err != nil {
+			return 0, err
+		}
+		// Salts are not timed, they are remembered until they are evicted by newer ones.
+		if c.Replay != nil && c.Replay.Seen(Pad(salt), math.MaxInt64) {
+			return 0, errors.New("daze: shadowsocks salt replayed")
+		}
+		rcp, err := c.Aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.rcp = rcp
+		c.rno = make([]byte, rcp.NonceSize())
+	}
+	if len(c.rbf) == 0 {
+		buf := make([]byte, 2+c.rcp.Overhead())
+		if _, err := io.ReadFull(c.ReadWriteCloser, buf); err != nil {
+			return 0, err
+		}
+		l, err := c.rcp.Open(buf[:0], c.rno, buf, nil)
+		if err != nil {
+			return 0, errors.New("daze: shadowsocks decryption failed")
+		}
+		Nonce(c.rno)
+		buf = make([]byte, int(binary.BigEndian.Uint16(l)&PayloadSizeMask)+c.rcp.Overhead())
+		if _, err := io.ReadFull(c.ReadWriteCloser, buf); err != nil {
+			return 0, err
+		}
+		c.rbf, err = c.rcp.Open(buf[:0], c.rno, buf, nil)
+		if err != nil {
+			return 0, errors.New("daze: shadowsocks decryption failed")
+		}
+		Nonce(c.rno)
+	}
+	n := copy(p, c.rbf)
+	c.rbf = c.rbf[n:]
+	return n, nil
+}
+
+// Write implements io.Writer.
+func (c *Conn) Write(p []byte) (int, error) {
+	buf := []byte{}
+	if c.wcp == nil {
+		salt := make([]byte, c.met.KeySize)
+		io.ReadFull(&daze.RandomReader{}, salt)
+		wcp, err := c.Aead(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.wcp = wcp
+		c.wno = make([]byte, wcp.NonceSize())
+		buf = append(buf, salt...)
+	}
+	for n := 0; n < len(p); {
+		l := min(len(p)-n, PayloadSizeMask)
+		buf = c.wcp.Seal(buf, c.wno, []byte{byte(l >> 8), byte(l)}, nil)
+		Nonce(c.wno)
+		buf = c.wcp.Seal(buf, c.wno, p[n:n+l], nil)
+		Nonce(c.wno)
+		n += l
+	}
+	_, err := c.ReadWriteCloser.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NewConn returns a new Conn.
+func NewConn(conn io.ReadWriteCloser, met Method, key []byte) *Conn {
+	return &Conn{ReadWriteCloser: conn, key: key, met: met}
+}
+
+// Server implemented the shadowsocks protocol.
+type Server struct {
+	// Cipher is the pre-shared key derived from the password.
+	Cipher []byte
+	Closer io.Closer
+	Dialer daze.Dialer
+	Hook   daze.Hook
+	Listen string
+	// Listener is used instead of listening on Listen if it is not nil, for example, a listener shared by daze.Demux.
+	Listener net.Listener
+	Method   Method
+	// Replay rejects the connections starting with a salt seen before.
+	Replay *ashe.Replay
+}
+
+// Serve incoming connections. Parameter cli will be closed automatically when the function exits.
+func (s *Server) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
+	con := NewConn(cli, s.Method, s.Cipher)
+	con.Replay = s.Replay
+	dst, err := s.Handshake(cli, con)
+	if err != nil {
+		return err
+	}
+	err = s.Hook.OnDial(ctx, "tcp", dst)
+	if err != nil {
+		return err
+	}
+	log.Printf("conn: %08x   dial network=tcp address=%s", ctx.Cid, dst)
+	srv, err := s.Dialer.Dial(ctx, "tcp", dst)
+	if err != nil {
+		return err
+	}
+	ctx.Link(con, srv)
+	return nil
+}
+
+// Handshake reads the destination address. A failed handshake is never answered, instead the connection is drained
+// until it is closed Conf.HandshakeTimeout after the handshake started, so that active probes can not tell the server
+// from a server which is still waiting for data.
+func (s *Server) Handshake(cli io.ReadWriteCloser, con *Conn) (string, error) {
+	t := time.AfterFunc(Conf.HandshakeTimeout, func() { cli.Close() })
+	dst, err := daze.SocksReadAddr(con)
+	if err == nil && t.Stop() {
+		return dst, nil
+	}
+	if err == nil {
+		err = errors.New("daze: handshake timeout")
+	}
+	io.Copy(io.Discard, cli)
+	return "", err
+}
+
+// Close listener. Established connections will not be closed.
+func (s *Server) Close() error {
+	if s.Closer != nil {
+		return s.Closer.Close()
+	}
+	return nil
+}
+
+// Run it.
+func (s *Server) Run() error {
+	l, err := daze.Listen(s.Listener, s.Listen)
+	if err != nil {
+		return err
+	}
+	s.Closer = l
+	log.Println("shadowsocks: listen and serve on", s.Listen)
+
+	go func() {
+		idx := uint32(math.MaxUint32)
+		for {
+			cli, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("shadowsocks:", err)
+				}
+				break
+			}
+			idx++
+			ctx := &daze.Context{Cid: idx}
+			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
+			go func() {
+				defer cli.Close()
+				err := s.Hook.OnAccept(ctx, cli.RemoteAddr())
+				if err == nil {
+					err = s.Serve(ctx, cli)
+				}
+				if err != nil {
+					log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				}
+				s.Hook.OnClose(ctx, err)
+				log.Printf("conn: %08x closed", ctx.Cid)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// NewServer returns a new Server. The method must be one of Methods.
+func NewServer(listen string, password string, method string) *Server {
+	met, ok := Methods[method]
+	if !ok {
+		log.Panicln("shadowsocks: unknown method", method)
+	}
+	return &Server{
+		Cipher: Kdf(password, met.KeySize),
+		Dialer: daze.NewEngine(),
+		Hook:   daze.NewHookChain(),
+		Listen: listen,
+		Method: met,
+		Replay: ashe.NewReplay(Conf.ReplaySize),
+	}
+}
+
+// Client implemented the shadowsocks protocol.
+type Client struct {
+	// Cipher is the pre-shared key derived from the password.
+	Cipher []byte
+	Dialer daze.Dialer
+	Method Method
+	Server string
+}
+
+// Dial connects to the address on the named network.
+func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("daze: shadowsocks does not support network %s", network)
+	}
+	dst, err := daze.SocksAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := c.Dialer.Dial(ctx, "tcp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+	con := NewConn(srv, c.Method, c.Cipher)
+	_, err = con.Write(dst)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return con, nil
+}
+
+// NewClient returns a new Client. The method must be one of Methods.
+func NewClient(server string, password string, method string) *Client {
+	met, ok := Methods[method]
+	if !ok {
+		log.Panicln("shadowsocks: unknown method", method)
+	}
+	return &Client{
+		Cipher: Kdf(password, met.KeySize),
+		Dialer: &daze.Direct{},
+		Method: met,
+		Server: server,
+	}
+}
@@ -0,0 +1,128 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/lib/doa"
+)
+
+const (
+	EchoServerListenOn = "127.0.0.1:28080"
+	DazeServerListenOn = "127.0.0.1:28081"
+	Password           = "password"
+)
+
+func TestProtocolShadowsocksKdf(t *testing.T) {
+	key := Kdf(Password, 32)
+	doa.Doa(bytes.Equal(key[:16], doa.Try(hex.DecodeString("5f4dcc3b5aa765d61d8327deb882cf99"))))
+}
+
+func TestProtocolShadowsocksTCP(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	for method := range Methods {
+		dazeServer := NewServer(DazeServerListenOn, Password, method)
+		dazeServer.Run()
+
+		dazeClient := NewClient(DazeServerListenOn, Password, method)
+		ctx := &daze.Context{}
+		cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+		doa.Try(cli.Write([]byte{0x00, 0x00, 0xff, 0xff}))
+		buf := make([]byte, 65535)
+		doa.Try(io.ReadFull(cli, buf))
+		cli.Close()
+		dazeServer.Close()
+	}
+}
+
+func TestProtocolShadowsocksWrongPassword(t *testing.T) {
+	defer func(d time.Duration) { Conf.HandshakeTimeout = d }(Conf.HandshakeTimeout)
+	Conf.HandshakeTimeout = time.Second
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password, Conf.Method)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, "wrong", Conf.Method)
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Doa(doa.Err(io.ReadFull(cli, make([]byte, 128))) != nil)
+}
+
+func TestProtocolShadowsocksProbe(t *testing.T) {
+	defer func(d time.Duration) { Conf.HandshakeTimeout = d }(Conf.HandshakeTimeout)
+	Conf.HandshakeTimeout = time.Second * 2
+
+	dazeServer := NewServer(DazeServerListenOn, Password, Conf.Method)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	// A garbage handshake is neither answered nor closed before the handshake timeout.
+	srv := doa.Try(net.Dial("tcp", DazeServerListenOn))
+	defer srv.Close()
+	doa.Try(srv.Write(make([]byte, 128)))
+	srv.SetReadDeadline(time.Now().Add(time.Second))
+	doa.Doa(errors.Is(doa.Err(srv.Read(make([]byte, 1))), os.ErrDeadlineExceeded))
+	srv.SetReadDeadline(time.Now().Add(time.Second * 4))
+	doa.Doa(doa.Err(srv.Read(make([]byte, 1))) == io.EOF)
+}
+
+// RecordConn records the data written to the connection.
+type RecordConn struct {
+	io.ReadWriteCloser
+	B *bytes.Buffer
+}
+
+func (c *RecordConn) Write(p []byte) (int, error) {
+	c.B.Write(p)
+	return c.ReadWriteCloser.Write(p)
+}
+
+func TestProtocolShadowsocksReplay(t *testing.T) {
+	defer func(d time.Duration) { Conf.HandshakeTimeout = d }(Conf.HandshakeTimeout)
+	Conf.HandshakeTimeout = time.Second
+
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password, Conf.Method)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	record := &bytes.Buffer{}
+	dazeClient := NewClient(DazeServerListenOn, Password, Conf.Method)
+	dazeClient.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		srv, err := daze.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &RecordConn{ReadWriteCloser: srv, B: record}, nil
+	})
+	cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Try(io.ReadFull(cli, make([]byte, 128)))
+	cli.Close()
+
+	// The captured connection is sent again, its salt is refused, so nothing is answered.
+	srv := doa.Try(net.Dial("tcp", DazeServerListenOn))
+	defer srv.Close()
+	doa.Try(srv.Write(record.Bytes()))
+	srv.SetReadDeadline(time.Now().Add(time.Second * 4))
+	doa.Doa(len(doa.Try(io.ReadAll(srv))) == 0)
+}
@@ -0,0 +1,156 @@
+package sshx
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/protocol/ashe"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Protocol sshx carries the ashe protocol over ssh channels. It allows any machine with only ssh access to be used as a
+// daze server without opening new ports: the ashe server listens on the loopback address of the machine, and the
+// client reaches it through the ssh server with direct-tcpip channels, which is exactly what "ssh -L" does.
+//
+// Client port: a.com ----┐                         ┌---- ashe server (127.0.0.1:1081) ---- a.com
+// Client port: b.com ----+---- ssh connection ---- sshd
+// Client port: c.com ----┘                         └---- ashe server (127.0.0.1:1081) ---- c.com
+
+// Conf is acting as package level configuration.
+var Conf = struct {
+	// Remote is the default address of the ashe server, as seen from the ssh server.
+	Remote string
+}{
+	Remote: "127.0.0.1:1081",
+}
+
+// Client implemented the sshx protocol.
+type Client struct {
+	// Cipher is a pre-shared key of the ashe server.
+	Cipher []byte
+	Config *ssh.ClientConfig
+	Remote string
+	Server string
+	m      *sync.Mutex
+	s      *ssh.Client
+}
+
+// Conn returns the ssh connection, it is established on demand.
+func (c *Client) Conn() (*ssh.Client, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.s != nil {
+		return c.s, nil
+	}
+	srv, err := daze.Dial("tcp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+	cc, ch, rq, err := ssh.NewClientConn(srv, c.Server, c.Config)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	log.Println("sshx: ssh init")
+	c.s = ssh.NewClient(cc, ch, rq)
+	return c.s, nil
+}
+
+// Open opens a channel to the ashe server. If the ssh connection is broken, it is re-established once.
+func (c *Client) Open() (io.ReadWriteCloser, error) {
+	for i := range 2 {
+		s, err := c.Conn()
+		if err != nil {
+			return nil, err
+		}
+		con, err := s.Dial("tcp", c.Remote)
+		// The ssh connection is still alive if the ssh server rejects the channel.
+		var e *ssh.OpenChannelError
+		if err == nil || errors.As(err, &e) || i == 1 {
+			return con, err
+		}
+		log.Println("sshx: ssh done")
+		c.m.Lock()
+		if c.s == s {
+			c.s.Close()
+			c.s = nil
+		}
+		c.m.Unlock()
+	}
+	panic("unreachable")
+}
+
+// Close the ssh connection. All streams will be closed at the same time.
+func (c *Client) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.s != nil {
+		return c.s.Close()
+	}
+	return nil
+}
+
+// Dial connects to the address on the named network.
+func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	srv, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
+	spy := &ashe.Client{Cipher: c.Cipher}
+	con, err := spy.Estab(ctx, srv, network, address)
+	if err != nil {
+		srv.Close()
+	}
+	return con, err
+}
+
+// NewClient returns a new Client. The ssh server is authenticated by ~/.ssh/known_hosts, and the user is authenticated
+// by the password if it is not empty, otherwise by the private keys in ~/.ssh.
+func NewClient(server string, user string, password string, cipher string) *Client {
+	home, _ := os.UserHomeDir()
+	auth := []ssh.AuthMethod{}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	signers := []ssh.Signer{}
+	for _, e := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		data, err := os.ReadFile(filepath.Join(home, ".ssh", e))
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) != 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	hostKeyCallback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		log.Println("sshx:", err)
+		hostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return err
+		}
+	}
+	return &Client{
+		Cipher: daze.Salt(cipher),
+		Config: &ssh.ClientConfig{
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         daze.Conf.DialerTimeout,
+			User:            user,
+		},
+		Remote: Conf.Remote,
+		Server: server,
+		m:      &sync.Mutex{},
+	}
+}
@@ -0,0 +1,173 @@
+package sshx
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/lib/doa"
+	"github.com/mohanson/daze/protocol/ashe"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	EchoServerListenOn = "127.0.0.1:28080"
+	DazeServerListenOn = "127.0.0.1:28081"
+	SshdServerListenOn = "127.0.0.1:28082"
+	Password           = "password"
+)
+
+// Sshd is a minimal ssh server which only supports password authentication and direct-tcpip channels.
+type Sshd struct {
+	Closer io.Closer
+	Config *ssh.ServerConfig
+	Listen string
+}
+
+// Close listener.
+func (s *Sshd) Close() error {
+	return s.Closer.Close()
+}
+
+// Serve serves incoming connections.
+func (s *Sshd) Serve(cli net.Conn) {
+	defer cli.Close()
+	_, chans, reqs, err := ssh.NewServerConn(cli, s.Config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for e := range chans {
+		if e.ChannelType() != "direct-tcpip" {
+			e.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		// See https://datatracker.ietf.org/doc/html/rfc4254#section-7.2
+		var msg struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		doa.Nil(ssh.Unmarshal(e.ExtraData(), &msg))
+		srv, err := daze.Dial("tcp", net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port))))
+		if err != nil {
+			e.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		con, reqs, err := e.Accept()
+		if err != nil {
+			srv.Close()
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		go daze.Link(con, srv)
+	}
+}
+
+// Run it.
+func (s *Sshd) Run() error {
+	l, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		return err
+	}
+	s.Closer = l
+	go func() {
+		for {
+			cli, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("main:", err)
+				}
+				break
+			}
+			go s.Serve(cli)
+		}
+	}()
+	return nil
+}
+
+// NewSshd returns a new Sshd, and the public key of it.
+func NewSshd(listen string, password string) (*Sshd, ssh.PublicKey) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	signer := doa.Try(ssh.NewSignerFromKey(key))
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) != password {
+				return nil, errors.New("password rejected")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	return &Sshd{Config: config, Listen: listen}, signer.PublicKey()
+}
+
+func TestProtocolSshxTCP(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := ashe.NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	sshdServer, sshdPubkey := NewSshd(SshdServerListenOn, Password)
+	defer sshdServer.Close()
+	sshdServer.Run()
+
+	dazeClient := NewClient(SshdServerListenOn, "daze", Password, Password)
+	defer dazeClient.Close()
+	dazeClient.Config.HostKeyCallback = ssh.FixedHostKey(sshdPubkey)
+	dazeClient.Remote = DazeServerListenOn
+	ctx := &daze.Context{}
+	for range 2 {
+		cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+		doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+		buf := make([]byte, 128)
+		doa.Try(io.ReadFull(cli, buf))
+		cli.Close()
+	}
+}
+
+func TestProtocolSshxUDP(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.UDP()
+
+	dazeServer := ashe.NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	sshdServer, sshdPubkey := NewSshd(SshdServerListenOn, Password)
+	defer sshdServer.Close()
+	sshdServer.Run()
+
+	dazeClient := NewClient(SshdServerListenOn, "daze", Password, Password)
+	defer dazeClient.Close()
+	dazeClient.Config.HostKeyCallback = ssh.FixedHostKey(sshdPubkey)
+	dazeClient.Remote = DazeServerListenOn
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "udp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	buf := make([]byte, 128)
+	doa.Try(io.ReadFull(cli, buf))
+}
+
+func TestProtocolSshxReject(t *testing.T) {
+	sshdServer, sshdPubkey := NewSshd(SshdServerListenOn, Password)
+	defer sshdServer.Close()
+	sshdServer.Run()
+
+	dazeClient := NewClient(SshdServerListenOn, "daze", "wrong", Password)
+	defer dazeClient.Close()
+	dazeClient.Config.HostKeyCallback = ssh.FixedHostKey(sshdPubkey)
+	ctx := &daze.Context{}
+	doa.Doa(doa.Err(dazeClient.Dial(ctx, "tcp", EchoServerListenOn)) != nil)
+}
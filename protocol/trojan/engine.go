@@ -0,0 +1,378 @@
+package trojan
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mohanson/daze"
+)
+
+// Protocol trojan[1] carries a socks5 like request in a tls connection, it is supported by many third-party clients.
+// The server behaves as an ordinary https server to anyone who does not know the password: such connections are handed
+// over to a fallback address.
+//
+// +-----------------------+---------+----------------+---------+----------+
+// | hex(SHA224(password)) |  CRLF   | Trojan Request |  CRLF   | Payload  |
+// +-----------------------+---------+----------------+---------+----------+
+// |          56           | X'0D0A' |    Variable    | X'0D0A' | Variable |
+// +-----------------------+---------+----------------+---------+----------+
+//
+// Trojan Request: Cmd(1 for connect, 3 for udp associate), followed by the destination address in socks5 format. For
+// udp associate, each packet in the payload is:
+//
+// +----------------------+--------+---------+----------+
+// | Address (socks5)     | Length |  CRLF   | Payload  |
+// +----------------------+--------+---------+----------+
+// |       Variable       |   2    | X'0D0A' | Variable |
+// +----------------------+--------+---------+----------+
+//
+// [1] https://trojan-gfw.github.io/trojan/protocol
+
+// Conf is acceptable to the trojan protocol.
+var Conf = struct {
+	// HandshakeTimeout is the time allowed for the client to send the header, a connection which sends less falls back
+	// with what it has sent.
+	HandshakeTimeout time.Duration
+}{
+	HandshakeTimeout: time.Second * 8,
+}
+
+// Cipher returns the hex encoded sha224 of the password.
+func Cipher(password string) []byte {
+	h := sha256.Sum224([]byte(password))
+	return []byte(hex.EncodeToString(h[:]))
+}
+
+// UDPConn is the packet stream of udp associate to a single destination.
+type UDPConn struct {
+	io.ReadWriteCloser
+	Dst []byte
+}
+
+// Read implements io.Reader. Each read returns a whole packet.
+func (c *UDPConn) Read(p []byte) (int, error) {
+	_, err := daze.SocksReadAddr(c.ReadWriteCloser)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c.ReadWriteCloser, buf)
+	if err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(buf[:2]))
+	if n > len(p) {
+		return 0, io.ErrShortBuffer
+	}
+	return io.ReadFull(c.ReadWriteCloser, p[:n])
+}
+
+// Write implements io.Writer. Each write is a whole packet.
+func (c *UDPConn) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(c.Dst)+4+len(p))
+	buf = append(buf, c.Dst...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(p)))
+	buf = append(buf, 0x0d, 0x0a)
+	buf = append(buf, p...)
+	_, err := c.ReadWriteCloser.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Server implemented the trojan protocol.
+type Server struct {
+	// Cipher is the hex encoded sha224 of the password.
+	Cipher []byte
+	Closer io.Closer
+	Config *tls.Config
+	Dialer daze.Dialer
+	Hook   daze.Hook
+	Listen string
+	// Listener is used instead of listening on Listen if it is not nil, for example, a listener shared by daze.Demux.
+	Listener net.Listener
+	// Masker is the fallback address for connections failing authentication, usually a web server. Connections are
+	// closed if it is empty.
+	Masker string
+}
+
+// Fallback hands the connection over to the masker, the bytes already read are replayed.
+func (s *Server) Fallback(ctx *daze.Context, cli io.ReadWriteCloser, head []byte) error {
+	if s.Masker == "" {
+		return errors.New("daze: trojan authentication failed")
+	}
+	srv, err := s.Dialer.Dial(ctx, "tcp", s.Masker)
+	if err != nil {
+		return err
+	}
+	_, err = srv.Write(head)
+	if err != nil {
+		srv.Close()
+		return err
+	}
+	ctx.Link(cli, srv)
+	return nil
+}
+
+// Serve incoming connections. Parameter cli will be closed automatically when the function exits.
+func (s *Server) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
+	var (
+		buf = make([]byte, 58)
+		cmd uint8
+		dst string
+		err error
+		n   = 0
+		srv io.ReadWriteCloser
+	)
+	// The whole header is read before it is checked in constant time, so that how a connection is refused tells
+	// nothing about how many bytes of the password it guessed.
+	d, _ := cli.(daze.Deadliner)
+	if d != nil {
+		d.SetReadDeadline(time.Now().Add(Conf.HandshakeTimeout))
+	}
+	n, err = io.ReadFull(cli, buf)
+	if d != nil {
+		d.SetReadDeadline(time.Time{})
+	}
+	if err != nil && n == 0 {
+		return err
+	}
+	if err != nil || subtle.ConstantTimeCompare(buf[:56], s.Cipher) != 1 || buf[56] != 0x0d || buf[57] != 0x0a {
+		return s.Fallback(ctx, cli, buf[:n])
+	}
+	_, err = io.ReadFull(cli, buf[:1])
+	if err != nil {
+		return err
+	}
+	cmd = buf[0]
+	dst, err = daze.SocksReadAddr(cli)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(cli, buf[:2])
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case 0x01:
+		err = s.Hook.OnDial(ctx, "tcp", dst)
+		if err != nil {
+			return err
+		}
+		log.Printf("conn: %08x   dial network=tcp address=%s", ctx.Cid, dst)
+		srv, err = s.Dialer.Dial(ctx, "tcp", dst)
+		if err != nil {
+			return err
+		}
+		ctx.Link(cli, srv)
+		return nil
+	case 0x03:
+		return s.ServeUDP(ctx, cli)
+	default:
+		return fmt.Errorf("daze: trojan unknown command %d", cmd)
+	}
+}
+
+// ServeUDP relays udp packets. The destination of each packet is carried by itself.
+func (s *Server) ServeUDP(ctx *daze.Context, cli io.ReadWriteCloser) error {
+	var (
+		buf = make([]byte, 65535)
+		m   = &sync.Mutex{}
+		usb = map[string]io.ReadWriteCloser{}
+	)
+	defer func() {
+		for _, e := range usb {
+			e.Close()
+		}
+	}()
+	for {
+		dst, err := daze.SocksReadAddr(cli)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(cli, buf[:4])
+		if err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(buf[:2]))
+		_, err = io.ReadFull(cli, buf[:n])
+		if err != nil {
+			return err
+		}
+		srv, ok := usb[dst]
+		if !ok {
+			err = s.Hook.OnDial(ctx, "udp", dst)
+			if err != nil {
+				return err
+			}
+			log.Printf("conn: %08x   dial network=udp address=%s", ctx.Cid, dst)
+			srv, err = s.Dialer.Dial(ctx, "udp", dst)
+			if err != nil {
+				return err
+			}
+			usb[dst] = srv
+			adr, err := daze.SocksAddr(dst)
+			if err != nil {
+				return err
+			}
+			go func() {
+				buf := make([]byte, 65535)
+				for {
+					n, err := srv.Read(buf)
+					if err != nil {
+						break
+					}
+					m.Lock()
+					_, err = (&UDPConn{ReadWriteCloser: cli, Dst: adr}).Write(buf[:n])
+					m.Unlock()
+					if err != nil {
+						break
+					}
+				}
+			}()
+		}
+		_, err = srv.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close listener. Established connections will not be closed.
+func (s *Server) Close() error {
+	if s.Closer != nil {
+		return s.Closer.Close()
+	}
+	return nil
+}
+
+// Run it.
+func (s *Server) Run() error {
+	l, err := daze.Listen(s.Listener, s.Listen)
+	if err != nil {
+		return err
+	}
+	l = tls.NewListener(l, s.Config)
+	s.Closer = l
+	log.Println("trojan: listen and serve on", s.Listen)
+
+	go func() {
+		idx := uint32(math.MaxUint32)
+		for {
+			cli, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("trojan:", err)
+				}
+				break
+			}
+			idx++
+			ctx := &daze.Context{Cid: idx}
+			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
+			go func() {
+				defer cli.Close()
+				err := s.Hook.OnAccept(ctx, cli.RemoteAddr())
+				if err == nil {
+					err = s.Serve(ctx, cli)
+				}
+				if err != nil {
+					log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				}
+				s.Hook.OnClose(ctx, err)
+				log.Printf("conn: %08x closed", ctx.Cid)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// NewServer returns a new Server. A self-signed certificate is used, replace the Config to use your own.
+func NewServer(listen string, password string) *Server {
+	host, _, _ := net.SplitHostPort(listen)
+	crt, err := daze.Certificate(host)
+	if err != nil {
+		log.Panicln("trojan:", err)
+	}
+	return &Server{
+		Cipher: Cipher(password),
+		Config: &tls.Config{Certificates: []tls.Certificate{crt}},
+		Dialer: daze.NewEngine(),
+		Hook:   daze.NewHookChain(),
+		Listen: listen,
+	}
+}
+
+// Client implemented the trojan protocol.
+type Client struct {
+	// Cipher is the hex encoded sha224 of the password.
+	Cipher []byte
+	Config *tls.Config
+	Dialer daze.Dialer
+	Server string
+}
+
+// Dial connects to the address on the named network.
+func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	var (
+		buf []byte
+		cmd uint8
+		dst []byte
+		err error
+		srv io.ReadWriteCloser
+	)
+	switch network {
+	case "tcp":
+		cmd = 0x01
+	case "udp":
+		cmd = 0x03
+	default:
+		return nil, fmt.Errorf("daze: network must be tcp or udp")
+	}
+	dst, err = daze.SocksAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	srv, err = c.Dialer.Dial(ctx, "tcp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+	con := tls.Client(daze.NewNetConn(srv), c.Config)
+	buf = append(buf, c.Cipher...)
+	buf = append(buf, 0x0d, 0x0a, cmd)
+	buf = append(buf, dst...)
+	buf = append(buf, 0x0d, 0x0a)
+	_, err = con.Write(buf)
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+	if cmd == 0x03 {
+		return &UDPConn{ReadWriteCloser: con, Dst: dst}, nil
+	}
+	return con, nil
+}
+
+// NewClient returns a new Client. The certificate of the server is not verified, since the server uses a self-signed
+// certificate by default.
+func NewClient(server string, password string) *Client {
+	host, _, _ := net.SplitHostPort(server)
+	return &Client{
+		Cipher: Cipher(password),
+		Config: &tls.Config{ServerName: host, InsecureSkipVerify: true},
+		Dialer: &daze.Direct{},
+		Server: server,
+	}
+}
@@ -0,0 +1,140 @@
+package trojan
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/lib/doa"
+)
+
+const (
+	EchoServerListenOn = "127.0.0.1:28080"
+	DazeServerListenOn = "127.0.0.1:28081"
+	Password           = "password"
+)
+
+func TestProtocolTrojanTCP(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Try(io.ReadFull(cli, make([]byte, 128)))
+}
+
+func TestProtocolTrojanUDP(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.UDP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "udp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Doa(doa.Try(cli.Read(make([]byte, 128))) == 128)
+}
+
+func TestProtocolTrojanFallback(t *testing.T) {
+	masker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "daze")
+	}))
+	defer masker.Close()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Masker = strings.TrimPrefix(masker.URL, "http://")
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	rep := doa.Try(client.Get("https://" + DazeServerListenOn))
+	defer rep.Body.Close()
+	doa.Doa(string(doa.Try(io.ReadAll(rep.Body))) == "daze")
+}
+
+func TestProtocolTrojanFallbackDialer(t *testing.T) {
+	masker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "daze")
+	}))
+	defer masker.Close()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		doa.Doa(address == "masker.invalid:80")
+		return daze.Dial(network, strings.TrimPrefix(masker.URL, "http://"))
+	})
+	dazeServer.Masker = "masker.invalid:80"
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	rep := doa.Try(client.Get("https://" + DazeServerListenOn))
+	defer rep.Body.Close()
+	doa.Doa(string(doa.Try(io.ReadAll(rep.Body))) == "daze")
+}
+
+func TestProtocolTrojanProbe(t *testing.T) {
+	masker := doa.Try(net.Listen("tcp", "127.0.0.1:0"))
+	defer masker.Close()
+	heads := make(chan []byte, 1)
+	go func() {
+		for {
+			cli, err := masker.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 58)
+			io.ReadFull(cli, buf)
+			cli.Close()
+			heads <- buf
+		}
+	}()
+
+	// A header with the right prefix and a wrong suffix is handled the same as a header which is wrong from the start:
+	// nothing happens until the whole header arrives, then it is handed over to the masker, or closed without one.
+	for _, e := range []string{"", masker.Addr().String()} {
+		dazeServer := NewServer(DazeServerListenOn, Password)
+		dazeServer.Dialer = &daze.Direct{}
+		dazeServer.Masker = e
+		dazeServer.Run()
+		for _, head := range [][]byte{
+			append(append([]byte{}, Cipher(Password)[:55]...), 'x', 0x0d, 0x0a),
+			append(bytes.Repeat([]byte{'x'}, 56), 0x0d, 0x0a),
+		} {
+			cli := doa.Try(tls.Dial("tcp", DazeServerListenOn, &tls.Config{InsecureSkipVerify: true}))
+			doa.Try(cli.Write(head[:55]))
+			cli.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+			doa.Doa(errors.Is(doa.Err(cli.Read(make([]byte, 1))), os.ErrDeadlineExceeded))
+			doa.Try(cli.Write(head[55:]))
+			if e != "" {
+				doa.Doa(bytes.Equal(<-heads, head))
+			}
+			cli.SetReadDeadline(time.Now().Add(time.Second))
+			doa.Doa(doa.Err(cli.Read(make([]byte, 1))) == io.EOF)
+			cli.Close()
+		}
+		dazeServer.Close()
+	}
+}
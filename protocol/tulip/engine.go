@@ -0,0 +1,148 @@
+package tulip
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/protocol/ashe"
+)
+
+// Protocol tulip carries the ashe protocol in a tls 1.3 connection. On the wire it is an ordinary https connection, the
+// ashe handshake and payload are sent as tls application data. The tls layer provides confidentiality and forward
+// secrecy, the ashe layer still authenticates the client with the pre-shared key.
+
+// Server implemented the tulip protocol.
+type Server struct {
+	// Cipher is a pre-shared key.
+	Cipher []byte
+	Closer io.Closer
+	Config *tls.Config
+	Dialer daze.Dialer
+	Hook   daze.Hook
+	Listen string
+	// Listener is used instead of listening on Listen if it is not nil, for example, a listener shared by daze.Demux.
+	Listener net.Listener
+	// Replay rejects replayed handshakes, it is disabled if it is nil.
+	Replay *ashe.Replay
+}
+
+// Serve incoming connections. Parameter cli will be closed automatically when the function exits.
+func (s *Server) Serve(ctx *daze.Context, cli io.ReadWriteCloser) error {
+	spy := &ashe.Server{
+		Cipher:      s.Cipher,
+		Dialer:      s.Dialer,
+		Hook:        s.Hook,
+		LifeExpired: ashe.Conf.LifeExpired,
+		Replay:      s.Replay,
+	}
+	return spy.Serve(ctx, cli)
+}
+
+// Close listener. Established connections will not be closed.
+func (s *Server) Close() error {
+	if s.Closer != nil {
+		return s.Closer.Close()
+	}
+	return nil
+}
+
+// Run it.
+func (s *Server) Run() error {
+	l, err := daze.Listen(s.Listener, s.Listen)
+	if err != nil {
+		return err
+	}
+	l = tls.NewListener(l, s.Config)
+	s.Closer = l
+	log.Println("tulip: listen and serve on", s.Listen)
+
+	go func() {
+		idx := uint32(math.MaxUint32)
+		for {
+			cli, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("tulip:", err)
+				}
+				break
+			}
+			idx++
+			ctx := &daze.Context{Cid: idx}
+			log.Printf("conn: %08x accept remote=%s", ctx.Cid, cli.RemoteAddr())
+			go func() {
+				defer cli.Close()
+				err := s.Hook.OnAccept(ctx, cli.RemoteAddr())
+				if err == nil {
+					err = s.Serve(ctx, cli)
+				}
+				if err != nil {
+					log.Printf("conn: %08x  error %s", ctx.Cid, err)
+				}
+				s.Hook.OnClose(ctx, err)
+				log.Printf("conn: %08x closed", ctx.Cid)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// NewServer returns a new Server. A self-signed certificate is used, replace the certificates of the Config to use your
+// own.
+func NewServer(listen string, cipher string) *Server {
+	host, _, _ := net.SplitHostPort(listen)
+	crt, err := daze.Certificate(host)
+	if err != nil {
+		log.Panicln("tulip:", err)
+	}
+	return &Server{
+		Cipher: daze.Salt(cipher),
+		Config: &tls.Config{Certificates: []tls.Certificate{crt}, MinVersion: tls.VersionTLS13},
+		Dialer: daze.NewEngine(),
+		Hook:   daze.NewHookChain(),
+		Listen: listen,
+		Replay: ashe.NewReplay(ashe.Conf.ReplaySize),
+	}
+}
+
+// Client implemented the tulip protocol.
+type Client struct {
+	// Cipher is a pre-shared key.
+	Cipher []byte
+	Config *tls.Config
+	// Dialer is used to connect to the server, for example, through an upstream proxy.
+	Dialer daze.Dialer
+	Server string
+}
+
+// Dial connects to the address on the named network.
+func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	srv, err := c.Dialer.Dial(ctx, "tcp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+	con := tls.Client(daze.NewNetConn(srv), c.Config)
+	spy := &ashe.Client{Cipher: c.Cipher}
+	ret, err := spy.Estab(ctx, con, network, address)
+	if err != nil {
+		con.Close()
+	}
+	return ret, err
+}
+
+// NewClient returns a new Client. The certificate of the server is not verified, since the server uses a self-signed
+// certificate by default.
+func NewClient(server string, cipher string) *Client {
+	host, _, _ := net.SplitHostPort(server)
+	return &Client{
+		Cipher: daze.Salt(cipher),
+		Config: &tls.Config{ServerName: host, InsecureSkipVerify: true, MinVersion: tls.VersionTLS13},
+		Dialer: &daze.Direct{},
+		Server: server,
+	}
+}
@@ -0,0 +1,370 @@
+package wsocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/lib/doa"
+	"github.com/mohanson/daze/protocol/ashe"
+)
+
+// Protocol wsocket carries the ashe protocol in the binary frames of a websocket[1] connection, so that the server can
+// be deployed behind cdns which only pass websocket upgrades. Each proxied connection costs a websocket connection.
+//
+// [1] https://datatracker.ietf.org/doc/html/rfc6455
+
+// Conf is acting as package level configuration. They are the default values, instances can be tuned by their own
+// fields.
+var Conf = struct {
+	// Path is the path of the websocket endpoint. Other requests are answered with 404.
+	Path string
+}{
+	Path: "/ws",
+}
+
+// Accept returns the value of the Sec-WebSocket-Accept header for the key sent by the client.
+func Accept(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// Conn is a websocket connection, which reads and writes binary frames. Frames written by the client are masked.
+type Conn struct {
+	// Client masks the written frames.
+	Client bool
+	Closer io.Closer
+	Reader io.Reader
+	Writer io.Writer
+	key    []byte
+	m      sync.Mutex
+	off    uint64
+	rem    uint64
+}
+
+// Frame writes a frame with the opcode.
+func (c *Conn) Frame(op byte, p []byte) error {
+	buf := make([]byte, 0, 14+len(p))
+	buf = append(buf, 0x80|op)
+	bit := byte(0x00)
+	if c.Client {
+		bit = 0x80
+	}
+	switch n := len(p); {
+	case n < 126:
+		buf = append(buf, bit|byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, bit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, bit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if c.Client {
+		key := make([]byte, 4)
+		io.ReadFull(&daze.RandomReader{}, key)
+		buf = append(buf, key...)
+		for i, e := range p {
+			buf = append(buf, e^key[i%4])
+		}
+	} else {
+		buf = append(buf, p...)
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	_, err := c.Writer.Write(buf)
+	return err
+}
+
+// Read implements io.Reader. Control frames are handled on the way: pings are answered, and a close frame ends the
+// stream.
+func (c *Conn) Read(p []byte) (int, error) {
+	for c.rem == 0 {
+		buf := make([]byte, 8)
+		_, err := io.ReadFull(c.Reader, buf[:2])
+		if err != nil {
+			return 0, err
+		}
+		op := buf[0] & 0x0f
+		mask := buf[1]&0x80 != 0
+		n := uint64(buf[1] & 0x7f)
+		switch n {
+		case 126:
+			_, err = io.ReadFull(c.Reader, buf[:2])
+			n = uint64(binary.BigEndian.Uint16(buf[:2]))
+		case 127:
+			_, err = io.ReadFull(c.Reader, buf[:8])
+			n = binary.BigEndian.Uint64(buf[:8])
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.key = nil
+		if mask {
+			c.key = make([]byte, 4)
+			_, err = io.ReadFull(c.Reader, c.key)
+			if err != nil {
+				return 0, err
+			}
+		}
+		c.off = 0
+		c.rem = n
+		if op < 0x08 {
+			continue
+		}
+		// Control frames carry at most 125 bytes.
+		if n > 125 {
+			return 0, errors.New("daze: websocket control frame too long")
+		}
+		msg := make([]byte, n)
+		_, err = io.ReadFull(c.Reader, msg)
+		if err != nil {
+			return 0, err
+		}
+		c.rem = 0
+		c.unmask(msg)
+		switch op {
+		case 0x08:
+			return 0, io.EOF
+		case 0x09:
+			err = c.Frame(0x0a, msg)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := c.Reader.Read(p[:min(uint64(len(p)), c.rem)])
+	c.unmask(p[:n])
+	c.rem -= uint64(n)
+	return n, err
+}
+
+// unmask unmasks the payload read at the current offset.
+func (c *Conn) unmask(p []byte) {
+	if c.key == nil {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.key[(c.off+uint64(i))%4]
+	}
+	c.off += uint64(len(p))
+}
+
+// Write implements io.Writer. Each write is sent in a binary frame.
+func (c *Conn) Write(p []byte) (int, error) {
+	err := c.Frame(0x02, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implements io.Closer. A close frame is sent before the connection is closed.
+func (c *Conn) Close() error {
+	c.Frame(0x08, nil)
+	return c.Closer.Close()
+}
+
+// Server implemented the wsocket protocol.
+type Server struct {
+	Cipher []byte
+	Closer io.Closer
+	// Config enables tls if it is not nil. Behind a cdn, tls is usually terminated by the cdn.
+	Config *tls.Config
+	Dialer daze.Dialer
+	Hook   daze.Hook
+	Listen string
+	// Listener is used instead of listening on Listen if it is not nil, for example, a listener shared by daze.Demux.
+	Listener net.Listener
+	NextID   uint32
+	Path     string
+	// Replay rejects replayed handshakes, it is disabled if it is nil.
+	Replay *ashe.Replay
+}
+
+// Serve a proxied connection with the ashe protocol.
+func (s *Server) Serve(cli io.ReadWriteCloser, addr net.Addr) {
+	spy := &ashe.Server{Cipher: s.Cipher, Dialer: s.Dialer, Hook: s.Hook, Replay: s.Replay}
+	ctx := &daze.Context{Cid: atomic.AddUint32(&s.NextID, 1)}
+	log.Printf("conn: %08x accept remote=%s", ctx.Cid, addr)
+	err := s.Hook.OnAccept(ctx, addr)
+	if err == nil {
+		err = spy.Serve(ctx, cli)
+	}
+	if err != nil {
+		log.Printf("conn: %08x  error %s", ctx.Cid, err)
+	}
+	s.Hook.OnClose(ctx, err)
+	log.Printf("conn: %08x closed", ctx.Cid)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.URL.Path != s.Path || key == "" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.NotFound(w, r)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	cc, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	io.WriteString(cc, "HTTP/1.1 101 Switching Protocols\r\n")
+	io.WriteString(cc, "Upgrade: websocket\r\n")
+	io.WriteString(cc, "Connection: Upgrade\r\n")
+	io.WriteString(cc, fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n\r\n", Accept(key)))
+	cli := &Conn{Closer: cc, Reader: rw.Reader, Writer: cc}
+	defer cli.Close()
+	s.Serve(cli, cc.RemoteAddr())
+}
+
+// Close listener. Established connections will not be closed.
+func (s *Server) Close() error {
+	if s.Closer != nil {
+		return s.Closer.Close()
+	}
+	return nil
+}
+
+// Run it.
+func (s *Server) Run() error {
+	l, err := daze.Listen(s.Listener, s.Listen)
+	if err != nil {
+		return err
+	}
+	log.Println("wsocket: listen and serve on", s.Listen)
+	// Websocket upgrades require http/1.1, so http/2 is disabled.
+	srv := &http.Server{Handler: s, TLSConfig: s.Config, TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){}}
+	s.Closer = srv
+	if s.Config != nil {
+		go srv.ServeTLS(l, "", "")
+		return nil
+	}
+	go srv.Serve(l)
+	return nil
+}
+
+// NewServer returns a new Server. Cipher is a password in string form, with no length limit.
+func NewServer(listen string, cipher string) *Server {
+	return &Server{
+		Cipher: daze.Salt(cipher),
+		Dialer: daze.NewEngine(),
+		Hook:   daze.NewHookChain(),
+		Listen: listen,
+		NextID: uint32(math.MaxUint32),
+		Path:   Conf.Path,
+		Replay: ashe.NewReplay(ashe.Conf.ReplaySize),
+	}
+}
+
+// Client implemented the wsocket protocol.
+type Client struct {
+	Cipher []byte
+	// Config enables tls if it is not nil.
+	Config *tls.Config
+	Dialer daze.Dialer
+	// Host is the value of the Host header, which tells the cdn which site is requested.
+	Host   string
+	Path   string
+	Server string
+}
+
+// Hello connects to the server and upgrades the connection into a websocket.
+func (c *Client) Hello(ctx *daze.Context) (io.ReadWriteCloser, error) {
+	srv, err := c.Dialer.Dial(ctx, "tcp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+	if c.Config != nil {
+		srv = tls.Client(daze.NewNetConn(srv), c.Config)
+	}
+	buf := make([]byte, 16)
+	io.ReadFull(&daze.RandomReader{}, buf)
+	key := base64.StdEncoding.EncodeToString(buf)
+	req := doa.Try(http.NewRequest("GET", "http://"+c.Host+c.Path, http.NoBody))
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	err = req.Write(srv)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(srv)
+	ret, err := http.ReadResponse(r, req)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	ret.Body.Close()
+	if ret.StatusCode != http.StatusSwitchingProtocols || ret.Header.Get("Sec-WebSocket-Accept") != Accept(key) {
+		srv.Close()
+		return nil, errors.New("daze: wsocket upgrade rejected")
+	}
+	return &Conn{Client: true, Closer: srv, Reader: r, Writer: srv}, nil
+}
+
+// Dial connects to the address on the named network.
+func (c *Client) Dial(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+	srv, err := c.Hello(ctx)
+	if err != nil {
+		return nil, err
+	}
+	spy := &ashe.Client{Cipher: c.Cipher}
+	con, err := spy.Estab(ctx, srv, network, address)
+	if err != nil {
+		srv.Close()
+	}
+	return con, err
+}
+
+// NewClient returns a new Client. Cipher is a password in string form, with no length limit. The server is either an
+// address, or a url such as wss://example.com/ws, in which case tls is enabled by the wss scheme. The certificate of
+// the server is verified for wss, since it is usually the certificate of a cdn.
+func NewClient(server string, cipher string) *Client {
+	c := &Client{
+		Cipher: daze.Salt(cipher),
+		Dialer: &daze.Direct{},
+		Host:   server,
+		Path:   Conf.Path,
+		Server: server,
+	}
+	if !strings.Contains(server, "://") {
+		return c
+	}
+	u := doa.Try(url.Parse(server))
+	c.Host = u.Host
+	c.Server = u.Host
+	if u.Path != "" {
+		c.Path = u.Path
+	}
+	port := "80"
+	if u.Scheme == "wss" {
+		c.Config = &tls.Config{ServerName: u.Hostname()}
+		port = "443"
+	}
+	if u.Port() == "" {
+		c.Server = net.JoinHostPort(u.Hostname(), port)
+	}
+	return c
+}
@@ -0,0 +1,162 @@
+package wsocket
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mohanson/daze"
+	"github.com/mohanson/daze/lib/doa"
+)
+
+const (
+	EchoServerListenOn = "127.0.0.1:28080"
+	DazeServerListenOn = "127.0.0.1:28081"
+	Password           = "password"
+)
+
+func TestProtocolWsocketAccept(t *testing.T) {
+	// The example of rfc 6455.
+	doa.Doa(Accept("dGhlIHNhbXBsZSBub25jZQ==") == "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+}
+
+func TestProtocolWsocketConn(t *testing.T) {
+	a, b := net.Pipe()
+	cli := &Conn{Client: true, Closer: a, Reader: a, Writer: a}
+	srv := &Conn{Closer: b, Reader: b, Writer: b}
+	for _, n := range []int{0x00, 0x7d, 0x7e, 0xffff, 0x10000} {
+		msg := make([]byte, n)
+		io.ReadFull(&daze.RandomReader{}, msg)
+		go cli.Write(msg)
+		buf := make([]byte, n)
+		doa.Try(io.ReadFull(srv, buf))
+		doa.Doa(string(buf) == string(msg))
+	}
+	// Pings are answered by the reader.
+	done := make(chan int)
+	go cli.Frame(0x09, []byte{0x2a})
+	go func() {
+		n, _ := srv.Read(make([]byte, 1))
+		done <- n
+	}()
+	buf := make([]byte, 3)
+	doa.Try(io.ReadFull(a, buf))
+	doa.Doa(buf[0] == 0x8a && buf[1] == 0x01 && buf[2] == 0x2a)
+	go cli.Write([]byte{0x2a})
+	doa.Doa(<-done == 1)
+	go cli.Close()
+	_, err := srv.Read(make([]byte, 1))
+	doa.Doa(err == io.EOF)
+}
+
+func TestProtocolWsocketTCP(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient("ws://"+DazeServerListenOn+"/ws", Password)
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Try(io.ReadFull(cli, make([]byte, 128)))
+}
+
+func TestProtocolWsocketUDP(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.UDP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient(DazeServerListenOn, Password)
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "udp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Doa(doa.Try(cli.Read(make([]byte, 128))) == 128)
+}
+
+func TestProtocolWsocketTLS(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	dazeServer.Config = &tls.Config{Certificates: []tls.Certificate{doa.Try(daze.Certificate("127.0.0.1"))}}
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	dazeClient := NewClient("wss://"+DazeServerListenOn+"/ws", Password)
+	dazeClient.Config.InsecureSkipVerify = true
+	ctx := &daze.Context{}
+	cli := doa.Try(dazeClient.Dial(ctx, "tcp", EchoServerListenOn))
+	defer cli.Close()
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Try(io.ReadFull(cli, make([]byte, 128)))
+}
+
+func TestProtocolWsocketNotFound(t *testing.T) {
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	rep := doa.Try(http.Get("http://" + DazeServerListenOn + "/ws"))
+	rep.Body.Close()
+	doa.Doa(rep.StatusCode == http.StatusNotFound)
+}
+
+// RecordConn records the data written to the connection.
+type RecordConn struct {
+	io.ReadWriteCloser
+	B *bytes.Buffer
+}
+
+func (c *RecordConn) Write(p []byte) (int, error) {
+	c.B.Write(p)
+	return c.ReadWriteCloser.Write(p)
+}
+
+func TestProtocolWsocketReplay(t *testing.T) {
+	dazeRemote := daze.NewTester(EchoServerListenOn)
+	defer dazeRemote.Close()
+	dazeRemote.TCP()
+
+	dazeServer := NewServer(DazeServerListenOn, Password)
+	defer dazeServer.Close()
+	dazeServer.Run()
+
+	record := &bytes.Buffer{}
+	dazeClient := NewClient("ws://"+DazeServerListenOn+"/ws", Password)
+	dazeClient.Dialer = daze.DialerFunc(func(ctx *daze.Context, network string, address string) (io.ReadWriteCloser, error) {
+		srv, err := daze.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &RecordConn{ReadWriteCloser: srv, B: record}, nil
+	})
+	cli := doa.Try(dazeClient.Dial(&daze.Context{}, "tcp", EchoServerListenOn))
+	doa.Try(cli.Write([]byte{0x00, 0x00, 0x00, 0x80}))
+	doa.Try(io.ReadFull(cli, make([]byte, 128)))
+	cli.Close()
+
+	// The captured upgrade and handshake are sent again, the upgrade is answered but the handshake is refused, so
+	// nothing but a close frame follows.
+	srv := doa.Try(net.Dial("tcp", DazeServerListenOn))
+	defer srv.Close()
+	doa.Try(srv.Write(record.Bytes()))
+	srv.SetReadDeadline(time.Now().Add(time.Second))
+	ret := doa.Try(io.ReadAll(srv))
+	_, body, ok := bytes.Cut(ret, []byte("\r\n\r\n"))
+	doa.Doa(ok && bytes.Equal(body, []byte{0x88, 0x00}))
+}